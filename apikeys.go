@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits given to a new key when the request to issue it leaves them out.
+const (
+	defaultKeyRateLimit  = 60
+	defaultKeyDailyQuota = 10000
+)
+
+// apiKeyHeader carries the client's API key. Authorization: Bearer is
+// accepted too.
+const apiKeyHeader = "X-API-Key"
+
+// publicPaths don't need an API key: probes, metrics, documentation, pages
+// for browsers, login callbacks, and the admin API, which has its own token.
+// Entries ending in a slash match every route under them.
+var publicPaths = []string{"/healthz", "/readyz", "/metrics", "/openapi.json", "/docs", "/admin/", "/p/", "/embed/", "/oembed", "/.well-known/", "/auth/spotify/callback"}
+
+/*
+apiKeyAuth checks API keys and enforces each key's per-minute rate limit and
+daily quota.
+
+Rate limits use fixed one-minute windows kept in memory, so each instance
+enforces them separately. Daily usage is counted in the store and shared by
+every instance.
+*/
+type apiKeyAuth struct {
+	keys     APIKeyStore
+	required bool
+
+	mu      sync.Mutex
+	cache   map[string]cachedAPIKey
+	windows map[string]*rateWindow
+	// swept is when expired windows and cache entries were last dropped.
+	swept time.Time
+}
+
+type cachedAPIKey struct {
+	key     apiKey
+	expires time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newAPIKeyAuth(keys APIKeyStore, required bool) *apiKeyAuth {
+	return &apiKeyAuth{
+		keys:     keys,
+		required: required,
+		cache:    map[string]cachedAPIKey{},
+		windows:  map[string]*rateWindow{},
+	}
+}
+
+// hashAPIKey is how keys are stored. Keys are long random strings, so a fast
+// hash is enough.
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret returns a key ID and the full key to give to the client.
+// The ID is part of the key so a leaked key can be traced back to its label.
+func newAPIKeySecret() (id string, secret string) {
+	idBytes := make([]byte, 6)
+	secretBytes := make([]byte, 32)
+	rand.Read(idBytes)
+	rand.Read(secretBytes)
+
+	id = "key_" + hex.EncodeToString(idBytes)
+	return id, "pk_" + strings.TrimPrefix(id, "key_") + "_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+}
+
+func isPublicPath(route string) bool {
+	for _, path := range publicPaths {
+		if route == path || strings.HasSuffix(path, "/") && strings.HasPrefix(route, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// presentedAPIKey returns the key sent with the request, if any.
+func presentedAPIKey(c *gin.Context) string {
+	if key := c.GetHeader(apiKeyHeader); key != "" {
+		return key
+	}
+
+	authorization := c.GetHeader("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+
+	return ""
+}
+
+// lookup finds the key for secret, using the cache when it is fresh.
+func (a *apiKeyAuth) lookup(c *gin.Context, secret string) (apiKey, error) {
+	hash := hashAPIKey(secret)
+
+	a.mu.Lock()
+	cached, ok := a.cache[hash]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.key, nil
+	}
+
+	key, err := a.keys.GetAPIKeyByHash(c.Request.Context(), hash)
+	if err != nil {
+		return apiKey{}, err
+	}
+
+	a.mu.Lock()
+	a.cache[hash] = cachedAPIKey{key: key, expires: time.Now().Add(config.Cache.APIKeyTTL)}
+	a.mu.Unlock()
+
+	return key, nil
+}
+
+// forget drops a key from the cache so a revocation takes effect at once.
+func (a *apiKeyAuth) forget(hash string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.cache, hash)
+}
+
+// sweep drops windows that have ended and cache entries that have expired, at
+// most once a minute, so keys that stop being used don't stay in memory. The
+// caller must hold a.mu.
+func (a *apiKeyAuth) sweep(now time.Time) {
+	if now.Sub(a.swept) < time.Minute {
+		return
+	}
+	a.swept = now
+
+	for id, window := range a.windows {
+		if now.Sub(window.start) >= time.Minute {
+			delete(a.windows, id)
+		}
+	}
+	for hash, cached := range a.cache {
+		if now.After(cached.expires) {
+			delete(a.cache, hash)
+		}
+	}
+}
+
+// take counts a request in the key's current window. It returns how many
+// requests are left in the window and when the window resets.
+func (a *apiKeyAuth) take(key apiKey, now time.Time) (remaining int, reset time.Time, allowed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(now)
+
+	window, ok := a.windows[key.ID]
+	if !ok || now.Sub(window.start) >= time.Minute {
+		window = &rateWindow{start: now.Truncate(time.Minute)}
+		a.windows[key.ID] = window
+	}
+	reset = window.start.Add(time.Minute)
+
+	if window.count >= key.RateLimit {
+		return 0, reset, false
+	}
+	window.count++
+
+	return key.RateLimit - window.count, reset, true
+}
+
+// peek reports the key's current window without counting a request.
+func (a *apiKeyAuth) peek(key apiKey, now time.Time) (remaining int, reset time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	window, ok := a.windows[key.ID]
+	if !ok || now.Sub(window.start) >= time.Minute {
+		return key.RateLimit, now.Truncate(time.Minute).Add(time.Minute)
+	}
+
+	return key.RateLimit - window.count, window.start.Add(time.Minute)
+}
+
+// usageDay is the quota day for t.
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// secondsUntil rounds up, so Retry-After never tells a client to come back
+// too early.
+func secondsUntil(t time.Time, now time.Time) string {
+	seconds := int64(t.Sub(now)+time.Second-1) / int64(time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return strconv.FormatInt(seconds, 10)
+}
+
+func (a *apiKeyAuth) reject(c *gin.Context, status int, reason string, message string) {
+	apiKeyRejections.WithLabelValues(reason).Inc()
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Bearer realm="polyphonic"`)
+	}
+	c.AbortWithStatusJSON(status, gin.H{"message": message})
+}
+
+/*
+middleware requires a valid API key on every route that isn't public. When
+keys aren't required, requests without one are let through, but a key that
+is sent is still checked and limited. That allows keys to be rolled out to
+clients before they are enforced.
+
+Responses carry X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+(seconds until the window resets), and X-Quota-Limit and X-Quota-Remaining
+for keys with a daily quota. Requests over either limit get 429 with
+Retry-After. The quota is checked first and only requests that are let
+through count against it, so requests turned away by either limit don't use
+it up. The check and the count are separate, so concurrent requests can
+overshoot the quota by a few.
+*/
+func (a *apiKeyAuth) middleware(c *gin.Context) {
+	route := c.FullPath()
+	// Unknown routes fall through to a 404.
+	if route == "" || isPublicPath(route) {
+		c.Next()
+		return
+	}
+
+	secret := presentedAPIKey(c)
+	if secret == "" {
+		if !a.required {
+			c.Next()
+			return
+		}
+		a.reject(c, http.StatusUnauthorized, "missing", "An API key is required. Send it in the X-API-Key header.")
+		return
+	}
+
+	key, err := a.lookup(c, secret)
+	if err == errAPIKeyNotFound {
+		a.reject(c, http.StatusUnauthorized, "invalid", "The API key is not valid")
+		return
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("looking up API key failed", "error", err)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": "API keys cannot be checked right now"})
+		return
+	}
+	if key.RevokedAt != nil {
+		a.reject(c, http.StatusUnauthorized, "revoked", "The API key has been revoked")
+		return
+	}
+	c.Set("api_key_id", key.ID)
+
+	now := time.Now()
+	if key.DailyQuota > 0 {
+		used, err := a.keys.APIKeyUsage(c.Request.Context(), key.ID, usageDay(now))
+		if err != nil {
+			// Counting is best effort; a database hiccup shouldn't lock out
+			// every client.
+			loggerFrom(c.Request.Context()).Error("reading API key usage failed", "api_key_id", key.ID, "error", err)
+		} else if used >= int64(key.DailyQuota) {
+			midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			c.Header("X-Quota-Limit", strconv.Itoa(key.DailyQuota))
+			c.Header("X-Quota-Remaining", "0")
+			c.Header("Retry-After", secondsUntil(midnight, now))
+			a.reject(c, http.StatusTooManyRequests, "quota_exceeded", "Daily quota exceeded for this API key")
+			return
+		}
+	}
+
+	remaining, reset, allowed := a.take(key, now)
+	c.Header("X-RateLimit-Limit", strconv.Itoa(key.RateLimit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	c.Header("X-RateLimit-Reset", secondsUntil(reset, now))
+	if !allowed {
+		c.Header("Retry-After", secondsUntil(reset, now))
+		a.reject(c, http.StatusTooManyRequests, "rate_limited", "Rate limit exceeded for this API key")
+		return
+	}
+
+	used, err := a.keys.AddAPIKeyUsage(c.Request.Context(), key.ID, usageDay(now))
+	if err != nil {
+		// Counting is best effort; a database hiccup shouldn't lock out
+		// every client.
+		loggerFrom(c.Request.Context()).Error("recording API key usage failed", "api_key_id", key.ID, "error", err)
+	} else if key.DailyQuota > 0 {
+		c.Header("X-Quota-Limit", strconv.Itoa(key.DailyQuota))
+		c.Header("X-Quota-Remaining", strconv.FormatInt(max(int64(key.DailyQuota)-used, 0), 10))
+	}
+
+	c.Next()
+}
+
+// adminMiddleware requires the admin token as a bearer token.
+func adminMiddleware(token string) gin.HandlerFunc {
+	want := sha256.Sum256([]byte(token))
+
+	return func(c *gin.Context) {
+		authorization := c.GetHeader("Authorization")
+		got := sha256.Sum256([]byte(strings.TrimPrefix(authorization, "Bearer ")))
+		if !strings.HasPrefix(authorization, "Bearer ") || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="polyphonic-admin"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Admin token required"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// apiKeyRequest is the body of POST /admin/keys.
+type apiKeyRequest struct {
+	Label      string `json:"label"`
+	RateLimit  *int   `json:"rate_limit"`
+	DailyQuota *int   `json:"daily_quota"`
+}
+
+// apiKeyDetails is an API key as reported to admins, with today's usage.
+type apiKeyDetails struct {
+	apiKey
+	UsageToday         int64 `json:"usage_today"`
+	RateLimitRemaining int   `json:"rate_limit_remaining"`
+}
+
+// postAPIKey issues a new key. The key is only ever returned here.
+func (a *apiKeyAuth) postAPIKey(c *gin.Context) {
+	var request apiKeyRequest
+	if !bindValidJSON(c, "APIKeyRequest", &request) {
+		return
+	}
+
+	id, secret := newAPIKeySecret()
+	key := apiKey{
+		ID:         id,
+		Label:      request.Label,
+		Hash:       hashAPIKey(secret),
+		RateLimit:  defaultKeyRateLimit,
+		DailyQuota: defaultKeyDailyQuota,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	if request.RateLimit != nil {
+		key.RateLimit = *request.RateLimit
+	}
+	if request.DailyQuota != nil {
+		key.DailyQuota = *request.DailyQuota
+	}
+
+	if err := a.keys.CreateAPIKey(c.Request.Context(), key); err != nil {
+		loggerFrom(c.Request.Context()).Error("issuing API key failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error issuing API key"})
+		return
+	}
+	loggerFrom(c.Request.Context()).Info("API key issued", "api_key_id", key.ID, "label", key.Label)
+
+	c.IndentedJSON(http.StatusCreated, gin.H{
+		"id":          key.ID,
+		"key":         secret,
+		"label":       key.Label,
+		"rate_limit":  key.RateLimit,
+		"daily_quota": key.DailyQuota,
+		"created_at":  key.CreatedAt,
+	})
+}
+
+func (a *apiKeyAuth) details(c *gin.Context, key apiKey) (apiKeyDetails, error) {
+	now := time.Now()
+	used, err := a.keys.APIKeyUsage(c.Request.Context(), key.ID, usageDay(now))
+	remaining, _ := a.peek(key, now)
+
+	return apiKeyDetails{apiKey: key, UsageToday: used, RateLimitRemaining: remaining}, err
+}
+
+// getAPIKeys lists every key, including revoked ones.
+func (a *apiKeyAuth) getAPIKeys(c *gin.Context) {
+	keys, err := a.keys.ListAPIKeys(c.Request.Context())
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("listing API keys failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error listing API keys"})
+		return
+	}
+
+	list := make([]apiKeyDetails, 0, len(keys))
+	for _, key := range keys {
+		details, err := a.details(c, key)
+		if err != nil {
+			loggerFrom(c.Request.Context()).Error("reading API key usage failed", "api_key_id", key.ID, "error", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error listing API keys"})
+			return
+		}
+		list = append(list, details)
+	}
+
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// getAPIKey reports one key with its usage today.
+func (a *apiKeyAuth) getAPIKey(c *gin.Context) {
+	key, err := a.keys.GetAPIKey(c.Request.Context(), c.Param("id"))
+	if err == errAPIKeyNotFound {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "There is no such API key"})
+		return
+	}
+	if err == nil {
+		var details apiKeyDetails
+		if details, err = a.details(c, key); err == nil {
+			c.IndentedJSON(http.StatusOK, details)
+			return
+		}
+	}
+
+	loggerFrom(c.Request.Context()).Error("reading API key failed", "api_key_id", c.Param("id"), "error", err)
+	c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error reading API key"})
+}
+
+// deleteAPIKey revokes a key. The key is kept so its usage can still be
+// inspected.
+func (a *apiKeyAuth) deleteAPIKey(c *gin.Context) {
+	id := c.Param("id")
+	err := a.keys.RevokeAPIKey(c.Request.Context(), id, time.Now().UTC().Truncate(time.Second))
+	if err == errAPIKeyNotFound {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "There is no such API key"})
+		return
+	}
+	var key apiKey
+	if err == nil {
+		key, err = a.keys.GetAPIKey(c.Request.Context(), id)
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("revoking API key failed", "api_key_id", id, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error revoking API key"})
+		return
+	}
+
+	a.forget(key.Hash)
+	loggerFrom(c.Request.Context()).Info("API key revoked", "api_key_id", key.ID, "label", key.Label)
+	c.IndentedJSON(http.StatusOK, key)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestAPIKey stores a key with the given limits and returns it with the
+// secret to send.
+func newTestAPIKey(t *testing.T, store APIKeyStore, rateLimit int, dailyQuota int) (apiKey, string) {
+	t.Helper()
+
+	id, secret := newAPIKeySecret()
+	key := apiKey{ID: id, Label: "test", Hash: hashAPIKey(secret), RateLimit: rateLimit, DailyQuota: dailyQuota, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	if err := store.CreateAPIKey(context.Background(), key); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+
+	return key, secret
+}
+
+// apiKeyRouter serves /ping behind auth's middleware.
+func apiKeyRouter(auth *apiKeyAuth) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(auth.middleware)
+	router.GET("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	return router
+}
+
+func ping(router *gin.Engine, secret string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	request.Header.Set(apiKeyHeader, secret)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestPostAPIKeyLimits(t *testing.T) {
+	spec, err := loadAPISpec()
+	if err != nil {
+		t.Fatalf("loadAPISpec: %v", err)
+	}
+	apiSpec = spec
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/admin/keys", newAPIKeyAuth(newMemoryPlaylistStore(), true).postAPIKey)
+
+	for _, test := range []struct {
+		body string
+		want int
+	}{
+		{`{"label": "app"}`, http.StatusCreated},
+		{`{"label": "app", "rate_limit": 1, "daily_quota": 0}`, http.StatusCreated},
+		{`{"label": "app", "rate_limit": 0}`, http.StatusBadRequest},
+		{`{"label": "app", "rate_limit": -5}`, http.StatusBadRequest},
+		{`{"label": "app", "daily_quota": -1}`, http.StatusBadRequest},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/admin/keys", strings.NewReader(test.body))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != test.want {
+			t.Errorf("POST /admin/keys %s = %d, want %d", test.body, recorder.Code, test.want)
+		}
+	}
+}
+
+func TestAPIKeyQuotaCheckedBeforeRateLimit(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryPlaylistStore()
+	auth := newAPIKeyAuth(store, true)
+	router := apiKeyRouter(auth)
+
+	// A key whose quota is used up is turned away without using its rate
+	// window.
+	spent, spentSecret := newTestAPIKey(t, store, 5, 1)
+	if _, err := store.AddAPIKeyUsage(ctx, spent.ID, usageDay(time.Now())); err != nil {
+		t.Fatalf("AddAPIKeyUsage: %v", err)
+	}
+	response := ping(router, spentSecret)
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("X-Quota-Remaining") != "0" {
+		t.Errorf("request over the quota = %d with X-Quota-Remaining %q, want 429 with 0", response.Code, response.Header().Get("X-Quota-Remaining"))
+	}
+	if remaining, _ := auth.peek(spent, time.Now()); remaining != spent.RateLimit {
+		t.Errorf("rate window after a request over the quota has %d left, want %d", remaining, spent.RateLimit)
+	}
+
+	// A request over the rate limit isn't counted against the quota.
+	limited, limitedSecret := newTestAPIKey(t, store, 1, 10)
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		if response := ping(router, limitedSecret); response.Code != want {
+			t.Errorf("request %d = %d, want %d", i+1, response.Code, want)
+		}
+	}
+	used, err := store.APIKeyUsage(ctx, limited.ID, usageDay(time.Now()))
+	if err != nil {
+		t.Fatalf("APIKeyUsage: %v", err)
+	}
+	if used != 1 {
+		t.Errorf("usage after one allowed and two rate limited requests = %d, want 1", used)
+	}
+}
+
+func TestAPIKeyIdleWindowsPruned(t *testing.T) {
+	auth := newAPIKeyAuth(newMemoryPlaylistStore(), true)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	idle := apiKey{ID: "key_idle", RateLimit: 10}
+	active := apiKey{ID: "key_active", RateLimit: 10}
+
+	auth.take(idle, start)
+	auth.cache["stale"] = cachedAPIKey{key: idle, expires: start.Add(30 * time.Second)}
+
+	// Within the minute nothing is swept.
+	auth.take(active, start.Add(30*time.Second))
+	if _, ok := auth.windows[idle.ID]; !ok {
+		t.Fatalf("the idle key's window was dropped before it ended")
+	}
+
+	auth.take(active, start.Add(2*time.Minute))
+	if _, ok := auth.windows[idle.ID]; ok {
+		t.Errorf("the idle key's window is still kept after it ended")
+	}
+	if _, ok := auth.cache["stale"]; ok {
+		t.Errorf("an expired cache entry is still kept")
+	}
+	if _, ok := auth.windows[active.ID]; !ok {
+		t.Errorf("the active key's window was dropped")
+	}
+}
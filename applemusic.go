@@ -1,15 +1,17 @@
 package main
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
-    "io/ioutil"
-    "log"
+    "io"
     "net/http"
-    "os"
     "strings"
     "sync"
     "time"
+
+    "go.opentelemetry.io/otel/attribute"
 )
 
 // used to avoid going over rate limit
@@ -37,6 +39,7 @@ type AppleMusicAttributes struct {
     TrackNumber    int     `json:"trackNumber"`
     AlbumName      string  `json:"albumName"`
     ContentRating *string  `json:"contentRating"`
+    DurationInMillis int   `json:"durationInMillis"`
 }
 
 type Artwork struct {
@@ -145,6 +148,7 @@ type AppleMusicPlaylistAttributes struct {
     CuratorName string  `json:"curatorName"`
     Name        string  `json:"name"`
     Artwork     Artwork `json:"artwork"`
+    URL         string  `json:"url"`
 }
 
 type AppleMusicPlaylistRelationships struct {
@@ -157,20 +161,27 @@ type AppleMusicPlaylistTracks struct {
 }
 
 type AppleMusicPlaylistTracksData struct {
-    ID string `json:"id"`
+    ID         string               `json:"id"`
+    Attributes AppleMusicAttributes `json:"attributes"`
 }
 /* -- playlist data structures -- */
 
 /*
 Checks to see if there is a wait time to be served b/c of rate limiting
 */
-func appleMusicWaitIfLimited(w *AppleWaitContainer) {
+func appleMusicWaitIfLimited(ctx context.Context, w *AppleWaitContainer) {
+    // The span covers waiting for the mutex as well as any back-off.
+    _, span := tracer.Start(ctx, "apple rate limit wait")
+    defer span.End()
+
     w.mu.Lock()
 
     if w.wait {
-        appleWaitTime := 10
-        fmt.Println("Apple: Retrying after:", appleWaitTime, "seconds")
-        time.Sleep(time.Duration(appleWaitTime) * time.Second)
+        appleWaitTime := config.Apple.RateLimitWait
+        loggerFrom(ctx).Info("Apple: waiting before retrying", "wait", appleWaitTime.String())
+        time.Sleep(appleWaitTime)
+        rateLimitWaitSeconds.WithLabelValues("apple").Add(appleWaitTime.Seconds())
+        span.SetAttributes(attribute.Float64("rate_limit.wait_seconds", appleWaitTime.Seconds()))
 
         w.wait = false
     }
@@ -178,19 +189,39 @@ func appleMusicWaitIfLimited(w *AppleWaitContainer) {
     w.mu.Unlock()
 }
 
+// getAppleMusicSongByID sends the song with the given ID on appleMusicSong,
+// or an empty one when it can't be fetched.
 func getAppleMusicSongByID(
+    ctx context.Context,
     w *AppleWaitContainer,
     id string,
     key string,
     appleMusicSong chan AppleMusicSong,
 ) {
-    appleMusicWaitIfLimited(w)
+    song, err := fetchAppleMusicSongByID(ctx, w, id, key)
+    if err != nil {
+        loggerFrom(ctx).Error("Apple: request failed", "error", err)
+    }
 
-    url := "https://api.music.apple.com/v1/catalog/us/songs/" + id
+    appleMusicSong <- song
+}
+
+// fetchAppleMusicSongByID fetches the song with the given ID. A song that
+// doesn't exist comes back with no data and no error; an error means Apple
+// Music couldn't be reached or didn't answer properly.
+func fetchAppleMusicSongByID(
+    ctx context.Context,
+    w *AppleWaitContainer,
+    id string,
+    key string,
+) (AppleMusicSong, error) {
+    appleMusicWaitIfLimited(ctx, w)
+
+    url := config.Apple.APIBaseURL + "/v1/catalog/" + config.Apple.Storefront + "/songs/" + id
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("apple", "songs")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -200,57 +231,59 @@ func getAppleMusicSongByID(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Apple: Too many requests")
-
-            w.mu.Lock()
-            w.wait = true
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        loggerFrom(ctx).Warn("Apple: too many requests")
+        response.Body.Close()
 
-            appleMusicWaitIfLimited(w)
-            w.mu.Unlock()
+        w.mu.Lock()
+        w.wait = true
+        w.mu.Unlock()
+        appleMusicWaitIfLimited(ctx, w)
 
-            attempt++
-            response, err = client.Do(request)
-        }
-        attempt = 2
+        response, err = client.Do(request)
     }
 
-	fmt.Println("Failed to get apple song by id: %d", response.StatusCode)
-
-
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        return AppleMusicSong{}, fmt.Errorf("apple: %w", err)
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    // Apple Music answers 400 for IDs that can't exist and 404 for ones
+    // that don't.
+    if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusBadRequest {
+        return AppleMusicSong{}, nil
+    }
+    if response.StatusCode < 200 || response.StatusCode > 299 {
+        return AppleMusicSong{}, fmt.Errorf("apple: status %d", response.StatusCode)
+    }
+
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        return AppleMusicSong{}, fmt.Errorf("apple: reading response: %w", err)
     }
 
     var responseObject AppleMusicSong
+    if err := json.Unmarshal(responseData, &responseObject); err != nil {
+        return AppleMusicSong{}, fmt.Errorf("apple: %w", err)
+    }
 
-    json.Unmarshal(responseData, &responseObject)
-
-    appleMusicSong <- responseObject
+    return responseObject, nil
 }
 
 func getAppleMusicSongsBySearch(
+    ctx context.Context,
     w *AppleWaitContainer,
     params string,
     key string,
     appleMusicSongSearch chan AppleMusicSongSearch,
 ) {
-    appleMusicWaitIfLimited(w)
+    appleMusicWaitIfLimited(ctx, w)
 
-    url := "https://api.music.apple.com/v1/catalog/us/search?types=songs&term=" + params
-    fmt.Println(url)
+    url := config.Apple.APIBaseURL + "/v1/catalog/" + config.Apple.Storefront + "/search?types=songs&term=" + params
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("apple", "search_songs")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -260,33 +293,30 @@ func getAppleMusicSongsBySearch(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-
-            w.mu.Lock()
-            w.wait = true
-
-            appleMusicWaitIfLimited(w)
-            w.mu.Unlock()
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        loggerFrom(ctx).Warn("Apple: too many requests")
+        response.Body.Close()
 
-            attempt++
-            response, err = client.Do(request)
-        }
+        w.mu.Lock()
+        w.wait = true
+        w.mu.Unlock()
+        appleMusicWaitIfLimited(ctx, w)
 
-        attempt = 2
+        response, err = client.Do(request)
     }
-    fmt.Println(response.StatusCode)
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Apple: request failed", "error", err)
+        appleMusicSongSearch <- AppleMusicSongSearch{}
+        return
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        loggerFrom(ctx).Error("Apple: reading response failed", "error", err)
+        appleMusicSongSearch <- AppleMusicSongSearch{}
+        return
     }
 
     var responseObject AppleMusicSongSearch
@@ -297,18 +327,19 @@ func getAppleMusicSongsBySearch(
 }
 
 func getAppleMusicAlbumByID(
+    ctx context.Context,
     w *AppleWaitContainer,
     id string,
     key string,
     appleMusicAlbum chan AppleMusicAlbum,
 ) {
-    appleMusicWaitIfLimited(w)
+    appleMusicWaitIfLimited(ctx, w)
 
-    url := "https://api.music.apple.com/v1/catalog/us/albums/" + id
+    url := config.Apple.APIBaseURL + "/v1/catalog/" + config.Apple.Storefront + "/albums/" + id
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("apple", "albums")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -318,32 +349,30 @@ func getAppleMusicAlbumByID(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-
-            w.mu.Lock()
-            w.wait = true
-
-            appleMusicWaitIfLimited(w)
-            w.mu.Unlock()
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        loggerFrom(ctx).Warn("Apple: too many requests")
+        response.Body.Close()
 
-            attempt++
-            response, err = client.Do(request)
-        }
+        w.mu.Lock()
+        w.wait = true
+        w.mu.Unlock()
+        appleMusicWaitIfLimited(ctx, w)
 
-        attempt = 2
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Apple: request failed", "error", err)
+        appleMusicAlbum <- AppleMusicAlbum{}
+        return
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        loggerFrom(ctx).Error("Apple: reading response failed", "error", err)
+        appleMusicAlbum <- AppleMusicAlbum{}
+        return
     }
 
     var responseObject AppleMusicAlbum
@@ -354,18 +383,19 @@ func getAppleMusicAlbumByID(
 }
 
 func getAppleMusicArtistByID(
+    ctx context.Context,
     w *AppleWaitContainer,
     id string,
     key string,
     appleMusicArtist chan AppleMusicArtist,
 ) {
-    appleMusicWaitIfLimited(w)
+    appleMusicWaitIfLimited(ctx, w)
 
-    url := "https://api.music.apple.com/v1/catalog/us/artists/" + id
+    url := config.Apple.APIBaseURL + "/v1/catalog/" + config.Apple.Storefront + "/artists/" + id
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("apple", "artists")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -375,32 +405,30 @@ func getAppleMusicArtistByID(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        loggerFrom(ctx).Warn("Apple: too many requests")
+        response.Body.Close()
 
-            w.mu.Lock()
-            w.wait = true
+        w.mu.Lock()
+        w.wait = true
+        w.mu.Unlock()
+        appleMusicWaitIfLimited(ctx, w)
 
-            appleMusicWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Apple: request failed", "error", err)
+        appleMusicArtist <- AppleMusicArtist{}
+        return
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        loggerFrom(ctx).Error("Apple: reading response failed", "error", err)
+        appleMusicArtist <- AppleMusicArtist{}
+        return
     }
 
     var responseObject AppleMusicArtist
@@ -411,19 +439,19 @@ func getAppleMusicArtistByID(
 }
 
 func getAppleMusicArtistsBySearch(
+    ctx context.Context,
     w *AppleWaitContainer,
     params string,
     key string,
     appleMusicArtistSearch chan AppleMusicArtistSearch,
 ) {
-    appleMusicWaitIfLimited(w)
+    appleMusicWaitIfLimited(ctx, w)
 
-    url := "https://api.music.apple.com/v1/catalog/us/search?types=artists&term=" + params
-    fmt.Println(url)
+    url := config.Apple.APIBaseURL + "/v1/catalog/" + config.Apple.Storefront + "/search?types=artists&term=" + params
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("apple", "search_artists")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -433,32 +461,30 @@ func getAppleMusicArtistsBySearch(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-
-            w.mu.Lock()
-            w.wait = true
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        loggerFrom(ctx).Warn("Apple: too many requests")
+        response.Body.Close()
 
-            appleMusicWaitIfLimited(w)
-            w.mu.Unlock()
+        w.mu.Lock()
+        w.wait = true
+        w.mu.Unlock()
+        appleMusicWaitIfLimited(ctx, w)
 
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Apple: request failed", "error", err)
+        appleMusicArtistSearch <- AppleMusicArtistSearch{}
+        return
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        loggerFrom(ctx).Error("Apple: reading response failed", "error", err)
+        appleMusicArtistSearch <- AppleMusicArtistSearch{}
+        return
     }
 
     var responseObject AppleMusicArtistSearch
@@ -468,77 +494,61 @@ func getAppleMusicArtistsBySearch(
     appleMusicArtistSearch <- responseObject
 }
 
+/*
+getAppleMusicPlaylistByID gets a playlist with its first page of tracks. A
+playlist that doesn't exist is returned with no data, without an error.
+*/
 func getAppleMusicPlaylistByID(
+    ctx context.Context,
     w *AppleWaitContainer,
     id string,
     key string,
-    appleMusicPlaylist chan AppleMusicPlaylist,
-) {
-    appleMusicWaitIfLimited(w)
-
-    url := "https://api.music.apple.com/v1/catalog/us/playlists/" + id
-    authVal := "Bearer " + key
-
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
-    // set HTTP header values
-    request.Header.Add("Content-Type", "application/json")
-    request.Header.Add("Authorization", authVal)
-
-    w.mu.Lock()
-    response, err := client.Do(request)
-    w.mu.Unlock()
-
-    // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-
-            w.mu.Lock()
-            w.wait = true
-
-            appleMusicWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
-    }
-
-    if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
-    }
-
-    responseData, err := ioutil.ReadAll(response.Body)
-    if err != nil {
-        log.Fatal(err)
-    }
-
+) (AppleMusicPlaylist, error) {
     var responseObject AppleMusicPlaylist
+    url := config.Apple.APIBaseURL + "/v1/catalog/" + config.Apple.Storefront + "/playlists/" + id
+    err := getAppleMusicPlaylistPage(ctx, w, "playlists", url, key, &responseObject)
+    if errors.Is(err, errAppleNotFound) {
+        return AppleMusicPlaylist{}, nil
+    }
 
-    json.Unmarshal(responseData, &responseObject)
-
-    appleMusicPlaylist <- responseObject
+    return responseObject, err
 }
 
+// getNextAppleMusicPlaylist gets the page of a playlist's tracks at nextURL.
 func getNextAppleMusicPlaylist(
+    ctx context.Context,
     w *AppleWaitContainer,
     nextURL string,
     key string,
-    nextAppleMusicPlaylistTracks chan AppleMusicPlaylistTracks,
-) {
-    appleMusicWaitIfLimited(w)
+) (AppleMusicPlaylistTracks, error) {
+    var responseObject AppleMusicPlaylistTracks
+    err := getAppleMusicPlaylistPage(ctx, w, "playlist_tracks_next", config.Apple.APIBaseURL+nextURL, key, &responseObject)
+
+    return responseObject, err
+}
 
-    url := "https://api.music.apple.com" + nextURL
+// errAppleNotFound is returned for a 404 from the Apple Music API.
+var errAppleNotFound = errors.New("apple: not found")
+
+/*
+getAppleMusicPlaylistPage requests url and decodes the response into out.
+Unlike the other lookups it fails on any error, since a page that is silently
+left out would truncate the playlist.
+*/
+func getAppleMusicPlaylistPage(
+    ctx context.Context,
+    w *AppleWaitContainer,
+    operation string,
+    url string,
+    key string,
+    out any,
+) error {
+    appleMusicWaitIfLimited(ctx, w)
 
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("apple", operation)
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -548,38 +558,38 @@ func getNextAppleMusicPlaylist(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        loggerFrom(ctx).Warn("Apple: too many requests")
+        response.Body.Close()
 
-            w.mu.Lock()
-            w.wait = true
+        w.mu.Lock()
+        w.wait = true
+        w.mu.Unlock()
+        appleMusicWaitIfLimited(ctx, w)
 
-            appleMusicWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Apple: request failed", "error", err)
+        return err
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
-    if err != nil {
-        log.Fatal(err)
+    if response.StatusCode == http.StatusNotFound {
+        return errAppleNotFound
+    }
+    if response.StatusCode != http.StatusOK {
+        loggerFrom(ctx).Error("Apple: request failed", "status", response.StatusCode)
+        return fmt.Errorf("apple: %s responded %d", operation, response.StatusCode)
     }
 
-    var responseObject AppleMusicPlaylistTracks
-
-    json.Unmarshal(responseData, &responseObject)
+    responseData, err := io.ReadAll(response.Body)
+    if err != nil {
+        loggerFrom(ctx).Error("Apple: reading response failed", "error", err)
+        return err
+    }
 
-    nextAppleMusicPlaylistTracks <- responseObject
+    return json.Unmarshal(responseData, out)
 }
 
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Apple Music has no server-side login: the app gets a Music-User-Token from
+MusicKit and sends it here, and requests made for the user carry it alongside
+the developer token. The token can't be refreshed; once Apple stops accepting
+it, the app has to get a new one from MusicKit.
+*/
+
+// appleLibraryBatch is how many songs are looked up in the catalog, or added
+// to a library playlist, per request.
+const appleLibraryBatch = 100
+
+// appleSongLink matches catalog song links, either the song page or a song
+// on its album page.
+var appleSongLink = regexp.MustCompile(`^https://music\.apple\.com/[a-z]{2}/(?:song/(?:[^/?#]+/)?(\d+)|album/[^?#]*\?(?:[^#]*&)?i=(\d+))`)
+
+// appleLoginRequest is the body for connecting an Apple Music account.
+type appleLoginRequest struct {
+	MusicUserToken string `json:"music_user_token"`
+}
+
+var (
+	// errAppleUserToken is returned when Apple no longer accepts a user's
+	// Music-User-Token, which it reports with a 403.
+	errAppleUserToken = errors.New("apple: music user token expired or revoked")
+	// errAppleDeveloperToken is returned when Apple rejects the app's
+	// developer token with a 401. The user's token isn't at fault.
+	errAppleDeveloperToken = errors.New("apple: developer token rejected")
+)
+
+/*
+appleUserRequest calls the Apple Music API with the developer token and, when
+userToken isn't empty, the user's Music-User-Token, encoding body and decoding
+the response into out when they aren't nil. Rate limited requests wait,
+shared with the app's own requests, and are retried. A 401 is the developer
+token's fault and a 403 the user token's.
+*/
+func appleUserRequest(ctx context.Context, operation string, userToken string, method string, path string, body any, out any) error {
+	if err := checkAppleMusicAuth(); err != nil {
+		return err
+	}
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	client := upstreamClient("apple", operation)
+
+	for attempt := 1; ; attempt++ {
+		appleMusicWaitIfLimited(ctx, &aWait)
+
+		request, err := http.NewRequestWithContext(ctx, method, config.Apple.APIBaseURL+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+currentAppleMusicKey())
+		if userToken != "" {
+			request.Header.Set("Music-User-Token", userToken)
+		}
+		if body != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+
+		response, err := client.Do(request)
+		if err != nil {
+			return fmt.Errorf("apple: %v", err)
+		}
+		responseData, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return fmt.Errorf("apple: %v", err)
+		}
+
+		if response.StatusCode == http.StatusTooManyRequests && attempt < maxUserRequestAttempts {
+			loggerFrom(ctx).Warn("Apple: too many requests")
+			aWait.mu.Lock()
+			aWait.wait = true
+			aWait.mu.Unlock()
+			continue
+		}
+		if response.StatusCode == http.StatusUnauthorized {
+			expireAppleMusicKey()
+			return errAppleDeveloperToken
+		}
+		if userToken != "" && response.StatusCode == http.StatusForbidden {
+			return errAppleUserToken
+		}
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			var problem struct {
+				Errors []struct {
+					Title  string `json:"title"`
+					Detail string `json:"detail"`
+				} `json:"errors"`
+			}
+			json.Unmarshal(responseData, &problem)
+			message := ""
+			if len(problem.Errors) > 0 {
+				message = problem.Errors[0].Title
+				if problem.Errors[0].Detail != "" {
+					message = problem.Errors[0].Detail
+				}
+			}
+			return userAPIError{Provider: "apple", Status: response.StatusCode, Message: message}
+		}
+
+		if out != nil && len(responseData) > 0 {
+			if err := json.Unmarshal(responseData, out); err != nil {
+				return fmt.Errorf("apple: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+// appleUserStorefront returns the storefront of the user's account, which
+// also checks that Apple still accepts their token.
+func appleUserStorefront(ctx context.Context, userToken string) (string, error) {
+	var storefronts struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := appleUserRequest(ctx, "me_storefront", userToken, "GET", "/v1/me/storefront", nil, &storefronts); err != nil {
+		return "", err
+	}
+	if len(storefronts.Data) == 0 {
+		return "", fmt.Errorf("apple: no storefront for the user")
+	}
+
+	return storefronts.Data[0].ID, nil
+}
+
+/*
+postAppleLogin connects an Apple Music account with a Music-User-Token from
+MusicKit. Like the Spotify login, the request's session is reused when one is
+sent; otherwise a new session is created and its token returned. The token is
+checked with Apple before it's saved.
+*/
+func postAppleLogin(c *gin.Context) {
+	ctx := c.Request.Context()
+	var request appleLoginRequest
+	if !bindValidJSON(c, "AppleLoginRequest", &request) {
+		return
+	}
+
+	storefront, err := appleUserStorefront(ctx, request.MusicUserToken)
+	if errors.Is(err, errAppleUserToken) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Apple Music did not accept the Music-User-Token; get a new one from MusicKit"})
+		return
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("checking Apple Music user token failed", "error", err)
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"error": "apple authentication unavailable"})
+		return
+	}
+
+	session, token, ok := loginSession(c)
+	if !ok {
+		return
+	}
+	status := http.StatusOK
+	response := gin.H{"storefront": storefront, "expires_at": session.ExpiresAt}
+	if token != "" {
+		status = http.StatusCreated
+		response["session"] = token
+	}
+
+	err = sessions.SaveProviderToken(ctx, providerToken{
+		SessionID:   session.ID,
+		Provider:    "apple",
+		AccessToken: request.MusicUserToken,
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("saving provider token failed", "provider", "apple", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error connecting the account"})
+		return
+	}
+	loggerFrom(ctx).Info("Apple Music account connected", "storefront", storefront)
+
+	c.IndentedJSON(status, response)
+}
+
+// appleTokenFor reads the session's Music-User-Token, responding when no Apple
+// Music account is connected.
+func appleTokenFor(c *gin.Context, session userSession) (string, bool) {
+	token, err := sessions.GetProviderToken(c.Request.Context(), session.ID, "apple")
+	if errors.Is(err, errSessionNotFound) {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "Connect an Apple Music account first with POST /auth/apple"})
+		return "", false
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("reading Apple Music token failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error reading the session"})
+		return "", false
+	}
+
+	return token.AccessToken, true
+}
+
+// appleTokenExpired responds when Apple stopped accepting the session's
+// Music-User-Token, disconnecting the account so the app knows to send a new
+// one.
+func appleTokenExpired(c *gin.Context, session userSession) {
+	loggerFrom(c.Request.Context()).Warn("Apple: music user token rejected; disconnecting account")
+	sessions.DeleteProviderToken(c.Request.Context(), session.ID, "apple")
+	c.IndentedJSON(http.StatusForbidden, gin.H{
+		"message": "The Apple Music user token has expired or was revoked; get a new one from MusicKit and send it to POST /auth/apple",
+	})
+}
+
+// appleAvailableSongs returns which of ids can be played in storefront.
+func appleAvailableSongs(ctx context.Context, storefront string, ids []string) (map[string]bool, error) {
+	available := map[string]bool{}
+	for start := 0; start < len(ids); start += appleLibraryBatch {
+		batch := ids[start:min(start+appleLibraryBatch, len(ids))]
+		var songs struct {
+			Data []struct {
+				ID         string `json:"id"`
+				Attributes struct {
+					PlayParams *struct {
+						ID string `json:"id"`
+					} `json:"playParams"`
+				} `json:"attributes"`
+			} `json:"data"`
+		}
+		path := "/v1/catalog/" + url.PathEscape(storefront) + "/songs?ids=" + strings.Join(batch, ",")
+		if err := appleUserRequest(ctx, "several_songs", "", "GET", path, nil, &songs); err != nil {
+			return nil, err
+		}
+		for _, song := range songs.Data {
+			if song.Attributes.PlayParams != nil {
+				available[song.ID] = true
+			}
+		}
+	}
+
+	return available, nil
+}
+
+// createAppleLibraryPlaylist creates an empty playlist in the user's Apple
+// Music library.
+func createAppleLibraryPlaylist(ctx context.Context, userToken string, name string, description string) (createdPlaylist, error) {
+	var libraryPlaylists struct {
+		Data []struct {
+			ID         string `json:"id"`
+			Attributes struct {
+				Name string `json:"name"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	err := appleUserRequest(ctx, "create_library_playlist", userToken, "POST", "/v1/me/library/playlists", gin.H{
+		"attributes": gin.H{"name": name, "description": description},
+	}, &libraryPlaylists)
+	if err != nil {
+		return createdPlaylist{}, err
+	}
+	if len(libraryPlaylists.Data) == 0 {
+		return createdPlaylist{}, fmt.Errorf("apple: no playlist in the response")
+	}
+
+	return createdPlaylist{Provider: "apple", ID: libraryPlaylists.Data[0].ID, Name: libraryPlaylists.Data[0].Attributes.Name}, nil
+}
+
+/*
+postApplePlaylistWrite creates a playlist in the user's Apple Music library
+from a shared playlist, adding each track's Apple Music song, whether it is
+the original or the converted one. Songs are first looked up in the user's
+own storefront, and those that can't be played there are skipped along with
+tracks that have no Apple Music match. Library playlists are always private,
+so the public option is ignored.
+*/
+func postApplePlaylistWrite(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	p, request, ok := sharedPlaylistForWrite(c)
+	if !ok {
+		return
+	}
+
+	var ids []string
+	songIDs := map[int]string{}
+	skipped := []skippedTrack{}
+	for i, content := range p.Content {
+		id := ""
+		for _, link := range []string{content.OriginalURL, content.ConvertURL} {
+			if match := appleSongLink.FindStringSubmatch(link); match != nil {
+				id = match[1] + match[2]
+				break
+			}
+		}
+		if id == "" {
+			skipped = append(skipped, skippedTrack{Position: i + 1, Title: content.Title, Artist: content.Artist, Reason: "no Apple Music match"})
+			continue
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+		songIDs[i] = id
+	}
+	if len(ids) == 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "None of the playlist's tracks are on Apple Music", "skipped": skipped})
+		return
+	}
+
+	token, ok := appleTokenFor(c, session)
+	if !ok {
+		return
+	}
+
+	storefront, err := appleUserStorefront(ctx, token)
+	if errors.Is(err, errAppleUserToken) {
+		appleTokenExpired(c, session)
+		return
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("reading Apple Music storefront failed", "error", err)
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"error": "apple authentication unavailable"})
+		return
+	}
+
+	available, err := appleAvailableSongs(ctx, storefront, ids)
+	if err != nil {
+		writeProviderError(c, "Apple Music", err, nil, 0)
+		return
+	}
+	var songs []gin.H
+	for i, content := range p.Content {
+		id, ok := songIDs[i]
+		if !ok {
+			continue
+		}
+		if !available[id] {
+			skipped = append(skipped, skippedTrack{Position: i + 1, Title: content.Title, Artist: content.Artist, Reason: "not available in the user's storefront"})
+			continue
+		}
+		songs = append(songs, gin.H{"id": id, "type": "songs"})
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Position < skipped[j].Position })
+	if len(songs) == 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "None of the playlist's tracks are available in the account's storefront", "skipped": skipped})
+		return
+	}
+
+	created, err := createAppleLibraryPlaylist(ctx, token, request.Name, request.Description)
+	if errors.Is(err, errAppleUserToken) {
+		appleTokenExpired(c, session)
+		return
+	}
+	if err != nil {
+		writeProviderError(c, "Apple Music", err, nil, 0)
+		return
+	}
+
+	added := 0
+	for start := 0; start < len(songs); start += appleLibraryBatch {
+		batch := songs[start:min(start+appleLibraryBatch, len(songs))]
+		err := appleUserRequest(ctx, "add_library_playlist_tracks", token, "POST", "/v1/me/library/playlists/"+url.PathEscape(created.ID)+"/tracks", gin.H{"data": batch}, nil)
+		if errors.Is(err, errAppleUserToken) {
+			sessions.DeleteProviderToken(ctx, session.ID, "apple")
+		}
+		if err != nil {
+			writeProviderError(c, "Apple Music", err, &created, added)
+			return
+		}
+		added += len(batch)
+	}
+	loggerFrom(ctx).Info("playlist written to Apple Music", "id", p.ID, "apple_id", created.ID, "storefront", storefront, "added", added, "skipped", len(skipped))
+
+	c.IndentedJSON(http.StatusCreated, gin.H{
+		"playlist": created,
+		"added":    added,
+		"skipped":  skipped,
+	})
+}
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+/*
+Config holds every setting the server needs. Values are loaded in order of
+increasing precedence:
+ 1. built-in defaults
+ 2. a JSON config file (-config flag or POLYPHONIC_CONFIG)
+ 3. environment variables
+ 4. command line flags
+*/
+type Config struct {
+	Server    ServerConfig
+	Database  DatabaseConfig
+	Spotify   SpotifyConfig
+	Apple     AppleConfig
+	Deezer    DeezerConfig
+	Health    HealthConfig
+	Log       LogConfig
+	Tracing   TracingConfig
+	Auth      AuthConfig
+	Share     ShareConfig
+	Migration MigrationConfig
+	Import    ImportConfig
+	Cache     CacheConfig
+}
+
+type ServerConfig struct {
+	ListenAddr  string
+	TLSCertPath string
+	TLSKeyPath  string
+	// AdminListenAddr moves /metrics, /readyz and /admin to a listener of
+	// their own.
+	AdminListenAddr string
+	// TLSClientCAPath turns on mutual TLS for the admin listener: clients
+	// must present a certificate signed by a CA in this bundle.
+	TLSClientCAPath string
+	// TLSReloadInterval is how often certificate files are checked for
+	// changes.
+	TLSReloadInterval time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish when
+	// the server is stopped.
+	ShutdownTimeout time.Duration
+	// JobShutdownTimeout is how long background jobs and shutdown hooks
+	// get once requests have drained.
+	JobShutdownTimeout time.Duration
+	Release            bool
+}
+
+type DatabaseConfig struct {
+	// Driver is mysql, postgres, sqlite or memory. When empty it is guessed
+	// from DSN.
+	Driver string
+	// DSN overrides the MySQL connection settings below.
+	DSN         string
+	User        string
+	Password    string
+	Addr        string
+	Name        string
+	AutoMigrate bool
+}
+
+type SpotifyConfig struct {
+	ClientID        string
+	ClientSecret    string
+	APIBaseURL      string
+	AccountsBaseURL string
+	// RedirectURL is the login callback registered with Spotify. When empty
+	// it is /auth/spotify/callback on the public URL.
+	RedirectURL string
+}
+
+type AppleConfig struct {
+	TeamID         string
+	KeyID          string
+	PrivateKeyPath string
+	APIBaseURL     string
+	Storefront     string
+	RateLimitWait  time.Duration
+}
+
+type DeezerConfig struct {
+	APIBaseURL string
+	// RateLimitWait is how long to back off when Deezer reports its quota
+	// is exceeded.
+	RateLimitWait time.Duration
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error.
+	Level string
+	// Format is json or text.
+	Format string
+}
+
+type ShareConfig struct {
+	// BaseURL is the public address of the server, used for absolute links
+	// in share pages. It is required in release mode; otherwise, when empty,
+	// it is taken from each request.
+	BaseURL string
+	// AppleAppID is the iOS app's TEAMID.bundle-id, published in
+	// apple-app-site-association so share links open the app.
+	AppleAppID string
+	// AppStoreID adds a Smart App Banner to share pages.
+	AppStoreID string
+}
+
+type AuthConfig struct {
+	// RequireAPIKey rejects requests without an API key. When off, keys
+	// that are sent are still checked and rate limited.
+	RequireAPIKey bool
+	// AdminToken enables the /admin API for managing keys.
+	AdminToken string
+	// SessionTTL is how long a user session, and the provider accounts
+	// connected to it, last.
+	SessionTTL time.Duration
+	// TokenKey is a base64-encoded 32-byte AES key that provider tokens are
+	// encrypted with in the database. It is required in release mode.
+	TokenKey string
+	// LoginReturnURL is where the browser is sent once a provider account is
+	// connected, such as the app's URL scheme. When empty a page saying so
+	// is shown.
+	LoginReturnURL string
+}
+
+type MigrationConfig struct {
+	// RetryWait is how long a library migration waits after a rate limit or
+	// an upstream error before trying again.
+	RetryWait time.Duration
+}
+
+type ImportConfig struct {
+	// MatchTimeout bounds the searches for the tracks of one import.
+	MatchTimeout time.Duration
+}
+
+type CacheConfig struct {
+	// LinkTTL is how long a resolved track link is reused before /link
+	// resolves it again.
+	LinkTTL time.Duration
+	// MaxLinks bounds how many resolved links are kept in memory; the least
+	// recently used go first. All of them stay in the database.
+	MaxLinks int
+	// APIKeyTTL is how long a looked-up API key is trusted before it is read
+	// from the store again. A key revoked on another instance stops working
+	// within this time; on this instance it stops immediately.
+	APIKeyTTL time.Duration
+}
+
+type TracingConfig struct {
+	// Exporter is none, file or otlp.
+	Exporter string
+	// File receives spans as JSON lines when Exporter is file.
+	File string
+	// OTLPEndpoint is the collector URL when Exporter is otlp. When empty
+	// the standard OTEL_EXPORTER_OTLP_* variables apply.
+	OTLPEndpoint string
+	ServiceName  string
+}
+
+type HealthConfig struct {
+	// CacheTTL is how long /readyz reuses its last result.
+	CacheTTL time.Duration
+	// Timeout bounds each run of the dependency checks.
+	Timeout time.Duration
+}
+
+// defaultConfig returns the settings used when nothing else is configured.
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			ListenAddr:         "0.0.0.0:7659",
+			TLSReloadInterval:  time.Minute,
+			ShutdownTimeout:    30 * time.Second,
+			JobShutdownTimeout: 15 * time.Second,
+		},
+		Database: DatabaseConfig{
+			User: "root",
+			Addr: "127.0.0.1:3306",
+			Name: "polyphonic",
+		},
+		Spotify: SpotifyConfig{
+			APIBaseURL:      "https://api.spotify.com/v1",
+			AccountsBaseURL: "https://accounts.spotify.com",
+		},
+		Apple: AppleConfig{
+			APIBaseURL:    "https://api.music.apple.com",
+			Storefront:    "us",
+			RateLimitWait: 10 * time.Second,
+		},
+		Deezer: DeezerConfig{
+			APIBaseURL:    "https://api.deezer.com",
+			RateLimitWait: 5 * time.Second,
+		},
+		Health: HealthConfig{
+			CacheTTL: 10 * time.Second,
+			Timeout:  5 * time.Second,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Auth: AuthConfig{
+			RequireAPIKey: true,
+			SessionTTL:    90 * 24 * time.Hour,
+		},
+		Migration: MigrationConfig{
+			RetryWait: time.Minute,
+		},
+		Import: ImportConfig{
+			MatchTimeout: 2 * time.Minute,
+		},
+		Cache: CacheConfig{
+			LinkTTL:   time.Hour,
+			MaxLinks:  1000,
+			APIKeyTTL: 30 * time.Second,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			File:        "traces.jsonl",
+			ServiceName: "polyphonic-backend",
+		},
+	}
+}
+
+/*
+setting describes one configuration value and where it can come from. key is
+the dotted path used in error messages, which is also the JSON path in the
+config file. Secret settings can also be read from a file named by the
+environment variable with a _FILE suffix, or by the flag with a -file suffix,
+as done for Docker and Kubernetes secrets.
+*/
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  any
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{key: "server.listen_addr", env: "POLYPHONIC_LISTEN_ADDR", flag: "listen", usage: "address to serve on", value: &c.Server.ListenAddr},
+		{key: "server.tls_cert_path", env: "POLYPHONIC_SSL_CERT_PATH", flag: "tls-cert", usage: "TLS certificate file; enables HTTPS", value: &c.Server.TLSCertPath},
+		{key: "server.tls_key_path", env: "POLYPHONIC_SSL_KEY_PATH", flag: "tls-key", usage: "TLS private key file", value: &c.Server.TLSKeyPath},
+		{key: "server.admin_listen_addr", env: "POLYPHONIC_ADMIN_LISTEN_ADDR", flag: "admin-listen", usage: "separate address to serve /metrics, /readyz and /admin on", value: &c.Server.AdminListenAddr},
+		{key: "server.tls_client_ca_path", env: "POLYPHONIC_TLS_CLIENT_CA_PATH", flag: "tls-client-ca", usage: "CA bundle for verifying client certificates; enables mutual TLS on the admin listener", value: &c.Server.TLSClientCAPath},
+		{key: "server.tls_reload_interval", env: "POLYPHONIC_TLS_RELOAD_INTERVAL", flag: "tls-reload-interval", usage: "how often to check TLS files for changes", value: &c.Server.TLSReloadInterval},
+		{key: "server.shutdown_timeout", env: "POLYPHONIC_SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", usage: "time allowed for in-flight requests to finish on shutdown", value: &c.Server.ShutdownTimeout},
+		{key: "server.job_shutdown_timeout", env: "POLYPHONIC_JOB_SHUTDOWN_TIMEOUT", flag: "job-shutdown-timeout", usage: "time allowed for background jobs and cleanup on shutdown", value: &c.Server.JobShutdownTimeout},
+		{key: "server.release", env: "POLYPHONIC_RELEASE", flag: "release", usage: "run gin in release mode", value: &c.Server.Release},
+
+		{key: "database.driver", env: "POLYPHONIC_DB_DRIVER", flag: "db-driver", usage: "mysql, postgres, sqlite or memory", value: &c.Database.Driver},
+		{key: "database.dsn", env: "POLYPHONIC_DB_DSN", flag: "db-dsn", usage: "database connection string", secret: true, value: &c.Database.DSN},
+		{key: "database.user", env: "POLYPHONIC_DB_USER", flag: "db-user", usage: "MySQL user when no DSN is set", value: &c.Database.User},
+		{key: "database.password", env: "DBPASS", flag: "db-password", usage: "MySQL password when no DSN is set", secret: true, value: &c.Database.Password},
+		{key: "database.addr", env: "POLYPHONIC_DB_ADDR", flag: "db-addr", usage: "MySQL host:port when no DSN is set", value: &c.Database.Addr},
+		{key: "database.name", env: "POLYPHONIC_DB_NAME", flag: "db-name", usage: "MySQL database name when no DSN is set", value: &c.Database.Name},
+		{key: "database.auto_migrate", env: "POLYPHONIC_AUTO_MIGRATE", flag: "auto-migrate", usage: "apply pending migrations on startup", value: &c.Database.AutoMigrate},
+
+		{key: "spotify.client_id", env: "SPOTIFY_CLIENT_ID", flag: "spotify-client-id", usage: "Spotify client ID", value: &c.Spotify.ClientID},
+		{key: "spotify.client_secret", env: "SPOTIFY_CLIENT_SECRET", flag: "spotify-client-secret", usage: "Spotify client secret", secret: true, value: &c.Spotify.ClientSecret},
+		{key: "spotify.api_base_url", env: "SPOTIFY_API_BASE_URL", flag: "spotify-api-url", usage: "Spotify Web API base URL", value: &c.Spotify.APIBaseURL},
+		{key: "spotify.accounts_base_url", env: "SPOTIFY_ACCOUNTS_BASE_URL", flag: "spotify-accounts-url", usage: "Spotify accounts service base URL", value: &c.Spotify.AccountsBaseURL},
+		{key: "spotify.redirect_url", env: "SPOTIFY_REDIRECT_URL", flag: "spotify-redirect-url", usage: "login callback URL registered with Spotify", value: &c.Spotify.RedirectURL},
+
+		{key: "apple.team_id", env: "APPLE_TEAM_ID", flag: "apple-team-id", usage: "Apple developer team ID", value: &c.Apple.TeamID},
+		{key: "apple.key_id", env: "APPLE_KEY_ID", flag: "apple-key-id", usage: "Apple Music key ID", value: &c.Apple.KeyID},
+		{key: "apple.private_key_path", env: "APPLE_P8_PATH", flag: "apple-p8", usage: "Apple Music .p8 private key file", value: &c.Apple.PrivateKeyPath},
+		{key: "apple.api_base_url", env: "APPLE_MUSIC_API_BASE_URL", flag: "apple-api-url", usage: "Apple Music API base URL", value: &c.Apple.APIBaseURL},
+		{key: "apple.storefront", env: "APPLE_MUSIC_STOREFRONT", flag: "apple-storefront", usage: "Apple Music catalog storefront", value: &c.Apple.Storefront},
+
+		{key: "deezer.api_base_url", env: "DEEZER_API_BASE_URL", flag: "deezer-api-url", usage: "Deezer API base URL", value: &c.Deezer.APIBaseURL},
+		{key: "health.cache_ttl", env: "POLYPHONIC_HEALTH_CACHE_TTL", flag: "health-cache-ttl", usage: "how long /readyz results are cached", value: &c.Health.CacheTTL},
+		{key: "health.timeout", env: "POLYPHONIC_HEALTH_TIMEOUT", flag: "health-timeout", usage: "time limit for /readyz dependency checks", value: &c.Health.Timeout},
+
+		{key: "log.level", env: "POLYPHONIC_LOG_LEVEL", flag: "log-level", usage: "minimum log level: debug, info, warn or error", value: &c.Log.Level},
+		{key: "log.format", env: "POLYPHONIC_LOG_FORMAT", flag: "log-format", usage: "log output format: json or text", value: &c.Log.Format},
+
+		{key: "auth.require_api_key", env: "POLYPHONIC_REQUIRE_API_KEY", flag: "require-api-key", usage: "reject requests without an API key", value: &c.Auth.RequireAPIKey},
+		{key: "auth.admin_token", env: "POLYPHONIC_ADMIN_TOKEN", flag: "admin-token", usage: "bearer token for the /admin API; the API is off when empty", secret: true, value: &c.Auth.AdminToken},
+		{key: "auth.session_ttl", env: "POLYPHONIC_SESSION_TTL", flag: "session-ttl", usage: "how long user sessions last", value: &c.Auth.SessionTTL},
+		{key: "auth.token_key", env: "POLYPHONIC_TOKEN_KEY", flag: "token-key", usage: "base64-encoded 32-byte key for encrypting provider tokens at rest", secret: true, value: &c.Auth.TokenKey},
+		{key: "auth.login_return_url", env: "POLYPHONIC_LOGIN_RETURN_URL", flag: "login-return-url", usage: "where to send the browser after a provider login, e.g. the app's URL scheme", value: &c.Auth.LoginReturnURL},
+
+		{key: "share.base_url", env: "POLYPHONIC_PUBLIC_URL", flag: "public-url", usage: "public URL of this server, for share links", value: &c.Share.BaseURL},
+		{key: "share.apple_app_id", env: "POLYPHONIC_APPLE_APP_ID", flag: "apple-app-id", usage: "iOS app ID (TEAMID.bundle-id) for apple-app-site-association", value: &c.Share.AppleAppID},
+		{key: "share.app_store_id", env: "POLYPHONIC_APP_STORE_ID", flag: "app-store-id", usage: "App Store ID for the Smart App Banner on share pages", value: &c.Share.AppStoreID},
+
+		{key: "migration.retry_wait", env: "POLYPHONIC_MIGRATION_RETRY_WAIT", flag: "migration-retry-wait", usage: "how long library migrations wait after a rate limit or upstream error", value: &c.Migration.RetryWait},
+
+		{key: "import.match_timeout", env: "POLYPHONIC_IMPORT_MATCH_TIMEOUT", flag: "import-match-timeout", usage: "time allowed for matching the tracks of one import", value: &c.Import.MatchTimeout},
+
+		{key: "cache.link_ttl", env: "POLYPHONIC_LINK_CACHE_TTL", flag: "link-cache-ttl", usage: "how long resolved track links are cached", value: &c.Cache.LinkTTL},
+		{key: "cache.max_links", env: "POLYPHONIC_LINK_CACHE_SIZE", flag: "link-cache-size", usage: "how many resolved track links are kept in memory", value: &c.Cache.MaxLinks},
+		{key: "cache.api_key_ttl", env: "POLYPHONIC_API_KEY_CACHE_TTL", flag: "api-key-cache-ttl", usage: "how long looked-up API keys are trusted before being read again", value: &c.Cache.APIKeyTTL},
+
+		{key: "tracing.exporter", env: "POLYPHONIC_TRACING_EXPORTER", flag: "tracing-exporter", usage: "where spans are sent: none, file or otlp", value: &c.Tracing.Exporter},
+		{key: "tracing.file", env: "POLYPHONIC_TRACING_FILE", flag: "tracing-file", usage: "file spans are appended to with the file exporter", value: &c.Tracing.File},
+		{key: "tracing.otlp_endpoint", env: "POLYPHONIC_TRACING_OTLP_ENDPOINT", flag: "tracing-otlp-endpoint", usage: "OTLP/HTTP collector URL, e.g. http://localhost:4318", value: &c.Tracing.OTLPEndpoint},
+		{key: "tracing.service_name", env: "POLYPHONIC_TRACING_SERVICE_NAME", flag: "tracing-service-name", usage: "service name recorded on spans", value: &c.Tracing.ServiceName},
+		{key: "apple.rate_limit_wait", env: "APPLE_RATE_LIMIT_WAIT", flag: "apple-rate-limit-wait", usage: "how long to back off after an Apple Music 429", value: &c.Apple.RateLimitWait},
+		{key: "deezer.rate_limit_wait", env: "DEEZER_RATE_LIMIT_WAIT", flag: "deezer-rate-limit-wait", usage: "how long to back off when Deezer's quota is exceeded", value: &c.Deezer.RateLimitWait},
+	}
+}
+
+// setValue parses raw into the setting's value.
+func (s setting) setValue(raw string) error {
+	switch v := s.value.(type) {
+	case *string:
+		*v = raw
+	case *bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not true or false", s.key, raw)
+		}
+		*v = b
+	case *time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a duration such as 10s or 1m", s.key, raw)
+		}
+		*v = d
+	case *int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a whole number", s.key, raw)
+		}
+		*v = n
+	default:
+		panic("config: unsupported setting type for " + s.key)
+	}
+
+	return nil
+}
+
+// readSecretFile reads a secret from a file, dropping the trailing newline
+// most secret files end with.
+func readSecretFile(key string, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: reading secret file: %v", key, err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+/*
+loadConfig builds the configuration from defaults, the config file,
+environment variables and the command line. It returns the arguments left
+after the flags, such as "migrate up".
+*/
+func loadConfig(args []string, getenv func(string) string, stderr io.Writer) (Config, []string, error) {
+	cfg := defaultConfig()
+	settings := cfg.settings()
+
+	flags := flag.NewFlagSet("polyphonic-backend", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", getenv("POLYPHONIC_CONFIG"), "JSON config file")
+
+	// Flags are parsed into strings first so they can be applied after the
+	// config file and environment, whatever order they were given in.
+	flagValues := map[string]*string{}
+	for _, s := range settings {
+		if _, isBool := s.value.(*bool); isBool {
+			// Allow a bare -release as well as -release=true.
+			flagValues[s.flag] = new(string)
+			flags.Var(boolFlag{flagValues[s.flag]}, s.flag, s.usage+" (env "+s.env+")")
+		} else {
+			flagValues[s.flag] = flags.String(s.flag, "", s.usage+" (env "+s.env+")")
+		}
+		if s.secret {
+			flagValues[s.flag+"-file"] = flags.String(s.flag+"-file", "", "file containing "+s.usage+" (env "+s.env+"_FILE)")
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("config file: %v", err)
+		}
+		if err := json.Unmarshal(data, &fileConfig{&cfg}); err != nil {
+			return cfg, nil, fmt.Errorf("config file %s: %v", *configPath, err)
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		if raw := getenv(s.env); raw != "" {
+			errs = append(errs, s.setValue(raw))
+		}
+		if s.secret && getenv(s.env+"_FILE") != "" {
+			secret, err := readSecretFile(s.key, getenv(s.env+"_FILE"))
+			errs = append(errs, err, s.setValue(secret))
+		}
+	}
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range settings {
+		if set[s.flag] {
+			errs = append(errs, s.setValue(*flagValues[s.flag]))
+		}
+		if s.secret && set[s.flag+"-file"] {
+			secret, err := readSecretFile(s.key, *flagValues[s.flag+"-file"])
+			errs = append(errs, err, s.setValue(secret))
+		}
+	}
+
+	cfg.Spotify.APIBaseURL = strings.TrimSuffix(cfg.Spotify.APIBaseURL, "/")
+	cfg.Spotify.AccountsBaseURL = strings.TrimSuffix(cfg.Spotify.AccountsBaseURL, "/")
+	cfg.Apple.APIBaseURL = strings.TrimSuffix(cfg.Apple.APIBaseURL, "/")
+	cfg.Deezer.APIBaseURL = strings.TrimSuffix(cfg.Deezer.APIBaseURL, "/")
+
+	return cfg, flags.Args(), errors.Join(errs...)
+}
+
+// boolFlag lets boolean settings be given as a bare flag.
+type boolFlag struct {
+	raw *string
+}
+
+func (b boolFlag) String() string {
+	if b.raw == nil {
+		return ""
+	}
+	return *b.raw
+}
+
+func (b boolFlag) Set(raw string) error {
+	*b.raw = raw
+	return nil
+}
+
+func (b boolFlag) IsBoolFlag() bool { return true }
+
+/*
+fileConfig decodes the JSON config file. Durations are written as strings
+such as "10s", numbers as JSON numbers, and secrets can be given as
+"<name>_file" paths instead of inline values.
+*/
+type fileConfig struct {
+	*Config
+}
+
+func (f *fileConfig) UnmarshalJSON(data []byte) error {
+	var sections map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return err
+	}
+
+	byKey := map[string]setting{}
+	for _, s := range f.settings() {
+		byKey[s.key] = s
+	}
+
+	var errs []error
+	for section, values := range sections {
+		for name, raw := range values {
+			key := section + "." + name
+			fromFile := false
+			s, ok := byKey[key]
+			if !ok && strings.HasSuffix(name, "_file") {
+				s, ok = byKey[strings.TrimSuffix(key, "_file")]
+				fromFile = ok && s.secret
+				ok = fromFile
+			}
+			if !ok {
+				errs = append(errs, fmt.Errorf("unknown setting %q", key))
+				continue
+			}
+
+			var value string
+			if _, isBool := s.value.(*bool); isBool {
+				var b bool
+				if err := json.Unmarshal(raw, &b); err != nil {
+					errs = append(errs, fmt.Errorf("%s: expected true or false", key))
+					continue
+				}
+				value = strconv.FormatBool(b)
+			} else if _, isInt := s.value.(*int); isInt {
+				var n int
+				if err := json.Unmarshal(raw, &n); err != nil {
+					errs = append(errs, fmt.Errorf("%s: expected a whole number", key))
+					continue
+				}
+				value = strconv.Itoa(n)
+			} else if err := json.Unmarshal(raw, &value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: expected a string", key))
+				continue
+			}
+
+			if fromFile {
+				secret, err := readSecretFile(s.key, value)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				value = secret
+			}
+			errs = append(errs, s.setValue(value))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// databaseDriver returns the configured storage driver, guessing it from the
+// DSN when it is not set.
+func (c Config) databaseDriver() string {
+	if c.Database.Driver != "" {
+		return c.Database.Driver
+	}
+
+	return driverForDSN(c.Database.DSN)
+}
+
+// databaseDSN returns the DSN for the configured driver, building a MySQL DSN
+// from the individual settings when none was given.
+func (c Config) databaseDSN() string {
+	if c.Database.DSN != "" {
+		return c.Database.DSN
+	}
+
+	switch c.databaseDriver() {
+	case "mysql":
+		mysqlConfig := mysql.Config{
+			User:                 c.Database.User,
+			Passwd:               c.Database.Password,
+			Net:                  "tcp",
+			Addr:                 c.Database.Addr,
+			DBName:               c.Database.Name,
+			ParseTime:            true,
+			AllowNativePasswords: true,
+			ClientFoundRows:      true,
+		}
+		return mysqlConfig.FormatDSN()
+	case "sqlite":
+		return "polyphonic.db"
+	}
+
+	return ""
+}
+
+// where describes how a setting can be provided, for error messages.
+func (s setting) where() string {
+	if s.secret {
+		return fmt.Sprintf("set %s or %s_FILE, -%s or %q in the config file", s.env, s.env, s.flag, s.key)
+	}
+	return fmt.Sprintf("set %s, -%s or %q in the config file", s.env, s.flag, s.key)
+}
+
+/*
+validate checks the configuration and returns every problem found at once.
+Provider credentials are only required when serving, so that commands such
+as "migrate" can run without them.
+*/
+func (c *Config) validate(serving bool) error {
+	byKey := map[string]setting{}
+	for _, s := range c.settings() {
+		byKey[s.key] = s
+	}
+
+	var errs []error
+	problem := func(key string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s (%s)", key, fmt.Sprintf(format, args...), byKey[key].where()))
+	}
+
+	switch c.databaseDriver() {
+	case "mysql", "postgres", "sqlite", "memory":
+	default:
+		problem("database.driver", "unknown driver %q, expected mysql, postgres, sqlite or memory", c.Database.Driver)
+	}
+	if c.databaseDriver() == "postgres" && c.Database.DSN == "" {
+		problem("database.dsn", "a DSN is required for postgres")
+	}
+
+	if !serving {
+		return errors.Join(errs...)
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.ListenAddr); err != nil {
+		problem("server.listen_addr", "%q is not a host:port address", c.Server.ListenAddr)
+	}
+	if (c.Server.TLSCertPath == "") != (c.Server.TLSKeyPath == "") {
+		problem("server.tls_cert_path", "TLS needs both a certificate and a key")
+	}
+	if c.Server.TLSClientCAPath != "" && c.Server.TLSCertPath == "" {
+		problem("server.tls_client_ca_path", "mutual TLS needs a server certificate and key as well")
+	}
+	if c.Server.TLSClientCAPath != "" && c.Server.AdminListenAddr == "" {
+		problem("server.tls_client_ca_path", "mutual TLS is only used on the admin listener; set server.admin_listen_addr")
+	}
+	if c.Server.AdminListenAddr != "" && c.Server.AdminListenAddr == c.Server.ListenAddr {
+		problem("server.admin_listen_addr", "must differ from server.listen_addr")
+	}
+	if c.Server.TLSReloadInterval <= 0 {
+		problem("server.tls_reload_interval", "must be positive")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		problem("server.shutdown_timeout", "must be positive")
+	}
+	if c.Server.JobShutdownTimeout <= 0 {
+		problem("server.job_shutdown_timeout", "must be positive")
+	}
+	for _, key := range []string{"server.tls_cert_path", "server.tls_key_path", "server.tls_client_ca_path", "apple.private_key_path"} {
+		path := *byKey[key].value.(*string)
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			problem(key, "cannot read %s: %v", path, err)
+		}
+	}
+
+	required := []string{"spotify.client_id", "spotify.client_secret", "apple.team_id", "apple.key_id", "apple.private_key_path", "apple.storefront"}
+	for _, key := range required {
+		if *byKey[key].value.(*string) == "" {
+			problem(key, "required")
+		}
+	}
+
+	for _, key := range []string{"spotify.api_base_url", "spotify.accounts_base_url", "apple.api_base_url", "deezer.api_base_url"} {
+		raw := *byKey[key].value.(*string)
+		if u, err := url.Parse(raw); err != nil || u.Scheme == "" || u.Host == "" {
+			problem(key, "%q is not an absolute URL", raw)
+		}
+	}
+
+	if c.Health.CacheTTL < 0 {
+		problem("health.cache_ttl", "must not be negative")
+	}
+	if c.Health.Timeout <= 0 {
+		problem("health.timeout", "must be positive")
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problem("log.level", "%q is not debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		problem("log.format", "%q is not json or text", c.Log.Format)
+	}
+
+	// Without a base URL, links in pages, embeds and playlists written to
+	// user accounts follow the Host header, which any client can set.
+	if c.Share.BaseURL == "" && c.Server.Release {
+		problem("share.base_url", "required in release mode")
+	}
+	if c.Auth.TokenKey == "" && c.Server.Release {
+		problem("auth.token_key", "required in release mode")
+	}
+	if c.Auth.TokenKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.Auth.TokenKey); err != nil || len(key) != 32 {
+			problem("auth.token_key", "must be 32 bytes, base64-encoded")
+		}
+	}
+	if c.Share.BaseURL != "" {
+		if u, err := url.Parse(c.Share.BaseURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problem("share.base_url", "%q is not an absolute http(s) URL", c.Share.BaseURL)
+		}
+	}
+	if c.Spotify.RedirectURL != "" {
+		if u, err := url.Parse(c.Spotify.RedirectURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problem("spotify.redirect_url", "%q is not an absolute http(s) URL", c.Spotify.RedirectURL)
+		}
+	}
+	if c.Auth.SessionTTL <= 0 {
+		problem("auth.session_ttl", "must be positive")
+	}
+	if c.Auth.LoginReturnURL != "" {
+		if u, err := url.Parse(c.Auth.LoginReturnURL); err != nil || u.Scheme == "" {
+			problem("auth.login_return_url", "%q is not an absolute URL", c.Auth.LoginReturnURL)
+		}
+	}
+	if c.Share.AppStoreID != "" {
+		if _, err := strconv.ParseUint(c.Share.AppStoreID, 10, 64); err != nil {
+			problem("share.app_store_id", "%q is not a numeric App Store ID", c.Share.AppStoreID)
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "otlp":
+	case "file":
+		if c.Tracing.File == "" {
+			problem("tracing.file", "required by the file exporter")
+		}
+	default:
+		problem("tracing.exporter", "%q is not none, file or otlp", c.Tracing.Exporter)
+	}
+	if c.Tracing.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.Tracing.OTLPEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			problem("tracing.otlp_endpoint", "%q is not an absolute URL", c.Tracing.OTLPEndpoint)
+		}
+	}
+
+	if c.Apple.RateLimitWait < 0 {
+		problem("apple.rate_limit_wait", "must not be negative")
+	}
+	if c.Deezer.RateLimitWait < 0 {
+		problem("deezer.rate_limit_wait", "must not be negative")
+	}
+	if c.Migration.RetryWait <= 0 {
+		problem("migration.retry_wait", "must be positive")
+	}
+	if c.Import.MatchTimeout <= 0 {
+		problem("import.match_timeout", "must be positive")
+	}
+	if c.Cache.LinkTTL <= 0 {
+		problem("cache.link_ttl", "must be positive")
+	}
+	if c.Cache.MaxLinks <= 0 {
+		problem("cache.max_links", "must be positive")
+	}
+	if c.Cache.APIKeyTTL < 0 {
+		problem("cache.api_key_ttl", "must not be negative")
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+/*
+Deezer's catalog API needs no token. Errors, including going over its quota of
+about 50 requests every 5 seconds, come back as a 200 response with an error
+object instead of a status code. Tracks and albums can be looked up directly
+by ISRC and UPC, so converting to Deezer tries those before searching.
+*/
+
+const (
+	// deezerQuotaExceeded is the error code Deezer uses for rate limiting.
+	deezerQuotaExceeded = 4
+	// deezerNoData is the error code for an ID that doesn't exist.
+	deezerNoData = 800
+	// maxDeezerPlaylistTracks bounds how many tracks are read from one
+	// playlist.
+	maxDeezerPlaylistTracks = 10000
+)
+
+// used to avoid going over rate limit
+type DeezerWaitContainer struct {
+	mu   sync.Mutex
+	wait bool
+}
+
+var dWait = DeezerWaitContainer{}
+
+// errDeezerNotFound is returned when Deezer has nothing with the given ID,
+// ISRC or UPC.
+var errDeezerNotFound = errors.New("deezer: no data")
+
+type DeezerTrack struct {
+	ID             int64          `json:"id"`
+	Title          string         `json:"title"`
+	ISRC           string         `json:"isrc,omitempty"`
+	Link           string         `json:"link"`
+	Duration       int            `json:"duration"`
+	TrackPosition  int            `json:"track_position,omitempty"`
+	DiskNumber     int            `json:"disk_number,omitempty"`
+	ExplicitLyrics bool           `json:"explicit_lyrics"`
+	Artist         DeezerArtist   `json:"artist"`
+	Contributors   []DeezerArtist `json:"contributors,omitempty"`
+	Album          DeezerAlbum    `json:"album"`
+}
+
+type DeezerAlbum struct {
+	ID             int64         `json:"id"`
+	Title          string        `json:"title"`
+	UPC            string        `json:"upc,omitempty"`
+	Link           string        `json:"link,omitempty"`
+	CoverXL        string        `json:"cover_xl,omitempty"`
+	Label          string        `json:"label,omitempty"`
+	NbTracks       int           `json:"nb_tracks,omitempty"`
+	ReleaseDate    string        `json:"release_date,omitempty"`
+	ExplicitLyrics bool          `json:"explicit_lyrics,omitempty"`
+	Artist         *DeezerArtist `json:"artist,omitempty"`
+	Tracks         *DeezerTracks `json:"tracks,omitempty"`
+}
+
+type DeezerArtist struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Link      string `json:"link,omitempty"`
+	PictureXL string `json:"picture_xl,omitempty"`
+	NbAlbum   int    `json:"nb_album,omitempty"`
+	NbFan     int    `json:"nb_fan,omitempty"`
+}
+
+type DeezerPlaylist struct {
+	ID          int64  `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Link        string `json:"link"`
+	PictureXL   string `json:"picture_xl"`
+	NbTracks    int    `json:"nb_tracks"`
+	Creator     struct {
+		Name string `json:"name"`
+	} `json:"creator"`
+	Tracks DeezerTracks `json:"tracks"`
+}
+
+// DeezerTracks is a page of tracks, as in playlists and search results.
+type DeezerTracks struct {
+	Data  []DeezerTrack `json:"data"`
+	Total int           `json:"total,omitempty"`
+	Next  string        `json:"next,omitempty"`
+}
+
+type DeezerAlbumSearch struct {
+	Data  []DeezerAlbum `json:"data"`
+	Total int           `json:"total"`
+}
+
+type DeezerArtistSearch struct {
+	Data  []DeezerArtist `json:"data"`
+	Total int            `json:"total"`
+}
+
+// deezerError is the error object Deezer sends in place of a result.
+type deezerError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+/*
+Checks to see if there is a wait time to be served b/c of rate limiting
+*/
+func deezerWaitIfLimited(ctx context.Context, w *DeezerWaitContainer) {
+	// The span covers waiting for the mutex as well as any back-off.
+	_, span := tracer.Start(ctx, "deezer rate limit wait")
+	defer span.End()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.wait {
+		deezerWaitTime := config.Deezer.RateLimitWait
+		loggerFrom(ctx).Info("Deezer: waiting before retrying", "wait", deezerWaitTime.String())
+		time.Sleep(deezerWaitTime)
+		rateLimitWaitSeconds.WithLabelValues("deezer").Add(deezerWaitTime.Seconds())
+		span.SetAttributes(attribute.Float64("rate_limit.wait_seconds", deezerWaitTime.Seconds()))
+
+		w.wait = false
+	}
+}
+
+/*
+deezerRequest gets path from the Deezer API and decodes the response into
+out. Requests over the quota wait, shared with other Deezer requests, and are
+retried. A missing ID, ISRC or UPC returns errDeezerNotFound.
+*/
+func deezerRequest(ctx context.Context, operation string, path string, out any) error {
+	client := upstreamClient("deezer", operation)
+
+	for attempt := 1; ; attempt++ {
+		deezerWaitIfLimited(ctx, &dWait)
+
+		request, err := http.NewRequestWithContext(ctx, "GET", config.Deezer.APIBaseURL+path, nil)
+		if err != nil {
+			return err
+		}
+
+		response, err := client.Do(request)
+		if err != nil {
+			return fmt.Errorf("deezer: %v", err)
+		}
+		responseData, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return fmt.Errorf("deezer: %v", err)
+		}
+
+		var problem struct {
+			Error *deezerError `json:"error"`
+		}
+		json.Unmarshal(responseData, &problem)
+		limited := response.StatusCode == http.StatusTooManyRequests ||
+			(problem.Error != nil && problem.Error.Code == deezerQuotaExceeded)
+		if limited && attempt < maxUserRequestAttempts {
+			loggerFrom(ctx).Warn("Deezer: quota exceeded")
+			if response.StatusCode != http.StatusTooManyRequests {
+				upstreamRateLimitedTotal.WithLabelValues("deezer", operation).Inc()
+			}
+			dWait.mu.Lock()
+			dWait.wait = true
+			dWait.mu.Unlock()
+			continue
+		}
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return fmt.Errorf("deezer: status %d", response.StatusCode)
+		}
+		if problem.Error != nil {
+			if problem.Error.Code == deezerNoData {
+				return errDeezerNotFound
+			}
+			return fmt.Errorf("deezer: %s (code %d)", problem.Error.Message, problem.Error.Code)
+		}
+
+		if err := json.Unmarshal(responseData, out); err != nil {
+			return fmt.Errorf("deezer: %v", err)
+		}
+		return nil
+	}
+}
+
+func getDeezerTrack(ctx context.Context, id string) (DeezerTrack, error) {
+	var track DeezerTrack
+	err := deezerRequest(ctx, "tracks", "/track/"+url.PathEscape(id), &track)
+
+	return track, err
+}
+
+// getDeezerTrackByISRC uses Deezer's direct ISRC lookup.
+func getDeezerTrackByISRC(ctx context.Context, isrc string) (DeezerTrack, error) {
+	var track DeezerTrack
+	err := deezerRequest(ctx, "tracks_isrc", "/track/isrc:"+url.PathEscape(strings.ToUpper(isrc)), &track)
+
+	return track, err
+}
+
+func getDeezerAlbum(ctx context.Context, id string) (DeezerAlbum, error) {
+	var album DeezerAlbum
+	err := deezerRequest(ctx, "albums", "/album/"+url.PathEscape(id), &album)
+
+	return album, err
+}
+
+// getDeezerAlbumByUPC uses Deezer's direct UPC lookup.
+func getDeezerAlbumByUPC(ctx context.Context, upc string) (DeezerAlbum, error) {
+	var album DeezerAlbum
+	err := deezerRequest(ctx, "albums_upc", "/album/upc:"+url.PathEscape(upc), &album)
+
+	return album, err
+}
+
+func getDeezerArtist(ctx context.Context, id string) (DeezerArtist, error) {
+	var artist DeezerArtist
+	err := deezerRequest(ctx, "artists", "/artist/"+url.PathEscape(id), &artist)
+
+	return artist, err
+}
+
+/*
+getDeezerPlaylist gets a playlist with every page of its tracks, up to limit.
+Deezer only includes the first tracks with the playlist, so the rest are read
+from its tracks pages.
+*/
+func getDeezerPlaylist(ctx context.Context, id string, limit int) (DeezerPlaylist, error) {
+	var playlist DeezerPlaylist
+	if err := deezerRequest(ctx, "playlists", "/playlist/"+url.PathEscape(id), &playlist); err != nil {
+		return playlist, err
+	}
+
+	for len(playlist.Tracks.Data) < min(playlist.NbTracks, limit) {
+		var page DeezerTracks
+		path := "/playlist/" + url.PathEscape(id) + "/tracks?index=" + strconv.Itoa(len(playlist.Tracks.Data)) + "&limit=100"
+		if err := deezerRequest(ctx, "playlist_tracks_next", path, &page); err != nil {
+			return playlist, err
+		}
+		if len(page.Data) == 0 {
+			break
+		}
+		playlist.Tracks.Data = append(playlist.Tracks.Data, page.Data...)
+	}
+	playlist.Tracks.Data = playlist.Tracks.Data[:min(limit, len(playlist.Tracks.Data))]
+	playlist.Tracks.Next = ""
+	loggerFrom(ctx).Debug("Deezer playlist", "id", id, "name", playlist.Title, "tracks", len(playlist.Tracks.Data))
+
+	return playlist, nil
+}
+
+// searchDeezer runs a search of kind (track, album or artist) for q, which
+// may use Deezer's advanced syntax such as artist:"name".
+func searchDeezer(ctx context.Context, kind string, q string, limit int, out any) error {
+	path := "/search/" + kind + "?q=" + url.QueryEscape(q) + "&limit=" + strconv.Itoa(limit)
+
+	return deezerRequest(ctx, "search_"+kind+"s", path, out)
+}
+
+// deezerQuoted quotes s for an advanced search field.
+func deezerQuoted(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "") + `"`
+}
+
+// deezerArtistNames joins a track's contributors, or its main artist when
+// contributors weren't included.
+func deezerArtistNames(track DeezerTrack) string {
+	if len(track.Contributors) == 0 {
+		return track.Artist.Name
+	}
+	names := make([]string, 0, len(track.Contributors))
+	for _, contributor := range track.Contributors {
+		names = append(names, contributor.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// deezerHandlerError responds to a failed Deezer lookup.
+func deezerHandlerError(c *gin.Context, what string, id string, err error) {
+	if err == errDeezerNotFound {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "There is no such " + what + " on Deezer"})
+		return
+	}
+	loggerFrom(c.Request.Context()).Error("Deezer lookup failed", "kind", what, "id", id, "error", err)
+	c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Deezer could not be reached"})
+}
+
+/*
+polyphonicGetDeezerSongByID gets a Deezer track's data from the Deezer API
+using the track's ID and then responds with only the required data for
+translation.
+*/
+func polyphonicGetDeezerSongByID(c *gin.Context) {
+	id := c.Param("id")
+
+	track, err := getDeezerTrack(c.Request.Context(), id)
+	if err != nil {
+		deezerHandlerError(c, "song", id, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, track)
+}
+
+// polyphonicGetDeezerSongByISRC looks a Deezer track up by its ISRC.
+func polyphonicGetDeezerSongByISRC(c *gin.Context) {
+	isrc := c.Param("isrc")
+
+	track, err := getDeezerTrackByISRC(c.Request.Context(), isrc)
+	if err != nil {
+		deezerHandlerError(c, "song", isrc, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, track)
+}
+
+/*
+polyphonicGetDeezerSongsBySearch searches Deezer tracks.
+
+Format of terms: "[track title] [artist name]", or Deezer's advanced search,
+such as `track:"[track title]" artist:"[artist name]"`
+*/
+func polyphonicGetDeezerSongsBySearch(c *gin.Context) {
+	terms := c.Param("terms")
+
+	var search DeezerTracks
+	if err := searchDeezer(c.Request.Context(), "track", terms, 25, &search); err != nil {
+		deezerHandlerError(c, "search", terms, err)
+		return
+	}
+	search.Next = ""
+
+	c.IndentedJSON(http.StatusOK, search)
+}
+
+/*
+polyphonicGetDeezerAlbumByID gets a Deezer album's data, with its tracks,
+from the Deezer API using the album's ID.
+*/
+func polyphonicGetDeezerAlbumByID(c *gin.Context) {
+	id := c.Param("id")
+
+	album, err := getDeezerAlbum(c.Request.Context(), id)
+	if err != nil {
+		deezerHandlerError(c, "album", id, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, album)
+}
+
+// polyphonicGetDeezerAlbumByUPC looks a Deezer album up by its UPC.
+func polyphonicGetDeezerAlbumByUPC(c *gin.Context) {
+	upc := c.Param("upc")
+
+	album, err := getDeezerAlbumByUPC(c.Request.Context(), upc)
+	if err != nil {
+		deezerHandlerError(c, "album", upc, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, album)
+}
+
+/*
+polyphonicGetDeezerAlbumsBySearch searches Deezer albums.
+
+Format of terms: "[album title] [artist name]"
+*/
+func polyphonicGetDeezerAlbumsBySearch(c *gin.Context) {
+	terms := c.Param("terms")
+
+	var search DeezerAlbumSearch
+	if err := searchDeezer(c.Request.Context(), "album", terms, 25, &search); err != nil {
+		deezerHandlerError(c, "search", terms, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, search)
+}
+
+// polyphonicGetDeezerArtistByID gets a Deezer artist's data using the
+// artist's ID.
+func polyphonicGetDeezerArtistByID(c *gin.Context) {
+	id := c.Param("id")
+
+	artist, err := getDeezerArtist(c.Request.Context(), id)
+	if err != nil {
+		deezerHandlerError(c, "artist", id, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, artist)
+}
+
+/*
+polyphonicGetDeezerArtistBySearch searches Deezer artists.
+
+Format of terms: "[artist name]"
+*/
+func polyphonicGetDeezerArtistBySearch(c *gin.Context) {
+	terms := c.Param("terms")
+
+	var search DeezerArtistSearch
+	if err := searchDeezer(c.Request.Context(), "artist", terms, 25, &search); err != nil {
+		deezerHandlerError(c, "search", terms, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, search)
+}
+
+/*
+polyphonicGetDeezerPlaylistByID gets a Deezer playlist's data, with every
+page of its tracks, using the playlist's ID.
+*/
+func polyphonicGetDeezerPlaylistByID(c *gin.Context) {
+	id := c.Param("id")
+
+	playlist, err := getDeezerPlaylist(c.Request.Context(), id, maxDeezerPlaylistTracks)
+	if err != nil {
+		deezerHandlerError(c, "playlist", id, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, playlist)
+}
+
+// deezerTrackQueries turns playlist tracks into queries, with the Deezer
+// tracks known by index. Tracks Deezer no longer has come without a title and
+// are left out.
+func deezerTrackQueries(tracks []DeezerTrack) ([]trackQuery, map[int]trackCandidate) {
+	var queries []trackQuery
+	known := map[int]trackCandidate{}
+	for _, track := range tracks {
+		if track.Title == "" {
+			continue
+		}
+		candidate := deezerCandidate(track)
+		known[len(queries)] = candidate
+		queries = append(queries, trackQuery{Title: candidate.Title, Artist: candidate.Artist, Album: candidate.Album})
+	}
+
+	return queries, known
+}
+
+/*
+postDeezerPlaylistImport reads a public Deezer playlist and saves it as a
+shared playlist, as playlists are imported from a Spotify or Apple Music
+account. Deezer playlists can be read without one. Playlists longer than the
+import limit are rejected.
+*/
+func postDeezerPlaylistImport(c *gin.Context) {
+	ctx := c.Request.Context()
+	request, ok := readUserImportRequest(c, "deezer")
+	if !ok {
+		return
+	}
+
+	// One track more than the limit is read, so longer playlists are told
+	// apart and rejected rather than cut short. Tracks Deezer no longer has
+	// count too, as they are only left out afterwards.
+	id := c.Param("id")
+	playlist, err := getDeezerPlaylist(ctx, id, maxImportEntries+1)
+	if err != nil {
+		deezerHandlerError(c, "playlist", id, err)
+		return
+	}
+	if len(playlist.Tracks.Data) > maxImportEntries {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprintf("At most %d tracks can be imported at once", maxImportEntries)})
+		return
+	}
+
+	queries, known := deezerTrackQueries(playlist.Tracks.Data)
+	importUserTracks(c, "deezer", request, playlist.Title, queries, known)
+}
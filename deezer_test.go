@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDeezerTrackQueries(t *testing.T) {
+	tracks := []DeezerTrack{
+		{ID: 1, Title: "Yesterday", ISRC: "GBAYE0601498", Artist: DeezerArtist{Name: "The Beatles"}, Album: DeezerAlbum{Title: "Help!"}},
+		// Deezer lists tracks it no longer has without a title.
+		{ID: 2},
+		{ID: 3, Title: "Glue", Artist: DeezerArtist{Name: "Bicep"}},
+	}
+
+	queries, known := deezerTrackQueries(tracks)
+	if len(queries) != 2 || queries[0].Title != "Yesterday" || queries[0].Album != "Help!" || queries[1].Title != "Glue" {
+		t.Fatalf("deezerTrackQueries = %+v, want Yesterday and Glue", queries)
+	}
+	if known[0].ISRC != "GBAYE0601498" || known[0].Provider != "deezer" || known[1].Title != "Glue" {
+		t.Errorf("deezerTrackQueries known = %+v, want both tracks by their index in the queries", known)
+	}
+}
+
+// TestPostDeezerPlaylistImportLimits checks the playlists rejected before
+// anything is matched, and that a long playlist isn't read to the end.
+func TestPostDeezerPlaylistImportLimits(t *testing.T) {
+	var pages atomic.Int32
+	page := func(index int, n int) []DeezerTrack {
+		tracks := make([]DeezerTrack, n)
+		for i := range tracks {
+			tracks[i] = DeezerTrack{ID: int64(index + i + 1), Title: "Track " + strconv.Itoa(index+i+1)}
+		}
+		return tracks
+	}
+	deezer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/playlist/long":
+			json.NewEncoder(w).Encode(DeezerPlaylist{ID: 1, Title: "Long", NbTracks: 2000, Tracks: DeezerTracks{Data: page(0, 100)}})
+		case r.URL.Path == "/playlist/long/tracks":
+			pages.Add(1)
+			index, _ := strconv.Atoi(r.URL.Query().Get("index"))
+			json.NewEncoder(w).Encode(DeezerTracks{Data: page(index, 100)})
+		case r.URL.Path == "/playlist/empty":
+			json.NewEncoder(w).Encode(DeezerPlaylist{ID: 2, Title: "Empty"})
+		default:
+			w.Write([]byte(`{"error": {"type": "DataException", "message": "no data", "code": 800}}`))
+		}
+	}))
+	defer deezer.Close()
+
+	defer func(saved Config) { config = saved }(config)
+	config.Deezer.APIBaseURL = deezer.URL
+	spec, err := loadAPISpec()
+	if err != nil {
+		t.Fatalf("loadAPISpec: %v", err)
+	}
+	apiSpec = spec
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/deezer/playlist/id/:id/import", postDeezerPlaylistImport)
+
+	tests := []struct {
+		id      string
+		body    string
+		want    int
+		message string
+	}{
+		{"long", "", http.StatusUnprocessableEntity, "At most 500 tracks"},
+		{"empty", "", http.StatusUnprocessableEntity, "No tracks"},
+		{"missing", "", http.StatusNotFound, "no such playlist"},
+		{"empty", `{"platform": "tidal"}`, http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/deezer/playlist/id/"+test.id+"/import", strings.NewReader(test.body))
+		request.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != test.want || !strings.Contains(recorder.Body.String(), test.message) {
+			t.Errorf("importing %s with %q = %d %s, want %d with %q", test.id, test.body, recorder.Code, recorder.Body.String(), test.want, test.message)
+		}
+	}
+
+	// 100 tracks come with the playlist, and 4 pages more make 500; only
+	// one page past the limit is read.
+	if n := pages.Load(); n != 5 {
+		t.Errorf("read %d pages of the long playlist, want 5", n)
+	}
+}
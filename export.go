@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Playlists can be exported for other players and spreadsheets. Every exporter
+works on playlist_data, so shared playlists and playlists fetched from Spotify
+or Apple Music go through the same code.
+*/
+
+// playlistExporter writes a playlist in one file format.
+type playlistExporter struct {
+	contentType string
+	extension   string
+	write       func(w io.Writer, p playlist_data) error
+}
+
+var playlistExporters = map[string]playlistExporter{
+	"m3u8": {contentType: "audio/x-mpegurl; charset=utf-8", extension: "m3u8", write: writeM3U8},
+	"xspf": {contentType: "application/xspf+xml; charset=utf-8", extension: "xspf", write: writeXSPF},
+	"jspf": {contentType: "application/json; charset=utf-8", extension: "jspf", write: writeJSPF},
+	"csv":  {contentType: "text/csv; charset=utf-8", extension: "csv", write: writeCSV},
+}
+
+// exportFormats lists the supported formats for error messages.
+func exportFormats() string {
+	formats := make([]string, 0, len(playlistExporters))
+	for format := range playlistExporters {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	return strings.Join(formats, ", ")
+}
+
+// trackLocations returns a track's links, original first.
+func trackLocations(content playlist_content) []string {
+	var locations []string
+	for _, location := range []string{content.OriginalURL, content.ConvertURL} {
+		if location != "" {
+			locations = append(locations, location)
+		}
+	}
+
+	return locations
+}
+
+// oneLine keeps a value from breaking out of a line-based format.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+/*
+writeM3U8 writes an extended M3U playlist in UTF-8. Each entry points at the
+track's original link, or its converted link if there is no original, and
+carries the match confidence as an attribute of its #EXTINF line.
+*/
+func writeM3U8(w io.Writer, p playlist_data) error {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", oneLine(p.Name))
+	for _, content := range p.Content {
+		locations := trackLocations(content)
+		if len(locations) == 0 {
+			continue
+		}
+		title := oneLine(content.Title)
+		if content.Artist != "" {
+			title = oneLine(content.Artist) + " - " + title
+		}
+		fmt.Fprintf(&b, "#EXTINF:-1 confidence=\"%d\",%s\n", content.Confidence, title)
+		if content.Album != "" {
+			fmt.Fprintf(&b, "#EXTALB:%s\n", oneLine(content.Album))
+		}
+		fmt.Fprintf(&b, "%s\n", oneLine(locations[0]))
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Fields without an XSPF element are kept as meta and extension entries
+// under this namespace.
+const exportNamespace = "https://github.com/dhruvweaver/polyphonic-backend/"
+
+type xspfPlaylist struct {
+	XMLName  xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version  string      `xml:"version,attr"`
+	Title    string      `xml:"title,omitempty"`
+	Creator  string      `xml:"creator,omitempty"`
+	Location string      `xml:"location,omitempty"`
+	Tracks   []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Locations   []string   `xml:"location"`
+	Identifiers []string   `xml:"identifier"`
+	Title       string     `xml:"title,omitempty"`
+	Creator     string     `xml:"creator,omitempty"`
+	Album       string     `xml:"album,omitempty"`
+	TrackNum    int        `xml:"trackNum,omitempty"`
+	Image       string     `xml:"image,omitempty"`
+	Meta        []xspfMeta `xml:"meta"`
+}
+
+type xspfMeta struct {
+	Rel   string `xml:"rel,attr"`
+	Value string `xml:",chardata"`
+}
+
+// trackMeta is what XSPF and JSPF keep as meta for a track.
+func trackMeta(content playlist_content) [][2]string {
+	return [][2]string{
+		{exportNamespace + "isrc", content.ISRC},
+		{exportNamespace + "explicit", strconv.FormatBool(content.Explicit)},
+		{exportNamespace + "converted_url", content.ConvertURL},
+		{exportNamespace + "confidence", strconv.Itoa(content.Confidence)},
+	}
+}
+
+// isrcURN identifies a track by ISRC, as RFC 3986 URIs are required by
+// XSPF and JSPF identifiers.
+func isrcURN(isrc string) []string {
+	if isrc == "" {
+		return nil
+	}
+
+	return []string{"urn:isrc:" + isrc}
+}
+
+// writeXSPF writes an XSPF playlist; encoding/xml does the escaping.
+func writeXSPF(w io.Writer, p playlist_data) error {
+	doc := xspfPlaylist{Version: "1", Title: p.Name, Creator: p.Creator, Location: p.OriginalURL}
+	for _, content := range p.Content {
+		track := xspfTrack{
+			Locations:   trackLocations(content),
+			Identifiers: isrcURN(content.ISRC),
+			Title:       content.Title,
+			Creator:     content.Artist,
+			Album:       content.Album,
+			TrackNum:    content.TrackNum,
+			Image:       artworkURL(content.ArtworkURL, shareArtworkSize),
+		}
+		for _, meta := range trackMeta(content) {
+			if meta[1] != "" {
+				track.Meta = append(track.Meta, xspfMeta{Rel: meta[0], Value: meta[1]})
+			}
+		}
+		doc.Tracks = append(doc.Tracks, track)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+type jspfDocument struct {
+	Playlist jspfPlaylist `json:"playlist"`
+}
+
+type jspfPlaylist struct {
+	Title    string      `json:"title,omitempty"`
+	Creator  string      `json:"creator,omitempty"`
+	Location string      `json:"location,omitempty"`
+	Track    []jspfTrack `json:"track"`
+}
+
+type jspfTrack struct {
+	Location   []string            `json:"location,omitempty"`
+	Identifier []string            `json:"identifier,omitempty"`
+	Title      string              `json:"title,omitempty"`
+	Creator    string              `json:"creator,omitempty"`
+	Album      string              `json:"album,omitempty"`
+	TrackNum   int                 `json:"trackNum,omitempty"`
+	Image      string              `json:"image,omitempty"`
+	Meta       []map[string]string `json:"meta,omitempty"`
+}
+
+// writeJSPF writes the JSON form of XSPF, with the same fields.
+func writeJSPF(w io.Writer, p playlist_data) error {
+	doc := jspfDocument{Playlist: jspfPlaylist{Title: p.Name, Creator: p.Creator, Location: p.OriginalURL, Track: []jspfTrack{}}}
+	for _, content := range p.Content {
+		track := jspfTrack{
+			Location:   trackLocations(content),
+			Identifier: isrcURN(content.ISRC),
+			Title:      content.Title,
+			Creator:    content.Artist,
+			Album:      content.Album,
+			TrackNum:   content.TrackNum,
+			Image:      artworkURL(content.ArtworkURL, shareArtworkSize),
+		}
+		for _, meta := range trackMeta(content) {
+			if meta[1] != "" {
+				track.Meta = append(track.Meta, map[string]string{meta[0]: meta[1]})
+			}
+		}
+		doc.Playlist.Track = append(doc.Playlist.Track, track)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+var csvHeader = []string{"position", "title", "artist", "album", "isrc", "explicit", "original_url", "converted_url", "confidence"}
+
+/*
+csvCell keeps spreadsheet apps from reading a value as a formula, which a
+track title starting with "=" or "@" would otherwise be.
+*/
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+
+	return s
+}
+
+// writeCSV writes one row per track after a header row; encoding/csv does
+// the quoting.
+func writeCSV(w io.Writer, p playlist_data) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+	for i, content := range p.Content {
+		record := []string{
+			strconv.Itoa(i + 1),
+			csvCell(content.Title),
+			csvCell(content.Artist),
+			csvCell(content.Album),
+			csvCell(content.ISRC),
+			strconv.FormatBool(content.Explicit),
+			csvCell(content.OriginalURL),
+			csvCell(content.ConvertURL),
+			strconv.Itoa(content.Confidence),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// exportFilename turns a playlist name into a safe download name.
+func exportFilename(name string, extension string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" {
+		name = "playlist"
+	}
+
+	return name + "." + extension
+}
+
+// exporterFor looks up the format query parameter, responding 400 if it is
+// missing or unknown.
+func exporterFor(c *gin.Context) (playlistExporter, bool) {
+	exporter, ok := playlistExporters[strings.ToLower(c.Query("format"))]
+	if !ok {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "format must be one of " + exportFormats()})
+	}
+
+	return exporter, ok
+}
+
+// sendExport writes p as a download in the chosen format.
+func sendExport(c *gin.Context, exporter playlistExporter, p playlist_data) {
+	var body bytes.Buffer
+	if err := exporter.write(&body, p); err != nil {
+		loggerFrom(c.Request.Context()).Error("exporting playlist failed", "id", p.ID, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong"})
+		return
+	}
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": exportFilename(p.Name, exporter.extension)})
+	c.Header("Content-Disposition", disposition)
+	c.Data(http.StatusOK, exporter.contentType, body.Bytes())
+}
+
+/*
+spotifyPlaylistData converts a fetched Spotify playlist for export. Tracks
+that are no longer available come back without a name and are skipped.
+*/
+func spotifyPlaylistData(p SpotifyPlaylist) playlist_data {
+	data := playlist_data{
+		ID:          p.ID,
+		Name:        p.Name,
+		Creator:     p.Owner.DisplayName,
+		Platform:    "spotify",
+		OriginalURL: p.ExternalURLs.Spotify,
+	}
+	for _, item := range p.Tracks.Items {
+		track := item.Track
+		if track.Name == "" {
+			continue
+		}
+		artists := make([]string, 0, len(track.Artists))
+		for _, artist := range track.Artists {
+			artists = append(artists, artist.Name)
+		}
+		content := playlist_content{
+			Title:       track.Name,
+			PTrackNum:   len(data.Content),
+			ISRC:        track.ExternalIDs.ISRC,
+			Artist:      strings.Join(artists, ", "),
+			Album:       track.Album.Name,
+			AlbumID:     track.Album.ID,
+			Explicit:    track.Explicit,
+			OriginalURL: track.ExternalURLs.Spotify,
+			TrackNum:    track.TrackNumber,
+		}
+		if len(track.Album.Images) > 0 {
+			content.ArtworkURL = track.Album.Images[0].URL
+		}
+		data.Content = append(data.Content, content)
+	}
+	data.SongCount = len(data.Content)
+
+	return data
+}
+
+// applePlaylistData converts a fetched Apple Music playlist for export.
+func applePlaylistData(p AppleMusicPlaylist) playlist_data {
+	playlist := p.Data[0]
+	data := playlist_data{
+		Name:        playlist.Attributes.Name,
+		Creator:     playlist.Attributes.CuratorName,
+		Platform:    "apple",
+		OriginalURL: playlist.Attributes.URL,
+	}
+	for _, track := range playlist.Relationships.Tracks.Data {
+		attributes := track.Attributes
+		if attributes.Name == "" {
+			continue
+		}
+		data.Content = append(data.Content, playlist_content{
+			ID:          track.ID,
+			Title:       attributes.Name,
+			PTrackNum:   len(data.Content),
+			ISRC:        attributes.ISRC,
+			Artist:      attributes.ArtistName,
+			Album:       attributes.AlbumName,
+			Explicit:    attributes.ContentRating != nil && *attributes.ContentRating == "explicit",
+			OriginalURL: attributes.URL,
+			TrackNum:    attributes.TrackNumber,
+			ArtworkURL:  attributes.Artwork.URL,
+		})
+	}
+	data.SongCount = len(data.Content)
+
+	return data
+}
+
+// exportPlaylistByID exports a shared playlist.
+func exportPlaylistByID(c *gin.Context) {
+	exporter, ok := exporterFor(c)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+
+	playlistData, err := store.GetPlaylist(c.Request.Context(), id)
+	if err == errPlaylistNotFound {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Playlist not found"})
+		return
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("exportPlaylistByID failed", "id", id, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong"})
+		return
+	}
+
+	sendExport(c, exporter, playlistData)
+}
+
+// exportSpotifyPlaylistByID fetches a Spotify playlist and exports it.
+func exportSpotifyPlaylistByID(c *gin.Context) {
+	exporter, ok := exporterFor(c)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+
+	if err := checkSpotifyAuth(c.Request.Context()); err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": "Spotify authentication unavailable",
+		})
+		return
+	}
+
+	spotifyPlaylist, err := fetchSpotifyPlaylist(c.Request.Context(), id)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Error reading the playlist from Spotify"})
+		return
+	}
+	if spotifyPlaylist.ID == "" {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Playlist not found"})
+		return
+	}
+
+	sendExport(c, exporter, spotifyPlaylistData(spotifyPlaylist))
+}
+
+// exportApplePlaylistByID fetches an Apple Music playlist and exports it.
+func exportApplePlaylistByID(c *gin.Context) {
+	exporter, ok := exporterFor(c)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+
+	if err := checkAppleMusicAuth(); err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": "Apple Music authentication unavailable",
+		})
+		return
+	}
+
+	appleMusicPlaylist, ok, err := fetchApplePlaylist(c.Request.Context(), id)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Error reading the playlist from Apple Music"})
+		return
+	}
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Playlist not found"})
+		return
+	}
+
+	playlistData := applePlaylistData(appleMusicPlaylist)
+	playlistData.ID = id
+	sendExport(c, exporter, playlistData)
+}
+
+// deezerPlaylistData converts a fetched Deezer playlist for export.
+func deezerPlaylistData(p DeezerPlaylist) playlist_data {
+	data := playlist_data{
+		ID:          strconv.FormatInt(p.ID, 10),
+		Name:        p.Title,
+		Creator:     p.Creator.Name,
+		Platform:    "deezer",
+		OriginalURL: p.Link,
+	}
+	for _, track := range p.Tracks.Data {
+		if track.Title == "" {
+			continue
+		}
+		candidate := deezerCandidate(track)
+		data.Content = append(data.Content, playlist_content{
+			ID:          strconv.FormatInt(track.ID, 10),
+			Title:       candidate.Title,
+			PTrackNum:   len(data.Content),
+			ISRC:        candidate.ISRC,
+			Artist:      candidate.Artist,
+			Album:       candidate.Album,
+			AlbumID:     candidate.AlbumID,
+			Explicit:    candidate.Explicit,
+			OriginalURL: candidate.URL,
+			TrackNum:    candidate.TrackNum,
+			ArtworkURL:  candidate.ArtworkURL,
+		})
+	}
+	data.SongCount = len(data.Content)
+
+	return data
+}
+
+// exportDeezerPlaylistByID fetches a Deezer playlist and exports it.
+func exportDeezerPlaylistByID(c *gin.Context) {
+	exporter, ok := exporterFor(c)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+
+	deezerPlaylist, err := getDeezerPlaylist(c.Request.Context(), id, maxDeezerPlaylistTracks)
+	if err != nil {
+		deezerHandlerError(c, "playlist", id, err)
+		return
+	}
+
+	sendExport(c, exporter, deezerPlaylistData(deezerPlaylist))
+}
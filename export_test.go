@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// exportPlaylist has the values exporters have to escape or keep on one
+// line, and a track without links that M3U8 leaves out.
+func exportPlaylist() playlist_data {
+	return playlist_data{
+		ID:          "p1",
+		Name:        "Road\nTrip <&> \"Mix\"",
+		Creator:     "tester",
+		OriginalURL: "https://open.spotify.com/playlist/abc",
+		Content: []playlist_content{
+			{
+				Title:       "=HYPERLINK(\"x\")",
+				Artist:      "AC/DC, \"Live\"",
+				Album:       "Back in\nBlack",
+				ISRC:        "AUAP08000046",
+				Explicit:    true,
+				OriginalURL: "https://open.spotify.com/track/1",
+				ConvertURL:  "https://music.apple.com/us/song/1",
+				Confidence:  3,
+				TrackNum:    6,
+			},
+			{Title: "No Links", Artist: "Nobody", Confidence: 1},
+			{
+				Title:      "Tom & Jerry <Theme>",
+				ConvertURL: "https://music.apple.com/us/song/2",
+				Confidence: 2,
+			},
+		},
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"Yesterday", "Yesterday"},
+		{"=1+1", "'=1+1"},
+		{"+44 Song", "'+44 Song"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tTabbed", "'\tTabbed"},
+		{"\rReturn", "'\rReturn"},
+		{"Song = Good", "Song = Good"},
+		{"'Quoted", "'Quoted"},
+	}
+
+	for _, test := range tests {
+		if got := csvCell(test.in); got != test.want {
+			t.Errorf("csvCell(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestWriteM3U8(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeM3U8(&b, exportPlaylist()); err != nil {
+		t.Fatalf("writeM3U8: %v", err)
+	}
+
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#PLAYLIST:Road Trip <&> \"Mix\"",
+		"#EXTINF:-1 confidence=\"3\",AC/DC, \"Live\" - =HYPERLINK(\"x\")",
+		"#EXTALB:Back in Black",
+		"https://open.spotify.com/track/1",
+		"#EXTINF:-1 confidence=\"2\",Tom & Jerry <Theme>",
+		"https://music.apple.com/us/song/2",
+	}, "\n") + "\n"
+	if b.String() != want {
+		t.Errorf("writeM3U8 =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestWriteXSPF(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeXSPF(&b, exportPlaylist()); err != nil {
+		t.Fatalf("writeXSPF: %v", err)
+	}
+	if strings.Contains(b.String(), "<Theme>") || !strings.Contains(b.String(), "Tom &amp; Jerry &lt;Theme&gt;") {
+		t.Errorf("writeXSPF didn't escape a title:\n%s", b.String())
+	}
+
+	var doc xspfPlaylist
+	if err := xml.Unmarshal(b.Bytes(), &doc); err != nil {
+		t.Fatalf("writeXSPF wrote XML that doesn't parse: %v", err)
+	}
+	if doc.Title != "Road\nTrip <&> \"Mix\"" || len(doc.Tracks) != 3 {
+		t.Fatalf("writeXSPF = title %q with %d tracks, want the playlist's name and 3 tracks", doc.Title, len(doc.Tracks))
+	}
+	first := doc.Tracks[0]
+	if !reflect.DeepEqual(first.Locations, []string{"https://open.spotify.com/track/1", "https://music.apple.com/us/song/1"}) ||
+		!reflect.DeepEqual(first.Identifiers, []string{"urn:isrc:AUAP08000046"}) || first.TrackNum != 6 {
+		t.Errorf("writeXSPF track = %+v", first)
+	}
+	wantMeta := []xspfMeta{
+		{exportNamespace + "isrc", "AUAP08000046"},
+		{exportNamespace + "explicit", "true"},
+		{exportNamespace + "converted_url", "https://music.apple.com/us/song/1"},
+		{exportNamespace + "confidence", "3"},
+	}
+	if !reflect.DeepEqual(first.Meta, wantMeta) {
+		t.Errorf("writeXSPF meta = %+v, want %+v", first.Meta, wantMeta)
+	}
+	if len(doc.Tracks[1].Locations) != 0 || len(doc.Tracks[1].Identifiers) != 0 {
+		t.Errorf("writeXSPF gave a track without links or ISRC = %+v", doc.Tracks[1])
+	}
+}
+
+func TestWriteJSPF(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeJSPF(&b, exportPlaylist()); err != nil {
+		t.Fatalf("writeJSPF: %v", err)
+	}
+
+	var doc jspfDocument
+	if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+		t.Fatalf("writeJSPF wrote JSON that doesn't parse: %v", err)
+	}
+	if doc.Playlist.Title != "Road\nTrip <&> \"Mix\"" || len(doc.Playlist.Track) != 3 {
+		t.Fatalf("writeJSPF = title %q with %d tracks, want the playlist's name and 3 tracks", doc.Playlist.Title, len(doc.Playlist.Track))
+	}
+	first := doc.Playlist.Track[0]
+	if first.Title != "=HYPERLINK(\"x\")" || first.Creator != "AC/DC, \"Live\"" || first.Meta[0][exportNamespace+"isrc"] != "AUAP08000046" {
+		t.Errorf("writeJSPF track = %+v", first)
+	}
+
+	b.Reset()
+	if err := writeJSPF(&b, playlist_data{Name: "Empty"}); err != nil {
+		t.Fatalf("writeJSPF: %v", err)
+	}
+	if !strings.Contains(b.String(), `"track": []`) {
+		t.Errorf("writeJSPF of an empty playlist = %s, want an empty track list", b.String())
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeCSV(&b, exportPlaylist()); err != nil {
+		t.Fatalf("writeCSV: %v", err)
+	}
+
+	records, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("writeCSV wrote CSV that doesn't parse: %v", err)
+	}
+	want := [][]string{
+		csvHeader,
+		{"1", "'=HYPERLINK(\"x\")", "AC/DC, \"Live\"", "Back in\nBlack", "AUAP08000046", "true", "https://open.spotify.com/track/1", "https://music.apple.com/us/song/1", "3"},
+		{"2", "No Links", "Nobody", "", "", "false", "", "", "1"},
+		{"3", "Tom & Jerry <Theme>", "", "", "", "false", "", "https://music.apple.com/us/song/2", "2"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("writeCSV =\n%q\nwant\n%q", records, want)
+	}
+}
+
+func TestExportFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Road Trip", "Road Trip.csv"},
+		{"  ", "playlist.csv"},
+		{"AC/DC: Best?", "AC_DC_ Best_.csv"},
+		{"a\nb", "a_b.csv"},
+	}
+
+	for _, test := range tests {
+		if got := exportFilename(test.name, "csv"); got != test.want {
+			t.Errorf("exportFilename(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dependencyCheck is the result of checking one dependency for /readyz.
+type dependencyCheck struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type readinessReport struct {
+	Status    string                     `json:"status"`
+	CheckedAt time.Time                  `json:"checked_at"`
+	Checks    map[string]dependencyCheck `json:"checks"`
+}
+
+/*
+readinessChecker runs the dependency checks behind /readyz. Results are
+cached for ttl so that frequent probes don't hit the database, Spotify and
+Apple every time.
+*/
+type readinessChecker struct {
+	ttl     time.Duration
+	timeout time.Duration
+	checks  map[string]func(ctx context.Context) error
+
+	mu     sync.Mutex
+	report readinessReport
+}
+
+func newReadinessChecker(ttl time.Duration, timeout time.Duration) *readinessChecker {
+	return &readinessChecker{
+		ttl:     ttl,
+		timeout: timeout,
+		checks: map[string]func(ctx context.Context) error{
+			"database": func(ctx context.Context) error {
+				return store.Ping(ctx)
+			},
+			"spotify": checkSpotifyAuth,
+			"apple": func(ctx context.Context) error {
+				return checkAppleMusicAuth()
+			},
+		},
+	}
+}
+
+// check returns the cached report, running the checks again if it is stale.
+// Holding the lock while checking means concurrent probes share one run.
+func (r *readinessChecker) check() readinessReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.report.CheckedAt) < r.ttl {
+		return r.report
+	}
+
+	// The probe's own request context isn't used, since the result is
+	// shared with other callers.
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	report := readinessReport{
+		Status:    "ok",
+		CheckedAt: time.Now(),
+		Checks:    map[string]dependencyCheck{},
+	}
+
+	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	for name, fn := range r.checks {
+		wg.Add(1)
+		go func(name string, fn func(ctx context.Context) error) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := fn(ctx)
+			result := dependencyCheck{
+				Status:    "ok",
+				LatencyMS: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+
+			resultsMu.Lock()
+			report.Checks[name] = result
+			if err != nil {
+				report.Status = "fail"
+			}
+			resultsMu.Unlock()
+		}(name, fn)
+	}
+	wg.Wait()
+
+	r.report = report
+	return report
+}
+
+// getHealthz reports that the process is up and serving requests.
+func getHealthz(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// getReadyz reports whether every dependency is usable, with a breakdown per
+// dependency. It responds 503 if any check fails.
+func (r *readinessChecker) getReadyz(c *gin.Context) {
+	report := r.check()
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	c.IndentedJSON(status, report)
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Playlists kept in files are imported by parsing the file into track queries,
+matching them on Spotify, Apple Music and Deezer, and saving the result as a shared
+playlist. Entries that can't be matched are reported instead of saved.
+*/
+
+// maxImportEntries bounds how many tracks one import searches for.
+const maxImportEntries = 500
+
+// importedPlaylist is a playlist read from a file, before matching.
+type importedPlaylist struct {
+	Name    string
+	Creator string
+	Entries []trackQuery
+}
+
+// importParsers read each supported file format.
+var importParsers = map[string]func([]byte) (importedPlaylist, error){
+	"m3u":  parseM3U,
+	"m3u8": parseM3U,
+	"xspf": parseXSPF,
+	"jspf": parseJSPF,
+	"csv":  parseCSV,
+}
+
+// splitArtistTitle splits "Artist - Title", as written by most players.
+func splitArtistTitle(s string) (artist string, title string) {
+	if artist, title, ok := strings.Cut(s, " - "); ok {
+		return strings.TrimSpace(artist), strings.TrimSpace(title)
+	}
+
+	return "", strings.TrimSpace(s)
+}
+
+/*
+parseM3U reads M3U and extended M3U. Entries take their artist and title from
+#EXTINF, or failing that from the file name in the location line.
+*/
+func parseM3U(data []byte) (importedPlaylist, error) {
+	var p importedPlaylist
+	var pending *trackQuery
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line == "#EXTM3U":
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			p.Name = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := strings.TrimPrefix(line, "#EXTINF:")
+			length, display, _ := strings.Cut(info, ",")
+			// Attributes such as tvg-id="..." may follow the length.
+			length, _, _ = strings.Cut(length, " ")
+			q := trackQuery{}
+			q.Artist, q.Title = splitArtistTitle(display)
+			if seconds, err := strconv.ParseFloat(length, 64); err == nil && seconds > 0 {
+				q.Duration = time.Duration(seconds * float64(time.Second))
+			}
+			pending = &q
+		case strings.HasPrefix(line, "#EXTALB:"):
+			if pending != nil {
+				pending.Album = strings.TrimSpace(strings.TrimPrefix(line, "#EXTALB:"))
+			}
+		case strings.HasPrefix(line, "#EXTART:"):
+			if pending != nil && pending.Artist == "" {
+				pending.Artist = strings.TrimSpace(strings.TrimPrefix(line, "#EXTART:"))
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			if pending == nil {
+				pending = &trackQuery{}
+			}
+			if pending.Title == "" {
+				name := line
+				if u, err := url.Parse(line); err == nil && u.Path != "" {
+					name = u.Path
+				}
+				name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+				name = strings.TrimSuffix(name, path.Ext(name))
+				pending.Artist, pending.Title = splitArtistTitle(name)
+			}
+			p.Entries = append(p.Entries, *pending)
+			pending = nil
+		}
+	}
+
+	return p, nil
+}
+
+// isrcFrom reads an ISRC out of an XSPF or JSPF identifier.
+func isrcFrom(identifier string) string {
+	lower := strings.ToLower(identifier)
+	for _, prefix := range []string{"urn:isrc:", "isrc:"} {
+		if strings.HasPrefix(lower, prefix) {
+			return strings.ToUpper(identifier[len(prefix):])
+		}
+	}
+
+	return ""
+}
+
+type xspfImport struct {
+	Title   string `xml:"title"`
+	Creator string `xml:"creator"`
+	Tracks  []struct {
+		Identifiers []string `xml:"identifier"`
+		Title       string   `xml:"title"`
+		Creator     string   `xml:"creator"`
+		Album       string   `xml:"album"`
+		TrackNum    int      `xml:"trackNum"`
+		Duration    int64    `xml:"duration"`
+		Meta        []struct {
+			Rel   string `xml:"rel,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"meta"`
+	} `xml:"trackList>track"`
+}
+
+// parseXSPF reads XSPF, including the ISRC our own exports keep as meta.
+func parseXSPF(data []byte) (importedPlaylist, error) {
+	var doc xspfImport
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return importedPlaylist{}, err
+	}
+
+	p := importedPlaylist{Name: doc.Title, Creator: doc.Creator}
+	for _, track := range doc.Tracks {
+		q := trackQuery{
+			Title:    strings.TrimSpace(track.Title),
+			Artist:   strings.TrimSpace(track.Creator),
+			Album:    strings.TrimSpace(track.Album),
+			Duration: time.Duration(track.Duration) * time.Millisecond,
+			TrackNum: track.TrackNum,
+		}
+		for _, identifier := range track.Identifiers {
+			if isrc := isrcFrom(strings.TrimSpace(identifier)); isrc != "" {
+				q.ISRC = isrc
+			}
+		}
+		for _, meta := range track.Meta {
+			if q.ISRC == "" && strings.HasSuffix(meta.Rel, "/isrc") {
+				q.ISRC = strings.TrimSpace(meta.Value)
+			}
+		}
+		p.Entries = append(p.Entries, q)
+	}
+
+	return p, nil
+}
+
+// stringList decodes a JSPF field that may be a string or a list of them.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var single string
+	if err := json.Unmarshal(data, &single); err != nil {
+		return err
+	}
+	*l = stringList{single}
+
+	return nil
+}
+
+type jspfImport struct {
+	Playlist struct {
+		Title   string `json:"title"`
+		Creator string `json:"creator"`
+		Track   []struct {
+			Identifier stringList          `json:"identifier"`
+			Title      string              `json:"title"`
+			Creator    string              `json:"creator"`
+			Album      string              `json:"album"`
+			TrackNum   int                 `json:"trackNum"`
+			Duration   int64               `json:"duration"`
+			Meta       []map[string]string `json:"meta"`
+		} `json:"track"`
+	} `json:"playlist"`
+}
+
+// parseJSPF reads JSPF, the JSON form of XSPF.
+func parseJSPF(data []byte) (importedPlaylist, error) {
+	var doc jspfImport
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return importedPlaylist{}, err
+	}
+
+	p := importedPlaylist{Name: doc.Playlist.Title, Creator: doc.Playlist.Creator}
+	for _, track := range doc.Playlist.Track {
+		q := trackQuery{
+			Title:    strings.TrimSpace(track.Title),
+			Artist:   strings.TrimSpace(track.Creator),
+			Album:    strings.TrimSpace(track.Album),
+			Duration: time.Duration(track.Duration) * time.Millisecond,
+			TrackNum: track.TrackNum,
+		}
+		for _, identifier := range track.Identifier {
+			if isrc := isrcFrom(strings.TrimSpace(identifier)); isrc != "" {
+				q.ISRC = isrc
+			}
+		}
+		for _, meta := range track.Meta {
+			for rel, value := range meta {
+				if q.ISRC == "" && strings.HasSuffix(rel, "/isrc") {
+					q.ISRC = strings.TrimSpace(value)
+				}
+			}
+		}
+		p.Entries = append(p.Entries, q)
+	}
+
+	return p, nil
+}
+
+// csvColumns are the header names recognised for each field, lowercased.
+// They cover our own exports and common tools such as Exportify.
+var csvColumns = map[string][]string{
+	"title":    {"title", "track", "track name", "name", "song", "song name"},
+	"artist":   {"artist", "artists", "artist name", "artist name(s)", "artist(s)"},
+	"album":    {"album", "album name", "album title"},
+	"isrc":     {"isrc"},
+	"duration": {"duration", "duration (ms)", "duration_ms", "time", "length", "total time"},
+}
+
+// parseDuration reads "3:45", "1:02:03" or a number of seconds, or of
+// milliseconds when the column says so.
+func parseDuration(s string, milliseconds bool) time.Duration {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+	if strings.Contains(s, ":") {
+		var total time.Duration
+		for _, part := range strings.Split(s, ":") {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0
+			}
+			total = total*60 + time.Duration(n)*time.Second
+		}
+		return total
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	if milliseconds {
+		return time.Duration(n * float64(time.Millisecond))
+	}
+
+	return time.Duration(n * float64(time.Second))
+}
+
+/*
+parseCSV reads a CSV file with a header row. The delimiter may be a comma,
+semicolon or tab, and the columns can be in any order; a title or ISRC column
+is required.
+*/
+func parseCSV(data []byte) (importedPlaylist, error) {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	for _, delimiter := range []rune{';', '\t'} {
+		if bytes.Count(firstLine, []byte(string(delimiter))) > bytes.Count(firstLine, []byte(",")) {
+			reader.Comma = delimiter
+		}
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return importedPlaylist{}, fmt.Errorf("reading the header row: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for field, aliases := range csvColumns {
+			for _, alias := range aliases {
+				if _, seen := columns[field]; !seen && name == alias {
+					columns[field] = i
+				}
+			}
+		}
+	}
+	if _, ok := columns["title"]; !ok {
+		if _, ok := columns["isrc"]; !ok {
+			return importedPlaylist{}, errors.New("the header row has no title or ISRC column")
+		}
+	}
+	durationInMS := false
+	if i, ok := columns["duration"]; ok {
+		durationInMS = strings.Contains(strings.ToLower(header[i]), "ms")
+	}
+
+	var p importedPlaylist
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return importedPlaylist{}, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimPrefix(strings.TrimSpace(record[i]), "'")
+			}
+			return ""
+		}
+		q := trackQuery{
+			Title:    field("title"),
+			Artist:   field("artist"),
+			Album:    field("album"),
+			ISRC:     strings.ToUpper(field("isrc")),
+			Duration: parseDuration(field("duration"), durationInMS),
+		}
+		if q.Title == "" && q.ISRC == "" {
+			continue
+		}
+		p.Entries = append(p.Entries, q)
+	}
+
+	return p, nil
+}
+
+// detectImportFormat works out a file's format from its name, or failing
+// that its first bytes.
+func detectImportFormat(filename string, data []byte) string {
+	extension := strings.TrimPrefix(strings.ToLower(path.Ext(filename)), ".")
+	if _, ok := importParsers[extension]; ok {
+		return extension
+	}
+
+	start := string(bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\ufeff"))))
+	switch {
+	case strings.HasPrefix(start, "#EXTM3U"):
+		return "m3u"
+	case strings.HasPrefix(start, "<"):
+		return "xspf"
+	case strings.HasPrefix(start, "{"):
+		return "jspf"
+	}
+
+	return "csv"
+}
+
+// newPlaylistID returns a random UUID for a playlist created by the server.
+func newPlaylistID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// truncate shortens s to the 255 characters a playlist column holds.
+func truncate(s string) string {
+	if utf8.RuneCountInString(s) <= 255 {
+		return s
+	}
+
+	return string([]rune(s)[:255])
+}
+
+// unmatchedEntry is an imported entry that wasn't saved.
+type unmatchedEntry struct {
+	Position int    `json:"position"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist,omitempty"`
+	Album    string `json:"album,omitempty"`
+	ISRC     string `json:"isrc,omitempty"`
+	Reason   string `json:"reason"`
+	// BestMatch is the closest candidate found, when there was one.
+	BestMatch *trackCandidate `json:"best_match,omitempty"`
+}
+
+/*
+buildImportedPlaylist turns matched entries into a shared playlist on
+platform, with the first other provider's match, in providerNames order, as
+the converted link. Entries without a confident match on platform are returned
+as unmatched. A track's confidence is the lower of its two matches.
+*/
+func buildImportedPlaylist(imported importedPlaylist, matches []trackMatches, platform string) (playlist_data, []unmatchedEntry) {
+	id := newPlaylistID()
+	p := playlist_data{
+		ID:       id,
+		Name:     truncate(imported.Name),
+		Creator:  truncate(imported.Creator),
+		Platform: platform,
+	}
+	unmatched := []unmatchedEntry{}
+	for i, q := range imported.Entries {
+		match, ok := matches[i].best(platform)
+		if !ok {
+			entry := unmatchedEntry{Position: i + 1, Title: q.Title, Artist: q.Artist, Album: q.Album, ISRC: q.ISRC, Reason: "no confident match on " + platform}
+			if q.Title == "" && q.ISRC == "" {
+				entry.Reason = "the entry has no title"
+			} else if candidates := matches[i][platform]; len(candidates) > 0 {
+				entry.BestMatch = &candidates[0]
+			} else {
+				entry.Reason = "not found on " + platform
+			}
+			unmatched = append(unmatched, entry)
+			continue
+		}
+
+		content := playlist_content{
+			ID:          id,
+			KeyID:       id + "-" + strconv.Itoa(len(p.Content)),
+			Title:       truncate(match.Title),
+			PTrackNum:   len(p.Content),
+			ISRC:        truncate(match.ISRC),
+			Artist:      truncate(match.Artist),
+			Album:       truncate(match.Album),
+			AlbumID:     truncate(match.AlbumID),
+			Explicit:    match.Explicit,
+			OriginalURL: truncate(match.URL),
+			Confidence:  match.Confidence,
+			TrackNum:    match.TrackNum,
+			ArtworkURL:  match.ArtworkURL,
+		}
+		for _, other := range providerNames {
+			if other == platform {
+				continue
+			}
+			if converted, ok := matches[i].best(other); ok {
+				content.ConvertURL = truncate(converted.URL)
+				content.Confidence = min(content.Confidence, converted.Confidence)
+				p.Converted = true
+				break
+			}
+		}
+		p.Content = append(p.Content, content)
+	}
+	p.SongCount = len(p.Content)
+
+	return p, unmatched
+}
+
+// importPlatform reads the platform form field: the provider the shared
+// playlist is built on.
+func importPlatform(c *gin.Context) (string, bool) {
+	platform := strings.ToLower(c.DefaultPostForm("platform", "spotify"))
+	for _, provider := range providerNames {
+		if platform == provider {
+			return platform, true
+		}
+	}
+	c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "platform must be spotify, apple or deezer"})
+
+	return "", false
+}
+
+/*
+saveImport matches an imported playlist on every provider and saves it as a
+shared playlist on platform, responding 201 with the playlist, its share URL
+and the entries left out. Imports with no entries, too many, or none that
+match are rejected.
+*/
+func saveImport(c *gin.Context, imported importedPlaylist, platform string) {
+	if !checkImport(c, &imported) {
+		return
+	}
+
+	matchImport(c, imported, platform, func(ctx context.Context, providers []string) []trackMatches {
+		return matchTracks(ctx, imported.Entries, providers)
+	})
+}
+
+// checkImport rejects imports with no entries or too many. It names unnamed
+// playlists.
+func checkImport(c *gin.Context, imported *importedPlaylist) bool {
+	if len(imported.Entries) == 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "No tracks were found to import"})
+		return false
+	}
+	if len(imported.Entries) > maxImportEntries {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprintf("At most %d tracks can be imported at once", maxImportEntries)})
+		return false
+	}
+	if imported.Name == "" {
+		imported.Name = "Imported playlist"
+	}
+
+	return true
+}
+
+/*
+matchImport runs match with the providers that can be searched right now and
+saves the result as a shared playlist on platform. Only platform has to be
+available; the others are left out and listed in the response. Matching
+stops after config.Import.MatchTimeout and the import is rejected with 504,
+rather than saving a playlist with the rest of its tracks missing.
+*/
+func matchImport(c *gin.Context, imported importedPlaylist, platform string, match func(ctx context.Context, providers []string) []trackMatches) {
+	providers := availableProviders(c.Request.Context(), providerNames)
+	if !slices.Contains(providers, platform) {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": platform + " authentication unavailable",
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.Import.MatchTimeout)
+	defer cancel()
+	matches := match(ctx, providers)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		loggerFrom(ctx).Warn("matching an import timed out", "tracks", len(imported.Entries), "timeout", config.Import.MatchTimeout.String())
+		c.IndentedJSON(http.StatusGatewayTimeout, gin.H{"message": "Matching the tracks took too long; try importing fewer at once"})
+		return
+	}
+
+	var skipped []string
+	for _, provider := range providerNames {
+		if !slices.Contains(providers, provider) {
+			skipped = append(skipped, provider)
+		}
+	}
+	saveMatches(c, imported, matches, platform, skipped)
+}
+
+// saveMatches saves the matches for an import as a shared playlist on
+// platform. skipped lists the providers that weren't searched.
+func saveMatches(c *gin.Context, imported importedPlaylist, matches []trackMatches, platform string, skipped []string) {
+	ctx := c.Request.Context()
+	playlistData, unmatched := buildImportedPlaylist(imported, matches, platform)
+	if len(playlistData.Content) == 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{
+			"message":   "None of the tracks could be matched",
+			"unmatched": unmatched,
+		})
+		return
+	}
+
+	playlistData, _, err := store.CreatePlaylist(ctx, playlistData, "")
+	if err != nil {
+		loggerFrom(ctx).Error("saving imported playlist failed", "id", playlistData.ID, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error adding a new playlist"})
+		return
+	}
+	loggerFrom(ctx).Info("imported playlist", "id", playlistData.ID, "tracks", len(playlistData.Content), "unmatched", len(unmatched))
+
+	response := gin.H{
+		"playlist":  playlistData,
+		"share_url": shareURL(publicBaseURL(c), playlistData.ID),
+		"unmatched": unmatched,
+	}
+	if len(skipped) > 0 {
+		response["skipped_providers"] = skipped
+	}
+	c.IndentedJSON(http.StatusCreated, response)
+}
+
+// readUpload reads the multipart "file" field, responding 400 if it is
+// missing or too large.
+func readUpload(c *gin.Context) (filename string, data []byte, ok bool) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRequestBody)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Upload the playlist as the multipart form field \"file\""})
+		return "", nil, false
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Could not read the uploaded file"})
+		return "", nil, false
+	}
+	defer f.Close()
+
+	data, err = io.ReadAll(f)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Could not read the uploaded file"})
+		return "", nil, false
+	}
+
+	return header.Filename, data, true
+}
+
+/*
+postPlaylistImport imports a playlist file: M3U/M3U8, XSPF, JSPF or CSV. The
+format comes from the format field, the file name or the content. The name
+field overrides the playlist name found in the file.
+*/
+func postPlaylistImport(c *gin.Context) {
+	filename, data, ok := readUpload(c)
+	if !ok {
+		return
+	}
+	platform, ok := importPlatform(c)
+	if !ok {
+		return
+	}
+
+	format := strings.ToLower(c.PostForm("format"))
+	if format == "" {
+		format = detectImportFormat(filename, data)
+	}
+	parse, ok := importParsers[format]
+	if !ok {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "format must be one of m3u, m3u8, xspf, jspf or csv"})
+		return
+	}
+
+	imported, err := parse(data)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": "Could not read the file as " + format,
+			"errors":  []string{err.Error()},
+		})
+		return
+	}
+	if name := strings.TrimSpace(c.PostForm("name")); name != "" {
+		imported.Name = name
+	}
+	if imported.Name == "" {
+		imported.Name = strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+	}
+
+	saveImport(c, imported, platform)
+}
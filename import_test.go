@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseM3U(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want importedPlaylist
+	}{
+		{
+			name: "extended",
+			data: "\ufeff#EXTM3U\n#PLAYLIST:Road Trip\n#EXTINF:125,The Beatles - Yesterday\n#EXTALB:Help!\nhttps://open.spotify.com/track/1\n",
+			want: importedPlaylist{Name: "Road Trip", Entries: []trackQuery{
+				{Title: "Yesterday", Artist: "The Beatles", Album: "Help!", Duration: 125 * time.Second},
+			}},
+		},
+		{
+			name: "attributes and EXTART",
+			data: "#EXTM3U\r\n#EXTINF:-1 tvg-id=\"x\",Yesterday\r\n#EXTART:The Beatles\r\nsong.mp3\r\n",
+			want: importedPlaylist{Entries: []trackQuery{{Title: "Yesterday", Artist: "The Beatles"}}},
+		},
+		{
+			name: "file names only",
+			data: "C:\\Music\\The Beatles - Yesterday.mp3\n/music/Help.flac\nfile:///music/Queen%20-%20Bohemian%20Rhapsody.ogg\n",
+			want: importedPlaylist{Entries: []trackQuery{
+				{Title: "Yesterday", Artist: "The Beatles"},
+				{Title: "Help"},
+				{Title: "Bohemian Rhapsody", Artist: "Queen"},
+			}},
+		},
+		{
+			name: "EXTINF without a location",
+			data: "#EXTM3U\n#EXTINF:10,Dangling\n",
+			want: importedPlaylist{},
+		},
+		{
+			name: "not a playlist",
+			data: "# just a comment\n\n",
+			want: importedPlaylist{},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseM3U([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: parseM3U: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseM3U = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseXSPF(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    importedPlaylist
+		wantErr bool
+	}{
+		{
+			name: "identifiers and meta",
+			data: `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <title>Road &amp; Trip</title>
+  <creator>tester</creator>
+  <trackList>
+    <track><title> Yesterday </title><creator>The Beatles</creator><album>Help!</album><trackNum>13</trackNum><duration>125000</duration><identifier>urn:isrc:gbaye0601498</identifier></track>
+    <track><title>Help!</title><meta rel="https://example.com/isrc">GBAYE0601477</meta></track>
+  </trackList>
+</playlist>`,
+			want: importedPlaylist{Name: "Road & Trip", Creator: "tester", Entries: []trackQuery{
+				{Title: "Yesterday", Artist: "The Beatles", Album: "Help!", ISRC: "GBAYE0601498", Duration: 125 * time.Second, TrackNum: 13},
+				{Title: "Help!", ISRC: "GBAYE0601477"},
+			}},
+		},
+		{name: "unclosed element", data: `<playlist><trackList><track>`, wantErr: true},
+		{name: "not XML", data: `{"playlist": {}}`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseXSPF([]byte(test.data))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parseXSPF error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseXSPF = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseJSPF(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    importedPlaylist
+		wantErr bool
+	}{
+		{
+			name: "identifier list and meta",
+			data: `{"playlist": {"title": "Road Trip", "track": [
+				{"title": "Yesterday", "creator": "The Beatles", "duration": 125000, "trackNum": 13, "identifier": ["https://example.com/1", "isrc:gbaye0601498"]},
+				{"title": "Help!", "meta": [{"https://example.com/isrc": "GBAYE0601477"}]}
+			]}}`,
+			want: importedPlaylist{Name: "Road Trip", Entries: []trackQuery{
+				{Title: "Yesterday", Artist: "The Beatles", ISRC: "GBAYE0601498", Duration: 125 * time.Second, TrackNum: 13},
+				{Title: "Help!", ISRC: "GBAYE0601477"},
+			}},
+		},
+		{
+			name: "single identifier",
+			data: `{"playlist": {"track": [{"title": "Yesterday", "identifier": "urn:isrc:GBAYE0601498"}]}}`,
+			want: importedPlaylist{Entries: []trackQuery{{Title: "Yesterday", ISRC: "GBAYE0601498"}}},
+		},
+		{name: "truncated", data: `{"playlist": {"track": [`, wantErr: true},
+		{name: "identifier of the wrong type", data: `{"playlist": {"track": [{"identifier": 5}]}}`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseJSPF([]byte(test.data))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parseJSPF error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseJSPF = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []trackQuery
+		wantErr bool
+	}{
+		{
+			name: "Exportify",
+			data: "\ufeffTrack Name,Artist Name(s),Album Name,Duration (ms),ISRC\nYesterday,The Beatles,Help!,125000,gbaye0601498\n",
+			want: []trackQuery{{Title: "Yesterday", Artist: "The Beatles", Album: "Help!", ISRC: "GBAYE0601498", Duration: 125 * time.Second}},
+		},
+		{
+			name: "semicolons and minutes",
+			data: "Artist;Title;Time\nThe Beatles;Yesterday;2:05\n;;\nQueen;\"Bohemian; Rhapsody\";1:02:03\n",
+			want: []trackQuery{
+				{Title: "Yesterday", Artist: "The Beatles", Duration: 125 * time.Second},
+				{Title: "Bohemian; Rhapsody", Artist: "Queen", Duration: time.Hour + 2*time.Minute + 3*time.Second},
+			},
+		},
+		{
+			name: "tabs, short rows and a guarded formula",
+			data: "title\tartist\tduration\n'=1+1\tSomeone\n'@home\t\tabc\n",
+			want: []trackQuery{{Title: "=1+1", Artist: "Someone"}, {Title: "@home"}},
+		},
+		{
+			name: "ISRC only",
+			data: "isrc\nGBAYE0601498\n",
+			want: []trackQuery{{ISRC: "GBAYE0601498"}},
+		},
+		{name: "no title or ISRC column", data: "artist,album\nThe Beatles,Help!\n", wantErr: true},
+		{name: "empty", data: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseCSV([]byte(test.data))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parseCSV error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got.Entries, test.want) {
+			t.Errorf("%s: parseCSV = %+v, want %+v", test.name, got.Entries, test.want)
+		}
+	}
+}
+
+// TestImportRoundTrip checks that every exported format reads back as the
+// tracks it was written from, as far as the format keeps them.
+func TestImportRoundTrip(t *testing.T) {
+	exported := playlist_data{
+		Name:    "Road Trip <&> \"Mix\"",
+		Creator: "tester",
+		Content: []playlist_content{
+			{Title: "=1+1 & <b>", Artist: "Guns N' Roses, \"Slash\"", Album: "Use; Your Illusion", ISRC: "USGF19141001", OriginalURL: "https://open.spotify.com/track/1", TrackNum: 4},
+			{Title: "Yesterday", Artist: "The Beatles", Album: "Help!", ISRC: "GBAYE0601498", ConvertURL: "https://music.apple.com/us/song/2", TrackNum: 13},
+		},
+	}
+	full := []trackQuery{
+		{Title: "=1+1 & <b>", Artist: "Guns N' Roses, \"Slash\"", Album: "Use; Your Illusion", ISRC: "USGF19141001", TrackNum: 4},
+		{Title: "Yesterday", Artist: "The Beatles", Album: "Help!", ISRC: "GBAYE0601498", TrackNum: 13},
+	}
+
+	tests := []struct {
+		format string
+		name   string
+		want   []trackQuery
+	}{
+		// M3U8 keeps no ISRC or track number.
+		{"m3u8", "Road Trip <&> \"Mix\"", []trackQuery{
+			{Title: "=1+1 & <b>", Artist: "Guns N' Roses, \"Slash\"", Album: "Use; Your Illusion"},
+			{Title: "Yesterday", Artist: "The Beatles", Album: "Help!"},
+		}},
+		{"xspf", "Road Trip <&> \"Mix\"", full},
+		{"jspf", "Road Trip <&> \"Mix\"", full},
+		// CSV keeps no playlist name or track number.
+		{"csv", "", []trackQuery{
+			{Title: "=1+1 & <b>", Artist: "Guns N' Roses, \"Slash\"", Album: "Use; Your Illusion", ISRC: "USGF19141001"},
+			{Title: "Yesterday", Artist: "The Beatles", Album: "Help!", ISRC: "GBAYE0601498"},
+		}},
+	}
+
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := playlistExporters[test.format].write(&b, exported); err != nil {
+			t.Fatalf("%s: writing: %v", test.format, err)
+		}
+		format := detectImportFormat("", b.Bytes())
+		if strings.TrimSuffix(test.format, "8") != format {
+			t.Errorf("%s: detectImportFormat = %q", test.format, format)
+		}
+		got, err := importParsers[test.format](b.Bytes())
+		if err != nil {
+			t.Fatalf("%s: reading: %v", test.format, err)
+		}
+		if got.Name != test.name || !reflect.DeepEqual(got.Entries, test.want) {
+			t.Errorf("%s: read back %q with %+v, want %q with %+v", test.format, got.Name, got.Entries, test.name, test.want)
+		}
+	}
+}
+
+func TestDetectImportFormat(t *testing.T) {
+	tests := []struct {
+		filename string
+		data     string
+		want     string
+	}{
+		{"mix.M3U8", "", "m3u8"},
+		{"mix.xspf", "", "xspf"},
+		{"mix.txt", "\ufeff  #EXTM3U\n", "m3u"},
+		{"", "<?xml version=\"1.0\"?>", "xspf"},
+		{"upload", "{\"playlist\": {}}", "jspf"},
+		{"upload", "title,artist\n", "csv"},
+	}
+
+	for _, test := range tests {
+		if got := detectImportFormat(test.filename, []byte(test.data)); got != test.want {
+			t.Errorf("detectImportFormat(%q, %q) = %q, want %q", test.filename, test.data, got, test.want)
+		}
+	}
+}
+
+func TestCheckImportLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		entries int
+		want    bool
+	}{
+		{0, false},
+		{1, true},
+		{maxImportEntries, true},
+		{maxImportEntries + 1, false},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		imported := importedPlaylist{Entries: make([]trackQuery, test.entries)}
+		if got := checkImport(c, &imported); got != test.want {
+			t.Errorf("checkImport with %d entries = %v, want %v", test.entries, got, test.want)
+		}
+		if !test.want && w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("checkImport with %d entries responded %d, want %d", test.entries, w.Code, http.StatusUnprocessableEntity)
+		}
+		if test.want && imported.Name != "Imported playlist" {
+			t.Errorf("checkImport named the playlist %q, want \"Imported playlist\"", imported.Name)
+		}
+	}
+}
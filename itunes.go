@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+iTunes and Music.app can export the whole library as Library.xml, a property
+list holding every track and playlist. Long-time users have playlists there
+that never made it into Apple Music's cloud library, so they can be imported
+like any other playlist file.
+*/
+
+// maxLibraryUpload bounds a library upload. Libraries are far bigger than
+// single playlist files.
+const maxLibraryUpload = 200 << 20
+
+/*
+Library.xml is read with a streaming decoder rather than into memory: a
+library can hold hundreds of thousands of tracks, and an import needs only one
+playlist's. The upload is read twice, first for the playlists and then for the
+tracks the chosen playlist references.
+*/
+
+// plistRootDict reads up to the top-level dict of a property list.
+func plistRootDict(decoder *xml.Decoder) error {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local != "plist" {
+			if start.Name.Local != "dict" {
+				return errors.New("the property list is not a dictionary")
+			}
+			return nil
+		}
+	}
+}
+
+// plistDict calls value with each key of the dict being read and the start of
+// its value, which value must read or skip.
+func plistDict(decoder *xml.Decoder, value func(key string, start xml.StartElement) error) error {
+	key := ""
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "key" {
+				if err := decoder.DecodeElement(&key, &t); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := value(key, t); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// plistArray calls value with the start of each element of the array being
+// read, which value must read or skip.
+func plistArray(decoder *xml.Decoder, value func(start xml.StartElement) error) error {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if err := value(t); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// plistString reads a scalar value as text. Booleans read as "true" or
+// "false"; dicts and arrays are skipped and read as "".
+func plistString(decoder *xml.Decoder, start xml.StartElement) (string, error) {
+	switch start.Name.Local {
+	case "true", "false":
+		return start.Name.Local, decoder.Skip()
+	case "dict", "array":
+		return "", decoder.Skip()
+	}
+
+	var text string
+	if err := decoder.DecodeElement(&text, &start); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(text), nil
+}
+
+// plistInt reads an integer value. Values of other types read as 0.
+func plistInt(decoder *xml.Decoder, start xml.StartElement) (int64, error) {
+	text, err := plistString(decoder, start)
+	if err != nil || start.Name.Local != "integer" {
+		return 0, err
+	}
+
+	return strconv.ParseInt(text, 10, 64)
+}
+
+// iTunesPlaylist is a playlist in Library.xml.
+type iTunesPlaylist struct {
+	ID                string
+	Name              string
+	Master            bool
+	Folder            bool
+	Smart             bool
+	DistinguishedKind int64
+	Items             int
+	// TrackIDs are the tracks in order. They are only kept for the playlist
+	// being imported.
+	TrackIDs []string
+}
+
+// readITunesPlaylist reads a playlist dict.
+func readITunesPlaylist(decoder *xml.Decoder) (iTunesPlaylist, error) {
+	var playlist iTunesPlaylist
+	err := plistDict(decoder, func(key string, start xml.StartElement) error {
+		var err error
+		switch key {
+		case "Playlist Persistent ID":
+			playlist.ID, err = plistString(decoder, start)
+		case "Name":
+			playlist.Name, err = plistString(decoder, start)
+		case "Master":
+			playlist.Master = start.Name.Local == "true"
+			err = decoder.Skip()
+		case "Folder":
+			playlist.Folder = start.Name.Local == "true"
+			err = decoder.Skip()
+		case "Smart Info":
+			playlist.Smart = true
+			err = decoder.Skip()
+		case "Distinguished Kind":
+			playlist.DistinguishedKind, err = plistInt(decoder, start)
+		case "Playlist Items":
+			if start.Name.Local != "array" {
+				return decoder.Skip()
+			}
+			err = plistArray(decoder, func(item xml.StartElement) error {
+				if item.Name.Local != "dict" {
+					return decoder.Skip()
+				}
+				playlist.Items++
+				return plistDict(decoder, func(key string, start xml.StartElement) error {
+					if key != "Track ID" {
+						return decoder.Skip()
+					}
+					id, err := plistInt(decoder, start)
+					playlist.TrackIDs = append(playlist.TrackIDs, strconv.FormatInt(id, 10))
+					return err
+				})
+			})
+		default:
+			err = decoder.Skip()
+		}
+		return err
+	})
+
+	return playlist, err
+}
+
+// is reports whether selected is the playlist's persistent ID or name.
+func (p iTunesPlaylist) is(selected string) bool {
+	return strings.EqualFold(p.ID, selected) || p.Name == selected
+}
+
+/*
+readITunesPlaylists reads the playlists in a Library.xml export without its
+tracks. Only playlists that selected names keep their track IDs.
+*/
+func readITunesPlaylists(r io.Reader, selected string) ([]iTunesPlaylist, error) {
+	decoder := xml.NewDecoder(r)
+	if err := plistRootDict(decoder); err != nil {
+		return nil, err
+	}
+
+	var playlists []iTunesPlaylist
+	hasTracks, hasPlaylists := false, false
+	err := plistDict(decoder, func(key string, start xml.StartElement) error {
+		switch {
+		case key == "Tracks" && start.Name.Local == "dict":
+			hasTracks = true
+		case key == "Playlists" && start.Name.Local == "array":
+			hasPlaylists = true
+			return plistArray(decoder, func(start xml.StartElement) error {
+				if start.Name.Local != "dict" {
+					return decoder.Skip()
+				}
+				playlist, err := readITunesPlaylist(decoder)
+				if err != nil {
+					return err
+				}
+				if selected == "" || !playlist.is(selected) {
+					playlist.TrackIDs = nil
+				}
+				playlists = append(playlists, playlist)
+				return nil
+			})
+		}
+		return decoder.Skip()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !hasTracks || !hasPlaylists {
+		return nil, errors.New("no Tracks or Playlists; is this an iTunes library export?")
+	}
+
+	return playlists, nil
+}
+
+// readITunesTracks reads the tracks in a Library.xml export whose IDs are in
+// wanted, as queries keyed by ID.
+func readITunesTracks(r io.Reader, wanted map[string]bool) (map[string]trackQuery, error) {
+	decoder := xml.NewDecoder(r)
+	if err := plistRootDict(decoder); err != nil {
+		return nil, err
+	}
+
+	tracks := map[string]trackQuery{}
+	err := plistDict(decoder, func(key string, start xml.StartElement) error {
+		if key != "Tracks" || start.Name.Local != "dict" {
+			return decoder.Skip()
+		}
+		return plistDict(decoder, func(id string, start xml.StartElement) error {
+			if !wanted[id] || start.Name.Local != "dict" {
+				return decoder.Skip()
+			}
+			var q trackQuery
+			err := plistDict(decoder, func(key string, start xml.StartElement) error {
+				var err error
+				switch key {
+				case "Name":
+					q.Title, err = plistString(decoder, start)
+				case "Artist":
+					q.Artist, err = plistString(decoder, start)
+				case "Album":
+					q.Album, err = plistString(decoder, start)
+				case "Total Time":
+					var ms int64
+					ms, err = plistInt(decoder, start)
+					q.Duration = time.Duration(ms) * time.Millisecond
+				case "Track Number":
+					var n int64
+					n, err = plistInt(decoder, start)
+					q.TrackNum = int(n)
+				default:
+					err = decoder.Skip()
+				}
+				return err
+			})
+			tracks[id] = q
+			return err
+		})
+	})
+
+	return tracks, err
+}
+
+// iTunesPlaylistSummary describes a playlist in the library.
+type iTunesPlaylistSummary struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Tracks int    `json:"tracks"`
+	Smart  bool   `json:"smart"`
+}
+
+// iTunesSummaries lists the playlists that can be imported. The whole
+// library, folders and built-in lists such as Music or Podcasts are left out.
+func iTunesSummaries(playlists []iTunesPlaylist) []iTunesPlaylistSummary {
+	summaries := []iTunesPlaylistSummary{}
+	for _, playlist := range playlists {
+		if playlist.Master || playlist.Folder || playlist.DistinguishedKind != 0 {
+			continue
+		}
+		summaries = append(summaries, iTunesPlaylistSummary{
+			ID:     playlist.ID,
+			Name:   playlist.Name,
+			Tracks: playlist.Items,
+			Smart:  playlist.Smart,
+		})
+	}
+
+	return summaries
+}
+
+// findITunesPlaylist finds a playlist by persistent ID or, failing that, by
+// name.
+func findITunesPlaylist(playlists []iTunesPlaylist, selected string) (iTunesPlaylist, bool) {
+	for _, playlist := range playlists {
+		if strings.EqualFold(playlist.ID, selected) {
+			return playlist, true
+		}
+	}
+	for _, playlist := range playlists {
+		if playlist.Name == selected {
+			return playlist, true
+		}
+	}
+
+	return iTunesPlaylist{}, false
+}
+
+/*
+postITunesImport reads an iTunes or Music.app Library.xml upload. Without a
+playlist field it lists the library's playlists; with one, given as a
+persistent ID or a name, it imports that playlist like a playlist file.
+*/
+func postITunesImport(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxLibraryUpload)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Upload Library.xml as the multipart form field \"file\""})
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Could not read the uploaded file"})
+		return
+	}
+	defer f.Close()
+
+	selected := strings.TrimSpace(c.PostForm("playlist"))
+	playlists, err := readITunesPlaylists(f, selected)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": "Could not read the file as an iTunes library",
+			"errors":  []string{err.Error()},
+		})
+		return
+	}
+
+	if selected == "" {
+		c.IndentedJSON(http.StatusOK, gin.H{"playlists": iTunesSummaries(playlists)})
+		return
+	}
+	platform, ok := importPlatform(c)
+	if !ok {
+		return
+	}
+
+	found, ok := findITunesPlaylist(playlists, selected)
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("The library has no playlist %q", selected)})
+		return
+	}
+	wanted := map[string]bool{}
+	for _, id := range found.TrackIDs {
+		wanted[id] = true
+	}
+	var tracks map[string]trackQuery
+	if _, err = f.Seek(0, io.SeekStart); err == nil {
+		tracks, err = readITunesTracks(f, wanted)
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": "Could not read the file as an iTunes library",
+			"errors":  []string{err.Error()},
+		})
+		return
+	}
+
+	imported := importedPlaylist{Name: found.Name}
+	for _, id := range found.TrackIDs {
+		if q, ok := tracks[id]; ok {
+			imported.Entries = append(imported.Entries, q)
+		}
+	}
+	if name := strings.TrimSpace(c.PostForm("name")); name != "" {
+		imported.Name = name
+	}
+
+	saveImport(c, imported, platform)
+}
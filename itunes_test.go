@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLibrary is a small Library.xml with the built-in playlists, a folder,
+// a smart playlist and an ordinary one.
+const testLibrary = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple Computer//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Major Version</key><integer>1</integer>
+	<key>Tracks</key>
+	<dict>
+		<key>101</key>
+		<dict>
+			<key>Track ID</key><integer>101</integer>
+			<key>Name</key><string>Yesterday</string>
+			<key>Artist</key><string>The Beatles</string>
+			<key>Album</key><string>Help!</string>
+			<key>Total Time</key><integer>125000</integer>
+			<key>Track Number</key><integer>13</integer>
+			<key>Compilation</key><true/>
+		</dict>
+		<key>102</key>
+		<dict>
+			<key>Name</key><string>Tom &amp; Jerry</string>
+			<key>Artist</key><string> Someone </string>
+			<key>Total Time</key><string>not a number</string>
+		</dict>
+		<key>103</key>
+		<dict>
+			<key>Name</key><string>Not Wanted</string>
+		</dict>
+	</dict>
+	<key>Playlists</key>
+	<array>
+		<dict>
+			<key>Name</key><string>Library</string>
+			<key>Master</key><true/>
+			<key>Playlist Persistent ID</key><string>AAAA</string>
+			<key>Playlist Items</key>
+			<array>
+				<dict><key>Track ID</key><integer>101</integer></dict>
+				<dict><key>Track ID</key><integer>102</integer></dict>
+				<dict><key>Track ID</key><integer>103</integer></dict>
+			</array>
+		</dict>
+		<dict>
+			<key>Name</key><string>Music</string>
+			<key>Distinguished Kind</key><integer>4</integer>
+			<key>Playlist Persistent ID</key><string>BBBB</string>
+		</dict>
+		<dict>
+			<key>Name</key><string>Old Stuff</string>
+			<key>Folder</key><true/>
+			<key>Playlist Persistent ID</key><string>CCCC</string>
+		</dict>
+		<dict>
+			<key>Name</key><string>Recently Added</string>
+			<key>Smart Info</key><data>AQEA</data>
+			<key>Playlist Persistent ID</key><string>DDDD</string>
+			<key>Playlist Items</key>
+			<array>
+				<dict><key>Track ID</key><integer>103</integer></dict>
+			</array>
+		</dict>
+		<dict>
+			<key>Name</key><string>Road Trip</string>
+			<key>Playlist Persistent ID</key><string>E1E2E3E4</string>
+			<key>Parent Persistent ID</key><string>CCCC</string>
+			<key>Playlist Items</key>
+			<array>
+				<dict><key>Track ID</key><integer>102</integer></dict>
+				<dict><key>Track ID</key><integer>101</integer></dict>
+			</array>
+		</dict>
+	</array>
+</dict>
+</plist>
+`
+
+func TestReadITunesPlaylists(t *testing.T) {
+	playlists, err := readITunesPlaylists(strings.NewReader(testLibrary), "e1e2e3e4")
+	if err != nil {
+		t.Fatalf("readITunesPlaylists: %v", err)
+	}
+
+	want := []iTunesPlaylistSummary{
+		{ID: "DDDD", Name: "Recently Added", Tracks: 1, Smart: true},
+		{ID: "E1E2E3E4", Name: "Road Trip", Tracks: 2},
+	}
+	if got := iTunesSummaries(playlists); !reflect.DeepEqual(got, want) {
+		t.Errorf("iTunesSummaries = %+v, want %+v", got, want)
+	}
+
+	for _, playlist := range playlists {
+		if playlist.ID != "E1E2E3E4" && playlist.TrackIDs != nil {
+			t.Errorf("playlist %q kept its track IDs %v; only the selected one should", playlist.Name, playlist.TrackIDs)
+		}
+	}
+	found, ok := findITunesPlaylist(playlists, "e1e2e3e4")
+	if !ok || !reflect.DeepEqual(found.TrackIDs, []string{"102", "101"}) {
+		t.Errorf("findITunesPlaylist = %+v, %v; want Road Trip with tracks 102 and 101", found, ok)
+	}
+}
+
+func TestFindITunesPlaylist(t *testing.T) {
+	playlists := []iTunesPlaylist{
+		{ID: "AAAA", Name: "BBBB"},
+		{ID: "BBBB", Name: "Road Trip"},
+		{ID: "CCCC", Name: "Road Trip"},
+	}
+	tests := []struct {
+		selected string
+		want     string
+	}{
+		{"aaaa", "AAAA"},
+		// A persistent ID wins over another playlist's name.
+		{"BBBB", "BBBB"},
+		{"Road Trip", "BBBB"},
+		{"road trip", ""},
+		{"DDDD", ""},
+	}
+
+	for _, test := range tests {
+		found, ok := findITunesPlaylist(playlists, test.selected)
+		if ok != (test.want != "") || found.ID != test.want {
+			t.Errorf("findITunesPlaylist(%q) = %q, %v; want %q", test.selected, found.ID, ok, test.want)
+		}
+	}
+}
+
+func TestReadITunesTracks(t *testing.T) {
+	tracks, err := readITunesTracks(strings.NewReader(testLibrary), map[string]bool{"101": true, "102": true})
+	if err != nil {
+		t.Fatalf("readITunesTracks: %v", err)
+	}
+
+	want := map[string]trackQuery{
+		"101": {Title: "Yesterday", Artist: "The Beatles", Album: "Help!", Duration: 125 * time.Second, TrackNum: 13},
+		"102": {Title: "Tom & Jerry", Artist: "Someone"},
+	}
+	if !reflect.DeepEqual(tracks, want) {
+		t.Errorf("readITunesTracks = %+v, want %+v", tracks, want)
+	}
+}
+
+func TestReadITunesMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"not XML", "title,artist\n"},
+		{"an array at the root", `<plist version="1.0"><array></array></plist>`},
+		{"no playlists", `<plist version="1.0"><dict><key>Tracks</key><dict></dict></dict></plist>`},
+		{"playlists that aren't an array", `<plist version="1.0"><dict><key>Tracks</key><dict></dict><key>Playlists</key><dict></dict></dict></plist>`},
+		{"truncated", testLibrary[:len(testLibrary)/2]},
+	}
+
+	for _, test := range tests {
+		if _, err := readITunesPlaylists(strings.NewReader(test.data), ""); err == nil {
+			t.Errorf("readITunesPlaylists of %s succeeded, want an error", test.name)
+		}
+	}
+	if _, err := readITunesTracks(strings.NewReader(testLibrary[:len(testLibrary)/3]), map[string]bool{"101": true}); err == nil {
+		t.Errorf("readITunesTracks of a truncated library succeeded, want an error")
+	}
+}
@@ -0,0 +1,1028 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+A library migration copies a user's library from one connected account to the
+other: liked songs, saved albums, followed artists and playlists. It runs in
+the background and saves its progress after every batch it matches or
+writes, so a job interrupted by a restart picks up where it stopped. A
+replica claims a job before running it and renews its lease while it does, so
+each job runs on one replica at a time, and one left behind by a replica that
+stopped is taken over by another once the lease runs out. Rate
+limits and upstream errors pause the job before it tries again; an account
+that has to be connected again fails it, and it can be resumed once it has
+been. What couldn't be migrated is listed in the job's report.
+*/
+
+// Migration job statuses. Queued, running and waiting jobs are unfinished and
+// are resumed when the server starts.
+const (
+	migrationQueued    = "queued"
+	migrationRunning   = "running"
+	migrationWaiting   = "waiting"
+	migrationCompleted = "completed"
+	migrationFailed    = "failed"
+	migrationCancelled = "cancelled"
+)
+
+const (
+	// migrationChunk is how many items are matched between checkpoints.
+	migrationChunk = 100
+	// maxMigrationRetries bounds how many times in a row a job waits and
+	// tries again without making progress.
+	maxMigrationRetries = 10
+	// maxMigrationTracks bounds how many items are read from one list, such
+	// as a playlist or the liked songs.
+	maxMigrationTracks = 10000
+	// minNameSimilarity and minArtistSimilarity decide whether an album or
+	// artist found by searching is the one being migrated.
+	minNameSimilarity   = 0.8
+	minArtistSimilarity = 0.5
+	// migrationLease is how long a replica holds a job after claiming it or
+	// renewing its claim. Replicas look for jobs to take over this often too.
+	migrationLease = time.Minute
+)
+
+// migrationKinds are what a migration can include, in the order they are
+// migrated.
+var migrationKinds = []string{"liked", "albums", "artists", "playlists"}
+
+// migrationListNames are the names of each provider's library lists.
+var migrationListNames = map[string]map[string]string{
+	"spotify": {"liked": "Liked Songs", "albums": "Saved albums", "artists": "Followed artists"},
+	"apple":   {"liked": "Library songs", "albums": "Library albums", "artists": "Library artists"},
+}
+
+// migrationJobs is set up by main from the same backend as store.
+var migrationJobs MigrationStore
+
+// migrationOwner identifies this process in the jobs it claims.
+var migrationOwner = randomToken(12)
+
+// errMigrationCancelled is the cause given when a user cancels a job.
+var errMigrationCancelled = errors.New("migration cancelled")
+
+// finished reports whether the job has stopped for good, rather than waiting
+// to run or be resumed.
+func (j migrationJob) finished() bool {
+	return j.Status == migrationCompleted || j.Status == migrationFailed || j.Status == migrationCancelled
+}
+
+// migrationProgress is a job's checkpoint. Steps are planned on the job's
+// first run, from the lists in the source account at the time.
+type migrationProgress struct {
+	Include []string        `json:"include"`
+	Planned bool            `json:"planned"`
+	Steps   []migrationStep `json:"steps"`
+}
+
+/*
+migrationStep is one list being migrated: the liked songs, saved albums,
+followed artists or a playlist. The list is read from the source once, when
+the step starts, and Items holds what is left of it, so a job that resumes
+carries on through the same list even if the source has changed since. The
+first Scanned items have been dealt with and dropped from Items. Pending holds
+the target IDs matched from the first Chunk of Items that have yet to be
+written.
+*/
+type migrationStep struct {
+	// Kind is liked, albums, artists or playlist.
+	Kind     string        `json:"kind"`
+	SourceID string        `json:"source_id,omitempty"`
+	Name     string        `json:"name"`
+	TargetID string        `json:"target_id,omitempty"`
+	Listed   bool          `json:"listed,omitempty"`
+	Items    []libraryItem `json:"items,omitempty"`
+	Total    int           `json:"total"`
+	Scanned  int           `json:"scanned"`
+	Chunk    int           `json:"chunk,omitempty"`
+	Pending  []string      `json:"pending,omitempty"`
+	Written  int           `json:"written"`
+	Done     bool          `json:"done"`
+}
+
+// migrationReport counts what has been migrated and lists what couldn't be.
+type migrationReport struct {
+	Migrated   migrationCounts  `json:"migrated"`
+	Unmigrated []unmigratedItem `json:"unmigrated"`
+}
+
+type migrationCounts struct {
+	Tracks    int `json:"tracks"`
+	Albums    int `json:"albums"`
+	Artists   int `json:"artists"`
+	Playlists int `json:"playlists"`
+}
+
+// unmigratedItem is a track, album, artist or playlist that couldn't be
+// migrated. List names the list it was in.
+type unmigratedItem struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Artist string `json:"artist,omitempty"`
+	List   string `json:"list,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// libraryItem is a track, album or artist read from the source account.
+type libraryItem struct {
+	Name   string `json:"name"`
+	Artist string `json:"artist,omitempty"`
+	// UPC is set for albums when the source has it.
+	UPC string `json:"upc,omitempty"`
+	// Query is set for tracks, and Known when the track is in the source
+	// catalog.
+	Query trackQuery      `json:"query"`
+	Known *trackCandidate `json:"known,omitempty"`
+}
+
+// trackItems turns queries, with the tracks known by index, into items.
+func trackItems(queries []trackQuery, known map[int]trackCandidate) []libraryItem {
+	items := make([]libraryItem, len(queries))
+	for i, query := range queries {
+		items[i] = libraryItem{Name: query.Title, Artist: query.Artist, Query: query}
+		if candidate, ok := known[i]; ok {
+			items[i].Known = &candidate
+		}
+	}
+
+	return items
+}
+
+// namesMatch reports whether an album or artist found by searching looks
+// like item.
+func namesMatch(item libraryItem, name string, artist string) bool {
+	if titleSimilarity(item.Name, name) < minNameSimilarity {
+		return false
+	}
+
+	return item.Artist == "" || artist == "" || similarity(item.Artist, artist) >= minArtistSimilarity
+}
+
+/*
+migrationAccount is a provider account a migration reads from or writes to.
+Reads return at most maxMigrationTracks+1 items, so a list that was cut short
+can be reported. IDs are the provider's catalog IDs.
+*/
+type migrationAccount interface {
+	playlists(ctx context.Context) ([]userPlaylistSummary, error)
+	items(ctx context.Context, step migrationStep) ([]libraryItem, error)
+
+	// trackID returns the ID of a track found by matching, or "".
+	trackID(candidate trackCandidate) string
+	// playable returns which of the tracks ids the account can play.
+	playable(ctx context.Context, ids []string) (map[string]bool, error)
+	// findAlbum and findArtist return "" when there's no match.
+	findAlbum(ctx context.Context, item libraryItem) (string, error)
+	findArtist(ctx context.Context, item libraryItem) (string, error)
+	// unsupported gives the reason when a kind can't be written to the
+	// account.
+	unsupported(kind string) string
+
+	createPlaylist(ctx context.Context, name string, description string) (string, error)
+	addToPlaylist(ctx context.Context, id string, ids []string) error
+	// save adds liked songs, albums or artists to the account's library.
+	save(ctx context.Context, kind string, ids []string) error
+	// batchSize is how many IDs save or addToPlaylist take at once.
+	batchSize(kind string) int
+}
+
+func newMigrationAccount(provider string, sessionID string) migrationAccount {
+	session := userSession{ID: sessionID}
+	if provider == "apple" {
+		return &appleMigrationAccount{session: session}
+	}
+
+	return &spotifyMigrationAccount{session: session}
+}
+
+// libraryMigration is a job while it runs.
+type libraryMigration struct {
+	job            migrationJob
+	source, target migrationAccount
+	retries        int
+	log            *slog.Logger
+}
+
+// save records the job and renews its lease. It isn't cut short by
+// cancellation, so that a batch that has been written is always recorded. It
+// returns errMigrationChanged when the job has been cancelled or taken over
+// elsewhere.
+func (m *libraryMigration) save(ctx context.Context) error {
+	now := time.Now().UTC()
+	m.job.UpdatedAt = now.Truncate(time.Second)
+	m.job.LeaseUntil = now.Add(migrationLease)
+	return migrationJobs.SaveMigration(context.WithoutCancel(ctx), m.job)
+}
+
+/*
+renewLease renews the job's lease until ctx is done, so that a job waiting to
+retry or matching a long chunk isn't taken over. When the job has been
+cancelled or taken over elsewhere, it stops the run with errMigrationChanged.
+*/
+func (m *libraryMigration) renewLease(ctx context.Context, stop context.CancelCauseFunc) {
+	ticker := time.NewTicker(migrationLease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		_, err := migrationJobs.ClaimMigration(ctx, m.job.ID, migrationOwner, now.Add(migrationLease), now)
+		switch {
+		case errors.Is(err, errMigrationChanged) || errors.Is(err, errMigrationNotFound):
+			stop(errMigrationChanged)
+			return
+		case err != nil && ctx.Err() == nil:
+			m.log.Warn("renewing library migration lease failed", "error", err)
+		}
+	}
+}
+
+// checkpoint saves progress, which also resets the retry count.
+func (m *libraryMigration) checkpoint(ctx context.Context) error {
+	m.retries = 0
+	return m.save(ctx)
+}
+
+/*
+run migrates until the job is done, waiting and trying again after rate
+limits and upstream errors. Other errors, and running out of retries, stop
+the job.
+*/
+func (m *libraryMigration) run(ctx context.Context) error {
+	for {
+		if m.job.Status != migrationRunning {
+			m.job.Status = migrationRunning
+			if err := m.save(ctx); err != nil {
+				return err
+			}
+		}
+
+		err := m.migrate(ctx)
+		if err == nil || ctx.Err() != nil || !retryableMigrationError(err) {
+			return err
+		}
+		m.retries++
+		if m.retries > maxMigrationRetries {
+			return err
+		}
+		m.log.Warn("library migration waiting to retry", "retry", m.retries, "wait", config.Migration.RetryWait.String(), "error", err)
+
+		m.job.Status = migrationWaiting
+		if err := m.save(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(config.Migration.RetryWait):
+		}
+	}
+}
+
+// migrate plans the job's steps, if that hasn't been done yet, and carries
+// on from the first step that isn't done.
+func (m *libraryMigration) migrate(ctx context.Context) error {
+	if !m.job.Progress.Planned {
+		if err := m.plan(ctx); err != nil {
+			return err
+		}
+	}
+
+	for i := range m.job.Progress.Steps {
+		if m.job.Progress.Steps[i].Done {
+			continue
+		}
+		if err := m.migrateStep(ctx, i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// plan lists the steps for what the job includes.
+func (m *libraryMigration) plan(ctx context.Context) error {
+	var steps []migrationStep
+	for _, kind := range m.job.Progress.Include {
+		if kind != "playlists" {
+			steps = append(steps, migrationStep{Kind: kind, Name: migrationListNames[m.job.Source][kind]})
+			continue
+		}
+
+		playlists, err := m.source.playlists(ctx)
+		if err != nil {
+			return err
+		}
+		for _, playlist := range playlists {
+			steps = append(steps, migrationStep{Kind: "playlist", SourceID: playlist.ID, Name: playlist.Name})
+		}
+	}
+
+	m.job.Progress.Steps = steps
+	m.job.Progress.Planned = true
+	m.log.Info("library migration planned", "steps", len(steps))
+	return m.checkpoint(ctx)
+}
+
+// unmigrated adds items to the report.
+func (m *libraryMigration) unmigrated(items ...unmigratedItem) {
+	m.job.Report.Unmigrated = append(m.job.Report.Unmigrated, items...)
+}
+
+// migrateStep reads step i's list, unless that has been done already, and
+// migrates it a chunk at a time.
+func (m *libraryMigration) migrateStep(ctx context.Context, i int) error {
+	step := &m.job.Progress.Steps[i]
+	if !step.Listed {
+		items, err := m.source.items(ctx, *step)
+		var apiErr userAPIError
+		if step.Kind == "playlist" && errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+			m.unmigrated(unmigratedItem{Kind: "playlist", Name: step.Name, Reason: "the playlist no longer exists"})
+			step.Done = true
+			return m.checkpoint(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		if len(items) > maxMigrationTracks {
+			items = items[:maxMigrationTracks]
+			m.unmigrated(unmigratedItem{Kind: step.Kind, Name: step.Name, Reason: fmt.Sprintf("only the first %d items were migrated", maxMigrationTracks)})
+		}
+		step.Listed, step.Items, step.Total = true, items, len(items)
+		if err := m.checkpoint(ctx); err != nil {
+			return err
+		}
+	}
+
+	if step.Kind == "playlist" && step.TargetID == "" {
+		id, err := m.target.createPlaylist(ctx, step.Name, "Migrated from "+providerDisplayNames[m.job.Source]+" with Polyphonic")
+		if err != nil {
+			return err
+		}
+		step.TargetID = id
+		if err := m.checkpoint(ctx); err != nil {
+			return err
+		}
+	}
+
+	for len(step.Items) > 0 || len(step.Pending) > 0 {
+		if step.Chunk == 0 {
+			chunk := step.Items[:min(migrationChunk, len(step.Items))]
+			ids, unmigrated, err := m.convert(ctx, *step, chunk)
+			if err != nil {
+				return err
+			}
+			m.unmigrated(unmigrated...)
+			step.Pending, step.Chunk = ids, len(chunk)
+		}
+
+		if len(step.Pending) > 0 {
+			batch := step.Pending[:min(m.target.batchSize(step.Kind), len(step.Pending))]
+			if err := m.write(ctx, *step, batch); err != nil {
+				return err
+			}
+			step.Pending = step.Pending[len(batch):]
+			step.Written += len(batch)
+		}
+		if len(step.Pending) == 0 {
+			step.Items = step.Items[step.Chunk:]
+			step.Scanned += step.Chunk
+			step.Chunk = 0
+		}
+		if err := m.checkpoint(ctx); err != nil {
+			return err
+		}
+	}
+
+	step.Done = true
+	if step.Kind == "playlist" {
+		m.job.Report.Migrated.Playlists++
+	}
+	m.log.Info("library migration step done", "kind", step.Kind, "name", step.Name, "written", step.Written, "total", step.Total)
+	return m.checkpoint(ctx)
+}
+
+/*
+convert finds a chunk of items in the target account's catalog, returning the
+IDs to write and the items that couldn't be found. Tracks are matched as
+imports are, then checked against what the account can play.
+*/
+func (m *libraryMigration) convert(ctx context.Context, step migrationStep, chunk []libraryItem) ([]string, []unmigratedItem, error) {
+	kind := map[string]string{"albums": "album", "artists": "artist"}[step.Kind]
+	if kind == "" {
+		kind = "track"
+	}
+	var ids []string
+	var unmigrated []unmigratedItem
+	notFound := func(item libraryItem, reason string) {
+		unmigrated = append(unmigrated, unmigratedItem{Kind: kind, Name: item.Name, Artist: item.Artist, List: step.Name, Reason: reason})
+	}
+	noMatch := "no match on " + providerDisplayNames[m.job.Target]
+
+	if reason := m.target.unsupported(step.Kind); reason != "" {
+		for _, item := range chunk {
+			notFound(item, reason)
+		}
+		return nil, unmigrated, nil
+	}
+
+	if kind != "track" {
+		for _, item := range chunk {
+			find := m.target.findAlbum
+			if kind == "artist" {
+				find = m.target.findArtist
+			}
+			id, err := find(ctx, item)
+			if err != nil {
+				return nil, nil, err
+			}
+			if id == "" {
+				notFound(item, noMatch)
+				continue
+			}
+			ids = append(ids, id)
+		}
+		return ids, unmigrated, nil
+	}
+
+	for _, provider := range []string{m.job.Source, m.job.Target} {
+		if err := checkProviderAuth(ctx, provider); err != nil {
+			return nil, nil, err
+		}
+	}
+	queries := make([]trackQuery, len(chunk))
+	known := map[int]trackCandidate{}
+	for i, item := range chunk {
+		queries[i] = item.Query
+		if item.Known != nil {
+			known[i] = *item.Known
+		}
+	}
+	// Only the target is searched; other providers play no part in a migration.
+	matches := matchKnownTracks(ctx, m.job.Source, []string{m.job.Target}, queries, known)
+	// Searches cut short look like misses.
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	found := make([]string, len(chunk))
+	var lookup []string
+	for i := range chunk {
+		if candidate, ok := matches[i].best(m.job.Target); ok {
+			found[i] = m.target.trackID(candidate)
+		}
+		if found[i] != "" && !slices.Contains(lookup, found[i]) {
+			lookup = append(lookup, found[i])
+		}
+	}
+	playable, err := m.target.playable(ctx, lookup)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, item := range chunk {
+		switch {
+		case found[i] == "":
+			notFound(item, noMatch)
+		case !playable[found[i]]:
+			notFound(item, "not available in the account's storefront")
+		default:
+			ids = append(ids, found[i])
+		}
+	}
+
+	return ids, unmigrated, nil
+}
+
+// write adds a batch of IDs to the target account and counts them.
+func (m *libraryMigration) write(ctx context.Context, step migrationStep, ids []string) error {
+	if step.Kind == "playlist" {
+		if err := m.target.addToPlaylist(ctx, step.TargetID, ids); err != nil {
+			return err
+		}
+	} else if err := m.target.save(ctx, step.Kind, ids); err != nil {
+		return err
+	}
+
+	switch step.Kind {
+	case "albums":
+		m.job.Report.Migrated.Albums += len(ids)
+	case "artists":
+		m.job.Report.Migrated.Artists += len(ids)
+	default:
+		m.job.Report.Migrated.Tracks += len(ids)
+	}
+	return nil
+}
+
+// retryableMigrationError reports whether err may go away by waiting: a rate
+// limit, an upstream server error or a network error.
+func retryableMigrationError(err error) bool {
+	var apiErr userAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status == http.StatusTooManyRequests || apiErr.Status >= 500
+	}
+
+	return !errors.Is(err, errNotConnected) && !errors.Is(err, errAppleUserToken) && !errors.Is(err, errMigrationChanged)
+}
+
+// migrationErrorMessage explains to the user why a job failed.
+func migrationErrorMessage(err error) string {
+	var apiErr userAPIError
+	switch {
+	case errors.Is(err, errNotConnected):
+		return "An account the migration uses is no longer connected; connect it again and resume the migration"
+	case errors.Is(err, errAppleUserToken):
+		return "The Apple Music user token has expired or was revoked; send a new one to POST /auth/apple and resume the migration"
+	case errors.As(err, &apiErr) && (apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden):
+		return "The " + providerDisplayNames[apiErr.Provider] + " account did not allow the migration; connect it again and resume the migration"
+	case errors.As(err, &apiErr):
+		return fmt.Sprintf("%s answered with status %d; resume the migration to try again", providerDisplayNames[apiErr.Provider], apiErr.Status)
+	}
+
+	return "The migration stopped after an error; resume it to try again"
+}
+
+// runningMigration is a job running in this process.
+type runningMigration struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// migrationRunner runs jobs as background jobs of the server, so shutdown
+// stops them; they are left unfinished and resumed on the next start.
+type migrationRunner struct {
+	mu      sync.Mutex
+	running map[string]runningMigration
+}
+
+var libraryMigrations = &migrationRunner{running: map[string]runningMigration{}}
+
+/*
+start claims the job for this process and runs it. It reports false, without
+an error, when the job is already running here, has finished or is held by
+another replica.
+*/
+func (r *migrationRunner) start(ctx context.Context, id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.running[id]; ok {
+		return false, nil
+	}
+
+	now := time.Now()
+	job, err := migrationJobs.ClaimMigration(ctx, id, migrationOwner, now.Add(migrationLease), now)
+	if errors.Is(err, errMigrationChanged) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	runCtx, cancel := context.WithCancelCause(lifecycle.ctx)
+	running := runningMigration{cancel: cancel, done: make(chan struct{})}
+	r.running[id] = running
+	lifecycle.Go("library migration", func(context.Context) {
+		defer close(running.done)
+		r.run(runCtx, cancel, job)
+	})
+	return true, nil
+}
+
+// run runs job and records how it finished, unless it was cancelled or taken
+// over elsewhere, which has already been recorded.
+func (r *migrationRunner) run(ctx context.Context, cancel context.CancelCauseFunc, job migrationJob) {
+	m := &libraryMigration{
+		job:    job,
+		source: newMigrationAccount(job.Source, job.SessionID),
+		target: newMigrationAccount(job.Target, job.SessionID),
+		log:    logger.With("migration", job.ID, "source", job.Source, "target", job.Target),
+	}
+	m.log.Info("library migration started", "owner", migrationOwner)
+	renewCtx, stopRenewing := context.WithCancel(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		m.renewLease(renewCtx, cancel)
+	}()
+	err := m.run(ctx)
+	stopRenewing()
+	<-renewed
+
+	r.mu.Lock()
+	delete(r.running, job.ID)
+	r.mu.Unlock()
+
+	switch {
+	case err == nil:
+		m.job.Status = migrationCompleted
+		m.log.Info("library migration completed", "tracks", m.job.Report.Migrated.Tracks, "unmigrated", len(m.job.Report.Unmigrated))
+	case errors.Is(err, errMigrationChanged) || errors.Is(context.Cause(ctx), errMigrationChanged):
+		m.log.Info("library migration stopped; it was cancelled or taken over elsewhere")
+		return
+	case errors.Is(context.Cause(ctx), errMigrationCancelled):
+		m.job.Status = migrationCancelled
+		m.log.Info("library migration cancelled")
+	case ctx.Err() != nil:
+		// Letting the lease run out now lets the next replica to start, or
+		// one already running, take the job over straight away.
+		now := time.Now()
+		if _, err := migrationJobs.ClaimMigration(context.WithoutCancel(ctx), job.ID, migrationOwner, now, now); err != nil {
+			m.log.Warn("releasing library migration failed", "error", err)
+		}
+		m.log.Info("library migration stopped for shutdown; it will resume on the next start")
+		return
+	default:
+		if errors.Is(err, errAppleUserToken) {
+			sessions.DeleteProviderToken(context.WithoutCancel(ctx), job.SessionID, "apple")
+		}
+		m.job.Status = migrationFailed
+		m.job.Error = migrationErrorMessage(err)
+		m.log.Warn("library migration failed", "error", err)
+	}
+
+	if err := m.save(ctx); err != nil {
+		m.log.Error("saving library migration failed", "error", err)
+		return
+	}
+	libraryMigrationsTotal.WithLabelValues(m.job.Status).Inc()
+}
+
+// cancel stops a running job and waits for it to record that. It reports
+// false when the job isn't running in this process.
+func (r *migrationRunner) cancel(ctx context.Context, id string) bool {
+	r.mu.Lock()
+	running, ok := r.running[id]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	running.cancel(errMigrationCancelled)
+	select {
+	case <-running.done:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+/*
+resumeMigrations starts the unfinished jobs no replica holds: those that were
+unfinished when the server last stopped, those whose replica stopped renewing
+its lease, and those queued while claiming them failed.
+*/
+func resumeMigrations(ctx context.Context) error {
+	jobs, err := migrationJobs.ListUnfinishedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	started := 0
+	for _, job := range jobs {
+		if job.Owner != "" && job.Owner != migrationOwner && !job.LeaseUntil.Before(now) {
+			continue
+		}
+		ok, err := libraryMigrations.start(ctx, job.ID)
+		if err != nil {
+			logger.Error("claiming library migration failed", "migration", job.ID, "error", err)
+			continue
+		}
+		if ok {
+			started++
+		}
+	}
+	if started > 0 {
+		logger.Info("Resuming library migrations", "jobs", started)
+	}
+
+	return nil
+}
+
+// watchMigrations resumes jobs left behind by other replicas every interval
+// until ctx is done.
+func watchMigrations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := resumeMigrations(ctx); err != nil && ctx.Err() == nil {
+			logger.Error("listing unfinished library migrations failed", "error", err)
+		}
+	}
+}
+
+// migrationRequest is the body for starting a migration.
+type migrationRequest struct {
+	Source  string   `json:"source"`
+	Target  string   `json:"target"`
+	Include []string `json:"include"`
+}
+
+// migrationStatus is a job as reported to the client. Steps and the report
+// are left out of listings.
+type migrationStatus struct {
+	ID        string                `json:"id"`
+	Source    string                `json:"source"`
+	Target    string                `json:"target"`
+	Status    string                `json:"status"`
+	Error     string                `json:"error,omitempty"`
+	Include   []string              `json:"include"`
+	CreatedAt time.Time             `json:"created_at"`
+	UpdatedAt time.Time             `json:"updated_at"`
+	Steps     []migrationStepStatus `json:"steps,omitempty"`
+	Report    *migrationReport      `json:"report,omitempty"`
+}
+
+type migrationStepStatus struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Total   int    `json:"total"`
+	Scanned int    `json:"scanned"`
+	Written int    `json:"written"`
+	Done    bool   `json:"done"`
+}
+
+func describeMigration(job migrationJob, detailed bool) migrationStatus {
+	status := migrationStatus{
+		ID:        job.ID,
+		Source:    job.Source,
+		Target:    job.Target,
+		Status:    job.Status,
+		Error:     job.Error,
+		Include:   job.Progress.Include,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+	if !detailed {
+		return status
+	}
+
+	status.Steps = []migrationStepStatus{}
+	for _, step := range job.Progress.Steps {
+		status.Steps = append(status.Steps, migrationStepStatus{
+			Kind:    step.Kind,
+			Name:    step.Name,
+			Total:   step.Total,
+			Scanned: step.Scanned,
+			Written: step.Written,
+			Done:    step.Done,
+		})
+	}
+	status.Report = &job.Report
+	return status
+}
+
+// migrationAccountsConnected checks that the session has both of the job's
+// accounts, responding when it doesn't.
+func migrationAccountsConnected(c *gin.Context, session userSession, source string, target string) bool {
+	for _, provider := range []string{source, target} {
+		var ok bool
+		switch provider {
+		case "spotify":
+			_, ok = spotifyTokenFor(c, session)
+		case "apple":
+			_, ok = appleTokenFor(c, session)
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sessionMigration loads the job named in the path, responding with a 404
+// when it belongs to another session.
+func sessionMigration(c *gin.Context, session userSession) (migrationJob, bool) {
+	job, err := migrationJobs.GetMigration(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, errMigrationNotFound) || err == nil && job.SessionID != session.ID {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Migration not found"})
+		return job, false
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("loading migration failed", "id", c.Param("id"), "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error loading the migration"})
+		return job, false
+	}
+
+	return job, true
+}
+
+// migrationInProgress responds with a 409 when the session already has an
+// unfinished migration.
+func migrationInProgress(c *gin.Context, session userSession) bool {
+	jobs, err := migrationJobs.ListMigrations(c.Request.Context(), session.ID)
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("listing migrations failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error reading the session's migrations"})
+		return true
+	}
+	for _, job := range jobs {
+		if !job.finished() {
+			c.IndentedJSON(http.StatusConflict, gin.H{"message": "A migration is already in progress for this session", "id": job.ID})
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+postMigration starts migrating the session's library from one connected
+account to the other. A session runs one migration at a time.
+*/
+func postMigration(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	var request migrationRequest
+	if !bindValidJSON(c, "MigrationRequest", &request) {
+		return
+	}
+	if request.Source == request.Target {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "The source and target must be different providers"})
+		return
+	}
+	if !migrationAccountsConnected(c, session, request.Source, request.Target) {
+		return
+	}
+
+	if migrationInProgress(c, session) {
+		return
+	}
+
+	include := migrationKinds
+	if len(request.Include) > 0 {
+		include = nil
+		for _, kind := range migrationKinds {
+			if slices.Contains(request.Include, kind) {
+				include = append(include, kind)
+			}
+		}
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	job := migrationJob{
+		ID:        randomToken(12),
+		SessionID: session.ID,
+		Source:    request.Source,
+		Target:    request.Target,
+		Status:    migrationQueued,
+		Progress:  migrationProgress{Include: include, Steps: []migrationStep{}},
+		Report:    migrationReport{Unmigrated: []unmigratedItem{}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := migrationJobs.CreateMigration(ctx, job); err != nil {
+		loggerFrom(ctx).Error("saving migration failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error starting the migration"})
+		return
+	}
+	loggerFrom(ctx).Info("library migration queued", "migration", job.ID, "source", job.Source, "target", job.Target)
+	// A job that can't be claimed now stays queued for a replica to pick up.
+	if _, err := libraryMigrations.start(ctx, job.ID); err != nil {
+		loggerFrom(ctx).Error("claiming library migration failed", "migration", job.ID, "error", err)
+	}
+
+	c.IndentedJSON(http.StatusAccepted, describeMigration(job, true))
+}
+
+// getMigrations lists the session's migrations, newest first.
+func getMigrations(c *gin.Context) {
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+
+	jobs, err := migrationJobs.ListMigrations(c.Request.Context(), session.ID)
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("listing migrations failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error listing migrations"})
+		return
+	}
+	migrations := []migrationStatus{}
+	for _, job := range jobs {
+		migrations = append(migrations, describeMigration(job, false))
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"migrations": migrations})
+}
+
+// getMigration reports a migration's progress, and once it has finished,
+// what couldn't be migrated.
+func getMigration(c *gin.Context) {
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	job, ok := sessionMigration(c, session)
+	if !ok {
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, describeMigration(job, true))
+}
+
+// deleteMigration cancels an unfinished migration. What has already been
+// written to the target account is kept.
+func deleteMigration(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	job, ok := sessionMigration(c, session)
+	if !ok {
+		return
+	}
+	if job.finished() {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "The migration has already " + job.Status})
+		return
+	}
+
+	// A job running on another replica stops when it next renews its lease
+	// or saves its progress.
+	if !libraryMigrations.cancel(ctx, job.ID) {
+		err := migrationJobs.CancelMigration(ctx, job.ID, time.Now().UTC().Truncate(time.Second))
+		if errors.Is(err, errMigrationChanged) {
+			c.IndentedJSON(http.StatusConflict, gin.H{"message": "The migration finished while it was being cancelled"})
+			return
+		}
+		if err != nil {
+			loggerFrom(ctx).Error("saving migration failed", "id", job.ID, "error", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error cancelling the migration"})
+			return
+		}
+	}
+	job, ok = sessionMigration(c, session)
+	if !ok {
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, describeMigration(job, true))
+}
+
+// postMigrationResume starts a failed or cancelled migration again from its
+// last checkpoint.
+func postMigrationResume(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	job, ok := sessionMigration(c, session)
+	if !ok {
+		return
+	}
+	if job.Status != migrationFailed && job.Status != migrationCancelled {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Only failed or cancelled migrations can be resumed; this one is " + job.Status})
+		return
+	}
+	if !migrationAccountsConnected(c, session, job.Source, job.Target) || migrationInProgress(c, session) {
+		return
+	}
+
+	job.Status = migrationQueued
+	job.Error = ""
+	job.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+	err := migrationJobs.ResumeMigration(ctx, job.ID, job.UpdatedAt)
+	if errors.Is(err, errMigrationChanged) {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "The migration is already being resumed"})
+		return
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("saving migration failed", "id", job.ID, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error resuming the migration"})
+		return
+	}
+	loggerFrom(ctx).Info("library migration resumed", "migration", job.ID)
+	if _, err := libraryMigrations.start(ctx, job.ID); err != nil {
+		loggerFrom(ctx).Error("claiming library migration failed", "migration", job.ID, "error", err)
+	}
+
+	c.IndentedJSON(http.StatusAccepted, describeMigration(job, true))
+}
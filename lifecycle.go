@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+serverLifecycle keeps track of background jobs and cleanup that have to run
+when the server shuts down. Jobs started with Go get a context that is
+cancelled once shutdown begins, and are given time to wrap up before the
+shutdown hooks run.
+*/
+type serverLifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	jobs   sync.WaitGroup
+
+	mu    sync.Mutex
+	hooks []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func newServerLifecycle() *serverLifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &serverLifecycle{ctx: ctx, cancel: cancel}
+}
+
+// Go runs fn in the background. fn should return promptly once its context
+// is cancelled.
+func (l *serverLifecycle) Go(name string, fn func(ctx context.Context)) {
+	l.jobs.Add(1)
+	go func() {
+		defer l.jobs.Done()
+		fn(l.ctx)
+		logger.Info("Background job finished", "job", name)
+	}()
+}
+
+// OnShutdown registers fn to run during shutdown, after background jobs have
+// stopped. Hooks run in the reverse order they were registered, so something
+// registered early, like the database, is closed last.
+func (l *serverLifecycle) OnShutdown(name string, fn func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.hooks = append(l.hooks, shutdownHook{name: name, fn: fn})
+}
+
+/*
+Shutdown stops the servers gracefully:
+ 1. stop accepting connections and wait up to drainTimeout for in-flight
+    requests to finish on every server
+ 2. cancel background jobs and wait up to jobTimeout for them to return
+ 3. run the shutdown hooks
+*/
+func (l *serverLifecycle) Shutdown(servers []*http.Server, drainTimeout time.Duration, jobTimeout time.Duration) error {
+	var errs []error
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	logger.Info("Draining in-flight requests", "timeout", drainTimeout.String())
+	for _, server := range servers {
+		if err := server.Shutdown(drainCtx); err != nil {
+			errs = append(errs, err)
+			// Whatever is still running after the deadline is cut off.
+			server.Close()
+		}
+	}
+
+	l.cancel()
+	jobsDone := make(chan struct{})
+	go func() {
+		l.jobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-time.After(jobTimeout):
+		errs = append(errs, errors.New("background jobs did not stop in time"))
+	}
+
+	l.mu.Lock()
+	hooks := append([]shutdownHook(nil), l.hooks...)
+	l.mu.Unlock()
+
+	hookCtx, cancelHooks := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancelHooks()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(hookCtx); err != nil {
+			logger.Error("Shutdown hook failed", "hook", hooks[i].name, "error", err)
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
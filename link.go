@@ -0,0 +1,328 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Link resolution turns a link to a track on one provider into links to the
+same track on the others, the way a single song is converted in the app.
+GET /link answers with JSON, and the song card at /embed/link is what oEmbed
+responses for /link URLs put in an iframe.
+*/
+
+// linkResolution is a track and where it can be found. Links has the source
+// track and the best confident match on each other provider that has one.
+type linkResolution struct {
+	URL    string                    `json:"url"`
+	Source trackCandidate            `json:"source"`
+	Links  map[string]trackCandidate `json:"links"`
+}
+
+// maxTrackIDLength bounds the track IDs that are resolved, so the keys links
+// are stored under stay short.
+const maxTrackIDLength = 64
+
+// resolvedLinks is set up by main from the same backend as store.
+var resolvedLinks LinkStore
+
+// linkCache keeps the most recently used resolutions in memory in front of
+// resolvedLinks.
+var linkCache = newLinkLRU()
+
+/*
+linkLRU is a cache of link resolutions that holds at most
+config.Cache.MaxLinks of them, dropping the least recently used one to make
+room for another.
+*/
+type linkLRU struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type linkLRUEntry struct {
+	key        string
+	resolution linkResolution
+	resolvedAt time.Time
+}
+
+func newLinkLRU() *linkLRU {
+	return &linkLRU{order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (l *linkLRU) get(key string) (linkResolution, time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.entries[key]
+	if !ok {
+		return linkResolution{}, time.Time{}, false
+	}
+	l.order.MoveToFront(element)
+	entry := element.Value.(linkLRUEntry)
+	return entry.resolution, entry.resolvedAt, true
+}
+
+func (l *linkLRU) add(key string, resolution linkResolution, resolvedAt time.Time, size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := linkLRUEntry{key: key, resolution: resolution, resolvedAt: resolvedAt}
+	if element, ok := l.entries[key]; ok {
+		element.Value = entry
+		l.order.MoveToFront(element)
+		return
+	}
+	l.entries[key] = l.order.PushFront(entry)
+	for l.order.Len() > size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(linkLRUEntry).key)
+	}
+}
+
+/*
+parseTrackURL returns the provider and track ID in a track link, such as
+https://open.spotify.com/track/<id>,
+https://music.apple.com/us/album/<name>/<album id>?i=<id> or
+https://www.deezer.com/en/track/<id>. Links to anything other than a single
+track are not recognised.
+*/
+func parseTrackURL(rawURL string) (provider string, id string, ok bool) {
+	if id, ok := strings.CutPrefix(rawURL, "spotify:track:"); ok && id != "" {
+		return "spotify", id, true
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", "", false
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	switch strings.ToLower(u.Hostname()) {
+	case "open.spotify.com", "play.spotify.com":
+		// Localised links start with intl-<language>.
+		if len(segments) > 0 && strings.HasPrefix(segments[0], "intl-") {
+			segments = segments[1:]
+		}
+		if len(segments) == 2 && segments[0] == "track" && segments[1] != "" {
+			return "spotify", segments[1], true
+		}
+	case "music.apple.com", "itunes.apple.com":
+		// /<storefront>/song/<name>/<id>, /<storefront>/song/<id>, or an
+		// album link with the track in ?i=.
+		if len(segments) >= 3 && segments[1] == "song" {
+			return "apple", segments[len(segments)-1], true
+		}
+		if len(segments) >= 3 && segments[1] == "album" && u.Query().Get("i") != "" {
+			return "apple", u.Query().Get("i"), true
+		}
+	case "deezer.com", "www.deezer.com":
+		// Localised links start with the language, as in /en/track/<id>.
+		if len(segments) == 3 {
+			segments = segments[1:]
+		}
+		if len(segments) == 2 && segments[0] == "track" && segments[1] != "" {
+			return "deezer", segments[1], true
+		}
+	}
+
+	return "", "", false
+}
+
+// lookupTrack fetches a track by its ID on provider. A track that doesn't
+// exist is reported with ok false, and err is set when the provider can't be
+// reached.
+func lookupTrack(ctx context.Context, provider string, id string) (candidate trackCandidate, ok bool, err error) {
+	switch provider {
+	case "spotify":
+		spotifySong, err := fetchSpotifySongByID(ctx, &sWait, url.PathEscape(id), currentSpotifyKey())
+		if err != nil || spotifySong.URI == "" {
+			return trackCandidate{}, false, err
+		}
+		return spotifyCandidate(spotifySong), true, nil
+	case "apple":
+		appleMusicSong, err := fetchAppleMusicSongByID(ctx, &aWait, url.PathEscape(id), currentAppleMusicKey())
+		if err != nil || len(appleMusicSong.Data) == 0 {
+			return trackCandidate{}, false, err
+		}
+		return appleCandidate(appleMusicSong.Data[0]), true, nil
+	case "deezer":
+		track, err := getDeezerTrack(ctx, id)
+		if err == errDeezerNotFound {
+			return trackCandidate{}, false, nil
+		}
+		if err != nil {
+			return trackCandidate{}, false, err
+		}
+		return deezerCandidate(track), true, nil
+	}
+
+	return trackCandidate{}, false, nil
+}
+
+// linkKey returns the key the track rawURL links to is stored under.
+func linkKey(rawURL string) (provider string, id string, key string, ok bool) {
+	provider, id, ok = parseTrackURL(rawURL)
+	if !ok || len(id) > maxTrackIDLength {
+		return "", "", "", false
+	}
+
+	return provider, id, provider + ":" + id, true
+}
+
+/*
+storedLink returns the resolution last saved for the track rawURL links to,
+however old it is, without contacting any provider. ok is false when the
+track hasn't been resolved through /link.
+*/
+func storedLink(ctx context.Context, rawURL string) (resolution linkResolution, resolvedAt time.Time, ok bool, err error) {
+	_, _, key, ok := linkKey(rawURL)
+	if !ok {
+		return linkResolution{}, time.Time{}, false, nil
+	}
+
+	if resolution, resolvedAt, ok := linkCache.get(key); ok {
+		resolution.URL = rawURL
+		return resolution, resolvedAt, true, nil
+	}
+	resolution, resolvedAt, err = resolvedLinks.GetLink(ctx, key)
+	if err == errLinkNotFound {
+		return linkResolution{}, time.Time{}, false, nil
+	}
+	if err != nil {
+		return linkResolution{}, time.Time{}, false, err
+	}
+	linkCache.add(key, resolution, resolvedAt, config.Cache.MaxLinks)
+
+	resolution.URL = rawURL
+	return resolution, resolvedAt, true, nil
+}
+
+/*
+resolveLink looks up the track rawURL links to and matches it on every other
+provider that can be searched right now. Resolutions are saved, and reused
+until config.Cache.LinkTTL has passed. ok is false when rawURL isn't a track
+link or the track doesn't exist; err is set when the source provider can't be
+reached.
+*/
+func resolveLink(ctx context.Context, rawURL string) (resolution linkResolution, ok bool, err error) {
+	provider, id, key, ok := linkKey(rawURL)
+	if !ok {
+		return linkResolution{}, false, nil
+	}
+
+	stored, resolvedAt, ok, err := storedLink(ctx, rawURL)
+	if err != nil {
+		loggerFrom(ctx).Warn("reading a stored link failed", "key", key, "error", err)
+	}
+	if ok && time.Since(resolvedAt) < config.Cache.LinkTTL {
+		return stored, true, nil
+	}
+
+	if err := checkProviderAuth(ctx, provider); err != nil {
+		return linkResolution{}, false, err
+	}
+	source, ok, err := lookupTrack(ctx, provider, id)
+	if err != nil || !ok {
+		return linkResolution{}, false, err
+	}
+	source.Confidence = 100
+
+	others := availableProviders(ctx, otherProviders(provider))
+	query := trackQuery{Title: source.Title, Artist: source.Artist}
+	matches := matchKnownTracks(ctx, provider, others, []trackQuery{query}, map[int]trackCandidate{0: source})
+	resolution = linkResolution{URL: rawURL, Source: source, Links: map[string]trackCandidate{}}
+	for _, name := range providerNames {
+		if best, ok := matches[0].best(name); ok {
+			resolution.Links[name] = best
+		}
+	}
+
+	now := time.Now()
+	if err := resolvedLinks.SaveLink(context.WithoutCancel(ctx), key, resolution, now); err != nil {
+		loggerFrom(ctx).Warn("saving a resolved link failed", "key", key, "error", err)
+	}
+	linkCache.add(key, resolution, now, config.Cache.MaxLinks)
+
+	return resolution, true, nil
+}
+
+/*
+getLink resolves the track link in ?url= and responds with the track on every
+provider it was found on.
+*/
+func getLink(c *gin.Context) {
+	rawURL := c.Query("url")
+	if rawURL == "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "url is required"})
+		return
+	}
+
+	resolution, ok, err := resolveLink(c.Request.Context(), rawURL)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "The track's provider can't be reached right now"})
+		return
+	}
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Not a link to a track that exists"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, resolution)
+}
+
+// songPage fills the embed card for a resolved track: its title and artist in
+// the header with a button for each provider, and no track list.
+func songPage(resolution linkResolution, pageURL string) sharePage {
+	source := resolution.Source
+	description := "Song by " + source.Artist
+	if source.Album != "" {
+		description += " · " + source.Album
+	}
+
+	var urls []string
+	for _, name := range providerNames {
+		if track, ok := resolution.Links[name]; ok {
+			urls = append(urls, track.URL)
+		}
+	}
+
+	return sharePage{
+		Title:         source.Title,
+		Description:   description,
+		PageURL:       pageURL,
+		ImageURL:      artworkURL(source.ArtworkURL, shareArtworkSize),
+		PlaylistLinks: providerLinks(urls...),
+	}
+}
+
+/*
+getLinkEmbed renders the song card that oEmbed responses for /link URLs put
+in an iframe. The page is public, so it only shows tracks that have already
+been resolved through /link and never contacts a provider.
+*/
+func getLinkEmbed(c *gin.Context) {
+	resolution, _, ok, err := storedLink(c.Request.Context(), c.Query("url"))
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("getLinkEmbed failed", "url", c.Query("url"), "error", err)
+		c.String(http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	if !ok {
+		renderHTML(c, http.StatusNotFound, "embed", sharePage{NotFound: true, Title: "Song not found", Description: "This link hasn't been resolved through /link yet."})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	renderHTML(c, http.StatusOK, "embed", songPage(resolution, resolution.Source.URL))
+}
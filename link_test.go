@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseTrackURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		provider string
+		id       string
+	}{
+		{"https://open.spotify.com/track/3n3Ppam7vgaVa1iaRUc9Lp", "spotify", "3n3Ppam7vgaVa1iaRUc9Lp"},
+		{"https://open.spotify.com/intl-de/track/3n3Ppam7vgaVa1iaRUc9Lp?si=x", "spotify", "3n3Ppam7vgaVa1iaRUc9Lp"},
+		{"spotify:track:3n3Ppam7vgaVa1iaRUc9Lp", "spotify", "3n3Ppam7vgaVa1iaRUc9Lp"},
+		{"https://music.apple.com/us/album/help/1441164426?i=1441164589", "apple", "1441164589"},
+		{"https://music.apple.com/us/song/yesterday/1441164589", "apple", "1441164589"},
+		{"https://www.deezer.com/en/track/3135556", "deezer", "3135556"},
+		{"https://deezer.com/track/3135556", "deezer", "3135556"},
+		{"https://open.spotify.com/album/0PT5m6hwPRrpBwIHVnvbFX", "", ""},
+		{"https://music.apple.com/us/album/help/1441164426", "", ""},
+		{"https://www.deezer.com/en/album/302127", "", ""},
+		{"ftp://open.spotify.com/track/1", "", ""},
+		{"not a link", "", ""},
+	}
+
+	for _, test := range tests {
+		provider, id, ok := parseTrackURL(test.url)
+		if provider != test.provider || id != test.id || ok != (test.provider != "") {
+			t.Errorf("parseTrackURL(%q) = %q, %q, %v; want %q, %q", test.url, provider, id, ok, test.provider, test.id)
+		}
+	}
+}
+
+// TestLookupTrackProviderErrors checks that a provider failing is told apart
+// from a track that doesn't exist, the same way for every provider.
+func TestLookupTrackProviderErrors(t *testing.T) {
+	var status int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case status == http.StatusNotFound && strings.HasPrefix(r.URL.Path, "/deezer/"):
+			// Deezer says a track doesn't exist in a 200 response.
+			w.Write([]byte(`{"error": {"type": "DataException", "message": "no data", "code": 800}}`))
+		case status != http.StatusOK:
+			w.WriteHeader(status)
+		case strings.HasPrefix(r.URL.Path, "/spotify/"):
+			w.Write([]byte(`{"id": "1", "uri": "spotify:track:1", "name": "Yesterday", "artists": [{"name": "The Beatles"}]}`))
+		case strings.HasPrefix(r.URL.Path, "/apple/"):
+			w.Write([]byte(`{"data": [{"id": "1", "attributes": {"name": "Yesterday", "artistName": "The Beatles"}}]}`))
+		default:
+			w.Write([]byte(`{"id": 1, "title": "Yesterday", "artist": {"name": "The Beatles"}}`))
+		}
+	}))
+	defer upstream.Close()
+
+	defer func(saved Config) { config = saved }(config)
+	config.Spotify.APIBaseURL = upstream.URL + "/spotify"
+	config.Apple.APIBaseURL = upstream.URL + "/apple"
+	config.Deezer.APIBaseURL = upstream.URL + "/deezer/"
+
+	tests := []struct {
+		status  int
+		wantOK  bool
+		wantErr bool
+	}{
+		{http.StatusOK, true, false},
+		{http.StatusNotFound, false, false},
+		{http.StatusInternalServerError, false, true},
+		{http.StatusBadGateway, false, true},
+	}
+	for _, provider := range providerNames {
+		for _, test := range tests {
+			status = test.status
+			_, ok, err := lookupTrack(context.Background(), provider, "1")
+			if ok != test.wantOK || (err != nil) != test.wantErr {
+				t.Errorf("lookupTrack(%s) with status %d = %v, %v; want ok %v and error %v", provider, test.status, ok, err, test.wantOK, test.wantErr)
+			}
+		}
+	}
+}
+
+func TestLinkLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLinkLRU()
+	now := time.Now()
+	cache.add("a", linkResolution{URL: "a"}, now, 2)
+	cache.add("b", linkResolution{URL: "b"}, now, 2)
+	cache.get("a")
+	cache.add("c", linkResolution{URL: "c"}, now, 2)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, ok := cache.get(key); ok != want {
+			t.Errorf("get(%q) found %v, want %v", key, ok, want)
+		}
+	}
+
+	cache.add("c", linkResolution{URL: "c2"}, now, 2)
+	if got, _, _ := cache.get("c"); got.URL != "c2" || cache.order.Len() != 2 {
+		t.Errorf("adding c again = %q with %d entries; want c2 with 2", got.URL, cache.order.Len())
+	}
+}
+
+// TestPublicLinkEmbedsOnlyStored checks that /embed/link and /oembed answer
+// from stored resolutions and don't look up tracks that haven't been
+// resolved.
+func TestPublicLinkEmbedsOnlyStored(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(links LinkStore, cache *linkLRU) { resolvedLinks, linkCache = links, cache }(resolvedLinks, linkCache)
+	resolvedLinks = newMemoryPlaylistStore()
+	linkCache = newLinkLRU()
+	defer func(size int) { config.Cache.MaxLinks = size }(config.Cache.MaxLinks)
+	config.Cache.MaxLinks = 10
+
+	stored := "https://open.spotify.com/track/stored"
+	err := resolvedLinks.SaveLink(context.Background(), "spotify:stored", linkResolution{
+		Source: trackCandidate{Provider: "spotify", Title: "Yesterday", Artist: "The Beatles", URL: stored},
+		Links:  map[string]trackCandidate{"spotify": {Provider: "spotify", URL: stored}},
+	}, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("SaveLink: %v", err)
+	}
+
+	router := gin.New()
+	router.GET("/embed/link", getLinkEmbed)
+	router.GET("/oembed", getOEmbed)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/embed/link?url=" + url.QueryEscape(stored), http.StatusOK},
+		{"/embed/link?url=" + url.QueryEscape("https://open.spotify.com/track/unknown"), http.StatusNotFound},
+		{"/oembed?url=" + url.QueryEscape("http://example.com/link?url="+url.QueryEscape(stored)), http.StatusOK},
+		{"/oembed?url=" + url.QueryEscape("http://example.com/link?url="+url.QueryEscape("https://open.spotify.com/track/unknown")), http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if w.Code != test.want {
+			t.Errorf("GET %s = %d, want %d: %s", test.path, w.Code, test.want, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logger is the process-wide structured logger. Use loggerFrom inside request
+// handling so lines carry the request ID.
+var logger = slog.Default()
+
+// redacted replaces any secret found in a log line.
+const redacted = "[REDACTED]"
+
+var (
+	bearerPattern = regexp.MustCompile(`(?i)(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+	// JSON web tokens, such as the Apple Music developer token.
+	jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+)
+
+/*
+secretRegistry holds secret values that must never be logged: configured
+credentials and the upstream tokens currently in use. Tokens rotate, so only
+the most recent ones are kept. Configured secrets too short to redact
+wherever they appear are redacted where they are a field's value instead.
+*/
+type secretRegistry struct {
+	mu      sync.RWMutex
+	fixed   []string
+	rotated []string
+	short   []*regexp.Regexp
+}
+
+const maxRotatedSecrets = 16
+
+// minSecretLength is the shortest value redacted by exact match. Anything
+// shorter would also blank out unrelated text, such as parts of request IDs.
+const minSecretLength = 8
+
+var secrets secretRegistry
+
+/*
+shortSecretPatterns find secret as the value of a known field: a password,
+secret or token parameter, an Authorization header, or the password in a
+DSN's user:password@ part. What comes before the value is kept in group 1 and
+what ends it in group 2.
+*/
+func shortSecretPatterns(secret string) []*regexp.Regexp {
+	quoted := regexp.QuoteMeta(secret)
+
+	return []*regexp.Regexp{
+		regexp.MustCompile(`(?i)((?:password|passwd|pwd|secret|token|authorization)["']?\s*[:=]\s*["']?(?:(?:basic|bearer)\s+)?)` + quoted + `(["'&;,)}\s]|$)`),
+		regexp.MustCompile(`((?:^|[\s/"'])[^\s:/@"']*:)` + quoted + `(@)`),
+	}
+}
+
+// addFixed registers a secret that stays valid for the life of the process.
+func (r *secretRegistry) addFixed(secret string) {
+	if secret == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(secret) < minSecretLength {
+		r.short = append(r.short, shortSecretPatterns(secret)...)
+		return
+	}
+	r.fixed = append(r.fixed, secret)
+}
+
+// addRotated registers a short-lived token.
+func (r *secretRegistry) addRotated(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rotated = append(r.rotated, secret)
+	if len(r.rotated) > maxRotatedSecrets {
+		r.rotated = r.rotated[len(r.rotated)-maxRotatedSecrets:]
+	}
+}
+
+// redact removes every known secret and anything that looks like a bearer
+// token or JWT from s.
+func (r *secretRegistry) redact(s string) string {
+	r.mu.RLock()
+	for _, list := range [][]string{r.fixed, r.rotated} {
+		for _, secret := range list {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	for _, pattern := range r.short {
+		s = pattern.ReplaceAllString(s, "${1}"+redacted+"${2}")
+	}
+	r.mu.RUnlock()
+
+	s = bearerPattern.ReplaceAllString(s, "$1 "+redacted)
+	return jwtPattern.ReplaceAllString(s, redacted)
+}
+
+// sensitiveKeys are attribute names whose values are always redacted.
+var sensitiveKeys = map[string]bool{
+	"authorization": true,
+	"token":         true,
+	"access_token":  true,
+	"client_secret": true,
+	"password":      true,
+}
+
+// redactAttr is the slog ReplaceAttr hook. It sees the message as well as
+// every attribute, so nothing reaches the output unredacted.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, secrets.redact(a.Value.String()))
+	case slog.KindAny:
+		value := a.Value.Any()
+		if err, ok := value.(error); ok {
+			return slog.String(a.Key, secrets.redact(err.Error()))
+		}
+		formatted := fmt.Sprintf("%+v", value)
+		if cleaned := secrets.redact(formatted); cleaned != formatted {
+			return slog.String(a.Key, cleaned)
+		}
+	}
+
+	return a
+}
+
+// setupLogging builds the process logger from the configured level and
+// format, and routes the standard library's log package through it.
+func setupLogging(w io.Writer, level string, format string) error {
+	var slogLevel slog.Level
+	if err := slogLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("log.level: %q is not debug, info, warn or error", level)
+	}
+
+	options := &slog.HandlerOptions{
+		Level:       slogLevel,
+		ReplaceAttr: redactAttr,
+	}
+
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return fmt.Errorf("log.format: %q is not json or text", format)
+	}
+
+	logger = slog.New(handler)
+	slog.SetDefault(logger)
+
+	return nil
+}
+
+// fatal logs err and exits. It is only for startup and shutdown; request
+// handling must never exit the process.
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// contextWithRequestID returns a copy of ctx carrying id.
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID stored in ctx, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// loggerFrom returns the logger for ctx, tagged with its request ID and,
+// when tracing is on, its trace ID.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	l := logger
+	if id := requestIDFrom(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+
+	return l
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware gives every request an ID, reusing the client's
+// X-Request-ID when it is sensible, and returns it in the response.
+func requestIDMiddleware(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = newRequestID()
+	}
+
+	c.Header(requestIDHeader, id)
+	c.Request = c.Request.WithContext(contextWithRequestID(c.Request.Context(), id))
+	c.Next()
+}
+
+// accessLogMiddleware writes one structured line per request. The query
+// string is left out, since it can contain search terms and tokens.
+func accessLogMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	level := slog.LevelInfo
+	if c.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+	attrs := []any{
+		"method", c.Request.Method,
+		"route", c.FullPath(),
+		"status", c.Writer.Status(),
+		"duration_ms", time.Since(start).Milliseconds(),
+		"client_ip", c.ClientIP(),
+	}
+	if keyID := c.GetString("api_key_id"); keyID != "" {
+		attrs = append(attrs, "api_key_id", keyID)
+	}
+	loggerFrom(c.Request.Context()).Log(c.Request.Context(), level, "request", attrs...)
+}
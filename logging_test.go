@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestRedactShortSecret(t *testing.T) {
+	var r secretRegistry
+	r.addFixed("pw1")
+	r.addFixed("a-longer-secret")
+
+	for _, test := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"mysql DSN", "root:pw1@tcp(127.0.0.1:3306)/polyphonic", "root:[REDACTED]@tcp(127.0.0.1:3306)/polyphonic"},
+		{"postgres URL", "dial postgres://app:pw1@db:5432/app failed", "dial postgres://app:[REDACTED]@db:5432/app failed"},
+		{"parameter", "client_secret=pw1&grant_type=client_credentials", "client_secret=[REDACTED]&grant_type=client_credentials"},
+		{"JSON field", `{"password": "pw1"}`, `{"password": "[REDACTED]"}`},
+		{"basic auth", "Authorization: Basic pw1", "Authorization: Basic [REDACTED]"},
+		{"long secret anywhere", "it was a-longer-secret!", "it was [REDACTED]!"},
+		{"short secret in other text", "request pw1xyz used pw1 spw1", "request pw1xyz used pw1 spw1"},
+		{"short secret after another colon", "retry: pw1 left", "retry: pw1 left"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := r.redact(test.in); got != test.want {
+				t.Errorf("redact(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
@@ -1,24 +1,25 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/x509"
-	"database/sql"
 	"encoding/pem"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-sql-driver/mysql"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var db *sql.DB
+var store PlaylistStore
 
 var authSpotifyExp = time.Now().Unix() - 10 // initialize spotify auth time to be something that must be replaced
 var authSpotifyKey string
@@ -37,11 +38,11 @@ var (
 	appleMusicKeyMu  sync.Mutex
 )
 
-var (
-	appleTeamID  = os.Getenv("APPLE_TEAM_ID")
-	appleKeyID   = os.Getenv("APPLE_KEY_ID")
-	appleKeyPath = os.Getenv("APPLE_P8_PATH")
-)
+// config is loaded once at startup by main.
+var config Config
+
+// lifecycle tracks background jobs and cleanup for graceful shutdown.
+var lifecycle = newServerLifecycle()
 
 type playlist struct {
 	ID          string `json:"id"`
@@ -68,6 +69,9 @@ type playlist_content struct {
 	ConvertURL  string `json:"converted_url"`
 	Confidence  int    `json:"confidence"`
 	TrackNum    int    `json:"track_num"`
+	// ArtworkURL is optional; it is left out of JSON when empty so uploads
+	// made before it existed still hash the same for idempotency.
+	ArtworkURL string `json:"artwork_url,omitempty"`
 }
 
 type playlist_data struct {
@@ -106,7 +110,7 @@ func loadApplePrivateKey(path string) (*ecdsa.PrivateKey, error) {
 }
 
 func generateAppleMusicToken() (string, int64, error) {
-	privateKey, err := loadApplePrivateKey(appleKeyPath)
+	privateKey, err := loadApplePrivateKey(config.Apple.PrivateKeyPath)
 	if err != nil {
 		return "", 0, err
 	}
@@ -115,13 +119,13 @@ func generateAppleMusicToken() (string, int64, error) {
 	exp := now.Add(20 * time.Minute)
 
 	claims := jwt.RegisteredClaims{
-		Issuer:    appleTeamID,
+		Issuer:    config.Apple.TeamID,
 		IssuedAt:  jwt.NewNumericDate(now),
 		ExpiresAt: jwt.NewNumericDate(exp),
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
-	token.Header["kid"] = appleKeyID
+	token.Header["kid"] = config.Apple.KeyID
 
 	signed, err := token.SignedString(privateKey)
 	if err != nil {
@@ -138,11 +142,13 @@ func checkAppleMusicAuth() error {
 	// Refresh if expiring in 30s
 	if time.Now().Unix() > appleMusicKeyExp-30 {
 		token, exp, err := generateAppleMusicToken()
+		countTokenRefresh("apple", err)
 		if err != nil {
-			log.Println("apple auth: failed to generate token:", err)
+			logger.Error("Apple auth: failed to generate developer token", "error", err)
 			return err
 		}
 
+		secrets.addRotated(token)
 		appleMusicKey = token
 		appleMusicKeyExp = exp
 	}
@@ -150,152 +156,131 @@ func checkAppleMusicAuth() error {
 	return nil
 }
 
+// currentAppleMusicKey returns the developer token checkAppleMusicAuth last
+// made.
+func currentAppleMusicKey() string {
+	appleMusicKeyMu.Lock()
+	defer appleMusicKeyMu.Unlock()
+
+	return appleMusicKey
+}
+
+// expireAppleMusicKey makes the next checkAppleMusicAuth generate a new
+// developer token, after Apple rejected the current one.
+func expireAppleMusicKey() {
+	appleMusicKeyMu.Lock()
+	defer appleMusicKeyMu.Unlock()
+
+	appleMusicKeyExp = 0
+}
+
 // getPlaylistByID locates the playlist whose ID value matches the id
 // parameter sent by the client, then returns that playlist as a response.
 func getPlaylistByID(c *gin.Context) {
 	id := c.Param("id")
 
-	// Playlist related structs to hold data from the returned data.
-	var playlistData playlist_data
-	var playlist playlist
-	var contents []playlist_content
-
-	playlistsRow := db.QueryRow("SELECT * FROM playlists WHERE id = ?", id)
-	if err := playlistsRow.Scan(
-		&playlist.ID,
-		&playlist.Name,
-		&playlist.Creator,
-		&playlist.SongCount,
-		&playlist.Platform,
-		&playlist.OriginalURL,
-		&playlist.Converted); err != nil {
-
-		log.Println(fmt.Errorf("playlistsById %v", err))
-		if err == sql.ErrNoRows {
+	playlistData, err := store.GetPlaylist(c.Request.Context(), id)
+	if err != nil {
+		if err == errPlaylistNotFound {
 			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "There is no such playlist"})
 			return
 		}
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Error getting playlist by ID"})
-	}
-
-	rows, err := db.Query("SELECT * FROM playlist_content WHERE id = ? ORDER BY playlist_track_num ASC", id)
-	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Error getting playlist content"})
-	}
-	defer rows.Close()
-	// Loop through rows, using Scan to assign column data to struct fields.
-	for rows.Next() {
-		var content playlist_content
-		if err := rows.Scan(
-			&content.ID,
-			&content.KeyID,
-			&content.Title,
-			&content.PTrackNum,
-			&content.ISRC,
-			&content.Artist,
-			&content.Album,
-			&content.AlbumID,
-			&content.Explicit,
-			&content.OriginalURL,
-			&content.ConvertURL,
-			&content.Confidence,
-			&content.TrackNum); err != nil {
-
-			log.Println(fmt.Errorf("playlistsById %v", err))
-			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Error getting playlist by ID"})
-		}
-
-		contents = append(contents, content)
-	}
-	if err := rows.Err(); err != nil {
-		log.Println(fmt.Errorf("playlistsById %v", err))
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Error getting playlist by ID"})
+		loggerFrom(c.Request.Context()).Error("getPlaylistByID failed", "id", id, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error getting playlist by ID"})
+		return
 	}
 
-	playlistData.ID = playlist.ID
-	playlistData.Name = playlist.Name
-	playlistData.Creator = playlist.Creator
-	playlistData.SongCount = playlist.SongCount
-	playlistData.Platform = playlist.Platform
-	playlistData.OriginalURL = playlist.OriginalURL
-	playlistData.Converted = playlist.Converted
-	playlistData.Content = contents
-
 	c.IndentedJSON(http.StatusOK, playlistData)
-
 }
 
-// postPlaylists adds a playlist from JSON received in the request body.
+/*
+postPlaylists adds a playlist from JSON received in the request body.
+
+Clients may send an Idempotency-Key header. Repeating a request with the same
+key returns the playlist that was created the first time instead of storing it
+again.
+*/
 func postPlaylists(c *gin.Context) {
 	var newPlaylistData playlist_data
 
-	// Call BindJSON to bind the received JSON to
-	// newPlaylistData.
-	if err := c.BindJSON(&newPlaylistData); err != nil {
+	// Check the body against the Playlist schema in the OpenAPI document,
+	// then bind it to newPlaylistData.
+	if !bindValidJSON(c, "Playlist", &newPlaylistData) {
+		return
+	}
+	// Content rows are filed under their own id, so one naming another
+	// playlist would add tracks to it.
+	var problems []string
+	for i, content := range newPlaylistData.Content {
+		if content.ID != newPlaylistData.ID {
+			problems = append(problems, fmt.Sprintf("content[%d].id: must equal the playlist's id", i))
+		}
+	}
+	if len(problems) > 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": "Playlist content belongs to a different playlist",
+			"errors":  problems,
+		})
 		return
 	}
 
-	// TODO: check to see if ID already exists
-
-	// Add the new album to the database.
-	_, err := db.Exec("INSERT INTO playlists (id, name, creator, song_count, platform, original_url, converted) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		newPlaylistData.ID,
-		newPlaylistData.Name,
-		newPlaylistData.Creator,
-		newPlaylistData.SongCount,
-		newPlaylistData.Platform,
-		newPlaylistData.OriginalURL,
-		newPlaylistData.Converted)
-
-	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Error adding a new playlist (1)"})
-	}
-
-	for _, content := range newPlaylistData.Content {
-		_, err := db.Exec("INSERT INTO playlist_content (id, key_id, title, playlist_track_num, isrc, artist, album, album_id, explicit, original_url, converted_url, confidence, track_num) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-			content.ID,
-			content.KeyID,
-			content.Title,
-			content.PTrackNum,
-			content.ISRC,
-			content.Artist,
-			content.Album,
-			content.AlbumID,
-			content.Explicit,
-			content.OriginalURL,
-			content.ConvertURL,
-			content.Confidence,
-			content.TrackNum)
+	idempotencyKey := c.GetHeader("Idempotency-Key")
 
-		if err != nil {
-			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Error adding a new playlist (2)"})
-		}
+	playlistData, replayed, err := store.CreatePlaylist(c.Request.Context(), newPlaylistData, idempotencyKey)
+	switch {
+	case err == errPlaylistExists:
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "A playlist with this ID already exists"})
+		return
+	case err == errIdempotencyKeyReused:
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Idempotency-Key was already used for a different playlist"})
+		return
+	case err != nil:
+		loggerFrom(c.Request.Context()).Error("postPlaylists failed", "id", newPlaylistData.ID, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error adding a new playlist"})
+		return
 	}
 
-	c.IndentedJSON(http.StatusCreated, newPlaylistData)
+	if replayed {
+		c.Header("Idempotent-Replayed", "true")
+	}
+	c.IndentedJSON(http.StatusCreated, playlistData)
 }
 
+var authSpotifyMu sync.Mutex
+
 /*
 checkSpotifyAuth checks to see if the Spotify authorization code is within
 30 seconds of expiring. If it is going to expire, it will get a new code.
 When a new code is received, the expiration date is updated.
 */
-func checkSpotifyAuth() {
-	var expIn int64
+func checkSpotifyAuth(ctx context.Context) error {
+	authSpotifyMu.Lock()
+	defer authSpotifyMu.Unlock()
 
 	// check that there is more than 30 seconds left before key expiration
 	if time.Now().Unix() > authSpotifyExp-30 {
-		fmt.Println("Getting another API key from Spotify")
-		key := make(chan string)
-		exp := make(chan int64)
-		go getSpotifyAuthKey(&sWait, key, exp)
+		loggerFrom(ctx).Info("Spotify: getting another API key")
+		key, expIn, err := getSpotifyAuthKey(ctx, &sWait)
+		countTokenRefresh("spotify", err)
+		if err != nil {
+			loggerFrom(ctx).Error("Spotify auth: failed to get token", "error", err)
+			return err
+		}
 
-		authSpotifyKey = <-key
-		expIn = <-exp
+		secrets.addRotated(key)
+		authSpotifyKey = key
 		authSpotifyExp = time.Now().Unix() + expIn
 	}
 
-	// fmt.Println(authSpotifyKey)
+	return nil
+}
+
+// currentSpotifyKey returns the API key checkSpotifyAuth last fetched.
+func currentSpotifyKey() string {
+	authSpotifyMu.Lock()
+	defer authSpotifyMu.Unlock()
+
+	return authSpotifyKey
 }
 
 /*
@@ -306,15 +291,19 @@ for translation.
 func polyphonicGetSpotifySongByID(c *gin.Context) {
 	id := c.Param("id")
 
-	checkSpotifyAuth()
+	if err := checkSpotifyAuth(c.Request.Context()); err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": "Spotify authentication unavailable",
+		})
+		return
+	}
 
 	/* Get song by ID */
 	spotifySongChan := make(chan SpotifySong)
-	go getSpotifySongByID(&sWait, id, authSpotifyKey, spotifySongChan)
+	go getSpotifySongByID(c.Request.Context(), &sWait, id, currentSpotifyKey(), spotifySongChan)
 
 	spotifySong := <-spotifySongChan
-	fmt.Println(spotifySong)
-	fmt.Println("Song title:", spotifySong.Name, "by", spotifySong.Artists[0].Name)
+	loggerFrom(c.Request.Context()).Debug("Spotify song", "id", id, "title", spotifySong.Name)
 	/* Get song by ID */
 
 	c.IndentedJSON(http.StatusOK, spotifySong)
@@ -330,16 +319,21 @@ Format of terms: "track:[track title] artist:[artist name]"
 func polyphonicGetSpotifySongsBySearch(c *gin.Context) {
 	terms := c.Param("terms")
 
-	checkSpotifyAuth()
+	if err := checkSpotifyAuth(c.Request.Context()); err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": "Spotify authentication unavailable",
+		})
+		return
+	}
 
 	/* Get song by search */
 	spotifySongSearchChan := make(chan SpotifySongSearch)
 
 	params := url.QueryEscape(terms) + "&type=track"
-	go getSpotifySongsBySearch(&sWait, params, authSpotifyKey, spotifySongSearchChan)
+	go getSpotifySongsBySearch(c.Request.Context(), &sWait, params, currentSpotifyKey(), spotifySongSearchChan)
 
 	spotifySongSearch := <-spotifySongSearchChan
-	fmt.Println("First song title:", spotifySongSearch.Tracks.Items[0].Name, "by", spotifySongSearch.Tracks.Items[0].Artists[0])
+	loggerFrom(c.Request.Context()).Debug("Spotify song search", "results", len(spotifySongSearch.Tracks.Items))
 	/* Get song by search */
 
 	c.IndentedJSON(http.StatusOK, spotifySongSearch)
@@ -353,14 +347,19 @@ for translation.
 func polyphonicGetSpotifyAlbumByID(c *gin.Context) {
 	id := c.Param("id")
 
-	checkSpotifyAuth()
+	if err := checkSpotifyAuth(c.Request.Context()); err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": "Spotify authentication unavailable",
+		})
+		return
+	}
 
 	/* Get album by ID */
 	spotifyAlbumChan := make(chan SpotifyAlbum)
-	go getSpotifyAlbumByID(&sWait, id, authSpotifyKey, spotifyAlbumChan)
+	go getSpotifyAlbumByID(c.Request.Context(), &sWait, id, currentSpotifyKey(), spotifyAlbumChan)
 
 	spotifyAlbum := <-spotifyAlbumChan
-	fmt.Println("Album title:", spotifyAlbum.Name, "by", spotifyAlbum.Artists[0].Name)
+	loggerFrom(c.Request.Context()).Debug("Spotify album", "id", id, "title", spotifyAlbum.Name)
 	/* Get album by ID */
 
 	c.IndentedJSON(http.StatusOK, spotifyAlbum)
@@ -374,14 +373,19 @@ for translation.
 func polyphonicGetSpotifyArtistByID(c *gin.Context) {
 	id := c.Param("id")
 
-	checkSpotifyAuth()
+	if err := checkSpotifyAuth(c.Request.Context()); err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": "Spotify authentication unavailable",
+		})
+		return
+	}
 
 	/* Get artist by ID */
 	spotifyArtistChan := make(chan SpotifyArtist)
-	go getSpotifyArtistByID(&sWait, id, authSpotifyKey, spotifyArtistChan)
+	go getSpotifyArtistByID(c.Request.Context(), &sWait, id, currentSpotifyKey(), spotifyArtistChan)
 
 	spotifyArtist := <-spotifyArtistChan
-	fmt.Println("Artist name:", spotifyArtist.Name)
+	loggerFrom(c.Request.Context()).Debug("Spotify artist", "id", id, "name", spotifyArtist.Name)
 	/* Get artist by ID */
 
 	c.IndentedJSON(http.StatusOK, spotifyArtist)
@@ -397,36 +401,37 @@ Format of terms: "[artist name]"
 func polyphonicGetSpotifyArtistBySearch(c *gin.Context) {
 	terms := c.Param("terms")
 
-	checkSpotifyAuth()
+	if err := checkSpotifyAuth(c.Request.Context()); err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": "Spotify authentication unavailable",
+		})
+		return
+	}
 
 	/* Get artist by search */
 	spotifyArtistSearchChan := make(chan SpotifyArtistSearch)
 
 	params := url.QueryEscape(terms) + "&type=artist"
-	go getSpotifyArtistsBySearch(&sWait, params, authSpotifyKey, spotifyArtistSearchChan)
+	go getSpotifyArtistsBySearch(c.Request.Context(), &sWait, params, currentSpotifyKey(), spotifyArtistSearchChan)
 
 	spotifyArtistSearch := <-spotifyArtistSearchChan
-	fmt.Println("First artist name:", spotifyArtistSearch.Artists.Items[0].Name)
+	loggerFrom(c.Request.Context()).Debug("Spotify artist search", "results", len(spotifyArtistSearch.Artists.Items))
 	/* Get artist by search */
 
 	c.IndentedJSON(http.StatusOK, spotifyArtistSearch)
 }
 
 /*
-polyphonicGetSpotifyPlaylistByID gets a Spotify playlist's data from the
-Spotify API using the playlist's ID and then responds with only the required
-data for translation.
+fetchSpotifyPlaylist gets a Spotify playlist with every page of its tracks.
+The caller must have checked Spotify authentication. A playlist that doesn't
+exist is returned empty; any failed request, including one for a later page,
+is an error rather than a shorter playlist.
 */
-func polyphonicGetSpotifyPlaylistByID(c *gin.Context) {
-	id := c.Param("id")
-
-	checkSpotifyAuth()
-
-	/* Get Playlist by ID */
-	spotifyPlaylistChan := make(chan SpotifyPlaylist)
-	go getSpotifyPlaylistByID(&sWait, id, authSpotifyKey, spotifyPlaylistChan)
-
-	spotifyPlayist := <-spotifyPlaylistChan
+func fetchSpotifyPlaylist(ctx context.Context, id string) (SpotifyPlaylist, error) {
+	spotifyPlayist, err := getSpotifyPlaylistByID(ctx, &sWait, id, currentSpotifyKey())
+	if err != nil {
+		return SpotifyPlaylist{}, err
+	}
 
 	var next = "Had more to get"
 	if spotifyPlayist.Tracks.Next == nil {
@@ -436,16 +441,15 @@ func polyphonicGetSpotifyPlaylistByID(c *gin.Context) {
 		var nextURL string = *spotifyPlayist.Tracks.Next
 
 		for getMore {
-			nextSpotifyPlaylistTracksChan := make(chan Tracks)
-			go getNextSpotifyPlaylist(&sWait, nextURL, authSpotifyKey, nextSpotifyPlaylistTracksChan)
-
-			nextSpotifyPlaylistTracks := <-nextSpotifyPlaylistTracksChan
-			fmt.Println("tracks from next section:", len(nextSpotifyPlaylistTracks.Items))
+			nextSpotifyPlaylistTracks, err := getNextSpotifyPlaylist(ctx, &sWait, nextURL, currentSpotifyKey())
+			if err != nil {
+				return SpotifyPlaylist{}, err
+			}
+			loggerFrom(ctx).Debug("Spotify playlist page", "tracks", len(nextSpotifyPlaylistTracks.Items))
 
 			spotifyPlayist.Tracks.Items = append(spotifyPlayist.Tracks.Items, nextSpotifyPlaylistTracks.Items...)
 
 			if nextSpotifyPlaylistTracks.Next == nil {
-				fmt.Println("done")
 				getMore = false
 			} else {
 				nextURL = *nextSpotifyPlaylistTracks.Next
@@ -453,8 +457,37 @@ func polyphonicGetSpotifyPlaylistByID(c *gin.Context) {
 		}
 	}
 
-	fmt.Println("Playlist name:", spotifyPlayist.Name, "track count:", len(spotifyPlayist.Tracks.Items),
-		"next?", next)
+	loggerFrom(ctx).Debug("Spotify playlist", "id", id, "name", spotifyPlayist.Name,
+		"tracks", len(spotifyPlayist.Tracks.Items), "next", next)
+
+	return spotifyPlayist, nil
+}
+
+/*
+polyphonicGetSpotifyPlaylistByID gets a Spotify playlist's data from the
+Spotify API using the playlist's ID and then responds with only the required
+data for translation.
+*/
+func polyphonicGetSpotifyPlaylistByID(c *gin.Context) {
+	id := c.Param("id")
+
+	if err := checkSpotifyAuth(c.Request.Context()); err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": "Spotify authentication unavailable",
+		})
+		return
+	}
+
+	/* Get Playlist by ID */
+	spotifyPlayist, err := fetchSpotifyPlaylist(c.Request.Context(), id)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Error reading the playlist from Spotify"})
+		return
+	}
+	if spotifyPlayist.ID == "" {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Playlist not found"})
+		return
+	}
 	/* Get Playlist by ID */
 
 	c.IndentedJSON(http.StatusOK, spotifyPlayist)
@@ -476,10 +509,10 @@ func polyphonicGetAppleSongByID(c *gin.Context) {
 		})
 		return
 	}
-	go getAppleMusicSongByID(&aWait, id, appleMusicKey, appleMusicSongChan)
+	go getAppleMusicSongByID(c.Request.Context(), &aWait, id, currentAppleMusicKey(), appleMusicSongChan)
 
 	appleMusicSong := <-appleMusicSongChan
-	fmt.Println("Song title:", appleMusicSong.Data[0].Attributes.Name, "by", appleMusicSong.Data[0].Attributes.ArtistName)
+	loggerFrom(c.Request.Context()).Debug("Apple song", "id", id, "results", len(appleMusicSong.Data))
 	/* Get song by ID */
 
 	c.IndentedJSON(http.StatusOK, appleMusicSong)
@@ -504,10 +537,10 @@ func polyphonicGetAppleSongsBySearch(c *gin.Context) {
 		})
 		return
 	}
-	go getAppleMusicSongsBySearch(&aWait, terms, appleMusicKey, appleMusicSongSearchChan)
+	go getAppleMusicSongsBySearch(c.Request.Context(), &aWait, terms, currentAppleMusicKey(), appleMusicSongSearchChan)
 
 	appleMusicSongSearch := <-appleMusicSongSearchChan
-	fmt.Println("First Song title:", appleMusicSongSearch.Results.Songs.Data[0].Attributes.Name, "by", appleMusicSongSearch.Results.Songs.Data[0].Attributes.ArtistName)
+	loggerFrom(c.Request.Context()).Debug("Apple song search", "results", len(appleMusicSongSearch.Results.Songs.Data))
 
 	/* Get song by search */
 
@@ -530,10 +563,10 @@ func polyphonicGetAppleAlbumByID(c *gin.Context) {
 		})
 		return
 	}
-	go getAppleMusicAlbumByID(&aWait, id, appleMusicKey, appleMusicAlbumChan)
+	go getAppleMusicAlbumByID(c.Request.Context(), &aWait, id, currentAppleMusicKey(), appleMusicAlbumChan)
 
 	appleMusicAlbum := <-appleMusicAlbumChan
-	fmt.Println("Album title:", appleMusicAlbum.Data[0].Attributes.Name, "by", appleMusicAlbum.Data[0].Attributes.ArtistName)
+	loggerFrom(c.Request.Context()).Debug("Apple album", "id", id, "results", len(appleMusicAlbum.Data))
 	/* Get album by ID */
 
 	c.IndentedJSON(http.StatusOK, appleMusicAlbum)
@@ -555,10 +588,10 @@ func polyphonicGetAppleArtistByID(c *gin.Context) {
 		})
 		return
 	}
-	go getAppleMusicArtistByID(&aWait, id, appleMusicKey, appleMusicArtistChan)
+	go getAppleMusicArtistByID(c.Request.Context(), &aWait, id, currentAppleMusicKey(), appleMusicArtistChan)
 
 	appleMusicArtist := <-appleMusicArtistChan
-	fmt.Println("Artist name:", appleMusicArtist.Data[0].Attributes.Name)
+	loggerFrom(c.Request.Context()).Debug("Apple artist", "id", id, "results", len(appleMusicArtist.Data))
 	/* Get artist by ID */
 
 	c.IndentedJSON(http.StatusOK, appleMusicArtist)
@@ -584,34 +617,29 @@ func polyphonicGetAppleArtistBySearch(c *gin.Context) {
 		})
 		return
 	}
-	go getAppleMusicArtistsBySearch(&aWait, params, appleMusicKey, appleMusicArtistSearchChan)
+	go getAppleMusicArtistsBySearch(c.Request.Context(), &aWait, params, currentAppleMusicKey(), appleMusicArtistSearchChan)
 
 	appleMusicArtistSearch := <-appleMusicArtistSearchChan
-	fmt.Println("First artist name:", appleMusicArtistSearch.Results.Artists.Data[0].Attributes.Name)
+	loggerFrom(c.Request.Context()).Debug("Apple artist search", "results", len(appleMusicArtistSearch.Results.Artists.Data))
 	/* Get Artist by search */
 
 	c.IndentedJSON(http.StatusOK, appleMusicArtistSearch)
 }
 
 /*
-polyphonicGetApplePlaylistByID gets an Apple Music playlist's data from the
-Apple Music API using the playlist's ID and then responds with only the
-required data for translation.
+fetchApplePlaylist gets an Apple Music playlist with every page of its tracks.
+The caller must have checked Apple Music authentication. It reports false when
+the playlist doesn't exist; any failed request, including one for a later
+page, is an error rather than a shorter playlist.
 */
-func polyphonicGetApplePlaylistByID(c *gin.Context) {
-	id := c.Param("id")
-
-	/* Get Playlist by ID */
-	appleMusicPlaylistChan := make(chan AppleMusicPlaylist)
-	if err := checkAppleMusicAuth(); err != nil {
-		c.IndentedJSON(http.StatusBadGateway, gin.H{
-			"error": "Apple Music authentication unavailable",
-		})
-		return
+func fetchApplePlaylist(ctx context.Context, id string) (AppleMusicPlaylist, bool, error) {
+	appleMusicPlaylist, err := getAppleMusicPlaylistByID(ctx, &aWait, id, currentAppleMusicKey())
+	if err != nil {
+		return AppleMusicPlaylist{}, false, err
+	}
+	if len(appleMusicPlaylist.Data) == 0 {
+		return appleMusicPlaylist, false, nil
 	}
-	go getAppleMusicPlaylistByID(&aWait, id, appleMusicKey, appleMusicPlaylistChan)
-
-	appleMusicPlaylist := <-appleMusicPlaylistChan
 
 	next := "Had more to get"
 	if appleMusicPlaylist.Data[0].Relationships.Tracks.Next == nil {
@@ -621,17 +649,16 @@ func polyphonicGetApplePlaylistByID(c *gin.Context) {
 		var nextURL string = *appleMusicPlaylist.Data[0].Relationships.Tracks.Next
 
 		for getMore {
-			nextAppleMusicPlaylistTracksChan := make(chan AppleMusicPlaylistTracks)
-			go getNextAppleMusicPlaylist(&aWait, nextURL, appleMusicKey, nextAppleMusicPlaylistTracksChan)
-
-			nextAppleMusicPlaylistTracks := <-nextAppleMusicPlaylistTracksChan
-			fmt.Println("tracks from next section:", len(nextAppleMusicPlaylistTracks.Data))
+			nextAppleMusicPlaylistTracks, err := getNextAppleMusicPlaylist(ctx, &aWait, nextURL, currentAppleMusicKey())
+			if err != nil {
+				return AppleMusicPlaylist{}, false, err
+			}
+			loggerFrom(ctx).Debug("Apple playlist page", "tracks", len(nextAppleMusicPlaylistTracks.Data))
 
 			appleMusicPlaylist.Data[0].Relationships.Tracks.Data = append(
 				appleMusicPlaylist.Data[0].Relationships.Tracks.Data, nextAppleMusicPlaylistTracks.Data...)
 
 			if nextAppleMusicPlaylistTracks.Next == nil {
-				fmt.Println("done")
 				getMore = false
 			} else {
 				nextURL = *nextAppleMusicPlaylistTracks.Next
@@ -639,40 +666,218 @@ func polyphonicGetApplePlaylistByID(c *gin.Context) {
 		}
 	}
 
-	fmt.Println("Playlist name:", appleMusicPlaylist.Data[0].Attributes.Name, "track count:", len(appleMusicPlaylist.Data[0].Relationships.Tracks.Data),
-		"next?", next)
+	loggerFrom(ctx).Debug("Apple playlist", "id", id, "next", next)
+
+	return appleMusicPlaylist, true, nil
+}
+
+/*
+polyphonicGetApplePlaylistByID gets an Apple Music playlist's data from the
+Apple Music API using the playlist's ID and then responds with only the
+required data for translation.
+*/
+func polyphonicGetApplePlaylistByID(c *gin.Context) {
+	id := c.Param("id")
+
+	if err := checkAppleMusicAuth(); err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{
+			"error": "Apple Music authentication unavailable",
+		})
+		return
+	}
+
+	/* Get Playlist by ID */
+	appleMusicPlaylist, ok, err := fetchApplePlaylist(c.Request.Context(), id)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Error reading the playlist from Apple Music"})
+		return
+	}
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Playlist not found"})
+		return
+	}
+	/* Get Playlist by ID */
 
 	c.IndentedJSON(http.StatusOK, appleMusicPlaylist)
 }
 
 func main() {
-	// Capture connection properties.
-	cfg := mysql.Config{
-		User:   "root",
-		Passwd: os.Getenv("DBPASS"),
-		Net:    "tcp",
-		// Addr:   "docker.for.mac.host.internal:3306",
-		Addr:   "127.0.0.1:3306",
-		DBName: "polyphonic",
+	var args []string
+	var err error
+	config, args, err = loadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fatal("loading configuration failed", err)
+	}
+
+	migrating := len(args) > 0 && args[0] == "migrate"
+	if err := config.validate(!migrating); err != nil {
+		fatal("invalid configuration", err)
+	}
+	if err := setupLogging(os.Stderr, config.Log.Level, config.Log.Format); err != nil {
+		fatal("invalid configuration", err)
+	}
+	shutdownTracing, err := setupTracing(context.Background(), config.Tracing)
+	if err != nil {
+		fatal("setting up tracing failed", err)
+	}
+	// Hooks run in reverse, so this flushes after the database closes and
+	// spans from the last queries are kept.
+	lifecycle.OnShutdown("tracing", shutdownTracing)
+	secrets.addFixed(config.Spotify.ClientSecret)
+	secrets.addFixed(config.Database.Password)
+	secrets.addFixed(config.Database.DSN)
+	secrets.addFixed(config.Auth.AdminToken)
+
+	apiSpec, err = loadAPISpec()
+	if err != nil {
+		fatal("startup failed", err)
 	}
 
 	// Get a database handle.
-	var err error
-	db, err = sql.Open("mysql", cfg.FormatDSN())
+	driver := config.databaseDriver()
+	store, err = openPlaylistStore(driver, config.databaseDSN())
 	if err != nil {
-		log.Fatal(err)
+		fatal("startup failed", err)
 	}
 
-	pingErr := db.Ping()
+	ctx := context.Background()
+	pingErr := store.Ping(ctx)
 	if pingErr != nil {
-		log.Fatal(pingErr)
+		fatal("connecting to database failed", pingErr)
+	}
+	logger.Info("Connected to database", "driver", driver)
+	lifecycle.OnShutdown("database", func(context.Context) error {
+		return store.Close()
+	})
+
+	// Only SQL stores have a schema to migrate.
+	sqlStore, hasSchema := store.(*sqlPlaylistStore)
+	if migrating {
+		if !hasSchema {
+			fatal("migrate", fmt.Errorf("the %s store has no schema to migrate", driver))
+		}
+		schema, err := sqlStore.migrator()
+		if err != nil {
+			fatal("startup failed", err)
+		}
+		if err := runMigrateCommand(ctx, schema, args[1:], os.Stdout); err != nil {
+			fatal("startup failed", err)
+		}
+		return
+	}
+	if len(args) > 0 {
+		fatal("invalid arguments", fmt.Errorf("unknown command %q", args[0]))
+	}
+
+	if hasSchema {
+		schema, err := sqlStore.migrator()
+		if err != nil {
+			fatal("startup failed", err)
+		}
+		if config.Database.AutoMigrate {
+			if err := schema.Up(ctx, os.Stdout); err != nil {
+				fatal("startup failed", err)
+			}
+		}
+		if err := schema.CheckCurrent(ctx); err != nil {
+			fatal("startup failed", err)
+		}
+	}
+
+	// Record store latency from here on; migrations above need the
+	// concrete SQL store.
+	keyStore, ok := store.(APIKeyStore)
+	if !ok {
+		fatal("startup failed", fmt.Errorf("the %s store cannot hold API keys", driver))
+	}
+	sessionStore, ok := store.(SessionStore)
+	if !ok {
+		fatal("startup failed", fmt.Errorf("the %s store cannot hold user sessions", driver))
+	}
+	migrationStore, ok := store.(MigrationStore)
+	if !ok {
+		fatal("startup failed", fmt.Errorf("the %s store cannot hold library migrations", driver))
+	}
+	linkStore, ok := store.(LinkStore)
+	if !ok {
+		fatal("startup failed", fmt.Errorf("the %s store cannot hold resolved links", driver))
+	}
+	observer := storeObserver{system: driver}
+	keys := newAPIKeyAuth(instrumentedAPIKeyStore{keyStore, observer}, config.Auth.RequireAPIKey)
+	sealedSessions, err := newSealedSessionStore(instrumentedSessionStore{sessionStore, observer}, config.Auth.TokenKey)
+	if err != nil {
+		fatal("startup failed", err)
 	}
-	fmt.Println("Connected!")
+	sessions = sealedSessions
+	migrationJobs = instrumentedMigrationStore{migrationStore, observer}
+	resolvedLinks = instrumentedLinkStore{linkStore, observer}
+	store = instrumentedStore{store, observer}
 
-	router := gin.Default()
+	if config.Server.Release {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	router := gin.New()
+	router.Use(gin.Recovery(), requestIDMiddleware, tracingMiddleware, accessLogMiddleware, metricsMiddleware, keys.middleware)
+
+	// Operational routes move to their own listener when one is configured,
+	// so they can be firewalled or put behind mutual TLS on their own.
+	adminRouter := router
+	if config.Server.AdminListenAddr != "" {
+		adminRouter = gin.New()
+		adminRouter.Use(gin.Recovery(), requestIDMiddleware, tracingMiddleware, accessLogMiddleware, metricsMiddleware)
+	}
+
+	readiness := newReadinessChecker(config.Health.CacheTTL, config.Health.Timeout)
+	router.GET("/healthz", getHealthz)
+	adminRouter.GET("/readyz", readiness.getReadyz)
+	adminRouter.GET("/metrics", getMetrics)
+	router.GET("/openapi.json", getOpenAPI)
+	router.GET("/docs", getDocs)
+
+	if config.Auth.AdminToken != "" {
+		admin := adminRouter.Group("/admin", adminMiddleware(config.Auth.AdminToken))
+		admin.POST("/keys", keys.postAPIKey)
+		admin.GET("/keys", keys.getAPIKeys)
+		admin.GET("/keys/:id", keys.getAPIKey)
+		admin.DELETE("/keys/:id", keys.deleteAPIKey)
+	}
+
+	router.GET("/p/:id", getSharePage)
+	router.GET("/embed/p/:id", getEmbed)
+	router.GET("/embed/link", getLinkEmbed)
+	router.GET("/link", getLink)
+	router.GET("/oembed", getOEmbed)
+	router.GET("/.well-known/apple-app-site-association", getAppleAppSiteAssociation)
+
+	router.GET("/auth/session", getSession)
+	router.DELETE("/auth/session", deleteSession)
+	router.POST("/auth/spotify/login", postSpotifyLogin)
+	router.GET("/auth/spotify/callback", getSpotifyCallback)
+	router.DELETE("/auth/spotify", deleteProviderAccount("spotify"))
+	router.POST("/auth/apple", postAppleLogin)
+	router.DELETE("/auth/apple", deleteProviderAccount("apple"))
+	router.GET("/me/spotify/playlists", getSpotifyUserPlaylists)
+	router.POST("/me/spotify/playlists/:id/import", postSpotifyUserImport)
+	router.GET("/me/apple/playlists", getAppleUserPlaylists)
+	router.POST("/me/apple/playlists/:id/import", postAppleUserImport)
+	router.GET("/migrations", getMigrations)
+	router.POST("/migrations", postMigration)
+	router.GET("/migrations/:id", getMigration)
+	router.DELETE("/migrations/:id", deleteMigration)
+	router.POST("/migrations/:id/resume", postMigrationResume)
 
 	router.GET("/playlist/:id", getPlaylistByID)
+	router.GET("/playlist/:id/export", exportPlaylistByID)
+	router.POST("/playlist/:id/spotify", postSpotifyPlaylistWrite)
+	router.POST("/playlist/:id/apple", postApplePlaylistWrite)
 	router.POST("/playlist", postPlaylists)
+	router.POST("/playlist/import", postPlaylistImport)
+	router.POST("/playlist/import/itunes", postITunesImport)
+	router.POST("/playlist/import/spotify", postSpotifyDataImport)
+	router.POST("/tracklist", postTracklist)
 
 	/* Spotify API interfacing */
 	router.GET("/spotify/song/id/:id", polyphonicGetSpotifySongByID)
@@ -684,6 +889,7 @@ func main() {
 	router.GET("/spotify/artist/search/:terms", polyphonicGetSpotifyArtistBySearch)
 
 	router.GET("/spotify/playlist/id/:id", polyphonicGetSpotifyPlaylistByID)
+	router.GET("/spotify/playlist/id/:id/export", exportSpotifyPlaylistByID)
 	/* Spotify API interfacing */
 
 	/* Apple Music API interfacing */
@@ -696,11 +902,87 @@ func main() {
 	router.GET("/apple/artist/search/:terms", polyphonicGetAppleArtistBySearch)
 
 	router.GET("/apple/playlist/id/:id", polyphonicGetApplePlaylistByID)
+	router.GET("/apple/playlist/id/:id/export", exportApplePlaylistByID)
 	/* Apple Music API interfacing */
 
-	// certPath := os.Getenv("POLYPHONIC_SSL_CERT_PATH")
-	// keyPath := os.Getenv("POLYPHONIC_SSL_KEY_PATH")
-	// router.RunTLS("0.0.0.0:7659", certPath, keyPath)
+	/* Deezer API interfacing */
+	router.GET("/deezer/song/id/:id", polyphonicGetDeezerSongByID)
+	router.GET("/deezer/song/isrc/:isrc", polyphonicGetDeezerSongByISRC)
+	router.GET("/deezer/song/search/:terms", polyphonicGetDeezerSongsBySearch)
+
+	router.GET("/deezer/album/id/:id", polyphonicGetDeezerAlbumByID)
+	router.GET("/deezer/album/upc/:upc", polyphonicGetDeezerAlbumByUPC)
+	router.GET("/deezer/album/search/:terms", polyphonicGetDeezerAlbumsBySearch)
+
+	router.GET("/deezer/artist/id/:id", polyphonicGetDeezerArtistByID)
+	router.GET("/deezer/artist/search/:terms", polyphonicGetDeezerArtistBySearch)
+
+	router.GET("/deezer/playlist/id/:id", polyphonicGetDeezerPlaylistByID)
+	router.GET("/deezer/playlist/id/:id/export", exportDeezerPlaylistByID)
+	router.POST("/deezer/playlist/id/:id/import", postDeezerPlaylistImport)
+	/* Deezer API interfacing */
+
+	if err := resumeMigrations(ctx); err != nil {
+		fatal("startup failed", err)
+	}
+	lifecycle.Go("session cleanup", func(ctx context.Context) {
+		cleanUpSessions(ctx, sessionCleanupInterval)
+	})
+	lifecycle.Go("library migration watch", func(ctx context.Context) {
+		watchMigrations(ctx, migrationLease)
+	})
+
+	server := &http.Server{
+		Addr:    config.Server.ListenAddr,
+		Handler: router,
+	}
+	servers := []*http.Server{server}
+	var adminServer *http.Server
+	if adminRouter != router {
+		adminServer = &http.Server{
+			Addr:    config.Server.AdminListenAddr,
+			Handler: adminRouter,
+		}
+		servers = append(servers, adminServer)
+	}
+
+	serveErr := make(chan error, len(servers))
+	if config.Server.TLSCertPath == "" {
+		for _, s := range servers {
+			go func(s *http.Server) { serveErr <- s.ListenAndServe() }(s)
+		}
+	} else {
+		certs, err := newCertReloader(config.Server.TLSCertPath, config.Server.TLSKeyPath, config.Server.TLSClientCAPath)
+		if err != nil {
+			fatal("startup failed", err)
+		}
+		lifecycle.Go("tls reloader", func(ctx context.Context) {
+			certs.watch(ctx, config.Server.TLSReloadInterval)
+		})
 
-	router.Run("0.0.0.0:7659")
+		server.TLSConfig = certs.tlsConfig()
+		if adminServer != nil {
+			adminServer.TLSConfig = certs.adminTLSConfig()
+		}
+		for _, s := range servers {
+			go func(s *http.Server) { serveErr <- s.ListenAndServeTLS("", "") }(s)
+		}
+	}
+
+	// Stop on SIGINT or SIGTERM. A second signal kills the process straight
+	// away, since stop restores the default behaviour.
+	signals, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		stop()
+		fatal("startup failed", err)
+	case <-signals.Done():
+		stop()
+	}
+
+	logger.Info("Shutting down")
+	if err := lifecycle.Shutdown(servers, config.Server.ShutdownTimeout, config.Server.JobShutdownTimeout); err != nil {
+		fatal("shutdown did not complete cleanly", err)
+	}
+	logger.Info("Shutdown complete")
 }
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+/*
+Imported tracks arrive as loose metadata (a title, maybe an artist, album,
+duration or ISRC) and are matched to catalog tracks by searching each
+provider and scoring the results. Confidence is a percentage: 100 is an ISRC
+match, and anything below minMatchConfidence is not treated as a match.
+*/
+
+const (
+	minMatchConfidence = 60
+	// searchWorkers bounds concurrent searches per import. The providers'
+	// rate limiters still apply on top of this.
+	searchWorkers = 4
+	// maxCandidates is how many scored results are kept per provider.
+	maxCandidates = 3
+)
+
+// providerNames are the providers tracks can be matched on.
+var providerNames = []string{"spotify", "apple", "deezer"}
+
+// trackQuery is what an imported entry says about a track.
+type trackQuery struct {
+	Title    string        `json:"title"`
+	Artist   string        `json:"artist"`
+	Album    string        `json:"album,omitempty"`
+	ISRC     string        `json:"isrc,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	// TrackNum is the track's position on Album.
+	TrackNum int `json:"track_num,omitempty"`
+}
+
+// trackCandidate is a catalog track considered for a trackQuery.
+type trackCandidate struct {
+	Provider   string `json:"provider"`
+	Title      string `json:"title"`
+	Artist     string `json:"artist"`
+	Album      string `json:"album"`
+	AlbumID    string `json:"album_id,omitempty"`
+	ISRC       string `json:"isrc,omitempty"`
+	Explicit   bool   `json:"explicit"`
+	TrackNum   int    `json:"track_num,omitempty"`
+	DurationMS int    `json:"duration_ms,omitempty"`
+	URL        string `json:"url"`
+	ArtworkURL string `json:"artwork_url,omitempty"`
+	Confidence int    `json:"confidence"`
+}
+
+func spotifyCandidate(song SpotifySong) trackCandidate {
+	artists := make([]string, 0, len(song.Artists))
+	for _, artist := range song.Artists {
+		artists = append(artists, artist.Name)
+	}
+	candidate := trackCandidate{
+		Provider:   "spotify",
+		Title:      song.Name,
+		Artist:     strings.Join(artists, ", "),
+		Album:      song.Album.Name,
+		AlbumID:    song.Album.ID,
+		ISRC:       song.ExternalIDs.ISRC,
+		Explicit:   song.Explicit,
+		TrackNum:   song.TrackNumber,
+		DurationMS: song.DurationMS,
+		URL:        song.ExternalURLs.Spotify,
+	}
+	if len(song.Album.Images) > 0 {
+		candidate.ArtworkURL = song.Album.Images[0].URL
+	}
+
+	return candidate
+}
+
+func appleCandidate(song AppleMusicSongData) trackCandidate {
+	attributes := song.Attributes
+	candidate := trackCandidate{
+		Provider:   "apple",
+		Title:      attributes.Name,
+		Artist:     attributes.ArtistName,
+		Album:      attributes.AlbumName,
+		ISRC:       attributes.ISRC,
+		Explicit:   attributes.ContentRating != nil && *attributes.ContentRating == "explicit",
+		TrackNum:   attributes.TrackNumber,
+		DurationMS: attributes.DurationInMillis,
+		URL:        attributes.URL,
+		ArtworkURL: attributes.Artwork.URL,
+	}
+	if len(song.Relationships.Albums.Data) > 0 {
+		candidate.AlbumID = song.Relationships.Albums.Data[0].ID
+	}
+
+	return candidate
+}
+
+func deezerCandidate(track DeezerTrack) trackCandidate {
+	candidate := trackCandidate{
+		Provider:   "deezer",
+		Title:      track.Title,
+		Artist:     deezerArtistNames(track),
+		Album:      track.Album.Title,
+		ISRC:       track.ISRC,
+		Explicit:   track.ExplicitLyrics,
+		TrackNum:   track.TrackPosition,
+		DurationMS: track.Duration * 1000,
+		URL:        track.Link,
+		ArtworkURL: track.Album.CoverXL,
+	}
+	if track.Album.ID != 0 {
+		candidate.AlbumID = strconv.FormatInt(track.Album.ID, 10)
+	}
+
+	return candidate
+}
+
+// searchSpotifyTracks searches Spotify by ISRC when there is one, then by
+// title and artist.
+func searchSpotifyTracks(ctx context.Context, q trackQuery) []trackCandidate {
+	var searches []string
+	if q.ISRC != "" {
+		searches = append(searches, "isrc:"+q.ISRC)
+	}
+	terms := "track:" + q.Title
+	if q.Artist != "" {
+		terms += " artist:" + q.Artist
+	}
+	searches = append(searches, terms)
+
+	var candidates []trackCandidate
+	for _, terms := range searches {
+		spotifySongSearchChan := make(chan SpotifySongSearch)
+		go getSpotifySongsBySearch(ctx, &sWait, url.QueryEscape(terms)+"&type=track&limit=10", currentSpotifyKey(), spotifySongSearchChan)
+
+		spotifySongSearch := <-spotifySongSearchChan
+		for _, song := range spotifySongSearch.Tracks.Items {
+			candidates = append(candidates, spotifyCandidate(song))
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+
+	return candidates
+}
+
+// searchAppleTracks searches Apple Music by title and artist. ISRCs can't be
+// searched for, but a result with the same ISRC still scores 100.
+func searchAppleTracks(ctx context.Context, q trackQuery) []trackCandidate {
+	terms := strings.TrimSpace(q.Title + " " + q.Artist)
+
+	appleMusicSongSearchChan := make(chan AppleMusicSongSearch)
+	go getAppleMusicSongsBySearch(ctx, &aWait, url.QueryEscape(terms)+"&limit=10", currentAppleMusicKey(), appleMusicSongSearchChan)
+
+	appleMusicSongSearch := <-appleMusicSongSearchChan
+	var candidates []trackCandidate
+	for _, song := range appleMusicSongSearch.Results.Songs.Data {
+		candidates = append(candidates, appleCandidate(song))
+	}
+
+	return candidates
+}
+
+/*
+searchDeezerTracks looks the ISRC up directly when there is one, then searches
+by title and artist, first with Deezer's field search and then with plain
+terms, which finds titles written differently.
+*/
+func searchDeezerTracks(ctx context.Context, q trackQuery) []trackCandidate {
+	if q.ISRC != "" {
+		track, err := getDeezerTrackByISRC(ctx, q.ISRC)
+		if err == nil && track.ID != 0 {
+			return []trackCandidate{deezerCandidate(track)}
+		}
+		if err != nil && err != errDeezerNotFound {
+			loggerFrom(ctx).Error("Deezer: ISRC lookup failed", "isrc", q.ISRC, "error", err)
+		}
+	}
+
+	searches := []string{"track:" + deezerQuoted(q.Title)}
+	if q.Artist != "" {
+		searches[0] += " artist:" + deezerQuoted(q.Artist)
+	}
+	searches = append(searches, strings.TrimSpace(q.Title+" "+q.Artist))
+
+	var candidates []trackCandidate
+	for _, terms := range searches {
+		var search DeezerTracks
+		if err := searchDeezer(ctx, "track", terms, 10, &search); err != nil {
+			loggerFrom(ctx).Error("Deezer: search failed", "error", err)
+			break
+		}
+		for _, track := range search.Data {
+			candidates = append(candidates, deezerCandidate(track))
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+
+	return candidates
+}
+
+var trackSearchers = map[string]func(context.Context, trackQuery) []trackCandidate{
+	"spotify": searchSpotifyTracks,
+	"apple":   searchAppleTracks,
+	"deezer":  searchDeezerTracks,
+}
+
+// otherProviders returns every provider but provider.
+func otherProviders(provider string) []string {
+	return withoutProvider(providerNames, provider)
+}
+
+// withoutProvider returns names without provider.
+func withoutProvider(names []string, provider string) []string {
+	var others []string
+	for _, name := range names {
+		if name != provider {
+			others = append(others, name)
+		}
+	}
+
+	return others
+}
+
+// checkProviderAuth makes sure there is a token for provider before
+// searching it.
+func checkProviderAuth(ctx context.Context, provider string) error {
+	switch provider {
+	case "spotify":
+		return checkSpotifyAuth(ctx)
+	case "apple":
+		return checkAppleMusicAuth()
+	case "deezer":
+		// Deezer's catalog needs no token.
+		return nil
+	}
+
+	return fmt.Errorf("unknown provider %q", provider)
+}
+
+/*
+availableProviders returns the providers in names that can be searched right
+now, in the same order. The others are logged and left out, so one provider's
+outage doesn't stop matching on the rest.
+*/
+func availableProviders(ctx context.Context, names []string) []string {
+	var available []string
+	for _, name := range names {
+		if err := checkProviderAuth(ctx, name); err != nil {
+			loggerFrom(ctx).Warn("skipping provider", "provider", name, "error", err)
+			continue
+		}
+		available = append(available, name)
+	}
+
+	return available
+}
+
+// normalizeWords lowercases s and splits it into words, dropping
+// punctuation and "feat." credits.
+func normalizeWords(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	kept := words[:0]
+	for _, word := range words {
+		switch word {
+		case "feat", "ft", "featuring", "the", "and":
+			continue
+		}
+		kept = append(kept, word)
+	}
+
+	return kept
+}
+
+// baseTitle drops parenthesised and bracketed parts, such as
+// "(Remastered 2011)" or "[Live]", and a version after " - ", as in
+// Spotify's "Yesterday - Remastered 2009".
+func baseTitle(s string) string {
+	s, _, _ = strings.Cut(s, " - ")
+
+	var b strings.Builder
+	depth := 0
+	for _, r := range s {
+		switch r {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			if depth > 0 {
+				depth--
+			}
+		default:
+			if depth == 0 {
+				b.WriteRune(r)
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// similarity is the Dice coefficient of the words in a and b, from 0 to 1.
+func similarity(a string, b string) float64 {
+	wordsA, wordsB := normalizeWords(a), normalizeWords(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+
+	counts := map[string]int{}
+	for _, word := range wordsA {
+		counts[word]++
+	}
+	shared := 0
+	for _, word := range wordsB {
+		if counts[word] > 0 {
+			counts[word]--
+			shared++
+		}
+	}
+
+	return 2 * float64(shared) / float64(len(wordsA)+len(wordsB))
+}
+
+// titleSimilarity also compares base titles, so a remaster or radio edit
+// still matches the plain title.
+func titleSimilarity(a string, b string) float64 {
+	return max(similarity(a, b), similarity(baseTitle(a), baseTitle(b)))
+}
+
+/*
+matchConfidence scores how likely candidate is the track q describes. The
+title counts for 55 points, the artist for 30, and the duration and album for
+10 and 5. When the query has a track number, 2 of the album's points go to it
+matching, which prefers the album release over a compilation. Information
+either side lacks gets half marks so it doesn't count against a candidate.
+*/
+func matchConfidence(q trackQuery, candidate trackCandidate) int {
+	if q.ISRC != "" && strings.EqualFold(q.ISRC, candidate.ISRC) {
+		return 100
+	}
+
+	score := 55 * titleSimilarity(q.Title, candidate.Title)
+
+	if q.Artist == "" {
+		score += 15
+	} else {
+		score += 30 * similarity(q.Artist, candidate.Artist)
+	}
+
+	switch {
+	case q.Duration <= 0 || candidate.DurationMS <= 0:
+		score += 5
+	default:
+		diff := q.Duration - time.Duration(candidate.DurationMS)*time.Millisecond
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= 3*time.Second {
+			score += 10
+		} else if diff <= 10*time.Second {
+			score += 5
+		}
+	}
+
+	albumPoints := 5.0
+	if q.TrackNum > 0 {
+		albumPoints = 3
+		switch {
+		case candidate.TrackNum <= 0:
+			score += 1
+		case candidate.TrackNum == q.TrackNum:
+			score += 2
+		}
+	}
+	if q.Album == "" {
+		score += albumPoints / 2
+	} else {
+		score += albumPoints * titleSimilarity(q.Album, candidate.Album)
+	}
+
+	return min(int(score+0.5), 99)
+}
+
+// rankCandidates scores candidates against q and keeps the best, highest
+// first.
+func rankCandidates(q trackQuery, candidates []trackCandidate) []trackCandidate {
+	if candidates == nil {
+		candidates = []trackCandidate{}
+	}
+	for i := range candidates {
+		candidates[i].Confidence = matchConfidence(q, candidates[i])
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+	if len(candidates) > maxCandidates {
+		candidates = candidates[:maxCandidates]
+	}
+
+	return candidates
+}
+
+// trackMatches holds the ranked candidates for one query, per provider.
+type trackMatches map[string][]trackCandidate
+
+// best returns the top candidate on provider if it is confident enough.
+func (m trackMatches) best(provider string) (trackCandidate, bool) {
+	candidates := m[provider]
+	if len(candidates) == 0 || candidates[0].Confidence < minMatchConfidence {
+		return trackCandidate{}, false
+	}
+
+	return candidates[0], true
+}
+
+/*
+matchTracks searches every provider for every query and returns the ranked
+candidates in the same order as queries. The caller must have checked each
+provider's authentication.
+*/
+func matchTracks(ctx context.Context, queries []trackQuery, providers []string) []trackMatches {
+	results := make([]trackMatches, len(queries))
+	for i := range results {
+		results[i] = trackMatches{}
+	}
+
+	type job struct {
+		index    int
+		provider string
+	}
+	jobs := make(chan job)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < searchWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				candidates := rankCandidates(queries[j.index], trackSearchers[j.provider](ctx, queries[j.index]))
+				mu.Lock()
+				results[j.index][j.provider] = candidates
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i, q := range queries {
+		if q.Title == "" && q.ISRC == "" {
+			continue
+		}
+		for _, provider := range providers {
+			select {
+			case jobs <- job{index: i, provider: provider}:
+			case <-ctx.Done():
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+/*
+matchKnownTracks matches queries when some tracks are already known on
+provider, keyed by their index in queries. Known tracks count as certain
+matches there, and their ISRC, duration and album are used to find them on the
+others; the rest are searched for on provider and the others too.
+*/
+func matchKnownTracks(ctx context.Context, provider string, others []string, queries []trackQuery, known map[int]trackCandidate) []trackMatches {
+	queries = slices.Clone(queries)
+	var missing []int
+	var missingQueries []trackQuery
+	for i := range queries {
+		candidate, ok := known[i]
+		if !ok {
+			missing = append(missing, i)
+			missingQueries = append(missingQueries, queries[i])
+			continue
+		}
+		queries[i] = trackQuery{
+			Title:    candidate.Title,
+			Artist:   candidate.Artist,
+			Album:    candidate.Album,
+			ISRC:     candidate.ISRC,
+			Duration: time.Duration(candidate.DurationMS) * time.Millisecond,
+			TrackNum: candidate.TrackNum,
+		}
+	}
+
+	matches := matchTracks(ctx, queries, others)
+	for i, candidate := range known {
+		candidate.Confidence = 100
+		matches[i][provider] = []trackCandidate{candidate}
+	}
+	for j, found := range matchTracks(ctx, missingQueries, []string{provider}) {
+		matches[missing[j]][provider] = found[provider]
+	}
+
+	return matches
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polyphonic_http_requests_total",
+		Help: "Requests handled, by route and response status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "polyphonic_http_request_duration_seconds",
+		Help:    "Time spent handling requests, by route.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"method", "route"})
+
+	upstreamRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polyphonic_upstream_requests_total",
+		Help: "Calls made to Spotify, Apple Music and Deezer, by endpoint and response status.",
+	}, []string{"provider", "endpoint", "status"})
+
+	upstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "polyphonic_upstream_request_duration_seconds",
+		Help:    "Latency of calls to Spotify, Apple Music and Deezer, by endpoint.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"provider", "endpoint"})
+
+	upstreamRateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polyphonic_upstream_rate_limited_total",
+		Help: "429 Too Many Requests responses, and Deezer quota errors, from Spotify, Apple Music and Deezer.",
+	}, []string{"provider", "endpoint"})
+
+	rateLimitWaitSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polyphonic_rate_limit_wait_seconds_total",
+		Help: "Time spent sleeping in the rate limiter before retrying.",
+	}, []string{"provider"})
+
+	apiKeyRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polyphonic_api_key_rejections_total",
+		Help: "Requests turned away by API key checks, by reason.",
+	}, []string{"reason"})
+
+	tokenRefreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polyphonic_token_refreshes_total",
+		Help: "Upstream access token refreshes, by result.",
+	}, []string{"provider", "result"})
+
+	libraryMigrationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polyphonic_library_migrations_total",
+		Help: "Library migrations that finished, by status.",
+	}, []string{"status"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "polyphonic_db_query_duration_seconds",
+		Help:    "Latency of playlist store operations.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"operation", "result"})
+)
+
+// metricsMiddleware records request counts and latency per gin route. The
+// route template (e.g. /spotify/song/id/:id) is used rather than the path so
+// that IDs and search terms don't each become a new series.
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequestsTotal.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	httpRequestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+}
+
+// getMetrics serves the metrics in the Prometheus text format.
+var getMetrics = gin.WrapH(promhttp.Handler())
+
+// instrumentedTransport records metrics and a log line for every call made
+// to a provider.
+type instrumentedTransport struct {
+	provider string
+	endpoint string
+	next     http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	_, span := startUpstreamSpan(request, t.provider, t.endpoint)
+	start := time.Now()
+	response, err := t.next.RoundTrip(request)
+	upstreamRequestDuration.WithLabelValues(t.provider, t.endpoint).Observe(time.Since(start).Seconds())
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(response.StatusCode)
+		if response.StatusCode == http.StatusTooManyRequests {
+			upstreamRateLimitedTotal.WithLabelValues(t.provider, t.endpoint).Inc()
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+		if response.StatusCode >= 400 {
+			span.SetStatus(codes.Error, response.Status)
+		}
+	}
+	endSpan(span, err)
+	upstreamRequestsTotal.WithLabelValues(t.provider, t.endpoint, status).Inc()
+
+	// Only the path is logged; query strings carry search terms.
+	upstreamLog := loggerFrom(request.Context()).With(
+		"provider", t.provider,
+		"endpoint", t.endpoint,
+		"method", request.Method,
+		"path", request.URL.Path,
+		"status", status,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+	switch {
+	case err != nil:
+		upstreamLog.Warn("upstream request failed", "error", err)
+	case response.StatusCode >= 400:
+		upstreamLog.Warn("upstream request")
+	default:
+		upstreamLog.Debug("upstream request")
+	}
+
+	return response, err
+}
+
+// upstreamClient returns an HTTP client for calling endpoint on provider,
+// with metrics recorded for each call.
+func upstreamClient(provider string, endpoint string) *http.Client {
+	return &http.Client{
+		Transport: instrumentedTransport{
+			provider: provider,
+			endpoint: endpoint,
+			next:     http.DefaultTransport,
+		},
+	}
+}
+
+// countTokenRefresh records the outcome of refreshing a provider's token.
+func countTokenRefresh(provider string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	tokenRefreshesTotal.WithLabelValues(provider, result).Inc()
+}
+
+// isNotFound reports whether err only says a lookup found nothing, or that a
+// conditional update matched nothing, which is an answer rather than a failed
+// query.
+func isNotFound(err error) bool {
+	return err == errPlaylistNotFound || err == errAPIKeyNotFound || err == errSessionNotFound || err == errMigrationNotFound || err == errMigrationChanged || err == errLinkNotFound
+}
+
+// observeDBQuery records how long a store operation took.
+func observeDBQuery(operation string, start time.Time, err error) {
+	result := "ok"
+	if err != nil && !isNotFound(err) {
+		result = "error"
+	}
+	dbQueryDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// storeObserver records latency and a span for store operations.
+type storeObserver struct {
+	// system is the database driver, recorded on spans.
+	system string
+}
+
+func (o storeObserver) observe(ctx context.Context, operation string, fn func(ctx context.Context) error) error {
+	ctx, span := tracer.Start(ctx, "db "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemKey.String(o.system),
+			semconv.DBOperation(operation),
+		),
+	)
+	start := time.Now()
+	err := fn(ctx)
+	observeDBQuery(operation, start, err)
+	if isNotFound(err) {
+		endSpan(span, nil)
+	} else {
+		endSpan(span, err)
+	}
+
+	return err
+}
+
+// instrumentedStore wraps a PlaylistStore to record query latency and a
+// span per query, whichever backend is in use.
+type instrumentedStore struct {
+	PlaylistStore
+	storeObserver
+}
+
+func (s instrumentedStore) GetPlaylist(ctx context.Context, id string) (p playlist_data, err error) {
+	err = s.observe(ctx, "get_playlist", func(ctx context.Context) error {
+		p, err = s.PlaylistStore.GetPlaylist(ctx, id)
+		return err
+	})
+
+	return p, err
+}
+
+func (s instrumentedStore) CreatePlaylist(ctx context.Context, p playlist_data, idempotencyKey string) (stored playlist_data, replayed bool, err error) {
+	err = s.observe(ctx, "create_playlist", func(ctx context.Context) error {
+		stored, replayed, err = s.PlaylistStore.CreatePlaylist(ctx, p, idempotencyKey)
+		if replayed {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("db.idempotent_replay", true))
+		}
+		return err
+	})
+
+	return stored, replayed, err
+}
+
+func (s instrumentedStore) Ping(ctx context.Context) error {
+	return s.observe(ctx, "ping", s.PlaylistStore.Ping)
+}
+
+// instrumentedAPIKeyStore does for an APIKeyStore what instrumentedStore
+// does for a PlaylistStore.
+type instrumentedAPIKeyStore struct {
+	APIKeyStore
+	storeObserver
+}
+
+func (s instrumentedAPIKeyStore) CreateAPIKey(ctx context.Context, key apiKey) error {
+	return s.observe(ctx, "create_api_key", func(ctx context.Context) error {
+		return s.APIKeyStore.CreateAPIKey(ctx, key)
+	})
+}
+
+func (s instrumentedAPIKeyStore) GetAPIKey(ctx context.Context, id string) (key apiKey, err error) {
+	err = s.observe(ctx, "get_api_key", func(ctx context.Context) error {
+		key, err = s.APIKeyStore.GetAPIKey(ctx, id)
+		return err
+	})
+
+	return key, err
+}
+
+func (s instrumentedAPIKeyStore) GetAPIKeyByHash(ctx context.Context, hash string) (key apiKey, err error) {
+	err = s.observe(ctx, "get_api_key_by_hash", func(ctx context.Context) error {
+		key, err = s.APIKeyStore.GetAPIKeyByHash(ctx, hash)
+		return err
+	})
+
+	return key, err
+}
+
+func (s instrumentedAPIKeyStore) ListAPIKeys(ctx context.Context) (keys []apiKey, err error) {
+	err = s.observe(ctx, "list_api_keys", func(ctx context.Context) error {
+		keys, err = s.APIKeyStore.ListAPIKeys(ctx)
+		return err
+	})
+
+	return keys, err
+}
+
+func (s instrumentedAPIKeyStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return s.observe(ctx, "revoke_api_key", func(ctx context.Context) error {
+		return s.APIKeyStore.RevokeAPIKey(ctx, id, at)
+	})
+}
+
+func (s instrumentedAPIKeyStore) AddAPIKeyUsage(ctx context.Context, id string, day string) (requests int64, err error) {
+	err = s.observe(ctx, "add_api_key_usage", func(ctx context.Context) error {
+		requests, err = s.APIKeyStore.AddAPIKeyUsage(ctx, id, day)
+		return err
+	})
+
+	return requests, err
+}
+
+func (s instrumentedAPIKeyStore) APIKeyUsage(ctx context.Context, id string, day string) (requests int64, err error) {
+	err = s.observe(ctx, "api_key_usage", func(ctx context.Context) error {
+		requests, err = s.APIKeyStore.APIKeyUsage(ctx, id, day)
+		return err
+	})
+
+	return requests, err
+}
+
+// instrumentedSessionStore does for a SessionStore what instrumentedStore
+// does for a PlaylistStore.
+type instrumentedSessionStore struct {
+	SessionStore
+	storeObserver
+}
+
+func (s instrumentedSessionStore) CreateSession(ctx context.Context, session userSession) error {
+	return s.observe(ctx, "create_session", func(ctx context.Context) error {
+		return s.SessionStore.CreateSession(ctx, session)
+	})
+}
+
+func (s instrumentedSessionStore) GetSession(ctx context.Context, id string) (session userSession, err error) {
+	err = s.observe(ctx, "get_session", func(ctx context.Context) error {
+		session, err = s.SessionStore.GetSession(ctx, id)
+		return err
+	})
+
+	return session, err
+}
+
+func (s instrumentedSessionStore) DeleteSession(ctx context.Context, id string) error {
+	return s.observe(ctx, "delete_session", func(ctx context.Context) error {
+		return s.SessionStore.DeleteSession(ctx, id)
+	})
+}
+
+func (s instrumentedSessionStore) CreateOAuthState(ctx context.Context, state oauthState) error {
+	return s.observe(ctx, "create_oauth_state", func(ctx context.Context) error {
+		return s.SessionStore.CreateOAuthState(ctx, state)
+	})
+}
+
+func (s instrumentedSessionStore) TakeOAuthState(ctx context.Context, state string) (taken oauthState, err error) {
+	err = s.observe(ctx, "take_oauth_state", func(ctx context.Context) error {
+		taken, err = s.SessionStore.TakeOAuthState(ctx, state)
+		return err
+	})
+
+	return taken, err
+}
+
+func (s instrumentedSessionStore) SaveProviderToken(ctx context.Context, token providerToken) error {
+	return s.observe(ctx, "save_provider_token", func(ctx context.Context) error {
+		return s.SessionStore.SaveProviderToken(ctx, token)
+	})
+}
+
+func (s instrumentedSessionStore) GetProviderToken(ctx context.Context, sessionID string, provider string) (token providerToken, err error) {
+	err = s.observe(ctx, "get_provider_token", func(ctx context.Context) error {
+		token, err = s.SessionStore.GetProviderToken(ctx, sessionID, provider)
+		return err
+	})
+
+	return token, err
+}
+
+func (s instrumentedSessionStore) ListProviderTokens(ctx context.Context, sessionID string) (tokens []providerToken, err error) {
+	err = s.observe(ctx, "list_provider_tokens", func(ctx context.Context) error {
+		tokens, err = s.SessionStore.ListProviderTokens(ctx, sessionID)
+		return err
+	})
+
+	return tokens, err
+}
+
+func (s instrumentedSessionStore) DeleteProviderToken(ctx context.Context, sessionID string, provider string) error {
+	return s.observe(ctx, "delete_provider_token", func(ctx context.Context) error {
+		return s.SessionStore.DeleteProviderToken(ctx, sessionID, provider)
+	})
+}
+
+func (s instrumentedSessionStore) DeleteExpiredSessions(ctx context.Context, now time.Time, statesBefore time.Time) (deleted int64, err error) {
+	err = s.observe(ctx, "delete_expired_sessions", func(ctx context.Context) error {
+		deleted, err = s.SessionStore.DeleteExpiredSessions(ctx, now, statesBefore)
+		return err
+	})
+
+	return deleted, err
+}
+
+// instrumentedMigrationStore does for a MigrationStore what instrumentedStore
+// does for a PlaylistStore.
+type instrumentedMigrationStore struct {
+	MigrationStore
+	storeObserver
+}
+
+func (s instrumentedMigrationStore) CreateMigration(ctx context.Context, job migrationJob) error {
+	return s.observe(ctx, "create_migration", func(ctx context.Context) error {
+		return s.MigrationStore.CreateMigration(ctx, job)
+	})
+}
+
+func (s instrumentedMigrationStore) GetMigration(ctx context.Context, id string) (job migrationJob, err error) {
+	err = s.observe(ctx, "get_migration", func(ctx context.Context) error {
+		job, err = s.MigrationStore.GetMigration(ctx, id)
+		return err
+	})
+
+	return job, err
+}
+
+func (s instrumentedMigrationStore) ClaimMigration(ctx context.Context, id string, owner string, leaseUntil time.Time, now time.Time) (job migrationJob, err error) {
+	err = s.observe(ctx, "claim_migration", func(ctx context.Context) error {
+		job, err = s.MigrationStore.ClaimMigration(ctx, id, owner, leaseUntil, now)
+		return err
+	})
+
+	return job, err
+}
+
+func (s instrumentedMigrationStore) SaveMigration(ctx context.Context, job migrationJob) error {
+	return s.observe(ctx, "save_migration", func(ctx context.Context) error {
+		return s.MigrationStore.SaveMigration(ctx, job)
+	})
+}
+
+func (s instrumentedMigrationStore) CancelMigration(ctx context.Context, id string, updatedAt time.Time) error {
+	return s.observe(ctx, "cancel_migration", func(ctx context.Context) error {
+		return s.MigrationStore.CancelMigration(ctx, id, updatedAt)
+	})
+}
+
+func (s instrumentedMigrationStore) ResumeMigration(ctx context.Context, id string, updatedAt time.Time) error {
+	return s.observe(ctx, "resume_migration", func(ctx context.Context) error {
+		return s.MigrationStore.ResumeMigration(ctx, id, updatedAt)
+	})
+}
+
+func (s instrumentedMigrationStore) ListMigrations(ctx context.Context, sessionID string) (jobs []migrationJob, err error) {
+	err = s.observe(ctx, "list_migrations", func(ctx context.Context) error {
+		jobs, err = s.MigrationStore.ListMigrations(ctx, sessionID)
+		return err
+	})
+
+	return jobs, err
+}
+
+func (s instrumentedMigrationStore) ListUnfinishedMigrations(ctx context.Context) (jobs []migrationJob, err error) {
+	err = s.observe(ctx, "list_unfinished_migrations", func(ctx context.Context) error {
+		jobs, err = s.MigrationStore.ListUnfinishedMigrations(ctx)
+		return err
+	})
+
+	return jobs, err
+}
+
+// instrumentedLinkStore does for a LinkStore what instrumentedStore does for a
+// PlaylistStore.
+type instrumentedLinkStore struct {
+	LinkStore
+	storeObserver
+}
+
+func (s instrumentedLinkStore) SaveLink(ctx context.Context, key string, resolution linkResolution, resolvedAt time.Time) error {
+	return s.observe(ctx, "save_link", func(ctx context.Context) error {
+		return s.LinkStore.SaveLink(ctx, key, resolution, resolvedAt)
+	})
+}
+
+func (s instrumentedLinkStore) GetLink(ctx context.Context, key string) (resolution linkResolution, resolvedAt time.Time, err error) {
+	err = s.observe(ctx, "get_link", func(ctx context.Context) error {
+		resolution, resolvedAt, err = s.LinkStore.GetLink(ctx, key)
+		return err
+	})
+
+	return resolution, resolvedAt, err
+}
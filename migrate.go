@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// embeddedMigrations holds one directory of migrations per SQL dialect.
+//
+//go:embed migrations
+var embeddedMigrations embed.FS
+
+// migration is one versioned schema change. Files are named
+// NNNN_description.up.sql and NNNN_description.down.sql.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads every migration in fsys, sorted by version.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionStr, name, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s: expected NNNN_description.%s.sql", fileName, direction)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %v", fileName, err)
+		}
+
+		contents, err := fs.ReadFile(fsys, fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+/*
+splitStatements breaks a migration script into individual statements, since
+not every driver can run several statements in one Exec. Semicolons inside
+quoted strings, quoted identifiers and SQL comments don't end a
+statement. Quotes are escaped by doubling them, as in standard SQL.
+*/
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	flush := func() {
+		statement := strings.TrimSpace(current.String())
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		ch := script[i]
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			// Copy through the closing quote; a doubled quote is an escaped
+			// one and keeps the string open.
+			end := i + 1
+			for end < len(script) {
+				if script[end] == ch {
+					if end+1 < len(script) && script[end+1] == ch {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			end = min(end, len(script)-1)
+			current.WriteString(script[i : end+1])
+			i = end
+		case ch == '-' && strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			current.WriteString(script[i : i+end])
+			i += end - 1
+		case ch == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				end = len(script) - i - 4
+			}
+			current.WriteString(script[i : i+end+4])
+			i += end + 3
+		case ch == ';':
+			flush()
+		default:
+			current.WriteByte(ch)
+		}
+	}
+	flush()
+
+	return statements
+}
+
+// migrator applies the embedded migrations to a database and keeps track of
+// them in the schema_migrations table.
+type migrator struct {
+	db         *sql.DB
+	dialect    sqlDialect
+	migrations []migration
+}
+
+func newMigrator(db *sql.DB, dialect sqlDialect) (*migrator, error) {
+	fsys, err := fs.Sub(embeddedMigrations, dialect.migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+func (m *migrator) ensureTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version    INT NOT NULL,
+  name       VARCHAR(255) NOT NULL,
+  applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (version)
+)`)
+	return err
+}
+
+// applied returns the time each applied migration version was run.
+func (m *migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// pending returns the migrations that have not been applied yet.
+func (m *migrator) pending(ctx context.Context) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []migration
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; !ok {
+			pending = append(pending, mig)
+		}
+	}
+
+	return pending, nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+/*
+apply runs script and then record, the statement that updates
+schema_migrations, with args. Where the database can roll back schema changes
+they run in one transaction, so a failed migration leaves nothing behind and
+is never recorded half-applied.
+*/
+func (m *migrator) apply(ctx context.Context, script string, record string, args ...any) error {
+	var db execer = m.db
+	var tx *sql.Tx
+	if m.dialect.transactionalDDL {
+		var err error
+		if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		// Rollback is a no-op once the transaction has been committed.
+		defer tx.Rollback()
+		db = tx
+	}
+
+	for _, statement := range splitStatements(script) {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	if _, err := db.ExecContext(ctx, m.dialect.bind(record), args...); err != nil {
+		return err
+	}
+	if tx != nil {
+		return tx.Commit()
+	}
+
+	return nil
+}
+
+/*
+lock takes the dialect's schema lock on a connection of its own and returns a
+function that releases it. Replicas that start together wait for each other
+here, and each then sees the migrations the others applied.
+*/
+func (m *migrator) lock(ctx context.Context) (func(), error) {
+	if m.dialect.lockSchema == "" {
+		return func() {}, nil
+	}
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, m.dialect.lockSchema).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("locking the schema: %v", err)
+	}
+	// pg_advisory_lock returns nothing; GET_LOCK returns 0 on timeout.
+	if locked.Valid && locked.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("locking the schema: timed out waiting for another migration")
+	}
+
+	return func() {
+		conn.ExecContext(context.WithoutCancel(ctx), m.dialect.unlockSchema)
+		conn.Close()
+	}, nil
+}
+
+// Up applies every pending migration in order.
+func (m *migrator) Up(ctx context.Context, w io.Writer) error {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pending, err := m.pending(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range pending {
+		fmt.Fprintf(w, "Applying migration %04d_%s\n", mig.Version, mig.Name)
+		err := m.apply(ctx, mig.Up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", mig.Version, mig.Name)
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s: %v", mig.Version, mig.Name, err)
+		}
+	}
+
+	if len(pending) == 0 {
+		fmt.Fprintln(w, "Schema is up to date")
+	}
+
+	return nil
+}
+
+// Down rolls back the most recently applied migrations, steps at a time.
+func (m *migrator) Down(ctx context.Context, w io.Writer, steps int) error {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		if mig.Down == "" {
+			return fmt.Errorf("migration %04d_%s cannot be rolled back", mig.Version, mig.Name)
+		}
+
+		fmt.Fprintf(w, "Rolling back migration %04d_%s\n", mig.Version, mig.Name)
+		if err := m.apply(ctx, mig.Down, "DELETE FROM schema_migrations WHERE version = ?", mig.Version); err != nil {
+			return fmt.Errorf("migration %04d_%s: %v", mig.Version, mig.Name, err)
+		}
+		steps--
+	}
+
+	return nil
+}
+
+// Status writes which migrations have been applied.
+func (m *migrator) Status(ctx context.Context, w io.Writer) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range m.migrations {
+		state := "pending"
+		if appliedAt, ok := applied[mig.Version]; ok {
+			state = "applied " + appliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d_%-30s %s\n", mig.Version, mig.Name, state)
+	}
+
+	return nil
+}
+
+// CheckCurrent returns an error if the database is missing any migrations,
+// so the server refuses to run against an out-of-date schema.
+func (m *migrator) CheckCurrent(ctx context.Context) error {
+	pending, err := m.pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is out of date: %d pending migration(s), starting with %04d_%s; run \"polyphonic-backend migrate up\" or enable database.auto_migrate",
+			len(pending), pending[0].Version, pending[0].Name)
+	}
+
+	return nil
+}
+
+/*
+runMigrateCommand handles "migrate up", "migrate down [steps]" and
+"migrate status" from the command line.
+*/
+func runMigrateCommand(ctx context.Context, m *migrator, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		return m.Up(ctx, w)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("migrate down: steps must be a positive number")
+			}
+		}
+		return m.Down(ctx, w, steps)
+	case "status":
+		return m.Status(ctx, w)
+	default:
+		return fmt.Errorf("unknown migrate command %q; usage: migrate up|down [steps]|status", args[0])
+	}
+}
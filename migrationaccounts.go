@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+The accounts library migrations read from and write to. Spotify keeps liked
+songs, saved albums and followed artists; the Apple Music library has songs,
+albums and artists, but its artists come from the songs in it and can't be
+added directly.
+*/
+
+// spotifySaveBatches are how many IDs Spotify saves per request, by kind.
+var spotifySaveBatches = map[string]int{"liked": 50, "albums": 20, "artists": 50, "playlist": spotifyPlaylistBatch}
+
+// spotifySavePaths are where each kind is saved to the account.
+var spotifySavePaths = map[string]string{"liked": "/me/tracks", "albums": "/me/albums", "artists": "/me/following?type=artist"}
+
+type spotifyMigrationAccount struct {
+	session userSession
+}
+
+func (a *spotifyMigrationAccount) playlists(ctx context.Context) ([]userPlaylistSummary, error) {
+	token, err := userSpotifyToken(ctx, a.session)
+	if err != nil {
+		return nil, err
+	}
+
+	return spotifyUserPlaylists(ctx, token)
+}
+
+func (a *spotifyMigrationAccount) items(ctx context.Context, step migrationStep) ([]libraryItem, error) {
+	token, err := userSpotifyToken(ctx, a.session)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []libraryItem
+	switch step.Kind {
+	case "albums":
+		nextURL := "/me/albums?limit=50"
+		for nextURL != "" && len(items) <= maxMigrationTracks {
+			var page struct {
+				Items []struct {
+					Album SpotifyAlbum `json:"album"`
+				} `json:"items"`
+				Next *string `json:"next"`
+			}
+			if err := spotifyUserRequest(ctx, "saved_albums", token, "GET", nextURL, nil, &page); err != nil {
+				return nil, err
+			}
+			for _, item := range page.Items {
+				var artists []string
+				for _, artist := range item.Album.Artists {
+					artists = append(artists, artist.Name)
+				}
+				items = append(items, libraryItem{Name: item.Album.Name, Artist: strings.Join(artists, ", "), UPC: item.Album.ExternalIDs.UPC})
+			}
+
+			nextURL = ""
+			if page.Next != nil {
+				nextURL = *page.Next
+			}
+		}
+	case "artists":
+		nextURL := "/me/following?type=artist&limit=50"
+		for nextURL != "" && len(items) <= maxMigrationTracks {
+			var page struct {
+				Artists struct {
+					Items []SpotifyArtist `json:"items"`
+					Next  *string         `json:"next"`
+				} `json:"artists"`
+			}
+			if err := spotifyUserRequest(ctx, "followed_artists", token, "GET", nextURL, nil, &page); err != nil {
+				return nil, err
+			}
+			for _, artist := range page.Artists.Items {
+				items = append(items, libraryItem{Name: artist.Name})
+			}
+
+			nextURL = ""
+			if page.Artists.Next != nil {
+				nextURL = *page.Artists.Next
+			}
+		}
+	default:
+		id := step.SourceID
+		if step.Kind == "liked" {
+			id = likedSongsID
+		}
+		_, playlistItems, err := readSpotifyUserPlaylist(ctx, token, id, maxMigrationTracks+1)
+		if err != nil {
+			return nil, err
+		}
+		items = trackItems(spotifyItemQueries(playlistItems))
+	}
+
+	return items, nil
+}
+
+func (a *spotifyMigrationAccount) trackID(candidate trackCandidate) string {
+	if match := spotifyTrackLink.FindStringSubmatch(candidate.URL); match != nil {
+		return match[1]
+	}
+
+	return ""
+}
+
+// playable treats every track as playable: Spotify relinks tracks that
+// aren't available in the account's market.
+func (a *spotifyMigrationAccount) playable(ctx context.Context, ids []string) (map[string]bool, error) {
+	playable := map[string]bool{}
+	for _, id := range ids {
+		playable[id] = true
+	}
+
+	return playable, nil
+}
+
+// search runs searches in turn, returning the ID of the first result accept
+// takes.
+func (a *spotifyMigrationAccount) search(ctx context.Context, kind string, searches []string, accept func(name string, artist string) bool) (string, error) {
+	token, err := userSpotifyToken(ctx, a.session)
+	if err != nil {
+		return "", err
+	}
+
+	type result struct {
+		ID      string   `json:"id"`
+		Name    string   `json:"name"`
+		Artists []Artist `json:"artists"`
+	}
+	for _, terms := range searches {
+		var found struct {
+			Albums struct {
+				Items []result `json:"items"`
+			} `json:"albums"`
+			Artists struct {
+				Items []result `json:"items"`
+			} `json:"artists"`
+		}
+		path := "/search?type=" + kind + "&limit=5&q=" + url.QueryEscape(terms)
+		if err := spotifyUserRequest(ctx, "search_"+kind, token, "GET", path, nil, &found); err != nil {
+			return "", err
+		}
+		for _, item := range append(found.Albums.Items, found.Artists.Items...) {
+			artist := ""
+			if len(item.Artists) > 0 {
+				artist = item.Artists[0].Name
+			}
+			if accept(item.Name, artist) {
+				return item.ID, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// findAlbum searches by UPC when the source has one, and then by name.
+func (a *spotifyMigrationAccount) findAlbum(ctx context.Context, item libraryItem) (string, error) {
+	if item.UPC != "" {
+		id, err := a.search(ctx, "album", []string{"upc:" + item.UPC}, func(string, string) bool { return true })
+		if id != "" || err != nil {
+			return id, err
+		}
+	}
+
+	terms := "album:" + item.Name
+	if item.Artist != "" {
+		terms += " artist:" + item.Artist
+	}
+	return a.search(ctx, "album", []string{terms}, func(name string, artist string) bool {
+		return namesMatch(item, name, artist)
+	})
+}
+
+func (a *spotifyMigrationAccount) findArtist(ctx context.Context, item libraryItem) (string, error) {
+	return a.search(ctx, "artist", []string{item.Name}, func(name string, _ string) bool {
+		return namesMatch(item, name, "")
+	})
+}
+
+func (a *spotifyMigrationAccount) unsupported(kind string) string {
+	return ""
+}
+
+func (a *spotifyMigrationAccount) createPlaylist(ctx context.Context, name string, description string) (string, error) {
+	token, err := userSpotifyToken(ctx, a.session)
+	if err != nil {
+		return "", err
+	}
+	created, err := createSpotifyPlaylist(ctx, token, providerPlaylistRequest{Name: name, Description: description})
+
+	return created.ID, err
+}
+
+func (a *spotifyMigrationAccount) addToPlaylist(ctx context.Context, id string, ids []string) error {
+	token, err := userSpotifyToken(ctx, a.session)
+	if err != nil {
+		return err
+	}
+	uris := make([]string, len(ids))
+	for i, trackID := range ids {
+		uris[i] = "spotify:track:" + trackID
+	}
+
+	return spotifyUserRequest(ctx, "add_playlist_tracks", token, "POST", "/playlists/"+url.PathEscape(id)+"/tracks", gin.H{"uris": uris}, nil)
+}
+
+func (a *spotifyMigrationAccount) save(ctx context.Context, kind string, ids []string) error {
+	token, err := userSpotifyToken(ctx, a.session)
+	if err != nil {
+		return err
+	}
+
+	return spotifyUserRequest(ctx, "save_"+kind, token, "PUT", spotifySavePaths[kind], gin.H{"ids": ids}, nil)
+}
+
+func (a *spotifyMigrationAccount) batchSize(kind string) int {
+	return spotifySaveBatches[kind]
+}
+
+// appleMigrationAccount looks songs and albums up in the account's own
+// storefront, which is read once a run.
+type appleMigrationAccount struct {
+	session    userSession
+	storefront string
+}
+
+func (a *appleMigrationAccount) token(ctx context.Context) (string, error) {
+	token, err := sessions.GetProviderToken(ctx, a.session.ID, "apple")
+	if errors.Is(err, errSessionNotFound) {
+		return "", errNotConnected
+	}
+
+	return token.AccessToken, err
+}
+
+func (a *appleMigrationAccount) userStorefront(ctx context.Context) (string, error) {
+	if a.storefront != "" {
+		return a.storefront, nil
+	}
+	token, err := a.token(ctx)
+	if err != nil {
+		return "", err
+	}
+	a.storefront, err = appleUserStorefront(ctx, token)
+
+	return a.storefront, err
+}
+
+func (a *appleMigrationAccount) playlists(ctx context.Context) ([]userPlaylistSummary, error) {
+	token, err := a.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return appleUserPlaylists(ctx, token)
+}
+
+func (a *appleMigrationAccount) items(ctx context.Context, step migrationStep) ([]libraryItem, error) {
+	token, err := a.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []libraryItem
+	switch step.Kind {
+	case "albums":
+		path := "/v1/me/library/albums?include=catalog&limit=100"
+		for path != "" && len(items) <= maxMigrationTracks {
+			var page struct {
+				Data []struct {
+					Attributes struct {
+						Name       string `json:"name"`
+						ArtistName string `json:"artistName"`
+					} `json:"attributes"`
+					Relationships struct {
+						Catalog AppleMusicAlbum `json:"catalog"`
+					} `json:"relationships"`
+				} `json:"data"`
+				Next *string `json:"next"`
+			}
+			if err := appleUserRequest(ctx, "library_albums", token, "GET", path, nil, &page); err != nil {
+				return nil, err
+			}
+			for _, album := range page.Data {
+				item := libraryItem{Name: album.Attributes.Name, Artist: album.Attributes.ArtistName}
+				if catalog := album.Relationships.Catalog.Data; len(catalog) > 0 {
+					item.UPC = catalog[0].Attributes.UPC
+				}
+				items = append(items, item)
+			}
+			path = appleNextPath(page.Next)
+		}
+	case "artists":
+		path := "/v1/me/library/artists?limit=100"
+		for path != "" && len(items) <= maxMigrationTracks {
+			var page struct {
+				Data []AppleMusicArtistData `json:"data"`
+				Next *string                `json:"next"`
+			}
+			if err := appleUserRequest(ctx, "library_artists", token, "GET", path, nil, &page); err != nil {
+				return nil, err
+			}
+			for _, artist := range page.Data {
+				items = append(items, libraryItem{Name: artist.Attributes.Name})
+			}
+			path = ""
+			if page.Next != nil {
+				path = *page.Next
+			}
+		}
+	default:
+		id := step.SourceID
+		if step.Kind == "liked" {
+			id = appleLibrarySongsID
+		}
+		_, songs, err := readAppleLibraryPlaylist(ctx, token, id, maxMigrationTracks+1)
+		if err != nil {
+			return nil, err
+		}
+		items = trackItems(appleLibraryQueries(songs))
+	}
+
+	return items, nil
+}
+
+func (a *appleMigrationAccount) trackID(candidate trackCandidate) string {
+	if match := appleSongLink.FindStringSubmatch(candidate.URL); match != nil {
+		return match[1] + match[2]
+	}
+
+	return ""
+}
+
+func (a *appleMigrationAccount) playable(ctx context.Context, ids []string) (map[string]bool, error) {
+	storefront, err := a.userStorefront(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return appleAvailableSongs(ctx, storefront, ids)
+}
+
+// findAlbum looks the album up by UPC when the source has one, and then
+// searches for it by name.
+func (a *appleMigrationAccount) findAlbum(ctx context.Context, item libraryItem) (string, error) {
+	storefront, err := a.userStorefront(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	type album struct {
+		ID         string                    `json:"id"`
+		Attributes AppleMusicAlbumAttributes `json:"attributes"`
+	}
+	if item.UPC != "" {
+		var albums struct {
+			Data []album `json:"data"`
+		}
+		path := "/v1/catalog/" + url.PathEscape(storefront) + "/albums?filter[upc]=" + url.QueryEscape(item.UPC)
+		if err := appleUserRequest(ctx, "albums_by_upc", "", "GET", path, nil, &albums); err != nil {
+			return "", err
+		}
+		if len(albums.Data) > 0 {
+			return albums.Data[0].ID, nil
+		}
+	}
+
+	var found struct {
+		Results struct {
+			Albums struct {
+				Data []album `json:"data"`
+			} `json:"albums"`
+		} `json:"results"`
+	}
+	terms := strings.TrimSpace(item.Name + " " + item.Artist)
+	path := "/v1/catalog/" + url.PathEscape(storefront) + "/search?types=albums&limit=5&term=" + url.QueryEscape(terms)
+	if err := appleUserRequest(ctx, "search_albums", "", "GET", path, nil, &found); err != nil {
+		return "", err
+	}
+	for _, result := range found.Results.Albums.Data {
+		if namesMatch(item, result.Attributes.Name, result.Attributes.ArtistName) {
+			return result.ID, nil
+		}
+	}
+
+	return "", nil
+}
+
+// findArtist isn't needed, since artists can't be added to the library.
+func (a *appleMigrationAccount) findArtist(ctx context.Context, item libraryItem) (string, error) {
+	return "", nil
+}
+
+func (a *appleMigrationAccount) unsupported(kind string) string {
+	if kind == "artists" {
+		return "Apple Music has no API for following artists"
+	}
+
+	return ""
+}
+
+func (a *appleMigrationAccount) createPlaylist(ctx context.Context, name string, description string) (string, error) {
+	token, err := a.token(ctx)
+	if err != nil {
+		return "", err
+	}
+	created, err := createAppleLibraryPlaylist(ctx, token, name, description)
+
+	return created.ID, err
+}
+
+func (a *appleMigrationAccount) addToPlaylist(ctx context.Context, id string, ids []string) error {
+	token, err := a.token(ctx)
+	if err != nil {
+		return err
+	}
+	songs := make([]gin.H, len(ids))
+	for i, songID := range ids {
+		songs[i] = gin.H{"id": songID, "type": "songs"}
+	}
+
+	return appleUserRequest(ctx, "add_library_playlist_tracks", token, "POST", "/v1/me/library/playlists/"+url.PathEscape(id)+"/tracks", gin.H{"data": songs}, nil)
+}
+
+// save adds songs or albums to the library.
+func (a *appleMigrationAccount) save(ctx context.Context, kind string, ids []string) error {
+	token, err := a.token(ctx)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	if kind == "albums" {
+		query.Set("ids[albums]", strings.Join(ids, ","))
+	} else {
+		query.Set("ids[songs]", strings.Join(ids, ","))
+	}
+
+	return appleUserRequest(ctx, "add_to_library", token, "POST", "/v1/me/library?"+query.Encode(), nil, nil)
+}
+
+func (a *appleMigrationAccount) batchSize(kind string) int {
+	return appleLibraryBatch
+}
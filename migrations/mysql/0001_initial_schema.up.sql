@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS playlists (
+  id           VARCHAR(255) NOT NULL,
+  name         VARCHAR(255) NOT NULL,
+  creator      VARCHAR(255) NOT NULL,
+  song_count   INT NOT NULL,
+  platform     VARCHAR(255) NOT NULL,
+  original_url VARCHAR(255) NOT NULL,
+  converted    BOOLEAN NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE IF NOT EXISTS playlist_content (
+  id                 VARCHAR(255) NOT NULL,
+  key_id             VARCHAR(255) NOT NULL,
+  title              VARCHAR(255) NOT NULL,
+  playlist_track_num INT NOT NULL,
+  isrc               VARCHAR(255) NOT NULL,
+  artist             VARCHAR(255) NOT NULL,
+  album              VARCHAR(255) NOT NULL,
+  album_id           VARCHAR(255) NOT NULL,
+  explicit           BOOLEAN NOT NULL,
+  original_url       VARCHAR(255) NOT NULL,
+  converted_url      VARCHAR(255),
+  confidence         INT NOT NULL,
+  track_num          INT NOT NULL,
+  PRIMARY KEY (`key_id`)
+);
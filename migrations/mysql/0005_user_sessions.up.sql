@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS user_sessions (
+  id         CHAR(64) NOT NULL,
+  created_at BIGINT NOT NULL,
+  expires_at BIGINT NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_states (
+  state         VARCHAR(64) NOT NULL,
+  session_id    CHAR(64) NOT NULL,
+  provider      VARCHAR(32) NOT NULL,
+  code_verifier VARCHAR(128) NOT NULL,
+  redirect_uri  VARCHAR(1024) NOT NULL,
+  created_at    BIGINT NOT NULL,
+  PRIMARY KEY (`state`)
+);
+
+CREATE TABLE IF NOT EXISTS provider_tokens (
+  session_id    CHAR(64) NOT NULL,
+  provider      VARCHAR(32) NOT NULL,
+  access_token  TEXT NOT NULL,
+  refresh_token TEXT,
+  scope         VARCHAR(1024),
+  expires_at    BIGINT,
+  PRIMARY KEY (`session_id`, `provider`)
+);
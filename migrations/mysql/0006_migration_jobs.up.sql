@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS migration_jobs (
+  id         VARCHAR(32) NOT NULL,
+  session_id CHAR(64) NOT NULL,
+  source     VARCHAR(32) NOT NULL,
+  target     VARCHAR(32) NOT NULL,
+  status     VARCHAR(16) NOT NULL,
+  error      TEXT,
+  progress   MEDIUMTEXT NOT NULL,
+  report     MEDIUMTEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `migration_jobs_session` (`session_id`, `created_at`),
+  KEY `migration_jobs_status` (`status`)
+);
@@ -0,0 +1 @@
+DROP INDEX playlist_content_playlist ON playlist_content;
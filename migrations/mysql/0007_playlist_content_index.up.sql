@@ -0,0 +1 @@
+CREATE INDEX playlist_content_playlist ON playlist_content (id, playlist_track_num);
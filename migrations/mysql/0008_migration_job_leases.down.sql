@@ -0,0 +1 @@
+ALTER TABLE migration_jobs DROP COLUMN owner, DROP COLUMN lease_until;
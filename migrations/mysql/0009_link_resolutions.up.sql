@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS link_resolutions (
+  track_key   VARCHAR(128) NOT NULL,
+  resolution  TEXT NOT NULL,
+  resolved_at BIGINT NOT NULL,
+  PRIMARY KEY (`track_key`)
+);
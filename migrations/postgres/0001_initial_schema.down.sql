@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS playlist_content;
+DROP TABLE IF EXISTS playlists;
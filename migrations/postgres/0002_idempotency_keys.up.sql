@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  idem_key     VARCHAR(255) NOT NULL PRIMARY KEY,
+  playlist_id  VARCHAR(255) NOT NULL,
+  request_hash CHAR(64) NOT NULL
+);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+  id          VARCHAR(64) NOT NULL PRIMARY KEY,
+  label       VARCHAR(255) NOT NULL,
+  key_hash    CHAR(64) NOT NULL UNIQUE,
+  rate_limit  INT NOT NULL,
+  daily_quota INT NOT NULL,
+  created_at  BIGINT NOT NULL,
+  revoked_at  BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS api_key_usage (
+  key_id   VARCHAR(64) NOT NULL,
+  day      CHAR(10) NOT NULL,
+  requests BIGINT NOT NULL,
+  PRIMARY KEY (key_id, day)
+);
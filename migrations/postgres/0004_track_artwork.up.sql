@@ -0,0 +1 @@
+ALTER TABLE playlist_content ADD COLUMN artwork_url VARCHAR(1024);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS migration_jobs (
+  id         VARCHAR(32) NOT NULL PRIMARY KEY,
+  session_id CHAR(64) NOT NULL,
+  source     VARCHAR(32) NOT NULL,
+  target     VARCHAR(32) NOT NULL,
+  status     VARCHAR(16) NOT NULL,
+  error      TEXT,
+  progress   TEXT NOT NULL,
+  report     TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS migration_jobs_session ON migration_jobs (session_id, created_at);
+CREATE INDEX IF NOT EXISTS migration_jobs_status ON migration_jobs (status);
@@ -0,0 +1 @@
+ALTER TABLE migration_jobs ADD COLUMN owner VARCHAR(32), ADD COLUMN lease_until BIGINT;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS link_resolutions (
+  track_key   VARCHAR(128) NOT NULL PRIMARY KEY,
+  resolution  TEXT NOT NULL,
+  resolved_at BIGINT NOT NULL
+);
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS playlists (
+  id           TEXT NOT NULL PRIMARY KEY,
+  name         TEXT NOT NULL,
+  creator      TEXT NOT NULL,
+  song_count   INTEGER NOT NULL,
+  platform     TEXT NOT NULL,
+  original_url TEXT NOT NULL,
+  converted    BOOLEAN NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS playlist_content (
+  id                 TEXT NOT NULL,
+  key_id             TEXT NOT NULL PRIMARY KEY,
+  title              TEXT NOT NULL,
+  playlist_track_num INTEGER NOT NULL,
+  isrc               TEXT NOT NULL,
+  artist             TEXT NOT NULL,
+  album              TEXT NOT NULL,
+  album_id           TEXT NOT NULL,
+  explicit           BOOLEAN NOT NULL,
+  original_url       TEXT NOT NULL,
+  converted_url      TEXT,
+  confidence         INTEGER NOT NULL,
+  track_num          INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS playlist_content_playlist ON playlist_content (id, playlist_track_num);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  idem_key     TEXT NOT NULL PRIMARY KEY,
+  playlist_id  TEXT NOT NULL,
+  request_hash TEXT NOT NULL
+);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+  id          TEXT NOT NULL PRIMARY KEY,
+  label       TEXT NOT NULL,
+  key_hash    TEXT NOT NULL UNIQUE,
+  rate_limit  INTEGER NOT NULL,
+  daily_quota INTEGER NOT NULL,
+  created_at  INTEGER NOT NULL,
+  revoked_at  INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS api_key_usage (
+  key_id   TEXT NOT NULL,
+  day      TEXT NOT NULL,
+  requests INTEGER NOT NULL,
+  PRIMARY KEY (key_id, day)
+);
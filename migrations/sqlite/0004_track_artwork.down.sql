@@ -0,0 +1 @@
+ALTER TABLE playlist_content DROP COLUMN artwork_url;
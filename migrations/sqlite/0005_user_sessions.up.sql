@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS user_sessions (
+  id         TEXT NOT NULL PRIMARY KEY,
+  created_at INTEGER NOT NULL,
+  expires_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oauth_states (
+  state         TEXT NOT NULL PRIMARY KEY,
+  session_id    TEXT NOT NULL,
+  provider      TEXT NOT NULL,
+  code_verifier TEXT NOT NULL,
+  redirect_uri  TEXT NOT NULL,
+  created_at    INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS provider_tokens (
+  session_id    TEXT NOT NULL,
+  provider      TEXT NOT NULL,
+  access_token  TEXT NOT NULL,
+  refresh_token TEXT,
+  scope         TEXT,
+  expires_at    INTEGER,
+  PRIMARY KEY (session_id, provider)
+);
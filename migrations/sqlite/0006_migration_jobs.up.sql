@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS migration_jobs (
+  id         TEXT NOT NULL PRIMARY KEY,
+  session_id TEXT NOT NULL,
+  source     TEXT NOT NULL,
+  target     TEXT NOT NULL,
+  status     TEXT NOT NULL,
+  error      TEXT,
+  progress   TEXT NOT NULL,
+  report     TEXT NOT NULL,
+  created_at INTEGER NOT NULL,
+  updated_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS migration_jobs_session ON migration_jobs (session_id, created_at);
+CREATE INDEX IF NOT EXISTS migration_jobs_status ON migration_jobs (status);
@@ -0,0 +1,2 @@
+ALTER TABLE migration_jobs DROP COLUMN lease_until;
+ALTER TABLE migration_jobs DROP COLUMN owner;
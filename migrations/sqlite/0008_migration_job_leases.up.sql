@@ -0,0 +1,2 @@
+ALTER TABLE migration_jobs ADD COLUMN owner TEXT;
+ALTER TABLE migration_jobs ADD COLUMN lease_until INTEGER;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS link_resolutions (
+  track_key   TEXT NOT NULL PRIMARY KEY,
+  resolution  TEXT NOT NULL,
+  resolved_at INTEGER NOT NULL
+);
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+oEmbed lets sites such as blogs, Discord and Notion turn a pasted share link
+into an embedded card. Consumers find the endpoint through the discovery link
+in each share page, or by registering it for our /p/ and /link URLs.
+See https://oembed.com.
+*/
+
+const (
+	// embedTrackLimit is how many tracks the embedded card lists before
+	// linking to the full share page.
+	embedTrackLimit = 10
+
+	embedWidth = 400
+	// The card's header, one row per track and the "more" link, in pixels.
+	embedHeaderHeight = 96
+	embedRowHeight    = 33
+	embedMoreHeight   = 35
+
+	// embedCacheAge matches the Cache-Control of the pages themselves.
+	embedCacheAge = 300
+)
+
+// oEmbedResponse is a "rich" oEmbed response.
+type oEmbedResponse struct {
+	Version         string `json:"version"`
+	Type            string `json:"type"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	Title           string `json:"title"`
+	AuthorName      string `json:"author_name,omitempty"`
+	HTML            string `json:"html"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	CacheAge        int    `json:"cache_age"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+/*
+sharedPlaylistID returns the playlist ID in a share page URL on this server,
+e.g. https://polyphonic.example.com/p/abc123. URLs for other hosts or paths
+aren't ours and are not recognised.
+*/
+func sharedPlaylistID(rawURL string, base string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", false
+	}
+	b, err := url.Parse(base)
+	if err != nil || !strings.EqualFold(u.Host, b.Host) {
+		return "", false
+	}
+
+	id, ok := strings.CutPrefix(strings.TrimSuffix(u.Path, "/"), "/p/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+
+	return id, true
+}
+
+/*
+linkedTrackURL returns the track link in a link resolution URL on this
+server, e.g. https://polyphonic.example.com/link?url=<track link>.
+*/
+func linkedTrackURL(rawURL string, base string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", false
+	}
+	b, err := url.Parse(base)
+	if err != nil || !strings.EqualFold(u.Host, b.Host) || strings.TrimSuffix(u.Path, "/") != "/link" {
+		return "", false
+	}
+
+	trackURL := u.Query().Get("url")
+	return trackURL, trackURL != ""
+}
+
+// embedHeight is the height at which the card shows every listed track
+// without scrolling.
+func embedHeight(tracks int, more bool) int {
+	height := embedHeaderHeight + tracks*embedRowHeight
+	if more {
+		height += embedMoreHeight
+	}
+
+	return height
+}
+
+// dimension reads an optional positive maxwidth or maxheight parameter.
+// Zero means no limit.
+func dimension(c *gin.Context, name string) (int, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// limit returns size, or max if that is smaller and set.
+func limit(size int, max int) int {
+	if max > 0 && max < size {
+		return max
+	}
+
+	return size
+}
+
+/*
+getOEmbed answers oEmbed requests for share page URLs and link resolution
+URLs. The embed is an iframe of /embed/p/:id, or of the song card at
+/embed/link, sized to fit maxwidth and maxheight. Only JSON is offered; asking
+for XML gets 501 as the specification requires.
+*/
+func getOEmbed(c *gin.Context) {
+	if format := c.DefaultQuery("format", "json"); format != "json" {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "Only the json format is supported"})
+		return
+	}
+	maxWidth, okWidth := dimension(c, "maxwidth")
+	maxHeight, okHeight := dimension(c, "maxheight")
+	if !okWidth || !okHeight {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "maxwidth and maxheight must be positive integers"})
+		return
+	}
+
+	base := publicBaseURL(c)
+	if trackURL, ok := linkedTrackURL(c.Query("url"), base); ok {
+		getSongOEmbed(c, base, trackURL, maxWidth, maxHeight)
+		return
+	}
+	id, ok := sharedPlaylistID(c.Query("url"), base)
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Not a Polyphonic share URL"})
+		return
+	}
+
+	playlistData, err := store.GetPlaylist(c.Request.Context(), id)
+	if err == errPlaylistNotFound {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Playlist not found"})
+		return
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("getOEmbed failed", "id", id, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong"})
+		return
+	}
+
+	listed := min(len(playlistData.Content), embedTrackLimit)
+	width := limit(embedWidth, maxWidth)
+	height := limit(embedHeight(listed, listed < len(playlistData.Content)), maxHeight)
+
+	embedURL := base + "/embed/p/" + url.PathEscape(id)
+	response := oEmbedResponse{
+		Version:      "1.0",
+		Type:         "rich",
+		ProviderName: "Polyphonic",
+		ProviderURL:  base,
+		Title:        playlistData.Name,
+		AuthorName:   playlistData.Creator,
+		HTML: `<iframe src="` + template.HTMLEscapeString(embedURL) + `" width="` + strconv.Itoa(width) +
+			`" height="` + strconv.Itoa(height) + `" frameborder="0" loading="lazy" title="` +
+			template.HTMLEscapeString(playlistData.Name) + `"></iframe>`,
+		Width:    width,
+		Height:   height,
+		CacheAge: embedCacheAge,
+	}
+
+	// Artwork templates can be rendered at any size, so the thumbnail fits
+	// within maxwidth and maxheight. Other artwork is assumed to be the
+	// usual 300px and left out when that is too big.
+	thumbSize := limit(limit(shareArtworkSize, maxWidth), maxHeight)
+	for _, content := range playlistData.Content {
+		if content.ArtworkURL == "" {
+			continue
+		}
+		if strings.Contains(content.ArtworkURL, "{w}") || thumbSize == shareArtworkSize {
+			response.ThumbnailURL = artworkURL(content.ArtworkURL, thumbSize)
+			response.ThumbnailWidth = thumbSize
+			response.ThumbnailHeight = thumbSize
+		}
+		break
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// getSongOEmbed answers an oEmbed request for a /link URL with the song
+// card for the linked track, provided it has been resolved through /link.
+func getSongOEmbed(c *gin.Context, base string, trackURL string, maxWidth int, maxHeight int) {
+	resolution, _, ok, err := storedLink(c.Request.Context(), trackURL)
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("getSongOEmbed failed", "url", trackURL, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong"})
+		return
+	}
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Song not found; resolve the link through /link first"})
+		return
+	}
+
+	source := resolution.Source
+	width := limit(embedWidth, maxWidth)
+	height := limit(embedHeaderHeight, maxHeight)
+	embedURL := base + "/embed/link?url=" + url.QueryEscape(trackURL)
+	response := oEmbedResponse{
+		Version:      "1.0",
+		Type:         "rich",
+		ProviderName: "Polyphonic",
+		ProviderURL:  base,
+		Title:        source.Title,
+		AuthorName:   source.Artist,
+		HTML: `<iframe src="` + template.HTMLEscapeString(embedURL) + `" width="` + strconv.Itoa(width) +
+			`" height="` + strconv.Itoa(height) + `" frameborder="0" loading="lazy" title="` +
+			template.HTMLEscapeString(source.Title) + `"></iframe>`,
+		Width:    width,
+		Height:   height,
+		CacheAge: embedCacheAge,
+	}
+
+	thumbSize := limit(limit(shareArtworkSize, maxWidth), maxHeight)
+	if source.ArtworkURL != "" && (strings.Contains(source.ArtworkURL, "{w}") || thumbSize == shareArtworkSize) {
+		response.ThumbnailURL = artworkURL(source.ArtworkURL, thumbSize)
+		response.ThumbnailWidth = thumbSize
+		response.ThumbnailHeight = thumbSize
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// getEmbed renders the compact card that oEmbed responses put in an iframe.
+func getEmbed(c *gin.Context) {
+	id := c.Param("id")
+
+	playlistData, err := store.GetPlaylist(c.Request.Context(), id)
+	if err == errPlaylistNotFound {
+		renderHTML(c, http.StatusNotFound, "embed", sharePage{NotFound: true, Title: "Playlist not found", Description: "This playlist doesn't exist or is no longer shared."})
+		return
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("getEmbed failed", "id", id, "error", err)
+		c.String(http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	page := newSharePage(playlistData, shareURL(publicBaseURL(c), id))
+	if len(page.Tracks) > embedTrackLimit {
+		page.MoreTracks = len(page.Tracks) - embedTrackLimit
+		page.Tracks = page.Tracks[:embedTrackLimit]
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	renderHTML(c, http.StatusOK, "embed", page)
+}
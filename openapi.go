@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+The OpenAPI document in api/openapi.json is the reference for the HTTP API.
+It is embedded in the binary, served at /openapi.json with a docs page at
+/docs, and its schemas are used to validate request bodies. Keep it in step
+with the routes registered in main.
+*/
+//go:embed api/openapi.json api/docs.html
+var apiFiles embed.FS
+
+// openAPISpec is the part of the OpenAPI document the server reads itself.
+type openAPISpec struct {
+	raw        []byte
+	Components struct {
+		Schemas map[string]*jsonSchema `json:"schemas"`
+	} `json:"components"`
+}
+
+/*
+jsonSchema is the subset of OpenAPI 3.0 schema objects used in our document.
+Keywords it doesn't know are ignored, so an unsupported keyword in the spec
+is not enforced; add it here when the spec starts relying on it.
+*/
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Nullable             bool                   `json:"nullable"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []any                  `json:"enum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+}
+
+var apiSpec *openAPISpec
+
+// loadAPISpec parses the embedded OpenAPI document.
+func loadAPISpec() (*openAPISpec, error) {
+	raw, err := apiFiles.ReadFile("api/openapi.json")
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &openAPISpec{raw: raw}
+	if err := json.Unmarshal(raw, spec); err != nil {
+		return nil, fmt.Errorf("parsing api/openapi.json: %v", err)
+	}
+
+	for _, match := range refPattern.FindAllSubmatch(raw, -1) {
+		if spec.Components.Schemas[string(match[1])] == nil {
+			return nil, fmt.Errorf("api/openapi.json: %s refers to a missing schema", match[0])
+		}
+	}
+
+	return spec, nil
+}
+
+// maxRequestBody bounds bodies read for validation.
+const maxRequestBody = 10 << 20
+
+/*
+validateJSON checks body against the named component schema. It returns one
+message per problem found, each starting with the path to the offending
+value, or nil if body is valid. The error is set if body isn't JSON at all.
+*/
+func (s *openAPISpec) validateJSON(schemaName string, body []byte) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+
+	var problems []string
+	s.validate(&jsonSchema{Ref: "#/components/schemas/" + schemaName}, value, "", &problems)
+
+	return problems, nil
+}
+
+var refPattern = regexp.MustCompile(`"\$ref": "#/components/schemas/([^"]+)"`)
+
+// resolve follows $ref to a component schema. loadAPISpec has checked that
+// every reference exists.
+func (s *openAPISpec) resolve(schema *jsonSchema) *jsonSchema {
+	for schema.Ref != "" {
+		schema = s.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+
+	return schema
+}
+
+// describe names a place in the body for error messages.
+func describe(path string) string {
+	if path == "" {
+		return "body"
+	}
+
+	return path
+}
+
+func (s *openAPISpec) validate(schema *jsonSchema, value any, path string, problems *[]string) {
+	schema = s.resolve(schema)
+	problem := func(format string, args ...any) {
+		*problems = append(*problems, describe(path)+": "+fmt.Sprintf(format, args...))
+	}
+
+	if value == nil {
+		if !schema.Nullable && schema.Type != "" {
+			problem("must not be null")
+		}
+		return
+	}
+
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problem("must be one of %v", schema.Enum)
+		}
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			problem("must be an object")
+			return
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				*problems = append(*problems, joinPath(path, name)+": required")
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := schema.Properties[name]; ok {
+				s.validate(property, object[name], joinPath(path, name), problems)
+				continue
+			}
+			if string(schema.AdditionalProperties) == "false" {
+				*problems = append(*problems, joinPath(path, name)+": unknown field")
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			problem("must be an array")
+			return
+		}
+		if schema.Items != nil {
+			for i, item := range array {
+				s.validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i), problems)
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			problem("must be a string")
+			return
+		}
+		length := utf8.RuneCountInString(str)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			if *schema.MinLength == 1 {
+				problem("must not be empty")
+			} else {
+				problem("must be at least %d characters", *schema.MinLength)
+			}
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			problem("must be at most %d characters", *schema.MaxLength)
+		}
+	case "integer", "number":
+		number, ok := value.(json.Number)
+		if !ok {
+			problem("must be a number")
+			return
+		}
+		if schema.Type == "integer" {
+			if _, err := number.Int64(); err != nil {
+				problem("must be an integer")
+				return
+			}
+		}
+		n, _ := number.Float64()
+		if schema.Minimum != nil && n < *schema.Minimum {
+			problem("must be at least %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && n > *schema.Maximum {
+			problem("must be at most %v", *schema.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problem("must be true or false")
+		}
+	}
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
+
+// getOpenAPI serves the OpenAPI document.
+func getOpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", apiSpec.raw)
+}
+
+// getDocs serves the API documentation page, which renders /openapi.json.
+func getDocs(c *gin.Context) {
+	page, err := apiFiles.ReadFile("api/docs.html")
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Documentation is unavailable"})
+		return
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
+
+// bindValidJSON reads the request body, checks it against the named schema
+// and decodes it into v. On failure it responds 400 and returns false.
+func bindValidJSON(c *gin.Context, schemaName string, v any) bool {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRequestBody)
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(c.Request.Body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": "Could not read the request body",
+			"errors":  []string{err.Error()},
+		})
+		return false
+	}
+
+	problems, err := apiSpec.validateJSON(schemaName, body.Bytes())
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": "Request body is not valid JSON",
+			"errors":  []string{err.Error()},
+		})
+		return false
+	}
+	if len(problems) > 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": fmt.Sprintf("Request body does not match the %s schema in /openapi.json", schemaName),
+			"errors":  problems,
+		})
+		return false
+	}
+
+	if err := json.Unmarshal(body.Bytes(), v); err != nil {
+		// The schema and the Go type disagree; the spec needs fixing.
+		loggerFrom(c.Request.Context()).Error("decoding validated body failed", "schema", schemaName, "error", err)
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": "Request body could not be decoded",
+			"errors":  []string{strings.TrimPrefix(err.Error(), "json: ")},
+		})
+		return false
+	}
+
+	return true
+}
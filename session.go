@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+User sessions let a client act on the user's own provider accounts. A session
+is created the first time the user connects an account, and its token is sent
+back on later requests in the X-Polyphonic-Session header, alongside the API
+key that identifies the app.
+*/
+
+// sessionHeader carries the user's session token.
+const sessionHeader = "X-Polyphonic-Session"
+
+// providerDisplayNames are the providers' names as shown to users.
+var providerDisplayNames = map[string]string{"spotify": "Spotify", "apple": "Apple Music", "deezer": "Deezer"}
+
+// sessions is set up by main from the same backend as store.
+var sessions SessionStore
+
+// sessionCleanupInterval is how often expired sessions, login states and
+// tokens are deleted.
+const sessionCleanupInterval = time.Hour
+
+// errNotConnected is returned when the session has no token for a provider,
+// or the token can no longer be refreshed.
+var errNotConnected = errors.New("provider account not connected")
+
+// randomToken returns n random bytes, base64url encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newSession creates a session and returns it with the token to give to the
+// client. The token is never stored; its hash is the session ID.
+func newSession(c *gin.Context) (userSession, string, error) {
+	token := "ps_" + randomToken(32)
+	now := time.Now().UTC().Truncate(time.Second)
+	session := userSession{
+		ID:        hashAPIKey(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(config.Auth.SessionTTL),
+	}
+
+	return session, token, sessions.CreateSession(c.Request.Context(), session)
+}
+
+/*
+currentSession looks up the session sent with the request. present is false
+when no session header was sent. A session that is unknown or has expired
+gets a 401 and ok false.
+*/
+func currentSession(c *gin.Context) (session userSession, present bool, ok bool) {
+	token := c.GetHeader(sessionHeader)
+	if token == "" {
+		return userSession{}, false, false
+	}
+
+	session, err := sessions.GetSession(c.Request.Context(), hashAPIKey(token))
+	if err == nil && time.Now().After(session.ExpiresAt) {
+		err = errSessionNotFound
+	}
+	if errors.Is(err, errSessionNotFound) {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": "The session has expired or does not exist; connect the account again"})
+		return userSession{}, true, false
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("reading session failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error reading the session"})
+		return userSession{}, true, false
+	}
+
+	return session, true, true
+}
+
+/*
+loginSession returns the session a provider account is being connected to:
+the one sent with the request, or a new one. token is set only for a new
+session, and must be returned to the client.
+*/
+func loginSession(c *gin.Context) (session userSession, token string, ok bool) {
+	session, present, ok := currentSession(c)
+	if present {
+		return session, "", ok
+	}
+
+	session, token, err := newSession(c)
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("creating session failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error creating a session"})
+		return userSession{}, "", false
+	}
+
+	return session, token, true
+}
+
+// requireSession is currentSession for routes that can't be used without
+// one.
+func requireSession(c *gin.Context) (userSession, bool) {
+	session, present, ok := currentSession(c)
+	if !present {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": "Send the session from connecting an account in the " + sessionHeader + " header"})
+	}
+
+	return session, ok
+}
+
+// connectedAccount is a provider account as reported to the client. Tokens
+// are never returned.
+type connectedAccount struct {
+	Provider  string     `json:"provider"`
+	Scope     string     `json:"scope,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// getSession reports the session's expiry and the accounts connected to it.
+func getSession(c *gin.Context) {
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+
+	tokens, err := sessions.ListProviderTokens(c.Request.Context(), session.ID)
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("listing provider tokens failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error reading the session"})
+		return
+	}
+	accounts := []connectedAccount{}
+	for _, token := range tokens {
+		account := connectedAccount{Provider: token.Provider, Scope: token.Scope}
+		if token.RefreshToken == "" && !token.ExpiresAt.IsZero() {
+			account.ExpiresAt = &token.ExpiresAt
+		}
+		accounts = append(accounts, account)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"created_at": session.CreatedAt,
+		"expires_at": session.ExpiresAt,
+		"accounts":   accounts,
+	})
+}
+
+// deleteSession signs out, forgetting every connected account.
+func deleteSession(c *gin.Context) {
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+
+	if err := sessions.DeleteSession(c.Request.Context(), session.ID); err != nil {
+		loggerFrom(c.Request.Context()).Error("deleting session failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error signing out"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// deleteProviderAccount disconnects one provider account from the session.
+func deleteProviderAccount(provider string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := requireSession(c)
+		if !ok {
+			return
+		}
+
+		if err := sessions.DeleteProviderToken(c.Request.Context(), session.ID, provider); err != nil {
+			loggerFrom(c.Request.Context()).Error("deleting provider token failed", "provider", provider, "error", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error disconnecting the account"})
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// sealedTokenPrefix marks a provider token encrypted by sealedSessionStore.
+const sealedTokenPrefix = "gcm1:"
+
+/*
+sealedSessionStore encrypts provider tokens on their way into the store, with
+AES-256-GCM under auth.token_key. The session ID and provider are bound as
+additional data, so a sealed token can't be copied to another row. Without a
+key, tokens are stored as they are. Tokens stored before a key was set are
+read as they are and sealed the next time they are saved. A token that can't
+be decrypted reads as not connected.
+*/
+type sealedSessionStore struct {
+	SessionStore
+	aead cipher.AEAD
+}
+
+// newSealedSessionStore wraps store. key is the base64 from auth.token_key,
+// or empty.
+func newSealedSessionStore(store SessionStore, key string) (sealedSessionStore, error) {
+	if key == "" {
+		return sealedSessionStore{SessionStore: store}, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return sealedSessionStore{}, fmt.Errorf("token key: %v", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return sealedSessionStore{}, fmt.Errorf("token key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return sealedSessionStore{}, fmt.Errorf("token key: %v", err)
+	}
+
+	return sealedSessionStore{SessionStore: store, aead: aead}, nil
+}
+
+func tokenAdditionalData(token providerToken) []byte {
+	return []byte(token.SessionID + " " + token.Provider)
+}
+
+func (s sealedSessionStore) seal(token providerToken, value string) string {
+	if s.aead == nil || value == "" {
+		return value
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), tokenAdditionalData(token))
+
+	return sealedTokenPrefix + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+func (s sealedSessionStore) open(token providerToken, value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, sealedTokenPrefix)
+	if !ok {
+		return value, nil
+	}
+	if s.aead == nil {
+		return "", errors.New("provider token is encrypted but auth.token_key is not set")
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", errors.New("provider token is not validly encrypted")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, tokenAdditionalData(token))
+	if err != nil {
+		return "", errors.New("provider token can't be decrypted; has auth.token_key changed?")
+	}
+
+	return string(plaintext), nil
+}
+
+// openToken decrypts both of token's secrets.
+func (s sealedSessionStore) openToken(token providerToken) (providerToken, error) {
+	var err error
+	if token.AccessToken, err = s.open(token, token.AccessToken); err != nil {
+		return providerToken{}, err
+	}
+	if token.RefreshToken, err = s.open(token, token.RefreshToken); err != nil {
+		return providerToken{}, err
+	}
+
+	return token, nil
+}
+
+func (s sealedSessionStore) SaveProviderToken(ctx context.Context, token providerToken) error {
+	token.AccessToken = s.seal(token, token.AccessToken)
+	token.RefreshToken = s.seal(token, token.RefreshToken)
+
+	return s.SessionStore.SaveProviderToken(ctx, token)
+}
+
+func (s sealedSessionStore) GetProviderToken(ctx context.Context, sessionID string, provider string) (providerToken, error) {
+	token, err := s.SessionStore.GetProviderToken(ctx, sessionID, provider)
+	if err != nil {
+		return providerToken{}, err
+	}
+	token, err = s.openToken(token)
+	if err != nil {
+		loggerFrom(ctx).Warn("reading provider token failed", "provider", provider, "error", err)
+		return providerToken{}, errSessionNotFound
+	}
+
+	return token, nil
+}
+
+func (s sealedSessionStore) ListProviderTokens(ctx context.Context, sessionID string) ([]providerToken, error) {
+	tokens, err := s.SessionStore.ListProviderTokens(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	opened := []providerToken{}
+	for _, token := range tokens {
+		plain, err := s.openToken(token)
+		if err != nil {
+			loggerFrom(ctx).Warn("reading provider token failed", "provider", token.Provider, "error", err)
+			continue
+		}
+		opened = append(opened, plain)
+	}
+
+	return opened, nil
+}
+
+// cleanUpSessions deletes expired sessions, login states and tokens every
+// interval until ctx is cancelled.
+func cleanUpSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		deleted, err := sessions.DeleteExpiredSessions(ctx, now, now.Add(-oauthStateTTL))
+		if err != nil && ctx.Err() == nil {
+			logger.Error("deleting expired sessions failed", "error", err)
+		} else if deleted > 0 {
+			logger.Info("deleted expired sessions", "rows", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
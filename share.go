@@ -0,0 +1,230 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webFiles holds the templates for pages served to browsers.
+//
+//go:embed web
+var webFiles embed.FS
+
+var webTemplates = template.Must(template.New("web").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).ParseFS(webFiles, "web/*.html"))
+
+// shareArtworkSize is the size requested from Apple Music artwork templates.
+const shareArtworkSize = 300
+
+// shareLink is an "Open in ..." button.
+type shareLink struct {
+	Label string
+	Class string
+	URL   string
+}
+
+type shareTrack struct {
+	Title      string
+	Artist     string
+	Album      string
+	Explicit   bool
+	ArtworkURL string
+	Links      []shareLink
+}
+
+// sharePage is what web/share.html renders.
+type sharePage struct {
+	NotFound      bool
+	Title         string
+	Description   string
+	PageURL       string
+	OEmbedURL     string
+	ImageURL      string
+	AppStoreID    string
+	PlaylistLinks []shareLink
+	Tracks        []shareTrack
+	// MoreTracks counts tracks left out of a shortened list.
+	MoreTracks int
+}
+
+/*
+providerLink turns a stored track or playlist URL into a button, based on the
+site it points to. Anything that isn't an http(s) link to Spotify, Apple
+Music or Deezer is left out.
+*/
+func providerLink(rawURL string) (shareLink, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return shareLink{}, false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == "spotify.com" || strings.HasSuffix(host, ".spotify.com"):
+		return shareLink{Label: "Open in Spotify", Class: "spotify", URL: rawURL}, true
+	case host == "music.apple.com" || host == "itunes.apple.com":
+		return shareLink{Label: "Open in Apple Music", Class: "apple", URL: rawURL}, true
+	case host == "deezer.com" || strings.HasSuffix(host, ".deezer.com"):
+		return shareLink{Label: "Open in Deezer", Class: "deezer", URL: rawURL}, true
+	}
+
+	return shareLink{}, false
+}
+
+// providerLinks returns the buttons for urls, at most one per provider.
+func providerLinks(urls ...string) []shareLink {
+	var links []shareLink
+	seen := map[string]bool{}
+	for _, raw := range urls {
+		link, ok := providerLink(raw)
+		if ok && !seen[link.Class] {
+			seen[link.Class] = true
+			links = append(links, link)
+		}
+	}
+
+	return links
+}
+
+// artworkURL fills in the {w}x{h} size in Apple Music artwork templates.
+// Other URLs are returned as they are.
+func artworkURL(raw string, size int) string {
+	if raw == "" {
+		return ""
+	}
+	if u, err := url.Parse(raw); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return ""
+	}
+
+	s := strconv.Itoa(size)
+	return strings.NewReplacer("{w}", s, "{h}", s).Replace(raw)
+}
+
+// publicBaseURL is where this server is reached from outside, for absolute
+// links in pages and embeds. Only development servers fall back to the Host
+// header; release mode requires share.base_url.
+func publicBaseURL(c *gin.Context) string {
+	if config.Share.BaseURL != "" {
+		return strings.TrimSuffix(config.Share.BaseURL, "/")
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + c.Request.Host
+}
+
+// shareURL is the public page for a shared playlist.
+func shareURL(base string, id string) string {
+	return base + "/p/" + url.PathEscape(id)
+}
+
+// playlistSummary is the one-line description used in link previews.
+func playlistSummary(p playlist_data) string {
+	songs := strconv.Itoa(len(p.Content)) + " songs"
+	if len(p.Content) == 1 {
+		songs = "1 song"
+	}
+	if p.Creator == "" {
+		return "Playlist · " + songs
+	}
+
+	return "Playlist by " + p.Creator + " · " + songs
+}
+
+// newSharePage builds the view of a stored playlist.
+func newSharePage(p playlist_data, pageURL string) sharePage {
+	page := sharePage{
+		Title:         p.Name,
+		Description:   playlistSummary(p),
+		PageURL:       pageURL,
+		AppStoreID:    config.Share.AppStoreID,
+		PlaylistLinks: providerLinks(p.OriginalURL),
+	}
+
+	for _, content := range p.Content {
+		track := shareTrack{
+			Title:      content.Title,
+			Artist:     content.Artist,
+			Album:      content.Album,
+			Explicit:   content.Explicit,
+			ArtworkURL: artworkURL(content.ArtworkURL, shareArtworkSize),
+			Links:      providerLinks(content.OriginalURL, content.ConvertURL),
+		}
+		if page.ImageURL == "" {
+			page.ImageURL = track.ArtworkURL
+		}
+		page.Tracks = append(page.Tracks, track)
+	}
+
+	return page
+}
+
+// renderHTML executes a template from web/ with the given status.
+func renderHTML(c *gin.Context, status int, name string, data any) {
+	var body strings.Builder
+	if err := webTemplates.ExecuteTemplate(&body, name, data); err != nil {
+		loggerFrom(c.Request.Context()).Error("rendering page failed", "template", name, "error", err)
+		c.String(http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	c.Data(status, "text/html; charset=utf-8", []byte(body.String()))
+}
+
+/*
+getSharePage renders the public web page for a shared playlist, so a share
+link works for people without the app. The page has Open Graph and Twitter
+tags for link previews.
+*/
+func getSharePage(c *gin.Context) {
+	id := c.Param("id")
+
+	playlistData, err := store.GetPlaylist(c.Request.Context(), id)
+	if err == errPlaylistNotFound {
+		renderHTML(c, http.StatusNotFound, "share", sharePage{NotFound: true, Title: "Playlist not found"})
+		return
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("getSharePage failed", "id", id, "error", err)
+		c.String(http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	// Shared playlists don't change, so previews and browsers can cache them.
+	c.Header("Cache-Control", "public, max-age=300")
+	base := publicBaseURL(c)
+	page := newSharePage(playlistData, shareURL(base, id))
+	page.OEmbedURL = base + "/oembed?url=" + url.QueryEscape(page.PageURL)
+	renderHTML(c, http.StatusOK, "share", page)
+}
+
+/*
+getAppleAppSiteAssociation tells iOS that share links belong to our app, so
+they open in it when it is installed. It is only served when share.apple_app_id
+is set.
+*/
+func getAppleAppSiteAssociation(c *gin.Context) {
+	if config.Share.AppleAppID == "" {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"applinks": gin.H{
+			"details": []gin.H{{
+				"appIDs":     []string{config.Share.AppleAppID},
+				"components": []gin.H{{"/": "/p/*", "comment": "Shared playlists"}},
+			}},
+		},
+	})
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
     "sync"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // used to avoid going over rate limit
@@ -30,6 +32,7 @@ type SpotifySong struct {
     ExternalURLs ExternalURLs `json:"external_urls"`
     Name         string      `json:"name"`
     TrackNumber  int         `json:"track_number"`
+    DurationMS   int         `json:"duration_ms"`
     URI          string      `json:"uri"`
 }
 
@@ -51,6 +54,10 @@ type ExternalIDs struct {
     ISRC string `json:"isrc"`
 }
 
+type SpotifySongs struct {
+    Tracks []SpotifySong `json:"tracks"`
+}
+
 type SpotifySongSearch struct {
     Tracks SpotifySongSearchTracks `json:"tracks"`
 }
@@ -143,13 +150,19 @@ type ExternalURLs struct {
 /*
     Checks to see if there is a wait time to be served b/c of rate limiting
 */
-func spotifyWaitIfLimited(w *SpotifyWaitContainer) {
+func spotifyWaitIfLimited(ctx context.Context, w *SpotifyWaitContainer) {
+    // The span covers waiting for the mutex as well as any back-off.
+    _, span := tracer.Start(ctx, "spotify rate limit wait")
+    defer span.End()
+
     w.mu.Lock()
 
     if w.waitTime > 0 {
-        fmt.Println("Spotify: Retrying after:", w.waitTime, "seconds")
+        loggerFrom(ctx).Info("Spotify: waiting before retrying", "wait_seconds", w.waitTime)
         waitDur := time.Duration(w.waitTime)
         time.Sleep(waitDur * time.Second)
+        rateLimitWaitSeconds.WithLabelValues("spotify").Add(float64(w.waitTime))
+        span.SetAttributes(attribute.Float64("rate_limit.wait_seconds", float64(w.waitTime)))
 
         w.waitTime = 0
     }
@@ -157,23 +170,22 @@ func spotifyWaitIfLimited(w *SpotifyWaitContainer) {
     w.mu.Unlock()
 }
 
-// gets Spotify auth key from local environment variables
+// gets Spotify auth key using the configured client credentials
 // and returns the key and expiration time (from now)
 func getSpotifyAuthKey(
+    ctx context.Context,
     w *SpotifyWaitContainer,
-    key chan string,
-    exp chan int64,
-) {
-    spotifyWaitIfLimited(w)
+) (string, int64, error) {
+    spotifyWaitIfLimited(ctx, w)
 
     type Response struct {
         AccessToken string `json:"access_token"`
         ExpiresIn   int64  `json:"expires_in"`
     }
 
-    // generate authorization value from env variables
-    clientID := os.Getenv("SPOTIFY_CLIENT_ID")
-    clientSecret := os.Getenv("SPOTIFY_CLIENT_SECRET")
+    // generate authorization value from the configured credentials
+    clientID := config.Spotify.ClientID
+    clientSecret := config.Spotify.ClientSecret
     authCode := clientID + ":" + clientSecret
     authCode = base64.StdEncoding.EncodeToString([]byte(authCode))
     authVal := "Basic " + authCode
@@ -182,10 +194,13 @@ func getSpotifyAuthKey(
     params := url.Values{}
     params.Add("grant_type","client_credentials")
 
-    url := "https://accounts.spotify.com/api/token"
+    url := config.Spotify.AccountsBaseURL + "/api/token"
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("POST", url, strings.NewReader(params.Encode()))
+    client := upstreamClient("spotify", "token")
+    request, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(params.Encode()))
+    if err != nil {
+        return "", 0, err
+    }
     // set HTTP header values
     request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
     request.Header.Add("Authorization", authVal)
@@ -195,57 +210,81 @@ func getSpotifyAuthKey(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Spotify: Too many requests")
-            retryAfter := response.Header.Values("retry-after")[0]
-            retryInt, _ := strconv.Atoi(retryAfter)
-
-            w.mu.Lock()
-            w.waitTime = retryInt
-
-            spotifyWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        retryAfter := response.Header.Get("retry-after")
+        retryInt, _ := strconv.Atoi(retryAfter)
+        loggerFrom(ctx).Warn("Spotify: too many requests", "retry_after", retryInt)
+        response.Body.Close()
+
+        w.mu.Lock()
+        w.waitTime = retryInt
+        w.mu.Unlock()
+        spotifyWaitIfLimited(ctx, w)
+
+        // the body was consumed by the first attempt
+        request.Body, _ = request.GetBody()
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        return "", 0, fmt.Errorf("spotify auth: %v", err)
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    if response.StatusCode != http.StatusOK {
+        return "", 0, fmt.Errorf("spotify auth: token request failed with status %d", response.StatusCode)
+    }
+
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        return "", 0, fmt.Errorf("spotify auth: %v", err)
     }
 
     var responseObject Response
 
-    json.Unmarshal(responseData, &responseObject)
+    if err := json.Unmarshal(responseData, &responseObject); err != nil {
+        return "", 0, fmt.Errorf("spotify auth: %v", err)
+    }
+    if responseObject.AccessToken == "" {
+        return "", 0, fmt.Errorf("spotify auth: no access token in response")
+    }
 
-    key <- responseObject.AccessToken
-    exp <- responseObject.ExpiresIn
+    return responseObject.AccessToken, responseObject.ExpiresIn, nil
 }
 
+// getSpotifySongByID sends the track with the given ID on spotifySong, or an
+// empty one when it can't be fetched.
 func getSpotifySongByID(
+    ctx context.Context,
     w *SpotifyWaitContainer,
     id string,
     key string,
     spotifySong chan SpotifySong,
 ) {
-    spotifyWaitIfLimited(w)
+    song, err := fetchSpotifySongByID(ctx, w, id, key)
+    if err != nil {
+        loggerFrom(ctx).Error("Spotify: request failed", "error", err)
+    }
+
+    spotifySong <- song
+}
 
-    url := "https://api.spotify.com/v1/tracks/" + id
+// fetchSpotifySongByID fetches the track with the given ID. A track that
+// doesn't exist comes back empty with no error; an error means Spotify
+// couldn't be reached or didn't answer properly.
+func fetchSpotifySongByID(
+    ctx context.Context,
+    w *SpotifyWaitContainer,
+    id string,
+    key string,
+) (SpotifySong, error) {
+    spotifyWaitIfLimited(ctx, w)
+
+    url := config.Spotify.APIBaseURL + "/tracks/" + id
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("spotify", "tracks")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -255,57 +294,121 @@ func getSpotifySongByID(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-            retryAfter := response.Header.Values("retry-after")[0]
-            retryInt, _ := strconv.Atoi(retryAfter)
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        retryAfter := response.Header.Get("retry-after")
+        retryInt, _ := strconv.Atoi(retryAfter)
+        loggerFrom(ctx).Warn("Spotify: too many requests", "retry_after", retryInt)
+        response.Body.Close()
+
+        w.mu.Lock()
+        w.waitTime = retryInt
+        w.mu.Unlock()
+        spotifyWaitIfLimited(ctx, w)
+
+        response, err = client.Do(request)
+    }
+
+    if err != nil {
+        return SpotifySong{}, fmt.Errorf("spotify: %w", err)
+    }
+    defer response.Body.Close()
+
+    // Spotify answers 400 for IDs that can't exist and 404 for ones that
+    // don't.
+    if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusBadRequest {
+        return SpotifySong{}, nil
+    }
+    if response.StatusCode < 200 || response.StatusCode > 299 {
+        return SpotifySong{}, fmt.Errorf("spotify: status %d", response.StatusCode)
+    }
+
+    responseData, err := io.ReadAll(response.Body)
+    if err != nil {
+        return SpotifySong{}, fmt.Errorf("spotify: reading response: %w", err)
+    }
 
-            w.mu.Lock()
-            w.waitTime = retryInt
+    var responseObject SpotifySong
+    if err := json.Unmarshal(responseData, &responseObject); err != nil {
+        return SpotifySong{}, fmt.Errorf("spotify: %w", err)
+    }
+
+    return responseObject, nil
+}
 
-            spotifyWaitIfLimited(w)
-            w.mu.Unlock()
+// getSpotifySongsByIDs fetches up to 50 tracks at once. Tracks that no longer
+// exist come back empty, in their place.
+func getSpotifySongsByIDs(
+    ctx context.Context,
+    w *SpotifyWaitContainer,
+    ids []string,
+    key string,
+    spotifySongs chan SpotifySongs,
+) {
+    spotifyWaitIfLimited(ctx, w)
+
+    url := config.Spotify.APIBaseURL + "/tracks?ids=" + strings.Join(ids, ",")
+    authVal := "Bearer " + key
+
+    client := upstreamClient("spotify", "several_tracks")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
+    // set HTTP header values
+    request.Header.Add("Content-Type", "application/json")
+    request.Header.Add("Authorization", authVal)
 
-            attempt++
-            response, err = client.Do(request)
-        }
+    w.mu.Lock()
+    response, err := client.Do(request)
+    w.mu.Unlock()
 
-        attempt = 2
+    // try request again after a delay if there is a 429 error
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        retryAfter := response.Header.Get("retry-after")
+        retryInt, _ := strconv.Atoi(retryAfter)
+        loggerFrom(ctx).Warn("Spotify: too many requests", "retry_after", retryInt)
+        response.Body.Close()
+
+        w.mu.Lock()
+        w.waitTime = retryInt
+        w.mu.Unlock()
+        spotifyWaitIfLimited(ctx, w)
+
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Spotify: request failed", "error", err)
+        spotifySongs <- SpotifySongs{}
+        return
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        loggerFrom(ctx).Error("Spotify: reading response failed", "error", err)
+        spotifySongs <- SpotifySongs{}
+        return
     }
 
-    var responseObject SpotifySong
+    var responseObject SpotifySongs
 
     json.Unmarshal(responseData, &responseObject)
 
-    spotifySong <- responseObject
+    spotifySongs <- responseObject
 }
 
 func getSpotifySongsBySearch(
+    ctx context.Context,
     w *SpotifyWaitContainer,
     params string,
     key string,
     spotifySongSearch chan SpotifySongSearch,
 ) {
-    spotifyWaitIfLimited(w)
+    spotifyWaitIfLimited(ctx, w)
 
-    url := "https://api.spotify.com/v1/search?q=" + params
-    fmt.Println(url)
+    url := config.Spotify.APIBaseURL + "/search?q=" + params
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("spotify", "search_tracks")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -315,57 +418,55 @@ func getSpotifySongsBySearch(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-            retryAfter := response.Header.Values("retry-after")[0]
-            retryInt, _ := strconv.Atoi(retryAfter)
-
-            w.mu.Lock()
-            w.waitTime = retryInt
-
-            spotifyWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        retryAfter := response.Header.Get("retry-after")
+        retryInt, _ := strconv.Atoi(retryAfter)
+        loggerFrom(ctx).Warn("Spotify: too many requests", "retry_after", retryInt)
+        response.Body.Close()
+
+        w.mu.Lock()
+        w.waitTime = retryInt
+        w.mu.Unlock()
+        spotifyWaitIfLimited(ctx, w)
+
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Spotify: request failed", "error", err)
+        spotifySongSearch <- SpotifySongSearch{}
+        return
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        loggerFrom(ctx).Error("Spotify: reading response failed", "error", err)
+        spotifySongSearch <- SpotifySongSearch{}
+        return
     }
 
     var responseObject SpotifySongSearch
 
     json.Unmarshal(responseData, &responseObject)
 
-    fmt.Println(responseObject)
     spotifySongSearch <- responseObject
 }
 
 func getSpotifyAlbumByID(
+    ctx context.Context,
     w *SpotifyWaitContainer,
     id string,
     key string,
     spotifyAlbum chan SpotifyAlbum,
 ) {
-    spotifyWaitIfLimited(w)
+    spotifyWaitIfLimited(ctx, w)
 
-    url := "https://api.spotify.com/v1/albums/" + id
+    url := config.Spotify.APIBaseURL + "/albums/" + id
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("spotify", "albums")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -375,34 +476,32 @@ func getSpotifyAlbumByID(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-            retryAfter := response.Header.Values("retry-after")[0]
-            retryInt, _ := strconv.Atoi(retryAfter)
-
-            w.mu.Lock()
-            w.waitTime = retryInt
-
-            spotifyWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        retryAfter := response.Header.Get("retry-after")
+        retryInt, _ := strconv.Atoi(retryAfter)
+        loggerFrom(ctx).Warn("Spotify: too many requests", "retry_after", retryInt)
+        response.Body.Close()
+
+        w.mu.Lock()
+        w.waitTime = retryInt
+        w.mu.Unlock()
+        spotifyWaitIfLimited(ctx, w)
+
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Spotify: request failed", "error", err)
+        spotifyAlbum <- SpotifyAlbum{}
+        return
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        loggerFrom(ctx).Error("Spotify: reading response failed", "error", err)
+        spotifyAlbum <- SpotifyAlbum{}
+        return
     }
 
     var responseObject SpotifyAlbum
@@ -413,18 +512,19 @@ func getSpotifyAlbumByID(
 }
 
 func getSpotifyArtistByID(
+    ctx context.Context,
     w *SpotifyWaitContainer,
     id string,
     key string,
     spotifyArtist chan SpotifyArtist,
 ) {
-    spotifyWaitIfLimited(w)
+    spotifyWaitIfLimited(ctx, w)
 
-    url := "https://api.spotify.com/v1/artists/" + id
+    url := config.Spotify.APIBaseURL + "/artists/" + id
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("spotify", "artists")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -434,34 +534,32 @@ func getSpotifyArtistByID(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-            retryAfter := response.Header.Values("retry-after")[0]
-            retryInt, _ := strconv.Atoi(retryAfter)
-
-            w.mu.Lock()
-            w.waitTime = retryInt
-
-            spotifyWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        retryAfter := response.Header.Get("retry-after")
+        retryInt, _ := strconv.Atoi(retryAfter)
+        loggerFrom(ctx).Warn("Spotify: too many requests", "retry_after", retryInt)
+        response.Body.Close()
+
+        w.mu.Lock()
+        w.waitTime = retryInt
+        w.mu.Unlock()
+        spotifyWaitIfLimited(ctx, w)
+
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Spotify: request failed", "error", err)
+        spotifyArtist <- SpotifyArtist{}
+        return
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        loggerFrom(ctx).Error("Spotify: reading response failed", "error", err)
+        spotifyArtist <- SpotifyArtist{}
+        return
     }
 
     var responseObject SpotifyArtist
@@ -472,19 +570,19 @@ func getSpotifyArtistByID(
 }
 
 func getSpotifyArtistsBySearch(
+    ctx context.Context,
     w *SpotifyWaitContainer,
     params string,
     key string,
     spotifyArtistSearch chan SpotifyArtistSearch,
 ) {
-    spotifyWaitIfLimited(w)
+    spotifyWaitIfLimited(ctx, w)
 
-    url := "https://api.spotify.com/v1/search?q=" + params
-    fmt.Println(url)
+    url := config.Spotify.APIBaseURL + "/search?q=" + params
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
+    client := upstreamClient("spotify", "search_artists")
+    request, _ := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -494,34 +592,32 @@ func getSpotifyArtistsBySearch(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-            retryAfter := response.Header.Values("retry-after")[0]
-            retryInt, _ := strconv.Atoi(retryAfter)
-
-            w.mu.Lock()
-            w.waitTime = retryInt
-
-            spotifyWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        retryAfter := response.Header.Get("retry-after")
+        retryInt, _ := strconv.Atoi(retryAfter)
+        loggerFrom(ctx).Warn("Spotify: too many requests", "retry_after", retryInt)
+        response.Body.Close()
+
+        w.mu.Lock()
+        w.waitTime = retryInt
+        w.mu.Unlock()
+        spotifyWaitIfLimited(ctx, w)
+
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Spotify: request failed", "error", err)
+        spotifyArtistSearch <- SpotifyArtistSearch{}
+        return
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
+    responseData, err := io.ReadAll(response.Body)
     if err != nil {
-        log.Fatal(err)
+        loggerFrom(ctx).Error("Spotify: reading response failed", "error", err)
+        spotifyArtistSearch <- SpotifyArtistSearch{}
+        return
     }
 
     var responseObject SpotifyArtistSearch
@@ -531,77 +627,60 @@ func getSpotifyArtistsBySearch(
     spotifyArtistSearch <- responseObject
 }
 
+/*
+getSpotifyPlaylistByID gets a playlist with its first page of tracks. A
+playlist that doesn't exist is returned empty, without an error.
+*/
 func getSpotifyPlaylistByID(
+    ctx context.Context,
     w *SpotifyWaitContainer,
     id string,
     key string,
-    spotifyPlaylist chan SpotifyPlaylist,
-) {
-    spotifyWaitIfLimited(w)
-
-    url := "https://api.spotify.com/v1/playlists/" + id
-    authVal := "Bearer " + key
-
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", url, strings.NewReader(""))
-    // set HTTP header values
-    request.Header.Add("Content-Type", "application/json")
-    request.Header.Add("Authorization", authVal)
-
-    w.mu.Lock()
-    response, err := client.Do(request)
-    w.mu.Unlock()
-
-    // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-            retryAfter := response.Header.Values("retry-after")[0]
-            retryInt, _ := strconv.Atoi(retryAfter)
-
-            w.mu.Lock()
-            w.waitTime = retryInt
-
-            spotifyWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
-    }
-
-    if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
-    }
-
-    responseData, err := ioutil.ReadAll(response.Body)
-    if err != nil {
-        log.Fatal(err)
-    }
-
+) (SpotifyPlaylist, error) {
     var responseObject SpotifyPlaylist
+    err := getSpotifyPlaylistPage(ctx, w, "playlists", config.Spotify.APIBaseURL+"/playlists/"+id, key, &responseObject)
+    if errors.Is(err, errSpotifyNotFound) {
+        return SpotifyPlaylist{}, nil
+    }
 
-    json.Unmarshal(responseData, &responseObject)
-
-    spotifyPlaylist <- responseObject
+    return responseObject, err
 }
 
+// getNextSpotifyPlaylist gets the page of a playlist's tracks at nextURL.
 func getNextSpotifyPlaylist(
+    ctx context.Context,
     w *SpotifyWaitContainer,
     nextURL string,
     key string,
-    nextSpotifyPlaylistTracks chan Tracks,
-) {
-    spotifyWaitIfLimited(w)
+) (Tracks, error) {
+    var responseObject Tracks
+    err := getSpotifyPlaylistPage(ctx, w, "playlist_tracks_next", nextURL, key, &responseObject)
+
+    return responseObject, err
+}
+
+// errSpotifyNotFound is returned for a 404 from the Spotify API.
+var errSpotifyNotFound = errors.New("spotify: not found")
+
+/*
+getSpotifyPlaylistPage requests url and decodes the response into out. Unlike
+the other lookups it fails on any error, since a page that is silently left
+out would truncate the playlist.
+*/
+func getSpotifyPlaylistPage(
+    ctx context.Context,
+    w *SpotifyWaitContainer,
+    operation string,
+    pageURL string,
+    key string,
+    out any,
+) error {
+    spotifyWaitIfLimited(ctx, w)
 
     authVal := "Bearer " + key
 
-    client := &http.Client{}
-    request, _ := http.NewRequest("GET", nextURL, strings.NewReader(""))
+    client := upstreamClient("spotify", operation)
+    request, _ := http.NewRequestWithContext(ctx, "GET", pageURL, strings.NewReader(""))
     // set HTTP header values
     request.Header.Add("Content-Type", "application/json")
     request.Header.Add("Authorization", authVal)
@@ -611,40 +690,40 @@ func getNextSpotifyPlaylist(
     w.mu.Unlock()
 
     // try request again after a delay if there is a 429 error
-    attempt := 0
-    for attempt < 2 {
-        if response.StatusCode == http.StatusTooManyRequests {
-            fmt.Println("Too many requests")
-            retryAfter := response.Header.Values("retry-after")[0]
-            retryInt, _ := strconv.Atoi(retryAfter)
-
-            w.mu.Lock()
-            w.waitTime = retryInt
-
-            spotifyWaitIfLimited(w)
-            w.mu.Unlock()
-
-            attempt++
-            response, err = client.Do(request)
-        }
-
-        attempt = 2
+    if err == nil && response.StatusCode == http.StatusTooManyRequests {
+        retryAfter := response.Header.Get("retry-after")
+        retryInt, _ := strconv.Atoi(retryAfter)
+        loggerFrom(ctx).Warn("Spotify: too many requests", "retry_after", retryInt)
+        response.Body.Close()
+
+        w.mu.Lock()
+        w.waitTime = retryInt
+        w.mu.Unlock()
+        spotifyWaitIfLimited(ctx, w)
+
+        response, err = client.Do(request)
     }
 
     if err != nil {
-        fmt.Print(err.Error())
-        os.Exit(1)
+        loggerFrom(ctx).Error("Spotify: request failed", "error", err)
+        return err
     }
+    defer response.Body.Close()
 
-    responseData, err := ioutil.ReadAll(response.Body)
-    if err != nil {
-        log.Fatal(err)
+    if response.StatusCode == http.StatusNotFound {
+        return errSpotifyNotFound
+    }
+    if response.StatusCode != http.StatusOK {
+        loggerFrom(ctx).Error("Spotify: request failed", "status", response.StatusCode)
+        return fmt.Errorf("spotify: %s responded %d", operation, response.StatusCode)
     }
 
-    var responseObject Tracks
-
-    json.Unmarshal(responseData, &responseObject)
+    responseData, err := io.ReadAll(response.Body)
+    if err != nil {
+        loggerFrom(ctx).Error("Spotify: reading response failed", "error", err)
+        return err
+    }
 
-    nextSpotifyPlaylistTracks <- responseObject
+    return json.Unmarshal(responseData, out)
 }
 
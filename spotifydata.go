@@ -0,0 +1,386 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Spotify's privacy data download ("Download your data" in the account
+settings) is a zip of JSON files. Playlist1.json, Playlist2.json and so on
+hold every playlist the account owns, including private ones, and
+YourLibrary.json holds the liked songs. Streaming history files are in the
+same archive but list plays, not playlists, so they are skipped.
+*/
+
+const (
+	// maxDataExportFile bounds a single JSON file read from an upload or
+	// from inside a zip.
+	maxDataExportFile = 50 << 20
+	// spotifyTracksBatch is how many tracks Spotify returns per request.
+	spotifyTracksBatch = 50
+	// likedSongsID selects the liked songs from YourLibrary.json.
+	likedSongsID = "liked"
+)
+
+var (
+	spotifyTrackURI = regexp.MustCompile(`^spotify:track:([0-9A-Za-z]{22})$`)
+	// Playlist1.json, Playlist2.json and so on.
+	playlistFileName = regexp.MustCompile(`^Playlist\d*\.json$`)
+)
+
+// spotifyDataTrack is a track listed in the data export. ID is empty for
+// local files, which are only searched for.
+type spotifyDataTrack struct {
+	ID    string
+	Query trackQuery
+}
+
+// spotifyDataPlaylist is a playlist, or the liked songs, from the export.
+type spotifyDataPlaylist struct {
+	ID           string
+	Name         string
+	LastModified string
+	Tracks       []spotifyDataTrack
+}
+
+// spotifyDataPlaylistSummary describes a playlist in the export.
+type spotifyDataPlaylistSummary struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Tracks       int    `json:"tracks"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// The parts of Playlist1.json that are used.
+type spotifyDataPlaylists struct {
+	Playlists []struct {
+		Name             string `json:"name"`
+		LastModifiedDate string `json:"lastModifiedDate"`
+		Items            []struct {
+			Track *struct {
+				TrackName  string `json:"trackName"`
+				ArtistName string `json:"artistName"`
+				AlbumName  string `json:"albumName"`
+				TrackURI   string `json:"trackUri"`
+			} `json:"track"`
+			LocalTrack *struct {
+				URI string `json:"uri"`
+			} `json:"localTrack"`
+		} `json:"items"`
+	} `json:"playlists"`
+}
+
+// The parts of YourLibrary.json that are used.
+type spotifyDataLibrary struct {
+	Tracks []struct {
+		Artist string `json:"artist"`
+		Album  string `json:"album"`
+		Track  string `json:"track"`
+		URI    string `json:"uri"`
+	} `json:"tracks"`
+}
+
+// spotifyDataExport collects what was read from every uploaded file.
+type spotifyDataExport struct {
+	playlists []spotifyDataPlaylist
+	liked     *spotifyDataPlaylist
+}
+
+func spotifyTrackID(uri string) string {
+	if match := spotifyTrackURI.FindStringSubmatch(uri); match != nil {
+		return match[1]
+	}
+
+	return ""
+}
+
+// localTrack reads a local file's URI, which looks like
+// spotify:local:Artist:Album:Title:215 with each part form-encoded.
+func localTrack(uri string) (trackQuery, bool) {
+	parts := strings.Split(strings.TrimPrefix(uri, "spotify:local:"), ":")
+	if len(parts) != 4 {
+		return trackQuery{}, false
+	}
+	for i := range parts {
+		parts[i], _ = url.QueryUnescape(parts[i])
+	}
+	seconds, _ := strconv.Atoi(parts[3])
+
+	return trackQuery{Artist: parts[0], Album: parts[1], Title: parts[2], Duration: time.Duration(seconds) * time.Second}, parts[2] != ""
+}
+
+// add reads one JSON file from the export. Files with neither playlists nor
+// liked songs are ignored.
+func (e *spotifyDataExport) add(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		var history []json.RawMessage
+		if json.Unmarshal(data, &history) == nil {
+			// Streaming history is a bare array.
+			return nil
+		}
+		return err
+	}
+
+	switch {
+	case fields["playlists"] != nil:
+		var file spotifyDataPlaylists
+		if err := json.Unmarshal(data, &file); err != nil {
+			return err
+		}
+		for _, playlist := range file.Playlists {
+			p := spotifyDataPlaylist{
+				ID:           strconv.Itoa(len(e.playlists) + 1),
+				Name:         strings.TrimSpace(playlist.Name),
+				LastModified: playlist.LastModifiedDate,
+			}
+			for _, item := range playlist.Items {
+				switch {
+				case item.Track != nil:
+					p.Tracks = append(p.Tracks, spotifyDataTrack{
+						ID:    spotifyTrackID(item.Track.TrackURI),
+						Query: trackQuery{Title: item.Track.TrackName, Artist: item.Track.ArtistName, Album: item.Track.AlbumName},
+					})
+				case item.LocalTrack != nil:
+					if q, ok := localTrack(item.LocalTrack.URI); ok {
+						p.Tracks = append(p.Tracks, spotifyDataTrack{Query: q})
+					}
+				}
+			}
+			e.playlists = append(e.playlists, p)
+		}
+	case fields["tracks"] != nil:
+		var file spotifyDataLibrary
+		if err := json.Unmarshal(data, &file); err != nil {
+			return err
+		}
+		liked := spotifyDataPlaylist{ID: likedSongsID, Name: "Liked Songs"}
+		for _, track := range file.Tracks {
+			liked.Tracks = append(liked.Tracks, spotifyDataTrack{
+				ID:    spotifyTrackID(track.URI),
+				Query: trackQuery{Title: track.Track, Artist: track.Artist, Album: track.Album},
+			})
+		}
+		e.liked = &liked
+	}
+
+	return nil
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxDataExportFile+1))
+	if err == nil && len(data) > maxDataExportFile {
+		err = fmt.Errorf("the file is larger than %d MiB", maxDataExportFile>>20)
+	}
+
+	return data, err
+}
+
+// addZip reads the playlist and library files from a zip of the export.
+func (e *spotifyDataExport) addZip(r io.ReaderAt, size int64) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range archive.File {
+		name := path.Base(f.Name)
+		if !playlistFileName.MatchString(name) && name != "YourLibrary.json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		data, err := readLimited(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := e.add(data); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// addUpload reads an uploaded zip or JSON file.
+func (e *spotifyDataExport) addUpload(header *multipart.FileHeader) error {
+	f, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if n, _ := io.ReadFull(f, magic); bytes.Equal(magic[:n], []byte("PK\x03\x04")) {
+		return e.addZip(f, header.Size)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := readLimited(f)
+	if err != nil {
+		return err
+	}
+
+	return e.add(bytes.TrimPrefix(data, []byte("\ufeff")))
+}
+
+// all lists the liked songs first, then the playlists in export order.
+func (e *spotifyDataExport) all() []spotifyDataPlaylist {
+	var all []spotifyDataPlaylist
+	if e.liked != nil {
+		all = append(all, *e.liked)
+	}
+
+	return append(all, e.playlists...)
+}
+
+func (e *spotifyDataExport) summaries() []spotifyDataPlaylistSummary {
+	summaries := []spotifyDataPlaylistSummary{}
+	for _, p := range e.all() {
+		summaries = append(summaries, spotifyDataPlaylistSummary{ID: p.ID, Name: p.Name, Tracks: len(p.Tracks), LastModified: p.LastModified})
+	}
+
+	return summaries
+}
+
+// playlist finds a playlist by ID or, failing that, by name.
+func (e *spotifyDataExport) playlist(selected string) (spotifyDataPlaylist, bool) {
+	all := e.all()
+	for _, p := range all {
+		if p.ID == selected {
+			return p, true
+		}
+	}
+	for _, p := range all {
+		if p.Name == selected {
+			return p, true
+		}
+	}
+
+	return spotifyDataPlaylist{}, false
+}
+
+// hydrateSpotifyTracks fetches the tracks with IDs from Spotify, keyed by ID.
+// Tracks Spotify no longer has are left out.
+func hydrateSpotifyTracks(ctx context.Context, tracks []spotifyDataTrack) map[string]SpotifySong {
+	var ids []string
+	for _, track := range tracks {
+		if track.ID != "" {
+			ids = append(ids, track.ID)
+		}
+	}
+
+	songs := map[string]SpotifySong{}
+	for start := 0; start < len(ids); start += spotifyTracksBatch {
+		batch := ids[start:min(start+spotifyTracksBatch, len(ids))]
+		spotifySongsChan := make(chan SpotifySongs)
+		go getSpotifySongsByIDs(ctx, &sWait, batch, currentSpotifyKey(), spotifySongsChan)
+
+		for i, song := range (<-spotifySongsChan).Tracks {
+			if song.Name != "" && i < len(batch) {
+				songs[batch[i]] = song
+			}
+		}
+	}
+
+	return songs
+}
+
+// matchSpotifyDataTracks matches exported tracks on providers, treating those
+// that still exist on Spotify as known there.
+func matchSpotifyDataTracks(ctx context.Context, tracks []spotifyDataTrack, providers []string) []trackMatches {
+	songs := hydrateSpotifyTracks(ctx, tracks)
+
+	queries := make([]trackQuery, len(tracks))
+	known := map[int]trackCandidate{}
+	for i, track := range tracks {
+		queries[i] = track.Query
+		if song, ok := songs[track.ID]; ok {
+			known[i] = spotifyCandidate(song)
+		}
+	}
+
+	return matchKnownTracks(ctx, "spotify", withoutProvider(providers, "spotify"), queries, known)
+}
+
+/*
+postSpotifyDataImport reads Spotify's account data export, as the zip or as
+its JSON files. Without a playlist field it lists the playlists and liked
+songs found; with one, given as an ID from that list or a name, it converts
+that playlist and saves it as a shared playlist.
+*/
+func postSpotifyDataImport(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxLibraryUpload)
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["file"]) == 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Upload the data export zip, or its JSON files, as the multipart form field \"file\""})
+		return
+	}
+
+	var export spotifyDataExport
+	var problems []string
+	for _, header := range form.File["file"] {
+		if err := export.addUpload(header); err != nil {
+			problems = append(problems, header.Filename+": "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": "Could not read the Spotify data export",
+			"errors":  problems,
+		})
+		return
+	}
+	if len(export.all()) == 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "No playlists or liked songs were found; upload Playlist1.json or YourLibrary.json"})
+		return
+	}
+
+	selected := strings.TrimSpace(c.PostForm("playlist"))
+	if selected == "" {
+		c.IndentedJSON(http.StatusOK, gin.H{"playlists": export.summaries()})
+		return
+	}
+	platform, ok := importPlatform(c)
+	if !ok {
+		return
+	}
+
+	p, ok := export.playlist(selected)
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("The export has no playlist %q", selected)})
+		return
+	}
+	imported := importedPlaylist{Name: p.Name}
+	if name := strings.TrimSpace(c.PostForm("name")); name != "" {
+		imported.Name = name
+	}
+	for _, track := range p.Tracks {
+		imported.Entries = append(imported.Entries, track.Query)
+	}
+	if !checkImport(c, &imported) {
+		return
+	}
+
+	matchImport(c, imported, platform, func(ctx context.Context, providers []string) []trackMatches {
+		return matchSpotifyDataTracks(ctx, p.Tracks, providers)
+	})
+}
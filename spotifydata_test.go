@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPlaylistFile = `{"playlists": [
+	{"name": " Road Trip ", "lastModifiedDate": "2023-05-01", "items": [
+		{"track": {"trackName": "Yesterday", "artistName": "The Beatles", "albumName": "Help!", "trackUri": "spotify:track:3BQHpFgAp4l80e1XslIjNI"}},
+		{"localTrack": {"uri": "spotify:local:Queen:A+Night+at+the+Opera:Bohemian+Rhapsody:354"}},
+		{"localTrack": {"uri": "spotify:local:::"}},
+		{"episode": {"episodeName": "A podcast"}},
+		{"track": {"trackName": "Odd URI", "artistName": "Someone", "trackUri": "spotify:track:short"}}
+	]},
+	{"name": "Empty", "lastModifiedDate": "2022-01-01", "items": []}
+]}`
+
+const testLibraryFile = `{"tracks": [
+	{"artist": "Bicep", "album": "Isles", "track": "Glue", "uri": "spotify:track:2aJDlirz6v2a4HREki98cP"}
+], "albums": []}`
+
+func TestSpotifyTrackID(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"spotify:track:3BQHpFgAp4l80e1XslIjNI", "3BQHpFgAp4l80e1XslIjNI"},
+		{"spotify:track:3BQHpFgAp4l80e1XslIjN", ""},
+		{"spotify:episode:3BQHpFgAp4l80e1XslIjNI", ""},
+		{"spotify:track:3BQHpFgAp4l80e1XslIjNI?x", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := spotifyTrackID(test.uri); got != test.want {
+			t.Errorf("spotifyTrackID(%q) = %q, want %q", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestLocalTrack(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want trackQuery
+		ok   bool
+	}{
+		{"spotify:local:Queen:A+Night+at+the+Opera:Bohemian+Rhapsody:354", trackQuery{Title: "Bohemian Rhapsody", Artist: "Queen", Album: "A Night at the Opera", Duration: 354 * time.Second}, true},
+		{"spotify:local:::Untitled%3A+Part+1:", trackQuery{Title: "Untitled: Part 1"}, true},
+		{"spotify:local:Queen:::354", trackQuery{Artist: "Queen", Duration: 354 * time.Second}, false},
+		{"spotify:local:Queen:Bohemian+Rhapsody", trackQuery{}, false},
+	}
+
+	for _, test := range tests {
+		got, ok := localTrack(test.uri)
+		if ok != test.ok || (ok && got != test.want) {
+			t.Errorf("localTrack(%q) = %+v, %v; want %+v, %v", test.uri, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestSpotifyDataExportAdd(t *testing.T) {
+	var export spotifyDataExport
+	for _, file := range []string{testLibraryFile, testPlaylistFile, `[{"ts": "2023-01-01", "ms_played": 1000}]`, `{"userName": "tester"}`} {
+		if err := export.add([]byte(file)); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	want := []spotifyDataPlaylistSummary{
+		{ID: likedSongsID, Name: "Liked Songs", Tracks: 1},
+		{ID: "1", Name: "Road Trip", Tracks: 3, LastModified: "2023-05-01"},
+		{ID: "2", Name: "Empty", LastModified: "2022-01-01"},
+	}
+	if got := export.summaries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("summaries = %+v, want %+v", got, want)
+	}
+
+	roadTrip, ok := export.playlist("Road Trip")
+	wantTracks := []spotifyDataTrack{
+		{ID: "3BQHpFgAp4l80e1XslIjNI", Query: trackQuery{Title: "Yesterday", Artist: "The Beatles", Album: "Help!"}},
+		{Query: trackQuery{Title: "Bohemian Rhapsody", Artist: "Queen", Album: "A Night at the Opera", Duration: 354 * time.Second}},
+		{Query: trackQuery{Title: "Odd URI", Artist: "Someone"}},
+	}
+	if !ok || !reflect.DeepEqual(roadTrip.Tracks, wantTracks) {
+		t.Errorf("playlist(\"Road Trip\") = %+v, %v; want %+v", roadTrip.Tracks, ok, wantTracks)
+	}
+	for _, selected := range []string{"1", likedSongsID, "Empty"} {
+		if _, ok := export.playlist(selected); !ok {
+			t.Errorf("playlist(%q) found nothing", selected)
+		}
+	}
+	if _, ok := export.playlist("3"); ok {
+		t.Errorf("playlist(\"3\") found a playlist that doesn't exist")
+	}
+}
+
+func TestSpotifyDataExportAddMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"truncated", testPlaylistFile[:len(testPlaylistFile)/2]},
+		{"playlists that aren't a list", `{"playlists": {"name": "Road Trip"}}`},
+		{"a track name that isn't a string", `{"tracks": [{"track": 5}]}`},
+		{"not JSON", "title,artist\n"},
+	}
+
+	for _, test := range tests {
+		var export spotifyDataExport
+		if err := export.add([]byte(test.data)); err == nil {
+			t.Errorf("add of %s succeeded, want an error", test.name)
+		}
+	}
+}
+
+// testZip returns a zip holding the given files.
+func testZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	archive := zip.NewWriter(&b)
+	for name, content := range files {
+		f, err := archive.Create(name)
+		if err != nil {
+			t.Fatalf("zip: %v", err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("zip: %v", err)
+	}
+
+	return b.Bytes()
+}
+
+func TestSpotifyDataExportAddZip(t *testing.T) {
+	data := testZip(t, map[string]string{
+		"Spotify Account Data/Playlist1.json":         testPlaylistFile,
+		"Spotify Account Data/YourLibrary.json":       testLibraryFile,
+		"Spotify Account Data/StreamingHistory0.json": "not even JSON",
+		"Spotify Account Data/Playlist1.json.bak":     "not even JSON",
+		"Spotify Account Data/MyPlaylists/Notes.json": "not even JSON",
+	})
+
+	var export spotifyDataExport
+	if err := export.addZip(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("addZip: %v", err)
+	}
+	if got := len(export.summaries()); got != 3 {
+		t.Errorf("addZip read %d playlists, want the liked songs and 2 playlists", got)
+	}
+
+	broken := testZip(t, map[string]string{"Playlist2.json": `{"playlists": [`})
+	err := (&spotifyDataExport{}).addZip(bytes.NewReader(broken), int64(len(broken)))
+	if err == nil || !strings.HasPrefix(err.Error(), "Playlist2.json: ") {
+		t.Errorf("addZip of a broken playlist file = %v, want an error naming the file", err)
+	}
+
+	notZip := []byte("PK\x03\x04 but not really")
+	if err := (&spotifyDataExport{}).addZip(bytes.NewReader(notZip), int64(len(notZip))); err == nil {
+		t.Errorf("addZip of a file that isn't a zip succeeded, want an error")
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	if _, err := readLimited(bytes.NewReader(make([]byte, maxDataExportFile))); err != nil {
+		t.Errorf("readLimited of %d bytes = %v, want no error", maxDataExportFile, err)
+	}
+	if _, err := readLimited(bytes.NewReader(make([]byte, maxDataExportFile+1))); err == nil {
+		t.Errorf("readLimited of %d bytes succeeded, want an error", maxDataExportFile+1)
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Users connect their Spotify accounts with the Authorization Code flow and
+PKCE. The server keeps the code verifier and exchanges the code itself, so
+the client only opens the authorize URL and later sends its session. The
+authorize and token endpoints are under the configured accounts URL, so a
+local stand-in can be used in development.
+*/
+
+const (
+	// spotifyLoginScopes lets playlists be written to the account, its
+	// private and collaborative playlists, liked songs and followed artists
+	// be read, and its library be added to by migrations.
+	spotifyLoginScopes = "playlist-modify-private playlist-modify-public playlist-read-private playlist-read-collaborative user-library-read user-library-modify user-follow-read user-follow-modify"
+	// oauthStateTTL is how long the user has to finish logging in.
+	oauthStateTTL = 10 * time.Minute
+	// loginCookie holds the state of the login a browser started. The
+	// callback only accepts the state the browser sends back in it, so an
+	// authorize URL handed to someone else can't connect their account to
+	// the session that started the login.
+	loginCookie = "polyphonic_login"
+	// loginCookiePath limits loginCookie to the callback.
+	loginCookiePath = "/auth/spotify/callback"
+	// tokenRefreshMargin refreshes tokens this long before they expire.
+	tokenRefreshMargin = time.Minute
+	// spotifyPlaylistBatch is how many tracks Spotify adds per request.
+	spotifyPlaylistBatch = 100
+	// maxUserRequestAttempts bounds retries of a rate limited request made
+	// for a user.
+	maxUserRequestAttempts = 3
+)
+
+var spotifyTrackLink = regexp.MustCompile(`^https://open\.spotify\.com/(?:intl-[a-z-]+/)?track/([0-9A-Za-z]{22})`)
+
+// pkceChallenge derives the S256 code challenge for verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func spotifyRedirectURL(c *gin.Context) string {
+	if config.Spotify.RedirectURL != "" {
+		return config.Spotify.RedirectURL
+	}
+
+	return publicBaseURL(c) + "/auth/spotify/callback"
+}
+
+// setLoginCookie binds a login to the browser by setting loginCookie to its
+// state, or clears the cookie when state is empty. SameSite=Lax still sends
+// it on the redirect back from the provider.
+func setLoginCookie(c *gin.Context, state string) {
+	maxAge := int(oauthStateTTL.Seconds())
+	if state == "" {
+		maxAge = -1
+	}
+	secure := c.Request.TLS != nil || strings.HasPrefix(publicBaseURL(c), "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(loginCookie, state, maxAge, loginCookiePath, "", secure, true)
+}
+
+/*
+postSpotifyLogin starts connecting a Spotify account. The request's session
+is reused when one is sent, so a user can connect both providers to one
+session; otherwise a new session is created and its token returned. The
+client opens authorize_url in a browser, and the provider sends the user back
+to the callback. The request must come from that browser, which is given the
+login cookie the callback checks.
+*/
+func postSpotifyLogin(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, token, ok := loginSession(c)
+	if !ok {
+		return
+	}
+	status := http.StatusOK
+	response := gin.H{}
+	if token != "" {
+		status = http.StatusCreated
+		response["session"] = token
+	}
+
+	state := oauthState{
+		State:        randomToken(24),
+		SessionID:    session.ID,
+		Provider:     "spotify",
+		CodeVerifier: randomToken(48),
+		RedirectURI:  spotifyRedirectURL(c),
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := sessions.CreateOAuthState(ctx, state); err != nil {
+		loggerFrom(ctx).Error("saving login state failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error starting the login"})
+		return
+	}
+	setLoginCookie(c, state.State)
+
+	query := url.Values{}
+	query.Set("client_id", config.Spotify.ClientID)
+	query.Set("response_type", "code")
+	query.Set("redirect_uri", state.RedirectURI)
+	query.Set("state", state.State)
+	query.Set("scope", spotifyLoginScopes)
+	query.Set("code_challenge_method", "S256")
+	query.Set("code_challenge", pkceChallenge(state.CodeVerifier))
+
+	response["authorize_url"] = config.Spotify.AccountsBaseURL + "/authorize?" + query.Encode()
+	response["expires_at"] = session.ExpiresAt
+	c.IndentedJSON(status, response)
+}
+
+// loginPage is shown in the browser when a login finishes and no return URL
+// is configured.
+type loginPage struct {
+	Provider string
+	Error    string
+}
+
+// finishLogin sends the browser back to the app, or shows a page, once a
+// login has succeeded or failed.
+func finishLogin(c *gin.Context, provider string, problem string) {
+	if config.Auth.LoginReturnURL != "" {
+		query := url.Values{}
+		query.Set("provider", provider)
+		query.Set("status", "connected")
+		if problem != "" {
+			query.Set("status", "error")
+			query.Set("error", problem)
+		}
+		separator := "?"
+		if strings.Contains(config.Auth.LoginReturnURL, "?") {
+			separator = "&"
+		}
+		c.Redirect(http.StatusSeeOther, config.Auth.LoginReturnURL+separator+query.Encode())
+		return
+	}
+
+	status := http.StatusOK
+	if problem != "" {
+		status = http.StatusBadRequest
+	}
+	c.Header("Cache-Control", "no-store")
+	renderHTML(c, status, "login", loginPage{Provider: providerDisplayNames[provider], Error: problem})
+}
+
+// spotifyTokenResponse is the accounts service's reply to a token request.
+type spotifyTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// requestSpotifyUserToken posts params to the token endpoint. invalid is set
+// when Spotify rejected the grant, as opposed to failing to answer.
+func requestSpotifyUserToken(ctx context.Context, params url.Values) (response spotifyTokenResponse, invalid bool, err error) {
+	params.Set("client_id", config.Spotify.ClientID)
+	request, err := http.NewRequestWithContext(ctx, "POST", config.Spotify.AccountsBaseURL+"/api/token", strings.NewReader(params.Encode()))
+	if err != nil {
+		return response, false, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpResponse, err := upstreamClient("spotify", "user_token").Do(request)
+	if err != nil {
+		return response, false, fmt.Errorf("spotify token: %v", err)
+	}
+	defer httpResponse.Body.Close()
+
+	responseData, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return response, false, fmt.Errorf("spotify token: %v", err)
+	}
+	json.Unmarshal(responseData, &response)
+	if httpResponse.StatusCode == http.StatusBadRequest || httpResponse.StatusCode == http.StatusUnauthorized {
+		return response, true, fmt.Errorf("spotify token: %s", response.Error)
+	}
+	if httpResponse.StatusCode != http.StatusOK || response.AccessToken == "" {
+		return response, false, fmt.Errorf("spotify token: request failed with status %d", httpResponse.StatusCode)
+	}
+
+	return response, false, nil
+}
+
+/*
+getSpotifyCallback finishes a Spotify login by exchanging the code for tokens
+and saving them to the session that started it. The state is used up either
+way, and is only accepted from the browser holding it in the login cookie.
+*/
+func getSpotifyCallback(c *gin.Context) {
+	ctx := c.Request.Context()
+	cookie, _ := c.Cookie(loginCookie)
+	setLoginCookie(c, "")
+	state, err := sessions.TakeOAuthState(ctx, c.Query("state"))
+	if err != nil || state.Provider != "spotify" || time.Since(state.CreatedAt) > oauthStateTTL {
+		if err != nil && !errors.Is(err, errSessionNotFound) {
+			loggerFrom(ctx).Error("reading login state failed", "error", err)
+		}
+		finishLogin(c, "spotify", "invalid_state")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(cookie), []byte(state.State)) != 1 {
+		loggerFrom(ctx).Warn("Spotify: login finished in a browser that didn't start it")
+		finishLogin(c, "spotify", "login_started_elsewhere")
+		return
+	}
+	if problem := c.Query("error"); problem != "" {
+		finishLogin(c, "spotify", problem)
+		return
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", c.Query("code"))
+	params.Set("redirect_uri", state.RedirectURI)
+	params.Set("code_verifier", state.CodeVerifier)
+	response, _, err := requestSpotifyUserToken(ctx, params)
+	if err != nil {
+		loggerFrom(ctx).Warn("Spotify: exchanging login code failed", "error", err)
+		finishLogin(c, "spotify", "token_exchange_failed")
+		return
+	}
+
+	token := providerToken{
+		SessionID:    state.SessionID,
+		Provider:     "spotify",
+		AccessToken:  response.AccessToken,
+		RefreshToken: response.RefreshToken,
+		Scope:        response.Scope,
+		ExpiresAt:    time.Now().Add(time.Duration(response.ExpiresIn) * time.Second).UTC(),
+	}
+	if err := sessions.SaveProviderToken(ctx, token); err != nil {
+		loggerFrom(ctx).Error("saving Spotify token failed", "error", err)
+		finishLogin(c, "spotify", "server_error")
+		return
+	}
+	loggerFrom(ctx).Info("Spotify account connected")
+
+	finishLogin(c, "spotify", "")
+}
+
+/*
+userSpotifyToken returns an access token for the session's Spotify account,
+refreshing it when it is about to expire. A refresh token Spotify no longer
+accepts disconnects the account.
+*/
+func userSpotifyToken(ctx context.Context, session userSession) (string, error) {
+	token, err := sessions.GetProviderToken(ctx, session.ID, "spotify")
+	if errors.Is(err, errSessionNotFound) {
+		return "", errNotConnected
+	}
+	if err != nil {
+		return "", err
+	}
+	if time.Until(token.ExpiresAt) > tokenRefreshMargin {
+		return token.AccessToken, nil
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "refresh_token")
+	params.Set("refresh_token", token.RefreshToken)
+	response, invalid, err := requestSpotifyUserToken(ctx, params)
+	if invalid {
+		loggerFrom(ctx).Warn("Spotify: refresh token rejected; disconnecting account", "error", err)
+		sessions.DeleteProviderToken(ctx, session.ID, "spotify")
+		return "", errNotConnected
+	}
+	if err != nil {
+		return "", err
+	}
+
+	token.AccessToken = response.AccessToken
+	token.ExpiresAt = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second).UTC()
+	if response.RefreshToken != "" {
+		token.RefreshToken = response.RefreshToken
+	}
+	if response.Scope != "" {
+		token.Scope = response.Scope
+	}
+	if err := sessions.SaveProviderToken(ctx, token); err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
+
+// spotifyTokenFor is userSpotifyToken for handlers, responding when the
+// session has no Spotify account or its token can't be refreshed.
+func spotifyTokenFor(c *gin.Context, session userSession) (string, bool) {
+	token, err := userSpotifyToken(c.Request.Context(), session)
+	if errors.Is(err, errNotConnected) {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "Connect a Spotify account first with POST /auth/spotify/login"})
+		return "", false
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("reading Spotify token failed", "error", err)
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"error": "spotify authentication unavailable"})
+		return "", false
+	}
+
+	return token, true
+}
+
+// userAPIError is an error response from a provider to a request made for a
+// user.
+type userAPIError struct {
+	Provider string
+	Status   int
+	Message  string
+}
+
+func (e userAPIError) Error() string {
+	return fmt.Sprintf("%s: request failed with status %d: %s", e.Provider, e.Status, e.Message)
+}
+
+/*
+spotifyUserRequest calls the Web API with a user's token, encoding body and
+decoding the response into out when they aren't nil. path is relative to the
+API base URL, or a full URL such as a page's next link. Rate limited requests
+wait for Retry-After, shared with the app's own requests, and are retried.
+*/
+func spotifyUserRequest(ctx context.Context, operation string, token string, method string, path string, body any, out any) error {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	target := path
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		target = config.Spotify.APIBaseURL + path
+	}
+	client := upstreamClient("spotify", operation)
+
+	for attempt := 1; ; attempt++ {
+		spotifyWaitIfLimited(ctx, &sWait)
+
+		request, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		if body != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+
+		response, err := client.Do(request)
+		if err != nil {
+			return fmt.Errorf("spotify: %v", err)
+		}
+		responseData, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return fmt.Errorf("spotify: %v", err)
+		}
+
+		if response.StatusCode == http.StatusTooManyRequests && attempt < maxUserRequestAttempts {
+			retryInt, _ := strconv.Atoi(response.Header.Get("retry-after"))
+			loggerFrom(ctx).Warn("Spotify: too many requests", "retry_after", retryInt)
+			sWait.mu.Lock()
+			sWait.waitTime = max(retryInt, 1)
+			sWait.mu.Unlock()
+			continue
+		}
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			var problem struct {
+				Error struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			json.Unmarshal(responseData, &problem)
+			return userAPIError{Provider: "spotify", Status: response.StatusCode, Message: problem.Error.Message}
+		}
+
+		if out != nil {
+			if err := json.Unmarshal(responseData, out); err != nil {
+				return fmt.Errorf("spotify: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+// providerPlaylistRequest is the optional body for writing a shared playlist
+// to a user's account.
+type providerPlaylistRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Public      bool   `json:"public"`
+}
+
+// createdPlaylist is a playlist written to a user's account.
+type createdPlaylist struct {
+	Provider string `json:"provider"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	URL      string `json:"url,omitempty"`
+}
+
+// skippedTrack is a track of a shared playlist that could not be added.
+type skippedTrack struct {
+	Position int    `json:"position"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Reason   string `json:"reason"`
+}
+
+/*
+sharedPlaylistForWrite reads the shared playlist named in the path and the
+optional request body, filling in a default name and description. It responds
+and reports false when either is missing or invalid.
+*/
+func sharedPlaylistForWrite(c *gin.Context) (playlist_data, providerPlaylistRequest, bool) {
+	var request providerPlaylistRequest
+	if c.Request.ContentLength != 0 && !bindValidJSON(c, "ProviderPlaylistRequest", &request) {
+		return playlist_data{}, request, false
+	}
+
+	p, err := store.GetPlaylist(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, errPlaylistNotFound) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Playlist not found"})
+		return p, request, false
+	}
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("loading playlist failed", "id", c.Param("id"), "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error loading the playlist"})
+		return p, request, false
+	}
+
+	if request.Name == "" {
+		request.Name = p.Name
+	}
+	if request.Description == "" {
+		request.Description = "Shared with Polyphonic: " + shareURL(publicBaseURL(c), p.ID)
+	}
+
+	return p, request, true
+}
+
+// writeProviderError responds to a failed write to a user's account.
+func writeProviderError(c *gin.Context, provider string, err error, created *createdPlaylist, added int) {
+	response := gin.H{"message": "Error writing the playlist to " + provider}
+	var apiErr userAPIError
+	if errors.Is(err, errAppleUserToken) || errors.As(err, &apiErr) && (apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden) {
+		response["message"] = "The " + provider + " account did not allow the playlist to be written; connect it again"
+	}
+	if created != nil {
+		response["playlist"] = created
+		response["added"] = added
+	}
+	loggerFrom(c.Request.Context()).Warn("writing playlist to user account failed", "provider", provider, "added", added, "error", err)
+	c.IndentedJSON(http.StatusBadGateway, response)
+}
+
+// createSpotifyPlaylist creates an empty playlist in the user's Spotify
+// account.
+func createSpotifyPlaylist(ctx context.Context, token string, request providerPlaylistRequest) (createdPlaylist, error) {
+	var user struct {
+		ID string `json:"id"`
+	}
+	if err := spotifyUserRequest(ctx, "me", token, "GET", "/me", nil, &user); err != nil {
+		return createdPlaylist{}, err
+	}
+
+	var spotifyPlaylist struct {
+		ID           string       `json:"id"`
+		Name         string       `json:"name"`
+		ExternalURLs ExternalURLs `json:"external_urls"`
+	}
+	err := spotifyUserRequest(ctx, "create_playlist", token, "POST", "/users/"+url.PathEscape(user.ID)+"/playlists", gin.H{
+		"name":        request.Name,
+		"description": request.Description,
+		"public":      request.Public,
+	}, &spotifyPlaylist)
+	if err != nil {
+		return createdPlaylist{}, err
+	}
+
+	return createdPlaylist{Provider: "spotify", ID: spotifyPlaylist.ID, Name: spotifyPlaylist.Name, URL: spotifyPlaylist.ExternalURLs.Spotify}, nil
+}
+
+/*
+postSpotifyPlaylistWrite creates a playlist in the user's Spotify account
+from a shared playlist, adding each track's Spotify link, whether it is the
+original or the converted one. Tracks are added 100 at a time; tracks with
+no Spotify link are skipped and reported.
+*/
+func postSpotifyPlaylistWrite(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	p, request, ok := sharedPlaylistForWrite(c)
+	if !ok {
+		return
+	}
+
+	var uris []string
+	skipped := []skippedTrack{}
+	for i, content := range p.Content {
+		id := ""
+		for _, link := range []string{content.OriginalURL, content.ConvertURL} {
+			if match := spotifyTrackLink.FindStringSubmatch(link); match != nil {
+				id = match[1]
+				break
+			}
+		}
+		if id == "" {
+			skipped = append(skipped, skippedTrack{Position: i + 1, Title: content.Title, Artist: content.Artist, Reason: "no Spotify match"})
+			continue
+		}
+		uris = append(uris, "spotify:track:"+id)
+	}
+	if len(uris) == 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "None of the playlist's tracks are on Spotify", "skipped": skipped})
+		return
+	}
+
+	token, ok := spotifyTokenFor(c, session)
+	if !ok {
+		return
+	}
+
+	created, err := createSpotifyPlaylist(ctx, token, request)
+	if err != nil {
+		writeProviderError(c, "Spotify", err, nil, 0)
+		return
+	}
+
+	added := 0
+	for start := 0; start < len(uris); start += spotifyPlaylistBatch {
+		batch := uris[start:min(start+spotifyPlaylistBatch, len(uris))]
+		err := spotifyUserRequest(ctx, "add_playlist_tracks", token, "POST", "/playlists/"+url.PathEscape(created.ID)+"/tracks", gin.H{"uris": batch}, nil)
+		if err != nil {
+			writeProviderError(c, "Spotify", err, &created, added)
+			return
+		}
+		added += len(batch)
+	}
+	loggerFrom(ctx).Info("playlist written to Spotify", "id", p.ID, "spotify_id", created.ID, "added", added, "skipped", len(skipped))
+
+	c.IndentedJSON(http.StatusCreated, gin.H{
+		"playlist": created,
+		"added":    added,
+		"skipped":  skipped,
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errPlaylistNotFound is returned when there is no playlist with the
+// requested ID.
+var errPlaylistNotFound = errors.New("playlist not found")
+
+// errPlaylistExists is returned when a playlist with the same ID is already
+// stored.
+var errPlaylistExists = errors.New("playlist already exists")
+
+// errIdempotencyKeyReused is returned when an Idempotency-Key is sent again
+// with a different playlist than the one it was first used for.
+var errIdempotencyKeyReused = errors.New("idempotency key was used for a different playlist")
+
+// errContentMismatch is returned when a content row names a different
+// playlist than the one it was uploaded with.
+var errContentMismatch = errors.New("playlist content belongs to a different playlist")
+
+/*
+PlaylistStore persists shared playlists and their content.
+
+CreatePlaylist stores a playlist and all of its content atomically. When
+idempotencyKey is not empty and has been used before with the same playlist,
+the playlist stored the first time is returned with replayed set to true.
+Every content row must carry the playlist's ID, or errContentMismatch is
+returned, so an upload can't add tracks to somebody else's playlist.
+*/
+type PlaylistStore interface {
+	GetPlaylist(ctx context.Context, id string) (playlist_data, error)
+	CreatePlaylist(ctx context.Context, p playlist_data, idempotencyKey string) (stored playlist_data, replayed bool, err error)
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// errAPIKeyNotFound is returned when no API key matches.
+var errAPIKeyNotFound = errors.New("API key not found")
+
+// apiKey is a client API key. Only a hash of the secret is stored; the key
+// itself is shown once, when it is issued.
+type apiKey struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Hash  string `json:"-"`
+	// RateLimit is the number of requests allowed per minute. It is at
+	// least 1; POST /admin/keys refuses 0, which would turn every request
+	// away.
+	RateLimit int `json:"rate_limit"`
+	// DailyQuota is the number of requests allowed per UTC day, or 0 for
+	// no quota.
+	DailyQuota int        `json:"daily_quota"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+/*
+APIKeyStore persists client API keys and how many requests each has made per
+day. Days are UTC dates formatted as 2006-01-02.
+
+AddAPIKeyUsage counts one request against a key and returns the day's total
+including it. RevokeAPIKey returns errAPIKeyNotFound for an unknown ID, and
+keeps the first revocation time if the key is revoked again.
+*/
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, key apiKey) error
+	GetAPIKey(ctx context.Context, id string) (apiKey, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (apiKey, error)
+	ListAPIKeys(ctx context.Context) ([]apiKey, error)
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+	AddAPIKeyUsage(ctx context.Context, id string, day string) (int64, error)
+	APIKeyUsage(ctx context.Context, id string, day string) (int64, error)
+}
+
+// errSessionNotFound is returned when no session, login state or provider
+// token matches.
+var errSessionNotFound = errors.New("session not found")
+
+// userSession links a client to the provider accounts it has connected. Like
+// API keys, only a hash of the session token is stored.
+type userSession struct {
+	ID        string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// oauthState is a login in progress, from the redirect to the provider until
+// its callback.
+type oauthState struct {
+	State        string
+	SessionID    string
+	Provider     string
+	CodeVerifier string
+	RedirectURI  string
+	CreatedAt    time.Time
+}
+
+// providerToken is a user's token for a provider. RefreshToken and ExpiresAt
+// are empty for tokens that can't be refreshed.
+type providerToken struct {
+	SessionID    string
+	Provider     string
+	AccessToken  string
+	RefreshToken string
+	Scope        string
+	ExpiresAt    time.Time
+}
+
+/*
+SessionStore persists user sessions and the provider tokens connected to
+them.
+
+TakeOAuthState returns a login state and deletes it, so each callback can only
+be used once. SaveProviderToken replaces any token the session already has for
+the provider. Deleting a session deletes its tokens.
+
+DeleteExpiredSessions deletes sessions that expired before now with their
+tokens, tokens that expired before now and can't be refreshed, and login
+states created before statesBefore. It returns how many rows went.
+*/
+type SessionStore interface {
+	CreateSession(ctx context.Context, session userSession) error
+	GetSession(ctx context.Context, id string) (userSession, error)
+	DeleteSession(ctx context.Context, id string) error
+	CreateOAuthState(ctx context.Context, state oauthState) error
+	TakeOAuthState(ctx context.Context, state string) (oauthState, error)
+	SaveProviderToken(ctx context.Context, token providerToken) error
+	GetProviderToken(ctx context.Context, sessionID string, provider string) (providerToken, error)
+	ListProviderTokens(ctx context.Context, sessionID string) ([]providerToken, error)
+	DeleteProviderToken(ctx context.Context, sessionID string, provider string) error
+	DeleteExpiredSessions(ctx context.Context, now time.Time, statesBefore time.Time) (int64, error)
+}
+
+// errMigrationNotFound is returned when no migration job matches.
+var errMigrationNotFound = errors.New("migration not found")
+
+// errMigrationChanged is returned when a migration job can't be claimed or
+// updated because it has since finished, been cancelled or been taken by
+// another replica.
+var errMigrationChanged = errors.New("migration changed elsewhere")
+
+/*
+migrationJob moves a user's library from one provider account to another.
+Progress is the job's checkpoint and Report what it has done so far; both are
+stored as JSON. Owner is the replica running the job, which holds it until
+LeaseUntil.
+*/
+type migrationJob struct {
+	ID         string
+	SessionID  string
+	Source     string
+	Target     string
+	Status     string
+	Error      string
+	Progress   migrationProgress
+	Report     migrationReport
+	Owner      string
+	LeaseUntil time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+/*
+MigrationStore persists library migration jobs.
+
+ClaimMigration makes owner the owner of an unfinished job until leaseUntil,
+provided it has no owner, owner already holds it or the lease has run out by
+now, and returns the claimed job. Claiming again renews the lease.
+SaveMigration replaces a job's status, error, progress, report and lease, but
+only while the job is unfinished and held by job.Owner. CancelMigration
+cancels an unfinished job and ResumeMigration queues a failed or cancelled one
+again without an owner. When a job exists but isn't in the state these expect,
+they return errMigrationChanged.
+
+ListMigrations returns a session's jobs, newest first, and
+ListUnfinishedMigrations every job that is queued, running or waiting, oldest
+first, so they can be resumed in the order they were started.
+*/
+type MigrationStore interface {
+	CreateMigration(ctx context.Context, job migrationJob) error
+	GetMigration(ctx context.Context, id string) (migrationJob, error)
+	ClaimMigration(ctx context.Context, id string, owner string, leaseUntil time.Time, now time.Time) (migrationJob, error)
+	SaveMigration(ctx context.Context, job migrationJob) error
+	CancelMigration(ctx context.Context, id string, updatedAt time.Time) error
+	ResumeMigration(ctx context.Context, id string, updatedAt time.Time) error
+	ListMigrations(ctx context.Context, sessionID string) ([]migrationJob, error)
+	ListUnfinishedMigrations(ctx context.Context) ([]migrationJob, error)
+}
+
+// errLinkNotFound is returned when no resolution has been stored for a track.
+var errLinkNotFound = errors.New("link not found")
+
+/*
+LinkStore keeps track links resolved through /link, keyed by provider and
+track ID, so public embeds can be answered without contacting providers.
+SaveLink replaces any resolution already stored for the key.
+*/
+type LinkStore interface {
+	SaveLink(ctx context.Context, key string, resolution linkResolution, resolvedAt time.Time) error
+	GetLink(ctx context.Context, key string) (linkResolution, time.Time, error)
+}
+
+// hashPlaylistData fingerprints a playlist upload so that a replayed
+// Idempotency-Key can be checked against the request it was first used with.
+func hashPlaylistData(p playlist_data) string {
+	data, _ := json.Marshal(p)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkContentIDs makes sure every content row belongs to p.
+func checkContentIDs(p playlist_data) error {
+	for _, content := range p.Content {
+		if content.ID != p.ID {
+			return errContentMismatch
+		}
+	}
+
+	return nil
+}
+
+/*
+openPlaylistStore opens the storage backend named by driver:
+  - "mysql": dsn is a go-sql-driver/mysql DSN
+  - "postgres": dsn is a lib/pq connection URL or keyword/value string
+  - "sqlite": dsn is a file path or ":memory:"
+  - "memory": dsn is ignored and nothing is persisted
+*/
+func openPlaylistStore(driver string, dsn string) (PlaylistStore, error) {
+	switch driver {
+	case "mysql":
+		return openSQLPlaylistStore(mysqlDialect, dsn)
+	case "postgres":
+		return openSQLPlaylistStore(postgresDialect, dsn)
+	case "sqlite":
+		return openSQLPlaylistStore(sqliteDialect, dsn)
+	case "memory":
+		return newMemoryPlaylistStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q (expected mysql, postgres, sqlite or memory)", driver)
+	}
+}
+
+// driverForDSN guesses the storage driver from a DSN. Postgres URLs are
+// recognised by their scheme; anything else is treated as MySQL.
+func driverForDSN(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return "postgres"
+	}
+
+	return "mysql"
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryPlaylistStore keeps playlists in memory. It is meant for development
+// and tests; everything is lost when the process exits.
+type memoryPlaylistStore struct {
+	mu              sync.Mutex
+	playlists       map[string]playlist_data
+	contentKeys     map[string]bool
+	idempotencyKeys map[string]memoryIdempotencyKey
+	apiKeys         map[string]apiKey
+	// apiKeyUsage is keyed by key ID and day.
+	apiKeyUsage map[string]int64
+	sessions    map[string]userSession
+	oauthStates map[string]oauthState
+	// providerTokens is keyed by session ID and provider.
+	providerTokens map[string]providerToken
+	migrations     map[string]migrationJob
+	links          map[string]memoryLink
+}
+
+type memoryLink struct {
+	resolution linkResolution
+	resolvedAt time.Time
+}
+
+type memoryIdempotencyKey struct {
+	playlistID  string
+	requestHash string
+}
+
+func newMemoryPlaylistStore() *memoryPlaylistStore {
+	return &memoryPlaylistStore{
+		playlists:       map[string]playlist_data{},
+		contentKeys:     map[string]bool{},
+		idempotencyKeys: map[string]memoryIdempotencyKey{},
+		apiKeys:         map[string]apiKey{},
+		apiKeyUsage:     map[string]int64{},
+		sessions:        map[string]userSession{},
+		oauthStates:     map[string]oauthState{},
+		providerTokens:  map[string]providerToken{},
+		migrations:      map[string]migrationJob{},
+		links:           map[string]memoryLink{},
+	}
+}
+
+// copyPlaylistData returns a deep copy so callers can't modify stored data.
+func copyPlaylistData(p playlist_data) playlist_data {
+	if p.Content != nil {
+		p.Content = append([]playlist_content(nil), p.Content...)
+	}
+
+	return p
+}
+
+func (s *memoryPlaylistStore) GetPlaylist(ctx context.Context, id string) (playlist_data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.playlists[id]
+	if !ok {
+		return playlist_data{}, errPlaylistNotFound
+	}
+
+	return copyPlaylistData(p), nil
+}
+
+func (s *memoryPlaylistStore) CreatePlaylist(ctx context.Context, p playlist_data, idempotencyKey string) (playlist_data, bool, error) {
+	if err := checkContentIDs(p); err != nil {
+		return p, false, err
+	}
+	requestHash := hashPlaylistData(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if idempotencyKey != "" {
+		if stored, ok := s.idempotencyKeys[idempotencyKey]; ok {
+			if stored.requestHash != requestHash {
+				return playlist_data{}, true, errIdempotencyKeyReused
+			}
+			return copyPlaylistData(s.playlists[stored.playlistID]), true, nil
+		}
+	}
+
+	if _, ok := s.playlists[p.ID]; ok {
+		return p, false, errPlaylistExists
+	}
+	// key_id is the primary key of SQL content rows, so a repeat within the
+	// upload conflicts just as one already stored does.
+	keys := map[string]bool{}
+	for _, content := range p.Content {
+		if s.contentKeys[content.KeyID] || keys[content.KeyID] {
+			return p, false, errPlaylistExists
+		}
+		keys[content.KeyID] = true
+	}
+
+	stored := copyPlaylistData(p)
+	sort.SliceStable(stored.Content, func(i, j int) bool {
+		return stored.Content[i].PTrackNum < stored.Content[j].PTrackNum
+	})
+
+	s.playlists[p.ID] = stored
+	for _, content := range p.Content {
+		s.contentKeys[content.KeyID] = true
+	}
+	if idempotencyKey != "" {
+		s.idempotencyKeys[idempotencyKey] = memoryIdempotencyKey{playlistID: p.ID, requestHash: requestHash}
+	}
+
+	return p, false, nil
+}
+
+func (s *memoryPlaylistStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryPlaylistStore) Close() error {
+	return nil
+}
+
+func (s *memoryPlaylistStore) CreateAPIKey(ctx context.Context, key apiKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apiKeys[key.ID] = key
+	return nil
+}
+
+func (s *memoryPlaylistStore) GetAPIKey(ctx context.Context, id string) (apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok {
+		return apiKey{}, errAPIKeyNotFound
+	}
+
+	return key, nil
+}
+
+func (s *memoryPlaylistStore) GetAPIKeyByHash(ctx context.Context, hash string) (apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.apiKeys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+
+	return apiKey{}, errAPIKeyNotFound
+}
+
+func (s *memoryPlaylistStore) ListAPIKeys(ctx context.Context) ([]apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]apiKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (s *memoryPlaylistStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok {
+		return errAPIKeyNotFound
+	}
+	if key.RevokedAt == nil {
+		key.RevokedAt = &at
+		s.apiKeys[id] = key
+	}
+
+	return nil
+}
+
+func (s *memoryPlaylistStore) AddAPIKeyUsage(ctx context.Context, id string, day string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apiKeyUsage[id+" "+day]++
+	return s.apiKeyUsage[id+" "+day], nil
+}
+
+func (s *memoryPlaylistStore) APIKeyUsage(ctx context.Context, id string, day string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.apiKeyUsage[id+" "+day], nil
+}
+
+func (s *memoryPlaylistStore) CreateSession(ctx context.Context, session userSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memoryPlaylistStore) GetSession(ctx context.Context, id string) (userSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return userSession{}, errSessionNotFound
+	}
+
+	return session, nil
+}
+
+func (s *memoryPlaylistStore) DeleteSession(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	for key, token := range s.providerTokens {
+		if token.SessionID == id {
+			delete(s.providerTokens, key)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryPlaylistStore) CreateOAuthState(ctx context.Context, state oauthState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.oauthStates[state.State] = state
+	return nil
+}
+
+func (s *memoryPlaylistStore) TakeOAuthState(ctx context.Context, state string) (oauthState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	taken, ok := s.oauthStates[state]
+	if !ok {
+		return oauthState{}, errSessionNotFound
+	}
+	delete(s.oauthStates, state)
+
+	return taken, nil
+}
+
+func (s *memoryPlaylistStore) SaveProviderToken(ctx context.Context, token providerToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.providerTokens[token.SessionID+" "+token.Provider] = token
+	return nil
+}
+
+func (s *memoryPlaylistStore) GetProviderToken(ctx context.Context, sessionID string, provider string) (providerToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.providerTokens[sessionID+" "+provider]
+	if !ok {
+		return providerToken{}, errSessionNotFound
+	}
+
+	return token, nil
+}
+
+func (s *memoryPlaylistStore) ListProviderTokens(ctx context.Context, sessionID string) ([]providerToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := []providerToken{}
+	for _, token := range s.providerTokens {
+		if token.SessionID == sessionID {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Provider < tokens[j].Provider })
+
+	return tokens, nil
+}
+
+func (s *memoryPlaylistStore) DeleteProviderToken(ctx context.Context, sessionID string, provider string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.providerTokens, sessionID+" "+provider)
+	return nil
+}
+
+func (s *memoryPlaylistStore) DeleteExpiredSessions(ctx context.Context, now time.Time, statesBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, session := range s.sessions {
+		if session.ExpiresAt.Before(now) {
+			delete(s.sessions, id)
+			deleted++
+		}
+	}
+	for key, token := range s.providerTokens {
+		_, live := s.sessions[token.SessionID]
+		expired := token.RefreshToken == "" && !token.ExpiresAt.IsZero() && token.ExpiresAt.Before(now)
+		if !live || expired {
+			delete(s.providerTokens, key)
+			deleted++
+		}
+	}
+	for state, login := range s.oauthStates {
+		if login.CreatedAt.Before(statesBefore) {
+			delete(s.oauthStates, state)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// copyMigrationJob returns a deep copy so callers can't modify stored jobs.
+func copyMigrationJob(job migrationJob) migrationJob {
+	progress, _ := json.Marshal(job.Progress)
+	report, _ := json.Marshal(job.Report)
+	job.Progress, job.Report = migrationProgress{}, migrationReport{}
+	json.Unmarshal(progress, &job.Progress)
+	json.Unmarshal(report, &job.Report)
+
+	return job
+}
+
+func (s *memoryPlaylistStore) CreateMigration(ctx context.Context, job migrationJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.migrations[job.ID] = copyMigrationJob(job)
+	return nil
+}
+
+func (s *memoryPlaylistStore) GetMigration(ctx context.Context, id string) (migrationJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.migrations[id]
+	if !ok {
+		return migrationJob{}, errMigrationNotFound
+	}
+
+	return copyMigrationJob(job), nil
+}
+
+func (s *memoryPlaylistStore) ClaimMigration(ctx context.Context, id string, owner string, leaseUntil time.Time, now time.Time) (migrationJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.migrations[id]
+	if !ok {
+		return migrationJob{}, errMigrationNotFound
+	}
+	if job.finished() || (job.Owner != "" && job.Owner != owner && !job.LeaseUntil.Before(now)) {
+		return migrationJob{}, errMigrationChanged
+	}
+	job.Owner, job.LeaseUntil = owner, leaseUntil
+	s.migrations[id] = job
+
+	return copyMigrationJob(job), nil
+}
+
+func (s *memoryPlaylistStore) SaveMigration(ctx context.Context, job migrationJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.migrations[job.ID]
+	if !ok {
+		return errMigrationNotFound
+	}
+	if stored.finished() || stored.Owner != job.Owner {
+		return errMigrationChanged
+	}
+	s.migrations[job.ID] = copyMigrationJob(job)
+	return nil
+}
+
+func (s *memoryPlaylistStore) CancelMigration(ctx context.Context, id string, updatedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.migrations[id]
+	if !ok {
+		return errMigrationNotFound
+	}
+	if job.finished() {
+		return errMigrationChanged
+	}
+	job.Status, job.UpdatedAt = migrationCancelled, updatedAt
+	s.migrations[id] = job
+	return nil
+}
+
+func (s *memoryPlaylistStore) ResumeMigration(ctx context.Context, id string, updatedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.migrations[id]
+	if !ok {
+		return errMigrationNotFound
+	}
+	if job.Status != migrationFailed && job.Status != migrationCancelled {
+		return errMigrationChanged
+	}
+	job.Status, job.Error, job.Owner, job.LeaseUntil, job.UpdatedAt = migrationQueued, "", "", time.Time{}, updatedAt
+	s.migrations[id] = job
+	return nil
+}
+
+// listMigrations returns copies of the jobs keep accepts, newest or oldest
+// first.
+func (s *memoryPlaylistStore) listMigrations(keep func(migrationJob) bool, newestFirst bool) []migrationJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := []migrationJob{}
+	for _, job := range s.migrations {
+		if keep(job) {
+			jobs = append(jobs, copyMigrationJob(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if newestFirst {
+			return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+		}
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	return jobs
+}
+
+func (s *memoryPlaylistStore) ListMigrations(ctx context.Context, sessionID string) ([]migrationJob, error) {
+	return s.listMigrations(func(job migrationJob) bool { return job.SessionID == sessionID }, true), nil
+}
+
+func (s *memoryPlaylistStore) ListUnfinishedMigrations(ctx context.Context) ([]migrationJob, error) {
+	return s.listMigrations(func(job migrationJob) bool { return !job.finished() }, false), nil
+}
+
+func (s *memoryPlaylistStore) SaveLink(ctx context.Context, key string, resolution linkResolution, resolvedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.links[key] = memoryLink{resolution: copyLinkResolution(resolution), resolvedAt: resolvedAt}
+	return nil
+}
+
+func (s *memoryPlaylistStore) GetLink(ctx context.Context, key string) (linkResolution, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, ok := s.links[key]
+	if !ok {
+		return linkResolution{}, time.Time{}, errLinkNotFound
+	}
+	return copyLinkResolution(link.resolution), link.resolvedAt, nil
+}
+
+// copyLinkResolution returns a copy whose Links map isn't shared.
+func copyLinkResolution(resolution linkResolution) linkResolution {
+	links := make(map[string]trackCandidate, len(resolution.Links))
+	for name, track := range resolution.Links {
+		links[name] = track
+	}
+	resolution.Links = links
+
+	return resolution
+}
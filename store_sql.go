@@ -0,0 +1,868 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqlDialect holds what differs between the SQL databases the playlist store
+// can run on.
+type sqlDialect struct {
+	name           string
+	driverName     string
+	migrationsDir  string
+	maxOpenConns   int
+	isDuplicateKey func(err error) bool
+	// numberedParams is set for databases that use $1, $2, ... instead of ?
+	// for query parameters.
+	numberedParams bool
+	// transactionalDDL is set for databases that can roll back schema
+	// changes, so each migration is applied in one transaction.
+	transactionalDDL bool
+	// lockSchema and unlockSchema take and release a lock held by one
+	// connection while migrations run, so replicas starting together
+	// don't apply the same migration twice. Empty when the database has
+	// no such lock.
+	lockSchema   string
+	unlockSchema string
+	// prepareDSN adjusts a DSN before it is opened.
+	prepareDSN func(dsn string) (string, error)
+}
+
+// bind rewrites the ? parameters in query for the dialect.
+func (d sqlDialect) bind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+var mysqlDialect = sqlDialect{
+	name:          "mysql",
+	driverName:    "mysql",
+	migrationsDir: "migrations/mysql",
+	isDuplicateKey: func(err error) bool {
+		var mysqlErr *mysql.MySQLError
+		return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+	},
+	// GET_LOCK waits up to the timeout, in seconds, and returns 1 once it
+	// holds the lock.
+	lockSchema:   "SELECT GET_LOCK('polyphonic_schema_migrations', 300)",
+	unlockSchema: "SELECT RELEASE_LOCK('polyphonic_schema_migrations')",
+	// schema_migrations.applied_at is scanned into a time.Time, which the
+	// driver only does with parseTime, so it is turned on for every DSN.
+	prepareDSN: func(dsn string) (string, error) {
+		mysqlConfig, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "", err
+		}
+		mysqlConfig.ParseTime = true
+		// Count the rows an UPDATE matches rather than those it changes, as
+		// the other databases do, so that a conditional update that leaves
+		// a row as it was isn't mistaken for one that matched nothing.
+		mysqlConfig.ClientFoundRows = true
+		return mysqlConfig.FormatDSN(), nil
+	},
+}
+
+var sqliteDialect = sqlDialect{
+	name:          "sqlite",
+	driverName:    "sqlite",
+	migrationsDir: "migrations/sqlite",
+	// SQLite only allows one writer at a time, and an in-memory database
+	// only exists on the connection that created it.
+	maxOpenConns: 1,
+	isDuplicateKey: func(err error) bool {
+		var sqliteErr *sqlite.Error
+		if !errors.As(err, &sqliteErr) {
+			return false
+		}
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY ||
+			sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+	},
+	// A SQLite file is only opened by one server, so there is nothing to
+	// lock against.
+	transactionalDDL: true,
+}
+
+var postgresDialect = sqlDialect{
+	name:          "postgres",
+	driverName:    "postgres",
+	migrationsDir: "migrations/postgres",
+	isDuplicateKey: func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code == "23505"
+	},
+	numberedParams:   true,
+	transactionalDDL: true,
+	// The key is arbitrary; it only has to be the same for every replica.
+	lockSchema:   "SELECT pg_advisory_lock(7659)",
+	unlockSchema: "SELECT pg_advisory_unlock(7659)",
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx so that playlist reads can
+// happen inside or outside of a transaction.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// sqlPlaylistStore is the PlaylistStore for SQL databases.
+type sqlPlaylistStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func openSQLPlaylistStore(dialect sqlDialect, dsn string) (*sqlPlaylistStore, error) {
+	if dialect.prepareDSN != nil {
+		var err error
+		if dsn, err = dialect.prepareDSN(dsn); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open(dialect.driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect.maxOpenConns > 0 {
+		db.SetMaxOpenConns(dialect.maxOpenConns)
+	}
+
+	return &sqlPlaylistStore{db: db, dialect: dialect}, nil
+}
+
+// migrator returns the schema migrator for this store's database.
+func (s *sqlPlaylistStore) migrator() (*migrator, error) {
+	return newMigrator(s.db, s.dialect)
+}
+
+func (s *sqlPlaylistStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlPlaylistStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlPlaylistStore) GetPlaylist(ctx context.Context, id string) (playlist_data, error) {
+	playlistData, err := s.loadPlaylistData(ctx, s.db, id)
+	if err == sql.ErrNoRows {
+		return playlistData, errPlaylistNotFound
+	}
+
+	return playlistData, err
+}
+
+// loadPlaylistData reads a playlist and all of its content from the database.
+// sql.ErrNoRows is returned if there is no playlist with the given ID.
+func (s *sqlPlaylistStore) loadPlaylistData(ctx context.Context, q queryer, id string) (playlist_data, error) {
+	var playlistData playlist_data
+
+	playlistsRow := q.QueryRowContext(ctx, s.dialect.bind(`SELECT id, name, creator, song_count, platform, original_url, converted
+FROM playlists WHERE id = ?`), id)
+	if err := playlistsRow.Scan(
+		&playlistData.ID,
+		&playlistData.Name,
+		&playlistData.Creator,
+		&playlistData.SongCount,
+		&playlistData.Platform,
+		&playlistData.OriginalURL,
+		&playlistData.Converted); err != nil {
+		return playlistData, err
+	}
+
+	rows, err := q.QueryContext(ctx, s.dialect.bind(`SELECT id, key_id, title, playlist_track_num, isrc, artist, album, album_id,
+  explicit, original_url, COALESCE(converted_url, ''), confidence, track_num, COALESCE(artwork_url, '')
+FROM playlist_content WHERE id = ? ORDER BY playlist_track_num ASC`), id)
+	if err != nil {
+		return playlistData, err
+	}
+	defer rows.Close()
+	// Loop through rows, using Scan to assign column data to struct fields.
+	for rows.Next() {
+		var content playlist_content
+		if err := rows.Scan(
+			&content.ID,
+			&content.KeyID,
+			&content.Title,
+			&content.PTrackNum,
+			&content.ISRC,
+			&content.Artist,
+			&content.Album,
+			&content.AlbumID,
+			&content.Explicit,
+			&content.OriginalURL,
+			&content.ConvertURL,
+			&content.Confidence,
+			&content.TrackNum,
+			&content.ArtworkURL); err != nil {
+			return playlistData, err
+		}
+
+		playlistData.Content = append(playlistData.Content, content)
+	}
+
+	return playlistData, rows.Err()
+}
+
+/*
+replayIdempotentPlaylist looks up a previously used idempotency key. If the key
+has been seen before, the playlist it created is returned with replayed set to
+true.
+*/
+func (s *sqlPlaylistStore) replayIdempotentPlaylist(ctx context.Context, key string, requestHash string) (playlist_data, bool, error) {
+	var playlistID, storedHash string
+
+	row := s.db.QueryRowContext(ctx, s.dialect.bind("SELECT playlist_id, request_hash FROM idempotency_keys WHERE idem_key = ?"), key)
+	if err := row.Scan(&playlistID, &storedHash); err != nil {
+		if err == sql.ErrNoRows {
+			return playlist_data{}, false, nil
+		}
+		return playlist_data{}, false, err
+	}
+
+	if storedHash != requestHash {
+		return playlist_data{}, true, errIdempotencyKeyReused
+	}
+
+	playlistData, err := s.loadPlaylistData(ctx, s.db, playlistID)
+	return playlistData, true, err
+}
+
+/*
+CreatePlaylist stores a playlist and all of its content in one transaction.
+Nothing is written if any insert fails. The idempotency key is recorded in the
+same transaction, so a retried upload either replays the original playlist or
+fails without leaving partial data behind.
+*/
+func (s *sqlPlaylistStore) CreatePlaylist(ctx context.Context, p playlist_data, idempotencyKey string) (playlist_data, bool, error) {
+	if err := checkContentIDs(p); err != nil {
+		return p, false, err
+	}
+	requestHash := hashPlaylistData(p)
+
+	if idempotencyKey != "" {
+		replay, found, err := s.replayIdempotentPlaylist(ctx, idempotencyKey, requestHash)
+		if found || err != nil {
+			return replay, found, err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return p, false, err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	if idempotencyKey != "" {
+		// Claiming the key first makes a concurrent retry wait on this
+		// transaction instead of racing it.
+		_, err := tx.ExecContext(ctx, s.dialect.bind("INSERT INTO idempotency_keys (idem_key, playlist_id, request_hash) VALUES (?, ?, ?)"),
+			idempotencyKey, p.ID, requestHash)
+		if s.dialect.isDuplicateKey(err) {
+			tx.Rollback()
+			return s.replayIdempotentPlaylist(ctx, idempotencyKey, requestHash)
+		}
+		if err != nil {
+			return p, false, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, s.dialect.bind("INSERT INTO playlists (id, name, creator, song_count, platform, original_url, converted) VALUES (?, ?, ?, ?, ?, ?, ?)"),
+		p.ID,
+		p.Name,
+		p.Creator,
+		p.SongCount,
+		p.Platform,
+		p.OriginalURL,
+		p.Converted)
+	if s.dialect.isDuplicateKey(err) {
+		return p, false, errPlaylistExists
+	}
+	if err != nil {
+		return p, false, err
+	}
+
+	for _, content := range p.Content {
+		_, err := tx.ExecContext(ctx, s.dialect.bind("INSERT INTO playlist_content (id, key_id, title, playlist_track_num, isrc, artist, album, album_id, explicit, original_url, converted_url, confidence, track_num, artwork_url) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+			content.ID,
+			content.KeyID,
+			content.Title,
+			content.PTrackNum,
+			content.ISRC,
+			content.Artist,
+			content.Album,
+			content.AlbumID,
+			content.Explicit,
+			content.OriginalURL,
+			content.ConvertURL,
+			content.Confidence,
+			content.TrackNum,
+			content.ArtworkURL)
+		if s.dialect.isDuplicateKey(err) {
+			return p, false, errPlaylistExists
+		}
+		if err != nil {
+			return p, false, err
+		}
+	}
+
+	return p, false, tx.Commit()
+}
+
+const apiKeyColumns = "id, label, key_hash, rate_limit, daily_quota, created_at, revoked_at"
+
+// scanAPIKey reads a row selected with apiKeyColumns. Times are stored as
+// Unix seconds so every dialect reads them the same way.
+func scanAPIKey(row interface{ Scan(dest ...any) error }) (apiKey, error) {
+	var key apiKey
+	var createdAt int64
+	var revokedAt sql.NullInt64
+
+	err := row.Scan(&key.ID, &key.Label, &key.Hash, &key.RateLimit, &key.DailyQuota, &createdAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	if err != nil {
+		return apiKey{}, err
+	}
+
+	key.CreatedAt = time.Unix(createdAt, 0).UTC()
+	if revokedAt.Valid {
+		revoked := time.Unix(revokedAt.Int64, 0).UTC()
+		key.RevokedAt = &revoked
+	}
+
+	return key, nil
+}
+
+func (s *sqlPlaylistStore) CreateAPIKey(ctx context.Context, key apiKey) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.bind("INSERT INTO api_keys (id, label, key_hash, rate_limit, daily_quota, created_at) VALUES (?, ?, ?, ?, ?, ?)"),
+		key.ID,
+		key.Label,
+		key.Hash,
+		key.RateLimit,
+		key.DailyQuota,
+		key.CreatedAt.Unix())
+
+	return err
+}
+
+func (s *sqlPlaylistStore) GetAPIKey(ctx context.Context, id string) (apiKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, s.dialect.bind("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?"), id))
+}
+
+func (s *sqlPlaylistStore) GetAPIKeyByHash(ctx context.Context, hash string) (apiKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, s.dialect.bind("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?"), hash))
+}
+
+func (s *sqlPlaylistStore) ListAPIKeys(ctx context.Context) ([]apiKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []apiKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *sqlPlaylistStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	result, err := s.db.ExecContext(ctx, s.dialect.bind("UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?"), at.Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	// An already revoked key still counts as a row, so none means the key
+	// may not exist; looking it up says which.
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		_, err := s.GetAPIKey(ctx, id)
+		return err
+	}
+
+	return nil
+}
+
+/*
+AddAPIKeyUsage increments the day's counter, creating it on the first request
+of the day. Two requests racing to create it are resolved by the primary key:
+the loser retries the update.
+*/
+func (s *sqlPlaylistStore) AddAPIKeyUsage(ctx context.Context, id string, day string) (int64, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		result, err := s.db.ExecContext(ctx, s.dialect.bind("UPDATE api_key_usage SET requests = requests + 1 WHERE key_id = ? AND day = ?"), id, day)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return 0, err
+		} else if n > 0 {
+			return s.APIKeyUsage(ctx, id, day)
+		}
+
+		_, err = s.db.ExecContext(ctx, s.dialect.bind("INSERT INTO api_key_usage (key_id, day, requests) VALUES (?, ?, 1)"), id, day)
+		if s.dialect.isDuplicateKey(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	return s.APIKeyUsage(ctx, id, day)
+}
+
+func (s *sqlPlaylistStore) APIKeyUsage(ctx context.Context, id string, day string) (int64, error) {
+	var requests int64
+	err := s.db.QueryRowContext(ctx, s.dialect.bind("SELECT requests FROM api_key_usage WHERE key_id = ? AND day = ?"), id, day).Scan(&requests)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return requests, err
+}
+
+func (s *sqlPlaylistStore) CreateSession(ctx context.Context, session userSession) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.bind("INSERT INTO user_sessions (id, created_at, expires_at) VALUES (?, ?, ?)"),
+		session.ID,
+		session.CreatedAt.Unix(),
+		session.ExpiresAt.Unix())
+
+	return err
+}
+
+func (s *sqlPlaylistStore) GetSession(ctx context.Context, id string) (userSession, error) {
+	session := userSession{ID: id}
+	var createdAt, expiresAt int64
+	err := s.db.QueryRowContext(ctx, s.dialect.bind("SELECT created_at, expires_at FROM user_sessions WHERE id = ?"), id).Scan(&createdAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return userSession{}, errSessionNotFound
+	}
+	if err != nil {
+		return userSession{}, err
+	}
+	session.CreatedAt = time.Unix(createdAt, 0).UTC()
+	session.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+
+	return session, nil
+}
+
+func (s *sqlPlaylistStore) DeleteSession(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.dialect.bind("DELETE FROM provider_tokens WHERE session_id = ?"), id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.bind("DELETE FROM user_sessions WHERE id = ?"), id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlPlaylistStore) CreateOAuthState(ctx context.Context, state oauthState) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.bind("INSERT INTO oauth_states (state, session_id, provider, code_verifier, redirect_uri, created_at) VALUES (?, ?, ?, ?, ?, ?)"),
+		state.State,
+		state.SessionID,
+		state.Provider,
+		state.CodeVerifier,
+		state.RedirectURI,
+		state.CreatedAt.Unix())
+
+	return err
+}
+
+/*
+TakeOAuthState reads the state and deletes it. When two callbacks race, only
+the one whose delete removes the row gets the state.
+*/
+func (s *sqlPlaylistStore) TakeOAuthState(ctx context.Context, state string) (oauthState, error) {
+	taken := oauthState{State: state}
+	var createdAt int64
+	err := s.db.QueryRowContext(ctx, s.dialect.bind("SELECT session_id, provider, code_verifier, redirect_uri, created_at FROM oauth_states WHERE state = ?"), state).
+		Scan(&taken.SessionID, &taken.Provider, &taken.CodeVerifier, &taken.RedirectURI, &createdAt)
+	if err == sql.ErrNoRows {
+		return oauthState{}, errSessionNotFound
+	}
+	if err != nil {
+		return oauthState{}, err
+	}
+	taken.CreatedAt = time.Unix(createdAt, 0).UTC()
+
+	result, err := s.db.ExecContext(ctx, s.dialect.bind("DELETE FROM oauth_states WHERE state = ?"), state)
+	if err != nil {
+		return oauthState{}, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return oauthState{}, errSessionNotFound
+	}
+
+	return taken, nil
+}
+
+// SaveProviderToken replaces the session's token for the provider in one
+// transaction.
+func (s *sqlPlaylistStore) SaveProviderToken(ctx context.Context, token providerToken) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.dialect.bind("DELETE FROM provider_tokens WHERE session_id = ? AND provider = ?"), token.SessionID, token.Provider); err != nil {
+		return err
+	}
+
+	var expiresAt sql.NullInt64
+	if !token.ExpiresAt.IsZero() {
+		expiresAt = sql.NullInt64{Int64: token.ExpiresAt.Unix(), Valid: true}
+	}
+	_, err = tx.ExecContext(ctx, s.dialect.bind("INSERT INTO provider_tokens (session_id, provider, access_token, refresh_token, scope, expires_at) VALUES (?, ?, ?, ?, ?, ?)"),
+		token.SessionID,
+		token.Provider,
+		token.AccessToken,
+		token.RefreshToken,
+		token.Scope,
+		expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const providerTokenColumns = "session_id, provider, access_token, refresh_token, scope, expires_at"
+
+// scanProviderToken reads a row selected with providerTokenColumns.
+func scanProviderToken(row interface{ Scan(dest ...any) error }) (providerToken, error) {
+	var token providerToken
+	var refreshToken, scope sql.NullString
+	var expiresAt sql.NullInt64
+
+	err := row.Scan(&token.SessionID, &token.Provider, &token.AccessToken, &refreshToken, &scope, &expiresAt)
+	if err == sql.ErrNoRows {
+		return providerToken{}, errSessionNotFound
+	}
+	if err != nil {
+		return providerToken{}, err
+	}
+
+	token.RefreshToken = refreshToken.String
+	token.Scope = scope.String
+	if expiresAt.Valid {
+		token.ExpiresAt = time.Unix(expiresAt.Int64, 0).UTC()
+	}
+
+	return token, nil
+}
+
+func (s *sqlPlaylistStore) GetProviderToken(ctx context.Context, sessionID string, provider string) (providerToken, error) {
+	return scanProviderToken(s.db.QueryRowContext(ctx, s.dialect.bind("SELECT "+providerTokenColumns+" FROM provider_tokens WHERE session_id = ? AND provider = ?"), sessionID, provider))
+}
+
+func (s *sqlPlaylistStore) ListProviderTokens(ctx context.Context, sessionID string) ([]providerToken, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.bind("SELECT "+providerTokenColumns+" FROM provider_tokens WHERE session_id = ? ORDER BY provider"), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []providerToken{}
+	for rows.Next() {
+		token, err := scanProviderToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (s *sqlPlaylistStore) DeleteProviderToken(ctx context.Context, sessionID string, provider string) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.bind("DELETE FROM provider_tokens WHERE session_id = ? AND provider = ?"), sessionID, provider)
+
+	return err
+}
+
+/*
+DeleteExpiredSessions deletes in one transaction, tokens first, so no token is
+left behind by a session deleted in between. Tokens whose session is already
+gone are deleted too.
+*/
+func (s *sqlPlaylistStore) DeleteExpiredSessions(ctx context.Context, now time.Time, statesBefore time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{"DELETE FROM provider_tokens WHERE session_id NOT IN (SELECT id FROM user_sessions WHERE expires_at >= ?)", []any{now.Unix()}},
+		{"DELETE FROM provider_tokens WHERE (refresh_token IS NULL OR refresh_token = '') AND expires_at IS NOT NULL AND expires_at < ?", []any{now.Unix()}},
+		{"DELETE FROM user_sessions WHERE expires_at < ?", []any{now.Unix()}},
+		{"DELETE FROM oauth_states WHERE created_at < ?", []any{statesBefore.Unix()}},
+	}
+	var deleted int64
+	for _, statement := range statements {
+		result, err := tx.ExecContext(ctx, s.dialect.bind(statement.query), statement.args...)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			deleted += n
+		}
+	}
+
+	return deleted, tx.Commit()
+}
+
+func (s *sqlPlaylistStore) CreateMigration(ctx context.Context, job migrationJob) error {
+	progress, err := json.Marshal(job.Progress)
+	if err != nil {
+		return err
+	}
+	report, err := json.Marshal(job.Report)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, s.dialect.bind("INSERT INTO migration_jobs (id, session_id, source, target, status, error, progress, report, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		job.ID,
+		job.SessionID,
+		job.Source,
+		job.Target,
+		job.Status,
+		job.Error,
+		string(progress),
+		string(report),
+		job.CreatedAt.Unix(),
+		job.UpdatedAt.Unix())
+
+	return err
+}
+
+const migrationJobColumns = "id, session_id, source, target, status, error, progress, report, owner, lease_until, created_at, updated_at"
+
+// scanMigrationJob reads a row selected with migrationJobColumns.
+func scanMigrationJob(row interface{ Scan(dest ...any) error }) (migrationJob, error) {
+	var job migrationJob
+	var jobError, owner sql.NullString
+	var progress, report string
+	var leaseUntil sql.NullInt64
+	var createdAt, updatedAt int64
+
+	err := row.Scan(&job.ID, &job.SessionID, &job.Source, &job.Target, &job.Status, &jobError, &progress, &report, &owner, &leaseUntil, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return migrationJob{}, errMigrationNotFound
+	}
+	if err != nil {
+		return migrationJob{}, err
+	}
+
+	job.Error = jobError.String
+	if err := json.Unmarshal([]byte(progress), &job.Progress); err != nil {
+		return migrationJob{}, err
+	}
+	if err := json.Unmarshal([]byte(report), &job.Report); err != nil {
+		return migrationJob{}, err
+	}
+	job.Owner = owner.String
+	if leaseUntil.Valid {
+		job.LeaseUntil = time.Unix(leaseUntil.Int64, 0).UTC()
+	}
+	job.CreatedAt = time.Unix(createdAt, 0).UTC()
+	job.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+
+	return job, nil
+}
+
+func (s *sqlPlaylistStore) GetMigration(ctx context.Context, id string) (migrationJob, error) {
+	return scanMigrationJob(s.db.QueryRowContext(ctx, s.dialect.bind("SELECT "+migrationJobColumns+" FROM migration_jobs WHERE id = ?"), id))
+}
+
+// updateMigration runs a conditional UPDATE of one job. When it matches no
+// row it tells a job that doesn't exist from one that isn't in the state the
+// update expects. An update that changes nothing, such as a lease renewed in
+// the second it was saved, still matches its row.
+func (s *sqlPlaylistStore) updateMigration(ctx context.Context, id string, query string, args ...any) error {
+	result, err := s.db.ExecContext(ctx, s.dialect.bind(query), args...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := s.GetMigration(ctx, id); err != nil {
+		return err
+	}
+
+	return errMigrationChanged
+}
+
+func (s *sqlPlaylistStore) ClaimMigration(ctx context.Context, id string, owner string, leaseUntil time.Time, now time.Time) (migrationJob, error) {
+	err := s.updateMigration(ctx, id, "UPDATE migration_jobs SET owner = ?, lease_until = ? WHERE id = ? AND status IN (?, ?, ?) AND (owner IS NULL OR owner = ? OR lease_until < ?)",
+		owner,
+		leaseUntil.Unix(),
+		id,
+		migrationQueued, migrationRunning, migrationWaiting,
+		owner,
+		now.Unix())
+	if err != nil {
+		return migrationJob{}, err
+	}
+
+	return s.GetMigration(ctx, id)
+}
+
+func (s *sqlPlaylistStore) SaveMigration(ctx context.Context, job migrationJob) error {
+	progress, err := json.Marshal(job.Progress)
+	if err != nil {
+		return err
+	}
+	report, err := json.Marshal(job.Report)
+	if err != nil {
+		return err
+	}
+
+	return s.updateMigration(ctx, job.ID, "UPDATE migration_jobs SET status = ?, error = ?, progress = ?, report = ?, lease_until = ?, updated_at = ? WHERE id = ? AND owner = ? AND status IN (?, ?, ?)",
+		job.Status,
+		job.Error,
+		string(progress),
+		string(report),
+		job.LeaseUntil.Unix(),
+		job.UpdatedAt.Unix(),
+		job.ID,
+		job.Owner,
+		migrationQueued, migrationRunning, migrationWaiting)
+}
+
+func (s *sqlPlaylistStore) CancelMigration(ctx context.Context, id string, updatedAt time.Time) error {
+	return s.updateMigration(ctx, id, "UPDATE migration_jobs SET status = ?, updated_at = ? WHERE id = ? AND status IN (?, ?, ?)",
+		migrationCancelled,
+		updatedAt.Unix(),
+		id,
+		migrationQueued, migrationRunning, migrationWaiting)
+}
+
+func (s *sqlPlaylistStore) ResumeMigration(ctx context.Context, id string, updatedAt time.Time) error {
+	return s.updateMigration(ctx, id, "UPDATE migration_jobs SET status = ?, error = '', owner = NULL, lease_until = NULL, updated_at = ? WHERE id = ? AND status IN (?, ?)",
+		migrationQueued,
+		updatedAt.Unix(),
+		id,
+		migrationFailed, migrationCancelled)
+}
+
+// queryMigrationJobs runs a query selecting migrationJobColumns.
+func (s *sqlPlaylistStore) queryMigrationJobs(ctx context.Context, query string, args ...any) ([]migrationJob, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []migrationJob{}
+	for rows.Next() {
+		job, err := scanMigrationJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+func (s *sqlPlaylistStore) ListMigrations(ctx context.Context, sessionID string) ([]migrationJob, error) {
+	return s.queryMigrationJobs(ctx, "SELECT "+migrationJobColumns+" FROM migration_jobs WHERE session_id = ? ORDER BY created_at DESC", sessionID)
+}
+
+func (s *sqlPlaylistStore) ListUnfinishedMigrations(ctx context.Context) ([]migrationJob, error) {
+	return s.queryMigrationJobs(ctx, "SELECT "+migrationJobColumns+" FROM migration_jobs WHERE status IN (?, ?, ?) ORDER BY created_at",
+		migrationQueued, migrationRunning, migrationWaiting)
+}
+
+// SaveLink replaces the resolution stored for key in one transaction. When
+// another request saves the same link at the same time, the first one wins.
+func (s *sqlPlaylistStore) SaveLink(ctx context.Context, key string, resolution linkResolution, resolvedAt time.Time) error {
+	data, err := json.Marshal(resolution)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.dialect.bind("DELETE FROM link_resolutions WHERE track_key = ?"), key); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.dialect.bind("INSERT INTO link_resolutions (track_key, resolution, resolved_at) VALUES (?, ?, ?)"), key, string(data), resolvedAt.Unix())
+	if s.dialect.isDuplicateKey(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlPlaylistStore) GetLink(ctx context.Context, key string) (linkResolution, time.Time, error) {
+	var data string
+	var resolvedAt int64
+	err := s.db.QueryRowContext(ctx, s.dialect.bind("SELECT resolution, resolved_at FROM link_resolutions WHERE track_key = ?"), key).Scan(&data, &resolvedAt)
+	if err == sql.ErrNoRows {
+		return linkResolution{}, time.Time{}, errLinkNotFound
+	}
+	if err != nil {
+		return linkResolution{}, time.Time{}, err
+	}
+
+	var resolution linkResolution
+	if err := json.Unmarshal([]byte(data), &resolution); err != nil {
+		return linkResolution{}, time.Time{}, err
+	}
+	return resolution, time.Unix(resolvedAt, 0), nil
+}
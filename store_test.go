@@ -0,0 +1,665 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore is every store interface a backend implements.
+type testStore interface {
+	PlaylistStore
+	APIKeyStore
+	SessionStore
+	MigrationStore
+	LinkStore
+}
+
+/*
+forEachStore runs test against a fresh store for every backend. Memory and
+SQLite always run; Postgres and MySQL run when POLYPHONIC_TEST_POSTGRES_DSN or
+POLYPHONIC_TEST_MYSQL_DSN names a database the tests may write to, and are
+skipped, so go untested, without them. The test workflow in .github sets both
+against service containers. Those databases are migrated but not emptied, so
+tests use random IDs.
+*/
+func forEachStore(t *testing.T, test func(t *testing.T, store testStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryPlaylistStore())
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, openTestSQLStore(t, sqliteDialect, filepath.Join(t.TempDir(), "polyphonic.db")))
+	})
+
+	for _, backend := range []struct {
+		dialect sqlDialect
+		env     string
+	}{
+		{postgresDialect, "POLYPHONIC_TEST_POSTGRES_DSN"},
+		{mysqlDialect, "POLYPHONIC_TEST_MYSQL_DSN"},
+	} {
+		t.Run(backend.dialect.name, func(t *testing.T) {
+			dsn := os.Getenv(backend.env)
+			if dsn == "" {
+				t.Skipf("%s is not set", backend.env)
+			}
+			test(t, openTestSQLStore(t, backend.dialect, dsn))
+		})
+	}
+}
+
+// openTestSQLStore opens a SQL store and applies every migration to it.
+func openTestSQLStore(t *testing.T, dialect sqlDialect, dsn string) *sqlPlaylistStore {
+	t.Helper()
+
+	store, err := openSQLPlaylistStore(dialect, dsn)
+	if err != nil {
+		t.Fatalf("opening %s store: %v", dialect.name, err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	m, err := store.migrator()
+	if err != nil {
+		t.Fatalf("loading migrations: %v", err)
+	}
+	if err := m.Up(context.Background(), io.Discard); err != nil {
+		t.Fatalf("migrating %s store: %v", dialect.name, err)
+	}
+
+	return store
+}
+
+// testPlaylist returns a playlist with a random ID and n tracks.
+func testPlaylist(n int) playlist_data {
+	p := playlist_data{
+		ID:          randomToken(8),
+		Name:        "Road Trip",
+		Creator:     "tester",
+		SongCount:   n,
+		Platform:    "spotify",
+		OriginalURL: "https://open.spotify.com/playlist/abc",
+		Content:     []playlist_content{},
+	}
+	for i := 0; i < n; i++ {
+		p.Content = append(p.Content, playlist_content{
+			ID:          p.ID,
+			KeyID:       randomToken(8),
+			Title:       "Song",
+			PTrackNum:   i + 1,
+			ISRC:        "USABC0000001",
+			Artist:      "Artist",
+			Album:       "Album",
+			AlbumID:     "album1",
+			OriginalURL: "https://open.spotify.com/track/abc",
+			ConvertURL:  "https://music.apple.com/us/song/1",
+			Confidence:  3,
+			TrackNum:    i + 2,
+		})
+	}
+
+	return p
+}
+
+func TestStoreCreateAndGetPlaylist(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		p := testPlaylist(3)
+
+		stored, replayed, err := store.CreatePlaylist(ctx, p, "")
+		if err != nil || replayed {
+			t.Fatalf("CreatePlaylist = replayed %v, %v; want a new playlist", replayed, err)
+		}
+		if !reflect.DeepEqual(stored, p) {
+			t.Errorf("CreatePlaylist returned %+v, want %+v", stored, p)
+		}
+
+		got, err := store.GetPlaylist(ctx, p.ID)
+		if err != nil {
+			t.Fatalf("GetPlaylist: %v", err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("GetPlaylist = %+v, want %+v", got, p)
+		}
+
+		if _, err := store.GetPlaylist(ctx, randomToken(8)); !errors.Is(err, errPlaylistNotFound) {
+			t.Errorf("GetPlaylist of an unknown ID = %v, want errPlaylistNotFound", err)
+		}
+	})
+}
+
+func TestStoreDuplicatePlaylist(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		p := testPlaylist(1)
+		if _, _, err := store.CreatePlaylist(ctx, p, ""); err != nil {
+			t.Fatalf("CreatePlaylist: %v", err)
+		}
+
+		if _, _, err := store.CreatePlaylist(ctx, p, ""); !errors.Is(err, errPlaylistExists) {
+			t.Errorf("CreatePlaylist of the same ID = %v, want errPlaylistExists", err)
+		}
+
+		// A different playlist reusing a stored key_id conflicts too.
+		other := testPlaylist(1)
+		other.Content[0].KeyID = p.Content[0].KeyID
+		if _, _, err := store.CreatePlaylist(ctx, other, ""); !errors.Is(err, errPlaylistExists) {
+			t.Errorf("CreatePlaylist with a stored key_id = %v, want errPlaylistExists", err)
+		}
+		if _, err := store.GetPlaylist(ctx, other.ID); !errors.Is(err, errPlaylistNotFound) {
+			t.Errorf("the conflicting playlist was stored: GetPlaylist = %v", err)
+		}
+	})
+}
+
+func TestStoreRejectsBadContent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+
+		mismatched := testPlaylist(2)
+		mismatched.Content[1].ID = randomToken(8)
+		if _, _, err := store.CreatePlaylist(ctx, mismatched, ""); !errors.Is(err, errContentMismatch) {
+			t.Errorf("CreatePlaylist with another playlist's content = %v, want errContentMismatch", err)
+		}
+
+		repeated := testPlaylist(2)
+		repeated.Content[1].KeyID = repeated.Content[0].KeyID
+		if _, _, err := store.CreatePlaylist(ctx, repeated, ""); !errors.Is(err, errPlaylistExists) {
+			t.Errorf("CreatePlaylist with a repeated key_id = %v, want errPlaylistExists", err)
+		}
+		if _, err := store.GetPlaylist(ctx, repeated.ID); !errors.Is(err, errPlaylistNotFound) {
+			t.Errorf("the rejected playlist was stored: GetPlaylist = %v", err)
+		}
+	})
+}
+
+func TestStoreIdempotencyKey(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := randomToken(16)
+		p := testPlaylist(2)
+
+		if _, replayed, err := store.CreatePlaylist(ctx, p, key); err != nil || replayed {
+			t.Fatalf("CreatePlaylist = replayed %v, %v; want a new playlist", replayed, err)
+		}
+
+		stored, replayed, err := store.CreatePlaylist(ctx, p, key)
+		if err != nil || !replayed {
+			t.Fatalf("replayed CreatePlaylist = replayed %v, %v; want a replay", replayed, err)
+		}
+		if !reflect.DeepEqual(stored, p) {
+			t.Errorf("replayed CreatePlaylist returned %+v, want %+v", stored, p)
+		}
+
+		changed := p
+		changed.Name = "Something Else"
+		if _, _, err := store.CreatePlaylist(ctx, changed, key); !errors.Is(err, errIdempotencyKeyReused) {
+			t.Errorf("CreatePlaylist reusing the key for another body = %v, want errIdempotencyKeyReused", err)
+		}
+		got, err := store.GetPlaylist(ctx, p.ID)
+		if err != nil || got.Name != p.Name {
+			t.Errorf("GetPlaylist after the reused key = %q, %v; want %q", got.Name, err, p.Name)
+		}
+	})
+}
+
+func TestStoreSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		now := time.Now().UTC().Truncate(time.Second)
+		session := userSession{ID: randomToken(16), CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+
+		if err := store.CreateSession(ctx, session); err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+		got, err := store.GetSession(ctx, session.ID)
+		if err != nil {
+			t.Fatalf("GetSession: %v", err)
+		}
+		if got.ID != session.ID || !got.CreatedAt.Equal(session.CreatedAt) || !got.ExpiresAt.Equal(session.ExpiresAt) {
+			t.Errorf("GetSession = %+v, want %+v", got, session)
+		}
+
+		token := providerToken{
+			SessionID:    session.ID,
+			Provider:     "spotify",
+			AccessToken:  "access",
+			RefreshToken: "refresh",
+			Scope:        "playlist-read-private",
+			ExpiresAt:    now.Add(time.Hour),
+		}
+		if err := store.SaveProviderToken(ctx, token); err != nil {
+			t.Fatalf("SaveProviderToken: %v", err)
+		}
+		token.AccessToken = "refreshed"
+		if err := store.SaveProviderToken(ctx, token); err != nil {
+			t.Fatalf("SaveProviderToken replacing a token: %v", err)
+		}
+		gotToken, err := store.GetProviderToken(ctx, session.ID, "spotify")
+		if err != nil {
+			t.Fatalf("GetProviderToken: %v", err)
+		}
+		if gotToken.AccessToken != "refreshed" || gotToken.RefreshToken != "refresh" || !gotToken.ExpiresAt.Equal(token.ExpiresAt) {
+			t.Errorf("GetProviderToken = %+v, want %+v", gotToken, token)
+		}
+		if tokens, err := store.ListProviderTokens(ctx, session.ID); err != nil || len(tokens) != 1 {
+			t.Errorf("ListProviderTokens = %d tokens, %v; want 1", len(tokens), err)
+		}
+		if _, err := store.GetProviderToken(ctx, session.ID, "apple"); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("GetProviderToken for an unconnected provider = %v, want errSessionNotFound", err)
+		}
+
+		if err := store.DeleteProviderToken(ctx, session.ID, "spotify"); err != nil {
+			t.Fatalf("DeleteProviderToken: %v", err)
+		}
+		if _, err := store.GetProviderToken(ctx, session.ID, "spotify"); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("GetProviderToken after deleting it = %v, want errSessionNotFound", err)
+		}
+
+		// Deleting the session takes its tokens with it.
+		if err := store.SaveProviderToken(ctx, token); err != nil {
+			t.Fatalf("SaveProviderToken: %v", err)
+		}
+		if err := store.DeleteSession(ctx, session.ID); err != nil {
+			t.Fatalf("DeleteSession: %v", err)
+		}
+		if _, err := store.GetSession(ctx, session.ID); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("GetSession after deleting it = %v, want errSessionNotFound", err)
+		}
+		if tokens, err := store.ListProviderTokens(ctx, session.ID); err != nil || len(tokens) != 0 {
+			t.Errorf("ListProviderTokens after deleting the session = %d tokens, %v; want none", len(tokens), err)
+		}
+	})
+}
+
+func TestStoreOAuthState(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		now := time.Now().UTC().Truncate(time.Second)
+		session := userSession{ID: randomToken(16), CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+		if err := store.CreateSession(ctx, session); err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+
+		state := oauthState{
+			State:        randomToken(16),
+			SessionID:    session.ID,
+			Provider:     "spotify",
+			CodeVerifier: "verifier",
+			RedirectURI:  "https://app.example.com/done",
+			CreatedAt:    now,
+		}
+		if err := store.CreateOAuthState(ctx, state); err != nil {
+			t.Fatalf("CreateOAuthState: %v", err)
+		}
+
+		got, err := store.TakeOAuthState(ctx, state.State)
+		if err != nil {
+			t.Fatalf("TakeOAuthState: %v", err)
+		}
+		if got.SessionID != state.SessionID || got.CodeVerifier != state.CodeVerifier || got.RedirectURI != state.RedirectURI || !got.CreatedAt.Equal(state.CreatedAt) {
+			t.Errorf("TakeOAuthState = %+v, want %+v", got, state)
+		}
+
+		if _, err := store.TakeOAuthState(ctx, state.State); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("taking the state a second time = %v, want errSessionNotFound", err)
+		}
+	})
+}
+
+func TestStoreDeleteExpiredSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		now := time.Now().UTC().Truncate(time.Second)
+		live := userSession{ID: randomToken(16), CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour)}
+		expired := userSession{ID: randomToken(16), CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)}
+		for _, session := range []userSession{live, expired} {
+			if err := store.CreateSession(ctx, session); err != nil {
+				t.Fatalf("CreateSession: %v", err)
+			}
+		}
+
+		tokens := []providerToken{
+			{SessionID: live.ID, Provider: "spotify", AccessToken: "a", RefreshToken: "r", ExpiresAt: now.Add(-time.Hour)},
+			{SessionID: live.ID, Provider: "apple", AccessToken: "a", ExpiresAt: now.Add(-time.Hour)},
+			{SessionID: expired.ID, Provider: "spotify", AccessToken: "a", RefreshToken: "r", ExpiresAt: now.Add(time.Hour)},
+		}
+		for _, token := range tokens {
+			if err := store.SaveProviderToken(ctx, token); err != nil {
+				t.Fatalf("SaveProviderToken: %v", err)
+			}
+		}
+		oldState := oauthState{State: randomToken(16), SessionID: live.ID, Provider: "spotify", CodeVerifier: "v", RedirectURI: "https://example.com", CreatedAt: now.Add(-time.Hour)}
+		newState := oauthState{State: randomToken(16), SessionID: live.ID, Provider: "spotify", CodeVerifier: "v", RedirectURI: "https://example.com", CreatedAt: now}
+		for _, state := range []oauthState{oldState, newState} {
+			if err := store.CreateOAuthState(ctx, state); err != nil {
+				t.Fatalf("CreateOAuthState: %v", err)
+			}
+		}
+
+		deleted, err := store.DeleteExpiredSessions(ctx, now, now.Add(-10*time.Minute))
+		if err != nil {
+			t.Fatalf("DeleteExpiredSessions: %v", err)
+		}
+		// Other tests' rows may share a Postgres or MySQL database.
+		if deleted < 4 {
+			t.Errorf("DeleteExpiredSessions deleted %d rows, want at least 4", deleted)
+		}
+
+		if _, err := store.GetSession(ctx, live.ID); err != nil {
+			t.Errorf("GetSession for a live session: %v", err)
+		}
+		if _, err := store.GetSession(ctx, expired.ID); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("GetSession for an expired session = %v, want errSessionNotFound", err)
+		}
+		if _, err := store.GetProviderToken(ctx, live.ID, "spotify"); err != nil {
+			t.Errorf("a token that can be refreshed was deleted: %v", err)
+		}
+		if _, err := store.GetProviderToken(ctx, live.ID, "apple"); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("GetProviderToken for an expired token = %v, want errSessionNotFound", err)
+		}
+		if _, err := store.GetProviderToken(ctx, expired.ID, "spotify"); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("GetProviderToken for an expired session = %v, want errSessionNotFound", err)
+		}
+		if _, err := store.TakeOAuthState(ctx, oldState.State); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("TakeOAuthState for an old state = %v, want errSessionNotFound", err)
+		}
+		if _, err := store.TakeOAuthState(ctx, newState.State); err != nil {
+			t.Errorf("TakeOAuthState for a new state: %v", err)
+		}
+	})
+}
+
+func TestSealedSessionStore(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemoryPlaylistStore()
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	sealed, err := newSealedSessionStore(backend, key)
+	if err != nil {
+		t.Fatalf("newSealedSessionStore: %v", err)
+	}
+
+	token := providerToken{SessionID: "session", Provider: "spotify", AccessToken: "access", RefreshToken: "refresh"}
+	if err := sealed.SaveProviderToken(ctx, token); err != nil {
+		t.Fatalf("SaveProviderToken: %v", err)
+	}
+	stored, _ := backend.GetProviderToken(ctx, "session", "spotify")
+	if !strings.HasPrefix(stored.AccessToken, sealedTokenPrefix) || strings.Contains(stored.AccessToken+stored.RefreshToken, "access") {
+		t.Errorf("stored token %+v is not encrypted", stored)
+	}
+	got, err := sealed.GetProviderToken(ctx, "session", "spotify")
+	if err != nil || got.AccessToken != "access" || got.RefreshToken != "refresh" {
+		t.Errorf("GetProviderToken = %+v, %v; want the token decrypted", got, err)
+	}
+
+	// A sealed token moved to another session doesn't decrypt.
+	stored.SessionID = "other"
+	backend.SaveProviderToken(ctx, stored)
+	if _, err := sealed.GetProviderToken(ctx, "other", "spotify"); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("GetProviderToken for a token copied to another session = %v, want errSessionNotFound", err)
+	}
+
+	// Tokens saved before a key was set are still read.
+	backend.SaveProviderToken(ctx, providerToken{SessionID: "legacy", Provider: "apple", AccessToken: "plain"})
+	if got, err := sealed.GetProviderToken(ctx, "legacy", "apple"); err != nil || got.AccessToken != "plain" {
+		t.Errorf("GetProviderToken for a plaintext token = %+v, %v", got, err)
+	}
+
+	unkeyed, _ := newSealedSessionStore(backend, "")
+	if _, err := unkeyed.GetProviderToken(ctx, "session", "spotify"); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("GetProviderToken for an encrypted token without a key = %v, want errSessionNotFound", err)
+	}
+}
+
+func TestStoreMigrationJobs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		now := time.Now().UTC().Truncate(time.Second)
+		sessionID := randomToken(16)
+		if err := store.CreateSession(ctx, userSession{ID: sessionID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+
+		older := migrationJob{
+			ID:        randomToken(8),
+			SessionID: sessionID,
+			Source:    "spotify",
+			Target:    "apple",
+			Status:    migrationQueued,
+			Progress:  migrationProgress{Include: []string{"liked"}},
+			CreatedAt: now.Add(-time.Minute),
+			UpdatedAt: now.Add(-time.Minute),
+		}
+		newer := older
+		newer.ID = randomToken(8)
+		newer.Status = migrationCompleted
+		newer.CreatedAt, newer.UpdatedAt = now, now
+		for _, job := range []migrationJob{older, newer} {
+			if err := store.CreateMigration(ctx, job); err != nil {
+				t.Fatalf("CreateMigration: %v", err)
+			}
+		}
+
+		claimed, err := store.ClaimMigration(ctx, older.ID, "replica-a", now.Add(time.Minute), now)
+		if err != nil {
+			t.Fatalf("ClaimMigration: %v", err)
+		}
+		if claimed.Owner != "replica-a" || !claimed.LeaseUntil.Equal(now.Add(time.Minute)) {
+			t.Errorf("ClaimMigration = owner %q until %v, want replica-a until %v", claimed.Owner, claimed.LeaseUntil, now.Add(time.Minute))
+		}
+		if _, err := store.ClaimMigration(ctx, older.ID, "replica-b", now.Add(time.Minute), now); !errors.Is(err, errMigrationChanged) {
+			t.Errorf("ClaimMigration of a job another replica holds = %v, want errMigrationChanged", err)
+		}
+		if _, err := store.ClaimMigration(ctx, newer.ID, "replica-a", now.Add(time.Minute), now); !errors.Is(err, errMigrationChanged) {
+			t.Errorf("ClaimMigration of a completed job = %v, want errMigrationChanged", err)
+		}
+		if _, err := store.ClaimMigration(ctx, randomToken(8), "replica-a", now.Add(time.Minute), now); !errors.Is(err, errMigrationNotFound) {
+			t.Errorf("ClaimMigration of an unknown job = %v, want errMigrationNotFound", err)
+		}
+
+		older.Owner = "replica-a"
+		older.LeaseUntil = now.Add(2 * time.Minute)
+		older.Status = migrationRunning
+		older.Progress.Planned = true
+		older.Progress.Steps = []migrationStep{{
+			Kind:   "liked",
+			Name:   "Liked Songs",
+			Listed: true,
+			Items: []libraryItem{{
+				Name:   "Yesterday",
+				Artist: "The Beatles",
+				Query:  trackQuery{Title: "Yesterday", Artist: "The Beatles", Album: "Help!", Duration: 125 * time.Second, TrackNum: 13},
+				Known:  &trackCandidate{Provider: "spotify", Title: "Yesterday", Artist: "The Beatles", URL: "https://open.spotify.com/track/1"},
+			}},
+			Total:   10,
+			Scanned: 4,
+			Pending: []string{"a", "b"},
+		}}
+		older.Report.Migrated.Tracks = 2
+		older.UpdatedAt = now
+		if err := store.SaveMigration(ctx, older); err != nil {
+			t.Fatalf("SaveMigration: %v", err)
+		}
+		got, err := store.GetMigration(ctx, older.ID)
+		if err != nil {
+			t.Fatalf("GetMigration: %v", err)
+		}
+		if got.Status != migrationRunning || !reflect.DeepEqual(got.Progress, older.Progress) || got.Report.Migrated.Tracks != 2 || !got.UpdatedAt.Equal(now) {
+			t.Errorf("GetMigration = %+v, want %+v", got, older)
+		}
+
+		jobs, err := store.ListMigrations(ctx, sessionID)
+		if err != nil {
+			t.Fatalf("ListMigrations: %v", err)
+		}
+		if len(jobs) != 2 || jobs[0].ID != newer.ID || jobs[1].ID != older.ID {
+			t.Errorf("ListMigrations = %d jobs; want the newer job, then the older", len(jobs))
+		}
+
+		unfinished, err := store.ListUnfinishedMigrations(ctx)
+		if err != nil {
+			t.Fatalf("ListUnfinishedMigrations: %v", err)
+		}
+		found := map[string]bool{}
+		for _, job := range unfinished {
+			found[job.ID] = true
+		}
+		if !found[older.ID] || found[newer.ID] {
+			t.Errorf("ListUnfinishedMigrations includes the running job %v and the completed one %v; want only the running job", found[older.ID], found[newer.ID])
+		}
+
+		// Unfinished jobs are resumed oldest first. Other tests' jobs may be
+		// in a shared database, so only these two are compared.
+		oldest := older
+		oldest.ID = randomToken(8)
+		oldest.CreatedAt = now.Add(-time.Hour)
+		if err := store.CreateMigration(ctx, oldest); err != nil {
+			t.Fatalf("CreateMigration: %v", err)
+		}
+		unfinished, err = store.ListUnfinishedMigrations(ctx)
+		if err != nil {
+			t.Fatalf("ListUnfinishedMigrations: %v", err)
+		}
+		var order []string
+		for _, job := range unfinished {
+			if job.ID == oldest.ID || job.ID == older.ID {
+				order = append(order, job.ID)
+			}
+		}
+		if !reflect.DeepEqual(order, []string{oldest.ID, older.ID}) {
+			t.Errorf("ListUnfinishedMigrations lists %v; want the oldest job %s before %s", order, oldest.ID, older.ID)
+		}
+
+		if err := store.SaveMigration(ctx, migrationJob{ID: randomToken(8)}); !errors.Is(err, errMigrationNotFound) {
+			t.Errorf("SaveMigration of an unknown job = %v, want errMigrationNotFound", err)
+		}
+
+		// Once the lease has run out another replica takes the job over, and
+		// the first can no longer save it.
+		later := now.Add(3 * time.Minute)
+		if _, err := store.ClaimMigration(ctx, older.ID, "replica-b", later.Add(time.Minute), later); err != nil {
+			t.Fatalf("ClaimMigration of a job whose lease ran out: %v", err)
+		}
+		if err := store.SaveMigration(ctx, older); !errors.Is(err, errMigrationChanged) {
+			t.Errorf("SaveMigration by a replica that lost the job = %v, want errMigrationChanged", err)
+		}
+
+		if err := store.CancelMigration(ctx, older.ID, later); err != nil {
+			t.Fatalf("CancelMigration: %v", err)
+		}
+		older.Owner = "replica-b"
+		if err := store.SaveMigration(ctx, older); !errors.Is(err, errMigrationChanged) {
+			t.Errorf("SaveMigration of a cancelled job = %v, want errMigrationChanged", err)
+		}
+		if err := store.CancelMigration(ctx, older.ID, later); !errors.Is(err, errMigrationChanged) {
+			t.Errorf("CancelMigration of a cancelled job = %v, want errMigrationChanged", err)
+		}
+
+		if err := store.ResumeMigration(ctx, older.ID, later); err != nil {
+			t.Fatalf("ResumeMigration: %v", err)
+		}
+		got, err = store.GetMigration(ctx, older.ID)
+		if err != nil {
+			t.Fatalf("GetMigration: %v", err)
+		}
+		if got.Status != migrationQueued || got.Owner != "" || !got.LeaseUntil.IsZero() {
+			t.Errorf("GetMigration after ResumeMigration = status %q, owner %q until %v; want queued with no owner", got.Status, got.Owner, got.LeaseUntil)
+		}
+		if err := store.ResumeMigration(ctx, older.ID, later); !errors.Is(err, errMigrationChanged) {
+			t.Errorf("ResumeMigration of a queued job = %v, want errMigrationChanged", err)
+		}
+	})
+}
+
+// TestStoreMigrationUnchangedUpdates checks that updates which leave a job as
+// it was still succeed, which MySQL only reports when connections count the
+// rows an UPDATE matches.
+func TestStoreMigrationUnchangedUpdates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		now := time.Now().UTC().Truncate(time.Second)
+		sessionID := randomToken(16)
+		if err := store.CreateSession(ctx, userSession{ID: sessionID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+		job := migrationJob{
+			ID:        randomToken(8),
+			SessionID: sessionID,
+			Source:    "spotify",
+			Target:    "apple",
+			Status:    migrationQueued,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := store.CreateMigration(ctx, job); err != nil {
+			t.Fatalf("CreateMigration: %v", err)
+		}
+
+		job, err := store.ClaimMigration(ctx, job.ID, "replica-a", now.Add(time.Minute), now)
+		if err != nil {
+			t.Fatalf("ClaimMigration: %v", err)
+		}
+		job.Status = migrationRunning
+		for i := 0; i < 2; i++ {
+			if err := store.SaveMigration(ctx, job); err != nil {
+				t.Fatalf("SaveMigration #%d of the same job: %v", i+1, err)
+			}
+		}
+		// A renewal in the same second as the save sets the same lease.
+		if _, err := store.ClaimMigration(ctx, job.ID, "replica-a", now.Add(time.Minute), now); err != nil {
+			t.Errorf("ClaimMigration renewing the lease it just saved: %v", err)
+		}
+	})
+}
+
+func TestMySQLDSNCountsMatchedRows(t *testing.T) {
+	dsn, err := mysqlDialect.prepareDSN("polyphonic:secret@tcp(localhost:3306)/polyphonic")
+	if err != nil {
+		t.Fatalf("prepareDSN: %v", err)
+	}
+	built := Config{Database: DatabaseConfig{Driver: "mysql", Addr: "localhost:3306", Name: "polyphonic"}}.databaseDSN()
+	for _, dsn := range []string{dsn, built} {
+		if !strings.Contains(dsn, "clientFoundRows=true") {
+			t.Errorf("MySQL DSN %q doesn't set clientFoundRows", dsn)
+		}
+	}
+}
+
+func TestStoreLinks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		now := time.Now().Truncate(time.Second)
+		key := "spotify:" + randomToken(8)
+
+		if _, _, err := store.GetLink(ctx, key); !errors.Is(err, errLinkNotFound) {
+			t.Errorf("GetLink of an unknown link = %v, want errLinkNotFound", err)
+		}
+
+		first := linkResolution{
+			Source: trackCandidate{Provider: "spotify", Title: "Yesterday", Artist: "The Beatles", URL: "https://open.spotify.com/track/1", Confidence: 100},
+			Links:  map[string]trackCandidate{},
+		}
+		second := first
+		second.Links = map[string]trackCandidate{"apple": {Provider: "apple", Title: "Yesterday", Artist: "The Beatles", URL: "https://music.apple.com/us/song/1"}}
+		for _, resolution := range []linkResolution{first, second} {
+			if err := store.SaveLink(ctx, key, resolution, now); err != nil {
+				t.Fatalf("SaveLink: %v", err)
+			}
+		}
+
+		got, resolvedAt, err := store.GetLink(ctx, key)
+		if err != nil {
+			t.Fatalf("GetLink: %v", err)
+		}
+		if !reflect.DeepEqual(got, second) || !resolvedAt.Equal(now) {
+			t.Errorf("GetLink = %+v at %v, want %+v at %v", got, resolvedAt, second, now)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+certReloader serves a TLS certificate that can be replaced while the server
+is running. The certificate, key and optional client CA bundle are re-read on
+SIGHUP, or when the files change on disk. Existing connections keep the
+certificate they were set up with; new handshakes get the new one.
+*/
+type certReloader struct {
+	certPath     string
+	keyPath      string
+	clientCAPath string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+func newCertReloader(certPath string, keyPath string, clientCAPath string) (*certReloader, error) {
+	r := &certReloader{
+		certPath:     certPath,
+		keyPath:      keyPath,
+		clientCAPath: clientCAPath,
+	}
+
+	return r, r.reload()
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certPath, r.keyPath}
+	if r.clientCAPath != "" {
+		files = append(files, r.clientCAPath)
+	}
+
+	return files
+}
+
+// reload reads the certificate files. On failure the previous certificate is
+// kept so a half-written rotation doesn't take the server down.
+func (r *certReloader) reload() error {
+	modTimes := map[string]time.Time{}
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAPath != "" {
+		caData, err := os.ReadFile(r.clientCAPath)
+		if err != nil {
+			return fmt.Errorf("loading client CA bundle: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			return fmt.Errorf("loading client CA bundle: no PEM certificates in %s", r.clientCAPath)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	r.mu.Unlock()
+
+	return nil
+}
+
+// changed reports whether any of the files were modified since they were
+// last loaded.
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			// The file may be mid-rotation; try again next time.
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[path]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// tlsConfig returns the TLS configuration for the public listener.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+		// Set here rather than left to net/http, which only adds them to its
+		// own copy of the config, so configs cloned from this one keep HTTP/2.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+}
+
+/*
+adminTLSConfig returns the TLS configuration for the admin listener. When a
+client CA bundle is configured, clients must present a certificate signed by
+one of its CAs (mutual TLS).
+*/
+func (r *certReloader) adminTLSConfig() *tls.Config {
+	cfg := r.tlsConfig()
+
+	if r.clientCAPath != "" {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		// ClientCAs can't be swapped on a shared config, so each handshake
+		// gets a copy with the current bundle.
+		base := cfg.Clone()
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			handshakeCfg := base.Clone()
+			handshakeCfg.ClientCAs = r.clientCAs
+			return handshakeCfg, nil
+		}
+	}
+
+	return cfg
+}
+
+// watch reloads the certificate on SIGHUP and whenever the files change,
+// checking every interval, until ctx is done.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			logger.Info("TLS: SIGHUP received, reloading certificate")
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			logger.Info("TLS: certificate files changed, reloading")
+		}
+
+		if err := r.reload(); err != nil {
+			logger.Error("TLS: reload failed, keeping previous certificate", "error", err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates every span in the server. Until setupTracing installs a
+// provider its spans are no-ops.
+var tracer = otel.Tracer("polyphonic-backend")
+
+// traceIDHeader returns the trace ID of a request so a slow or failed call
+// can be looked up in the tracing backend.
+const traceIDHeader = "X-Trace-ID"
+
+/*
+setupTracing installs the span exporter chosen in cfg: none, file (spans
+written as JSON lines) or otlp (OTLP over HTTP). It returns a function that
+flushes buffered spans and releases the exporter.
+*/
+func setupTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	// Incoming W3C traceparent headers are honoured whether or not spans
+	// are exported here.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var closeFile func() error
+	switch cfg.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("opening trace file: %v", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		closeFile = f.Close
+	case "otlp":
+		options := []otlptracehttp.Option{}
+		if cfg.OTLPEndpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+		}
+		var err error
+		exporter, err = otlptracehttp.New(ctx, options...)
+		if err != nil {
+			return nil, fmt.Errorf("creating OTLP exporter: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	// The sampler can be changed with the standard OTEL_TRACES_SAMPLER
+	// variables; by default every trace is kept.
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeFile != nil {
+			err = errors.Join(err, closeFile())
+		}
+		return err
+	}, nil
+}
+
+// tracingMiddleware starts the server span for a request, continuing the
+// caller's trace if it sent one, and returns the trace ID in X-Trace-ID.
+func tracingMiddleware(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.HTTPRoute(route),
+		),
+	)
+	defer span.End()
+
+	if sc := span.SpanContext(); sc.IsValid() {
+		c.Header(traceIDHeader, sc.TraceID().String())
+	}
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// startUpstreamSpan starts the client span for one call to a provider. Every
+// attempt gets its own span, so retries and pages show up separately.
+func startUpstreamSpan(request *http.Request, provider string, endpoint string) (context.Context, trace.Span) {
+	return tracer.Start(request.Context(), provider+" "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("upstream.provider", provider),
+			attribute.String("upstream.endpoint", endpoint),
+			semconv.HTTPRequestMethodKey.String(request.Method),
+			semconv.ServerAddress(request.URL.Hostname()),
+			semconv.URLPath(request.URL.Path),
+		),
+	)
+}
+
+// endSpan records err on span, if there is one, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Tracklists pasted from radio shows, DJ sets and forum posts are read one line
+at a time. The parser is tolerant rather than strict: numbering, bullets and
+timestamps are dropped, and the artist and title are split on whichever
+separator the line uses.
+*/
+
+var (
+	// A timestamp such as "01:02:03", "[12:30]" or "(4:05)".
+	leadingTimestamp  = regexp.MustCompile(`^[\[(]?\d{1,2}:\d{2}(:\d{2})?[\])]?\s*[-–—|.]?\s+`)
+	trailingTimestamp = regexp.MustCompile(`\s*[\[(]?(\d{1,2}:\d{2}(:\d{2})?)[\])]?$`)
+	// Numbering such as "1.", "01)", "#3", "[4]" or "12 -".
+	leadingNumber = regexp.MustCompile(`^(#?\d{1,3}[.):\]]|\[\d{1,3}\]|#\d{1,3}|\d{1,3}\s+[-–—])\s*`)
+	leadingBullet = regexp.MustCompile(`^[-*•·–—>]+\s*`)
+	// A featured artist credit in brackets, or running to the end of the
+	// artist or title.
+	bracketedFeaturing = regexp.MustCompile(`(?i)\s*[(\[](?:feat\.?|ft\.?|featuring)\s+([^)\]]+)[)\]]`)
+	trailingFeaturing  = regexp.MustCompile(`(?i)\s+(?:feat\.?|ft\.?|featuring)\s+(.+)$`)
+	// Separators between artist and title, most specific first.
+	artistTitleSeparators = []string{" – ", " — ", " -- ", " - ", " | ", " ~ "}
+	byPattern             = regexp.MustCompile(`(?i)^(.+?)\s+by\s+(.+)$`)
+	trailingLabel         = regexp.MustCompile(`\s*\[([^\]]*)\]$`)
+	versionWords          = regexp.MustCompile(`(?i)\b(mix|remix|edit|version|live|dub|rework|bootleg|vip)\b`)
+)
+
+// tracklistLine is one parsed line of a tracklist.
+type tracklistLine struct {
+	Line      int    `json:"line"`
+	Text      string `json:"text"`
+	Title     string `json:"title"`
+	Artist    string `json:"artist,omitempty"`
+	Featuring string `json:"featuring,omitempty"`
+	// DurationSeconds is set when the line ends with a track length.
+	DurationSeconds int                         `json:"duration_seconds,omitempty"`
+	Candidates      map[string][]trackCandidate `json:"candidates"`
+	// swapped is the same line read as "Title - Artist", tried when the
+	// usual reading finds nothing.
+	swapped *trackQuery
+}
+
+// query is what the line is searched for with.
+func (l tracklistLine) query() trackQuery {
+	return trackQuery{Title: l.Title, Artist: l.Artist, Duration: time.Duration(l.DurationSeconds) * time.Second}
+}
+
+// stripQuotes removes quotes around a whole title.
+func stripQuotes(s string) string {
+	s = strings.TrimSpace(s)
+	for _, pair := range []string{`""`, `“”`, `''`, `‘’`} {
+		quotes := []rune(pair)
+		if strings.HasPrefix(s, string(quotes[0])) && strings.HasSuffix(s, string(quotes[1])) && len(s) > 2 {
+			return strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(s, string(quotes[0])), string(quotes[1])))
+		}
+	}
+
+	return s
+}
+
+/*
+parseTracklistLine reads "Artist – Title (Remix)", "1. Title by Artist",
+"[00:12:30] Artist - Title [Label]" and similar. It reports false for lines
+that aren't tracks, such as blank lines and headings ending in a colon.
+*/
+func parseTracklistLine(text string) (tracklistLine, bool) {
+	line := tracklistLine{Text: text}
+	s := strings.TrimSpace(text)
+	if s == "" || strings.HasSuffix(s, ":") {
+		return line, false
+	}
+
+	for {
+		before := s
+		s = leadingTimestamp.ReplaceAllString(s, "")
+		s = leadingNumber.ReplaceAllString(s, "")
+		s = leadingBullet.ReplaceAllString(s, "")
+		if s == before {
+			break
+		}
+	}
+	if match := trailingTimestamp.FindStringSubmatch(s); match != nil && match[0] != s {
+		line.DurationSeconds = int(parseDuration(match[1], false) / time.Second)
+		s = strings.TrimSpace(strings.TrimSuffix(s, match[0]))
+	}
+	// Record labels are dropped, but a bracketed "[Extended Mix]" is kept.
+	if match := trailingLabel.FindStringSubmatch(s); match != nil {
+		s = strings.TrimSuffix(s, match[0])
+		if versionWords.MatchString(match[1]) {
+			s += " (" + match[1] + ")"
+		}
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return line, false
+	}
+
+	split := false
+	for _, separator := range artistTitleSeparators {
+		if artist, title, ok := strings.Cut(s, separator); ok {
+			line.Artist, line.Title = artist, title
+			split = true
+			break
+		}
+	}
+	if match := byPattern.FindStringSubmatch(s); !split && match != nil {
+		line.Title, line.Artist = match[1], match[2]
+	} else if !split {
+		line.Title = s
+	}
+	line.Title = line.removeFeaturing(line.Title)
+	line.Artist = line.removeFeaturing(line.Artist)
+	if split {
+		line.swapped = &trackQuery{Title: line.Artist, Artist: line.Title, Duration: time.Duration(line.DurationSeconds) * time.Second}
+	}
+
+	return line, line.Title != ""
+}
+
+// removeFeaturing takes a featured artist credit out of s, noting it on the
+// line, and strips quotes around what is left.
+func (l *tracklistLine) removeFeaturing(s string) string {
+	for _, pattern := range []*regexp.Regexp{bracketedFeaturing, trailingFeaturing} {
+		if match := pattern.FindStringSubmatch(s); match != nil {
+			l.Featuring = strings.TrimSpace(match[1])
+			s = strings.Replace(s, match[0], "", 1)
+		}
+	}
+
+	return stripQuotes(s)
+}
+
+// parseTracklist parses every line of text, skipping those that aren't
+// tracks. Line numbers start at 1.
+func parseTracklist(text string) []tracklistLine {
+	var lines []tracklistLine
+	for i, raw := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line, ok := parseTracklistLine(raw)
+		if !ok {
+			continue
+		}
+		line.Line = i + 1
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// tracklistRequest is the body of POST /tracklist.
+type tracklistRequest struct {
+	Text      string   `json:"text"`
+	Name      string   `json:"name"`
+	Providers []string `json:"providers"`
+}
+
+// confident reports whether any provider has a confident match.
+func (m trackMatches) confident() bool {
+	for provider := range m {
+		if _, ok := m.best(provider); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+postTracklist parses a pasted tracklist and searches each line on the chosen
+providers. It responds with the candidates for every line, and a playlist
+built from the best matches on the first provider that can be shared with
+POST /playlist. Nothing is saved.
+*/
+func postTracklist(c *gin.Context) {
+	var request tracklistRequest
+	if !bindValidJSON(c, "TracklistRequest", &request) {
+		return
+	}
+	providers := request.Providers
+	if len(providers) == 0 {
+		providers = providerNames
+	}
+
+	lines := parseTracklist(request.Text)
+	if len(lines) == 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "No tracks were found in the text"})
+		return
+	}
+	if len(lines) > maxImportEntries {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprintf("At most %d tracks can be searched at once", maxImportEntries)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.Import.MatchTimeout)
+	defer cancel()
+	for _, provider := range providers {
+		if err := checkProviderAuth(ctx, provider); err != nil {
+			c.IndentedJSON(http.StatusBadGateway, gin.H{
+				"error": provider + " authentication unavailable",
+			})
+			return
+		}
+	}
+
+	queries := make([]trackQuery, len(lines))
+	for i, line := range lines {
+		queries[i] = line.query()
+	}
+	matches := matchTracks(ctx, queries, providers)
+
+	// Lines written "Title - Artist" find nothing the usual way round, so
+	// try those the other way.
+	var retry []int
+	var swapped []trackQuery
+	for i, line := range lines {
+		if line.swapped != nil && !matches[i].confident() {
+			retry = append(retry, i)
+			swapped = append(swapped, *line.swapped)
+		}
+	}
+	for j, swappedMatches := range matchTracks(ctx, swapped, providers) {
+		i := retry[j]
+		if swappedMatches.confident() {
+			matches[i] = swappedMatches
+			lines[i].Title, lines[i].Artist = lines[i].Artist, lines[i].Title
+			queries[i] = swapped[j]
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		loggerFrom(ctx).Warn("matching a tracklist timed out", "lines", len(lines), "timeout", config.Import.MatchTimeout.String())
+		c.IndentedJSON(http.StatusGatewayTimeout, gin.H{"message": "Searching for the tracks took too long; try fewer lines at once"})
+		return
+	}
+
+	for i := range lines {
+		lines[i].Candidates = matches[i]
+	}
+
+	name := request.Name
+	if name == "" {
+		name = "Tracklist"
+	}
+	playlistData, unmatched := buildImportedPlaylist(importedPlaylist{Name: name, Entries: queries}, matches, providers[0])
+	for i := range unmatched {
+		// Report positions as line numbers, which is what the user sees.
+		unmatched[i].Position = lines[unmatched[i].Position-1].Line
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"lines":     lines,
+		"playlist":  playlistData,
+		"unmatched": unmatched,
+	})
+}
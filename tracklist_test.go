@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseTracklistLine(t *testing.T) {
+	tests := []struct {
+		text      string
+		ok        bool
+		artist    string
+		title     string
+		featuring string
+		seconds   int
+	}{
+		{"Daft Punk - One More Time", true, "Daft Punk", "One More Time", "", 0},
+		{"1. Daft Punk – One More Time", true, "Daft Punk", "One More Time", "", 0},
+		{"[00:12:30] Bicep - Glue [Ninja Tune]", true, "Bicep", "Glue", "", 0},
+		{"03) Fred again.. — Delilah (pull me out of this) [Extended Mix]", true, "Fred again..", "Delilah (pull me out of this) (Extended Mix)", "", 0},
+		{"• Yesterday by The Beatles", true, "The Beatles", "Yesterday", "", 0},
+		{"#4 Calvin Harris feat. Rihanna - This Is What You Came For 3:42", true, "Calvin Harris", "This Is What You Came For", "Rihanna", 222},
+		{"Disclosure | Latch (ft. Sam Smith)", true, "Disclosure", "Latch", "Sam Smith", 0},
+		{`Queen - "Bohemian Rhapsody"`, true, "Queen", "Bohemian Rhapsody", "", 0},
+		{"Windowlicker", true, "", "Windowlicker", "", 0},
+		{"", false, "", "", "", 0},
+		{"   ", false, "", "", "", 0},
+		{"Side A:", false, "", "", "", 0},
+		{"- ", false, "", "", "", 0},
+	}
+
+	for _, test := range tests {
+		line, ok := parseTracklistLine(test.text)
+		if ok != test.ok {
+			t.Errorf("parseTracklistLine(%q) ok = %v, want %v", test.text, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if line.Artist != test.artist || line.Title != test.title || line.Featuring != test.featuring || line.DurationSeconds != test.seconds {
+			t.Errorf("parseTracklistLine(%q) = artist %q, title %q, featuring %q, %ds; want %q, %q, %q, %ds",
+				test.text, line.Artist, line.Title, line.Featuring, line.DurationSeconds, test.artist, test.title, test.featuring, test.seconds)
+		}
+	}
+}
+
+func TestParseTracklistLineSwapped(t *testing.T) {
+	line, _ := parseTracklistLine("One More Time - Daft Punk")
+	if line.Artist != "One More Time" || line.swapped == nil || line.swapped.Title != "One More Time" || line.swapped.Artist != "Daft Punk" {
+		t.Errorf("parseTracklistLine = artist %q, swapped %+v; want the swapped reading to take Daft Punk as the artist", line.Artist, line.swapped)
+	}
+
+	line, _ = parseTracklistLine("Windowlicker")
+	if line.swapped != nil {
+		t.Errorf("swapped of a line without a separator = %+v, want nil", line.swapped)
+	}
+}
+
+func TestParseTracklistLineNumbers(t *testing.T) {
+	lines := parseTracklist("Tracklist:\r\n\r\n1. Bicep - Glue\r\nnot: a track:\n2. Bicep - Apricots")
+	if len(lines) != 2 || lines[0].Line != 3 || lines[1].Line != 5 || lines[1].Title != "Apricots" {
+		t.Errorf("parseTracklist = %+v, want Glue on line 3 and Apricots on line 5", lines)
+	}
+}
+
+// TestPostTracklistLimits checks the requests rejected before anything is
+// searched.
+func TestPostTracklistLimits(t *testing.T) {
+	spec, err := loadAPISpec()
+	if err != nil {
+		t.Fatalf("loadAPISpec: %v", err)
+	}
+	apiSpec = spec
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/tracklist", postTracklist)
+
+	tooMany := strings.Repeat("Bicep - Glue\n", maxImportEntries+1)
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", http.StatusBadRequest},
+		{"Side A:\n\n", http.StatusUnprocessableEntity},
+		{tooMany, http.StatusUnprocessableEntity},
+	}
+	for _, test := range tests {
+		body, _ := json.Marshal(map[string]string{"text": test.text})
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tracklist", strings.NewReader(string(body))))
+		if recorder.Code != test.want {
+			t.Errorf("POST /tracklist with %d lines = %d, want %d: %s", strings.Count(test.text, "\n"), recorder.Code, test.want, recorder.Body.String())
+		}
+	}
+}
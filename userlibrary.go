@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Reading from a user's own account reaches what the app's credentials can't:
+private and collaborative Spotify playlists, liked songs, and the Apple Music
+library. The tracks go through the same matching as imports and are saved as
+a shared playlist.
+*/
+
+// appleLibrarySongsID selects the songs in the user's Apple Music library.
+const appleLibrarySongsID = "library"
+
+// userPlaylistSummary describes a playlist in a user's account. Tracks is
+// left out when the provider doesn't report it.
+type userPlaylistSummary struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Tracks        *int   `json:"tracks,omitempty"`
+	Owner         string `json:"owner,omitempty"`
+	Public        bool   `json:"public"`
+	Collaborative bool   `json:"collaborative,omitempty"`
+}
+
+// userImportRequest is the optional body for importing from a user's
+// account.
+type userImportRequest struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform"`
+}
+
+// appleLibrarySong is a song in the user's library, with the catalog song it
+// was added from when there is one.
+type appleLibrarySong struct {
+	Attributes    AppleMusicAttributes `json:"attributes"`
+	Relationships struct {
+		Catalog AppleMusicSong `json:"catalog"`
+	} `json:"relationships"`
+}
+
+type appleLibrarySongs struct {
+	Data []appleLibrarySong `json:"data"`
+	Next *string            `json:"next"`
+}
+
+// readUserImportRequest reads the optional body, defaulting the platform to
+// the provider read from.
+func readUserImportRequest(c *gin.Context, provider string) (userImportRequest, bool) {
+	var request userImportRequest
+	if c.Request.ContentLength != 0 && !bindValidJSON(c, "UserPlaylistImport", &request) {
+		return request, false
+	}
+	if request.Platform == "" {
+		request.Platform = provider
+	}
+
+	return request, true
+}
+
+// readProviderError responds to a failed read from a user's account.
+func readProviderError(c *gin.Context, session userSession, provider string, err error) {
+	name := providerDisplayNames[provider]
+	var apiErr userAPIError
+	switch {
+	case errors.Is(err, errAppleUserToken):
+		appleTokenExpired(c, session)
+	case errors.Is(err, errAppleDeveloperToken):
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"error": "apple authentication unavailable"})
+	case errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound:
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "The " + name + " account has no such playlist"})
+	case errors.As(err, &apiErr) && (apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden):
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "The " + name + " account did not allow its library to be read; connect it again"})
+	default:
+		loggerFrom(c.Request.Context()).Warn("reading user account failed", "provider", provider, "error", err)
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Error reading from " + name})
+	}
+}
+
+// importUserTracks matches tracks read from a user's account and saves them
+// as a shared playlist, as with file imports.
+func importUserTracks(c *gin.Context, provider string, request userImportRequest, name string, queries []trackQuery, known map[int]trackCandidate) {
+	imported := importedPlaylist{Name: name, Entries: queries}
+	if request.Name != "" {
+		imported.Name = request.Name
+	}
+	if !checkImport(c, &imported) {
+		return
+	}
+
+	matchImport(c, imported, request.Platform, func(ctx context.Context, providers []string) []trackMatches {
+		return matchKnownTracks(ctx, provider, withoutProvider(providers, provider), imported.Entries, known)
+	})
+}
+
+/*
+spotifyUserTracks returns the tracks on page and the pages after it, stopping
+once there are limit tracks.
+*/
+func spotifyUserTracks(ctx context.Context, token string, page Tracks, limit int) ([]PlaylistItem, error) {
+	items := page.Items
+	for page.Next != nil && len(items) < limit {
+		nextURL := *page.Next
+		page = Tracks{}
+		if err := spotifyUserRequest(ctx, "tracks_next", token, "GET", nextURL, nil, &page); err != nil {
+			return nil, err
+		}
+		loggerFrom(ctx).Debug("Spotify user tracks page", "tracks", len(page.Items))
+		items = append(items, page.Items...)
+	}
+
+	return items[:min(limit, len(items))], nil
+}
+
+// spotifyItemQueries turns playlist items into queries, with the Spotify
+// tracks known by index. Local files are only searched for; podcast episodes
+// are left out.
+func spotifyItemQueries(items []PlaylistItem) ([]trackQuery, map[int]trackCandidate) {
+	var queries []trackQuery
+	known := map[int]trackCandidate{}
+	for _, item := range items {
+		if spotifyTrackID(item.Track.URI) != "" {
+			candidate := spotifyCandidate(item.Track)
+			known[len(queries)] = candidate
+			queries = append(queries, trackQuery{Title: candidate.Title, Artist: candidate.Artist, Album: candidate.Album})
+		} else if query, ok := localTrack(item.Track.URI); ok {
+			queries = append(queries, query)
+		}
+	}
+
+	return queries, known
+}
+
+// spotifyUserPlaylists lists the playlists in the user's Spotify account.
+func spotifyUserPlaylists(ctx context.Context, token string) ([]userPlaylistSummary, error) {
+	var playlists []userPlaylistSummary
+	nextURL := "/me/playlists?limit=50"
+	for nextURL != "" {
+		var page struct {
+			Items []struct {
+				ID            string        `json:"id"`
+				Name          string        `json:"name"`
+				Public        bool          `json:"public"`
+				Collaborative bool          `json:"collaborative"`
+				Owner         PlaylistOwner `json:"owner"`
+				Tracks        struct {
+					Total int `json:"total"`
+				} `json:"tracks"`
+			} `json:"items"`
+			Next *string `json:"next"`
+		}
+		if err := spotifyUserRequest(ctx, "me_playlists", token, "GET", nextURL, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			total := item.Tracks.Total
+			playlists = append(playlists, userPlaylistSummary{
+				ID:            item.ID,
+				Name:          item.Name,
+				Tracks:        &total,
+				Owner:         item.Owner.DisplayName,
+				Public:        item.Public,
+				Collaborative: item.Collaborative,
+			})
+		}
+
+		nextURL = ""
+		if page.Next != nil {
+			nextURL = *page.Next
+		}
+	}
+
+	return playlists, nil
+}
+
+/*
+getSpotifyUserPlaylists lists the playlists in the session's Spotify account,
+including private and collaborative ones, after its liked songs.
+*/
+func getSpotifyUserPlaylists(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	token, ok := spotifyTokenFor(c, session)
+	if !ok {
+		return
+	}
+
+	var liked struct {
+		Total int `json:"total"`
+	}
+	if err := spotifyUserRequest(ctx, "saved_tracks", token, "GET", "/me/tracks?limit=1", nil, &liked); err != nil {
+		readProviderError(c, session, "spotify", err)
+		return
+	}
+	playlists := []userPlaylistSummary{{ID: likedSongsID, Name: "Liked Songs", Tracks: &liked.Total}}
+
+	owned, err := spotifyUserPlaylists(ctx, token)
+	if err != nil {
+		readProviderError(c, session, "spotify", err)
+		return
+	}
+	playlists = append(playlists, owned...)
+
+	c.IndentedJSON(http.StatusOK, gin.H{"playlists": playlists})
+}
+
+/*
+readSpotifyUserPlaylist reads a playlist, or the liked songs, from the user's
+Spotify account. Only the most recent limit liked songs are read; a longer
+playlist returns one more track than limit, so the caller can tell.
+*/
+func readSpotifyUserPlaylist(ctx context.Context, token string, id string, limit int) (string, []PlaylistItem, error) {
+	var name string
+	var page Tracks
+	var err error
+	if id == likedSongsID {
+		name = "Liked Songs"
+		err = spotifyUserRequest(ctx, "saved_tracks", token, "GET", "/me/tracks?limit=50", nil, &page)
+	} else {
+		var playlist SpotifyPlaylist
+		err = spotifyUserRequest(ctx, "playlist", token, "GET", "/playlists/"+url.PathEscape(id), nil, &playlist)
+		name, page = playlist.Name, playlist.Tracks
+		limit++
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	items, err := spotifyUserTracks(ctx, token, page, limit)
+
+	return name, items, err
+}
+
+/*
+postSpotifyUserImport reads a playlist, or the liked songs, from the session's
+Spotify account and saves it as a shared playlist. Only the most recent liked
+songs, up to the import limit, are read; longer playlists are rejected.
+*/
+func postSpotifyUserImport(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	request, ok := readUserImportRequest(c, "spotify")
+	if !ok {
+		return
+	}
+	token, ok := spotifyTokenFor(c, session)
+	if !ok {
+		return
+	}
+
+	id := c.Param("id")
+	name, items, err := readSpotifyUserPlaylist(ctx, token, id, maxImportEntries)
+	if err != nil {
+		readProviderError(c, session, "spotify", err)
+		return
+	}
+	loggerFrom(ctx).Debug("Spotify user playlist", "id", id, "name", name, "tracks", len(items))
+
+	queries, known := spotifyItemQueries(items)
+	importUserTracks(c, "spotify", request, name, queries, known)
+}
+
+// appleNextPath returns the path of the page after one with the next link
+// next, or "" on the last page. Next links don't always keep include.
+func appleNextPath(next *string) string {
+	if next == nil {
+		return ""
+	}
+	if !strings.Contains(*next, "include=") {
+		return *next + "&include=catalog"
+	}
+
+	return *next
+}
+
+/*
+appleUserTracks reads library songs from path and the pages after it,
+stopping once there are limit songs. A 404 is an empty playlist: Apple Music
+answers that way for playlists with no tracks.
+*/
+func appleUserTracks(ctx context.Context, token string, path string, limit int) ([]appleLibrarySong, error) {
+	var songs []appleLibrarySong
+	for path != "" && len(songs) < limit {
+		var page appleLibrarySongs
+		err := appleUserRequest(ctx, "library_tracks", token, "GET", path, nil, &page)
+		var apiErr userAPIError
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		loggerFrom(ctx).Debug("Apple library tracks page", "tracks", len(page.Data))
+		songs = append(songs, page.Data...)
+
+		path = appleNextPath(page.Next)
+	}
+
+	return songs[:min(limit, len(songs))], nil
+}
+
+// appleLibraryQueries turns library songs into queries, with the catalog
+// songs known by index. Uploaded songs have no catalog song and are only
+// searched for.
+func appleLibraryQueries(songs []appleLibrarySong) ([]trackQuery, map[int]trackCandidate) {
+	queries := make([]trackQuery, len(songs))
+	known := map[int]trackCandidate{}
+	for i, song := range songs {
+		attributes := song.Attributes
+		queries[i] = trackQuery{
+			Title:    attributes.Name,
+			Artist:   attributes.ArtistName,
+			Album:    attributes.AlbumName,
+			Duration: time.Duration(attributes.DurationInMillis) * time.Millisecond,
+		}
+		if catalog := song.Relationships.Catalog.Data; len(catalog) > 0 {
+			known[i] = appleCandidate(catalog[0])
+		}
+	}
+
+	return queries, known
+}
+
+// appleUserPlaylists lists the playlists in the user's Apple Music library.
+func appleUserPlaylists(ctx context.Context, token string) ([]userPlaylistSummary, error) {
+	var playlists []userPlaylistSummary
+	nextURL := "/v1/me/library/playlists?limit=100"
+	for nextURL != "" {
+		var page struct {
+			Data []struct {
+				ID         string `json:"id"`
+				Attributes struct {
+					Name     string `json:"name"`
+					IsPublic bool   `json:"isPublic"`
+				} `json:"attributes"`
+			} `json:"data"`
+			Next *string `json:"next"`
+		}
+		if err := appleUserRequest(ctx, "library_playlists", token, "GET", nextURL, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Data {
+			playlists = append(playlists, userPlaylistSummary{ID: item.ID, Name: item.Attributes.Name, Public: item.Attributes.IsPublic})
+		}
+
+		nextURL = ""
+		if page.Next != nil {
+			nextURL = *page.Next
+		}
+	}
+
+	return playlists, nil
+}
+
+// getAppleUserPlaylists lists the playlists in the session's Apple Music
+// library, after the library's songs.
+func getAppleUserPlaylists(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	token, ok := appleTokenFor(c, session)
+	if !ok {
+		return
+	}
+
+	playlists := []userPlaylistSummary{{ID: appleLibrarySongsID, Name: "Library songs"}}
+	library, err := appleUserPlaylists(ctx, token)
+	if err != nil {
+		readProviderError(c, session, "apple", err)
+		return
+	}
+	playlists = append(playlists, library...)
+
+	c.IndentedJSON(http.StatusOK, gin.H{"playlists": playlists})
+}
+
+/*
+readAppleLibraryPlaylist reads a playlist, or the songs, from the user's Apple
+Music library. Only the first limit library songs are read; a longer playlist
+returns one more song than limit, so the caller can tell.
+*/
+func readAppleLibraryPlaylist(ctx context.Context, token string, id string, limit int) (string, []appleLibrarySong, error) {
+	name := "Library songs"
+	path := "/v1/me/library/songs?include=catalog&limit=100"
+	if id != appleLibrarySongsID {
+		var playlist struct {
+			Data []struct {
+				Attributes struct {
+					Name string `json:"name"`
+				} `json:"attributes"`
+			} `json:"data"`
+		}
+		err := appleUserRequest(ctx, "library_playlist", token, "GET", "/v1/me/library/playlists/"+url.PathEscape(id), nil, &playlist)
+		if err == nil && len(playlist.Data) == 0 {
+			err = userAPIError{Provider: "apple", Status: http.StatusNotFound}
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		name = playlist.Data[0].Attributes.Name
+		path = "/v1/me/library/playlists/" + url.PathEscape(id) + "/tracks?include=catalog&limit=100"
+		limit++
+	}
+	songs, err := appleUserTracks(ctx, token, path, limit)
+
+	return name, songs, err
+}
+
+/*
+postAppleUserImport reads a playlist, or the songs, from the session's Apple
+Music library and saves it as a shared playlist. Only the first library
+songs, up to the import limit, are read; longer playlists are rejected.
+*/
+func postAppleUserImport(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, ok := requireSession(c)
+	if !ok {
+		return
+	}
+	request, ok := readUserImportRequest(c, "apple")
+	if !ok {
+		return
+	}
+	token, ok := appleTokenFor(c, session)
+	if !ok {
+		return
+	}
+
+	id := c.Param("id")
+	name, songs, err := readAppleLibraryPlaylist(ctx, token, id, maxImportEntries)
+	if err != nil {
+		readProviderError(c, session, "apple", err)
+		return
+	}
+	loggerFrom(ctx).Debug("Apple library playlist", "id", id, "name", name, "tracks", len(songs))
+
+	queries, known := appleLibraryQueries(songs)
+	importUserTracks(c, "apple", request, name, queries, known)
+}